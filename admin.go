@@ -0,0 +1,191 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// instances are the command sources of the running configs, so
+// that the admin API can reach them. They are keyed by the loaded
+// module, not by their state, which a source of a reloaded config
+// shares with the one it replaces, so that cleaning up the old
+// one does not unregister the new one.
+var instances = struct {
+	mu   sync.Mutex
+	byID map[*Command]Command
+}{byID: make(map[*Command]Command)}
+
+// register makes c reachable by the admin API.
+func (c *Command) register() {
+	instances.mu.Lock()
+	defer instances.mu.Unlock()
+	instances.byID[c] = *c
+}
+
+// unregister makes c unreachable by the admin API.
+func (c *Command) unregister() {
+	instances.mu.Lock()
+	defer instances.mu.Unlock()
+	delete(instances.byID, c)
+}
+
+// adminAPI is a module that serves the admin endpoints
+// of the command sources:
+//
+//	POST /dynamic_dns/command/refresh
+//
+// flushes the cached results of all command sources, or of the
+// ones running the command given by the `command` query param
+// or with the label given by the `label` query param,
+// runs their lookups right away and returns the addresses.
+//
+//	GET /dynamic_dns/command/health
+//
+// returns the health of the command sources.
+//
+//	GET /dynamic_dns/command/bundle
+//
+// returns a support bundle of the command sources, a gzipped
+// tarball with their config, secrets redacted, health and
+// captured output, and the version info and environment.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.dynamic_dns_command",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the routes of the admin endpoints.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/dynamic_dns/command/refresh",
+			Handler: caddy.AdminHandlerFunc(a.handleRefresh),
+		},
+		{
+			Pattern: "/dynamic_dns/command/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+		{
+			Pattern: "/dynamic_dns/command/bundle",
+			Handler: caddy.AdminHandlerFunc(a.handleBundle),
+		},
+	}
+}
+
+// selected returns true if c is selected by the `command`
+// and `label` query params of an admin request, if given.
+func (c Command) selected(query url.Values) bool {
+	if cmd := query.Get("command"); cmd != "" && c.Cmd != cmd {
+		return false
+	}
+	if label := query.Get("label"); label != "" && c.Label != label {
+		return false
+	}
+	return true
+}
+
+// refreshResult is the result of refreshing a command source.
+type refreshResult struct {
+	Label   string   `json:"label,omitempty"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	IPs     []string `json:"ips"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// handleRefresh flushes the caches and runs the lookups.
+func (adminAPI) handleRefresh(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	query := r.URL.Query()
+
+	instances.mu.Lock()
+	var cmds []Command
+	for _, c := range instances.byID {
+		if c.selected(query) {
+			cmds = append(cmds, c)
+		}
+	}
+	instances.mu.Unlock()
+
+	if len(cmds) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no command source found"),
+		}
+	}
+
+	results := make([]refreshResult, len(cmds))
+	var wg sync.WaitGroup
+	for i, c := range cmds {
+		wg.Add(1)
+		go func(i int, c Command) {
+			defer wg.Done()
+			results[i] = c.refresh(r)
+		}(i, c)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// refresh flushes the cached result and runs the lookup.
+func (c Command) refresh(r *http.Request) refreshResult {
+	c.logger.Info("refreshing addresses by admin request",
+		zap.String("command", c.Cmd),
+		zap.String("remote_addr", r.RemoteAddr))
+
+	var ips []net.IP
+	var err error
+	if c.Watch {
+		// the watch command reports changes by itself
+		ips, err = c.watchIPs(r.Context(), dynamicdns.IPVersions{})
+	} else {
+		c.state.flush()
+		ips, err = c.state.shared(r.Context(), dynamicdns.IPVersions{}, func() ([]net.IP, error) {
+			return c.resolve(r.Context(), dynamicdns.IPVersions{})
+		})
+	}
+
+	result := refreshResult{
+		Label:   c.Label,
+		Command: c.Cmd,
+		Args:    c.redactArgs(c.Args),
+		IPs:     ipStrings(ips),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
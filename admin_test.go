@@ -0,0 +1,58 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRegisterReload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs echo")
+	}
+	// the sources need the app of a running config
+	err := caddy.Load([]byte(`{"admin":{"disabled":true,"config":{"persist":false}},"apps":{"dynamic_dns_command":{}}}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+
+	// a reload loads the new source, with the state of the old
+	// one, before it cleans up the old one
+	config := []byte(`{"command":"echo","args":["203.0.113.1"]}`)
+	load := func() (*Command, func()) {
+		t.Helper()
+		ctx, cancel := caddy.NewContext(caddy.ActiveContext())
+		mod, err := ctx.LoadModuleByID("dynamic_dns.ip_sources.command", config)
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		return mod.(*Command), cancel
+	}
+	old, cancelOld := load()
+	cur, cancelCur := load()
+	defer cancelCur()
+	if old.state != cur.state {
+		t.Fatal("the new source did not keep the state of the old one")
+	}
+	cancelOld()
+
+	instances.mu.Lock()
+	registered := 0
+	for _, c := range instances.byID {
+		if c.state == cur.state {
+			registered++
+		}
+	}
+	instances.mu.Unlock()
+	if registered != 1 {
+		t.Errorf("%d sources registered after the reload, want the new one", registered)
+	}
+}
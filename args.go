@@ -0,0 +1,199 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// filePlaceholderPrefix is the prefix of the placeholder that
+// expands to the contents of a file, e.g. {file./run/secrets/token}.
+const filePlaceholderPrefix = "file."
+
+// cacheBustPlaceholder is the placeholder that expands to a random
+// value, a new one every time the args are expanded, e.g. to add to
+// the URL of an echo service, so that no cache along the way answers
+// with the address of an earlier request.
+const cacheBustPlaceholder = "cache_bust"
+
+// unmarshalArgs parses an args subdirective, whose arguments are
+// appended to the ones after the command. They may follow it on
+// the same line or, to keep long lists readable, in a block, one
+// or more per line. Syntax:
+//
+//	args [<args...>] {
+//	    <args...>
+//	}
+func unmarshalArgs(d *caddyfile.Dispenser) ([]string, error) {
+	args := d.RemainingArgs()
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		args = append(args, d.Val())
+		args = append(args, d.RemainingArgs()...)
+	}
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	return args, nil
+}
+
+// expandArgs expands placeholders in args. Besides the global
+// placeholders, {file.<path>} is replaced with the contents of
+// the file at path (without a trailing newline), so that secrets
+// can be passed to the command without putting them into the
+// config. The file is read every time the args are expanded.
+// {cache_bust} is replaced with the same random value in all
+// args, which is new every time. Credential placeholders are
+// looked up by their providers every time too.
+//
+// The returned redacted args are safe to log: arguments that
+// contain a file or credential placeholder are returned
+// unexpanded.
+func expandArgs(args []string) (expanded, redacted []string, err error) {
+	replacer := caddy.NewReplacer()
+	var cacheBust string
+	replacer.Map(func(key string) (any, bool) {
+		if key == cacheBustPlaceholder {
+			if cacheBust == "" {
+				cacheBust = newRunID()
+			}
+			return cacheBust, true
+		}
+		if ref, ok := strings.CutPrefix(key, credentialPlaceholderPrefix); ok {
+			value, lookupErr := lookupCredential(context.Background(), ref)
+			if lookupErr != nil && err == nil {
+				err = lookupErr
+			}
+			return value, true
+		}
+		if !strings.HasPrefix(key, filePlaceholderPrefix) {
+			return nil, false
+		}
+		contents, readErr := os.ReadFile(strings.TrimPrefix(key, filePlaceholderPrefix))
+		if readErr != nil {
+			if err == nil {
+				err = readErr
+			}
+			return "", true
+		}
+		return strings.TrimRight(string(contents), "\r\n"), true
+	})
+
+	expanded = make([]string, len(args))
+	redacted = make([]string, len(args))
+	for i := range args {
+		expanded[i] = replacer.ReplaceAll(args[i], "")
+		redacted[i] = expanded[i]
+		if strings.Contains(args[i], "{"+filePlaceholderPrefix) || strings.Contains(args[i], "{"+credentialPlaceholderPrefix) {
+			redacted[i] = args[i]
+		}
+	}
+	return expanded, redacted, err
+}
+
+// expandDir replaces the global placeholders in dir, like
+// {env.HOME} or {system.wd}. Unlike the args, it is expanded
+// once when the config is loaded, so that the checks of the
+// commands, like sha256, see the same directory they run in.
+func expandDir(dir string) string {
+	return caddy.NewReplacer().ReplaceKnown(dir, "")
+}
+
+// provisionArgsFromEnv appends the args read from
+// the ArgsFromEnv environment variable to the args.
+func (c *Command) provisionArgsFromEnv() error {
+	if c.ArgsFromEnv == "" {
+		return nil
+	}
+	value, ok := os.LookupEnv(c.ArgsFromEnv)
+	if !ok {
+		return fmt.Errorf("args_from_env: environment variable %s is not set", c.ArgsFromEnv)
+	}
+	args, err := splitShellWords(value)
+	if err != nil {
+		return fmt.Errorf("args_from_env: splitting %s: %v", c.ArgsFromEnv, err)
+	}
+	c.Args = append(c.Args, args...)
+	return nil
+}
+
+// splitShellWords splits s into words like a POSIX shell, without
+// expanding anything: words are separated by whitespace, single
+// quotes keep everything literally, double quotes keep everything
+// but a backslash before ", \, $ or `, and a backslash outside of
+// quotes escapes the next character.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case ch == '\\':
+			i++
+			if i == len(s) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			// a backslash before a newline continues the line
+			if s[i] != '\n' {
+				word.WriteByte(s[i])
+				inWord = true
+			}
+
+		case ch == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+
+		case ch == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inWord = true
+
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// stdin returns the payload for the standard input of the
+// command, with placeholders expanded like in args.
+func (c Command) stdin() ([]byte, error) {
+	expanded, _, err := expandArgs([]string{c.Stdin})
+	return []byte(expanded[0]), err
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// The sources of the addresses in the audit log.
+const (
+	// the command was run
+	AuditSourceCommand = "command"
+	// the command reported no change by UnchangedExitCode,
+	// so the previous addresses were reused
+	AuditSourceUnchanged = "unchanged"
+	// the watch command reported them
+	AuditSourceWatch = "watch"
+)
+
+// AuditLog is an append-only history of the addresses the
+// lookups resolved, written as JSON lines to a file or to
+// Caddy's storage.
+type AuditLog struct {
+	// The file to append to.
+	File string `json:"file,omitempty"`
+
+	// The key in Caddy's storage to append to. As storage
+	// cannot append, the whole log is rewritten every time,
+	// so this is meant for low volumes only.
+	StorageKey string `json:"storage_key,omitempty"`
+
+	mu sync.Mutex
+}
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time     time.Time `json:"ts"`
+	Label    string    `json:"label,omitempty"`
+	Command  string    `json:"command"`
+	RunID    string    `json:"run_id"`
+	IPs      []string  `json:"ips"`
+	Duration float64   `json:"duration"`
+	Source   string    `json:"source"`
+}
+
+// unmarshalAuditLog parses the audit_log subdirective. Syntax:
+//
+//	audit_log file <path>
+//	audit_log storage <key>
+func unmarshalAuditLog(d *caddyfile.Dispenser) (*AuditLog, error) {
+	var kind, target string
+	if !d.AllArgs(&kind, &target) {
+		return nil, d.ArgErr()
+	}
+	switch kind {
+	case "file":
+		return &AuditLog{File: target}, nil
+	case "storage":
+		return &AuditLog{StorageKey: target}, nil
+	}
+	return nil, d.Errf("invalid audit_log '%s': must be file or storage", kind)
+}
+
+// validate ensures exactly one target is set.
+func (a *AuditLog) validate() error {
+	if (a.File == "") == (a.StorageKey == "") {
+		return fmt.Errorf("audit log needs either a file or a storage key")
+	}
+	return nil
+}
+
+// audit appends a successful lookup to the audit log, if
+// configured. Failing to write it is logged, but does not
+// fail the lookup.
+func (c Command) audit(ips []net.IP, duration time.Duration, source string) {
+	if c.AuditLog == nil {
+		return
+	}
+	line, err := json.Marshal(auditEntry{
+		Time:     time.Now().UTC(),
+		Label:    c.Label,
+		Command:  c.Cmd,
+		RunID:    c.runID,
+		IPs:      ipStrings(ips),
+		Duration: duration.Seconds(),
+		Source:   source,
+	})
+	if err == nil {
+		err = c.AuditLog.append(c.ctx, append(line, '\n'))
+	}
+	if err != nil {
+		c.logger.Error("writing audit log failed",
+			zap.String("file", c.AuditLog.File),
+			zap.String("storage_key", c.AuditLog.StorageKey),
+			zap.Error(err))
+	}
+}
+
+// append appends line to the file or storage key.
+func (a *AuditLog) append(ctx caddy.Context, line []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.File != "" {
+		f, err := os.OpenFile(a.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(line)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	storage := ctx.Storage()
+	if err := storage.Lock(ctx, a.StorageKey); err != nil {
+		return err
+	}
+	defer func() { _ = storage.Unlock(ctx, a.StorageKey) }()
+
+	data, err := storage.Load(ctx, a.StorageKey)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return storage.Store(ctx, a.StorageKey, append(data, line...))
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// autoTokens detects the format of the output and splits it
+// into tokens accordingly, for FormatAuto:
+//
+//   - an envelope of the protocol, see envelope;
+//   - the JSON output of `ip -j addr`, like FormatIPRoute2;
+//   - a JSON object with an "ips" key, like FormatExtended;
+//   - any other JSON, whose string values that are addresses
+//     are used, like {"ip": "203.0.113.5"} of echo services;
+//   - lines labeled with ipv4: or ipv6:, like FormatLabeled;
+//   - else a list separated by commas, semicolons or whitespace.
+func (o ParseOptions) autoTokens(output string) ([]token, error) {
+	trimmed := strings.TrimSpace(output)
+	if trimmed == "" {
+		return nil, ErrEmptyOutput
+	}
+
+	if (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid([]byte(trimmed)) {
+		if isEnvelope(trimmed) {
+			return envelopeTokens(trimmed, o.metadata())
+		}
+		var links []struct {
+			AddrInfo json.RawMessage `json:"addr_info"`
+		}
+		if json.Unmarshal([]byte(trimmed), &links) == nil && len(links) > 0 && links[0].AddrInfo != nil {
+			return o.iproute2Tokens(trimmed)
+		}
+		var ext struct {
+			IPs json.RawMessage `json:"ips"`
+		}
+		if json.Unmarshal([]byte(trimmed), &ext) == nil && ext.IPs != nil {
+			o.Format = FormatExtended
+			return o.tokenize(trimmed)
+		}
+		return jsonAddressTokens(trimmed)
+	}
+
+	if isLabeled(trimmed) {
+		o.Format = FormatLabeled
+		o.Unlabeled = UnlabeledReject
+		return o.tokenize(trimmed)
+	}
+
+	var tokens []token
+	for _, value := range strings.FieldsFunc(trimmed, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		tokens = append(tokens, token{value: value})
+	}
+	return tokens, nil
+}
+
+// isLabeled returns true if every line of output
+// is labeled with ipv4: or ipv6:.
+func isLabeled(output string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		label, _, ok := strings.Cut(line, ":")
+		label = strings.ToLower(strings.TrimSpace(label))
+		if !ok || (label != "ipv4" && label != "ipv6") {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonAddressTokens returns the string values of the JSON document
+// output that are addresses, without duplicates. Object keys are
+// visited in sorted order, so that the result does not depend on
+// the order of the output.
+func jsonAddressTokens(output string) ([]token, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(output)))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var tokens []token
+	var walk func(val any)
+	walk = func(val any) {
+		switch v := val.(type) {
+		case string:
+			v = strings.TrimSpace(v)
+			if ip := net.ParseIP(stripZone(v)); ip != nil {
+				for _, t := range tokens {
+					if t.value == v {
+						return
+					}
+				}
+				tokens = append(tokens, token{value: v})
+			}
+		case []any:
+			for _, elem := range v {
+				walk(elem)
+			}
+		case map[string]any:
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				walk(v[key])
+			}
+		}
+	}
+	walk(doc)
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no addresses in JSON output")
+	}
+	return tokens, nil
+}
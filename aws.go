@@ -0,0 +1,208 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(AWSIMDS{})
+}
+
+// The default endpoint of the EC2 instance metadata service.
+const defaultAWSEndpoint = "http://169.254.169.254"
+
+// How long the IMDSv2 session tokens are valid.
+const awsTokenTTL = 6 * time.Hour
+
+// AWSIMDS is an IP source that looks up the public IP addresses
+// of an EC2 instance from the instance metadata service (IMDSv2).
+//
+// The public IPv4 address is the one associated with the instance,
+// i.e. its public or Elastic IP address. The IPv6 addresses are the
+// ones assigned to its primary network interface.
+type AWSIMDS struct {
+	// The endpoint of the metadata service. Use http://[fd00:ec2::254]
+	// on instances which only reach it over IPv6.
+	// Default: http://169.254.169.254
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// How long to wait for the metadata service. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	client *http.Client
+	token  *awsToken
+	logger *zap.Logger
+}
+
+// awsToken is the cached IMDSv2 session token.
+type awsToken struct {
+	mu      sync.Mutex
+	value   string
+	expires time.Time
+}
+
+// CaddyModule returns the Caddy module information.
+func (AWSIMDS) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.aws_imds",
+		New: func() caddy.Module { return new(AWSIMDS) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	aws_imds {
+//	    endpoint <url>
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (a *AWSIMDS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "endpoint":
+				err = singleArg(d, &a.Endpoint)
+			case "timeout":
+				err = durationArg(d, &a.Timeout)
+			case "filter":
+				err = a.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (a *AWSIMDS) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+	if err := a.Filters.load(ctx); err != nil {
+		return err
+	}
+	if a.Endpoint == "" {
+		a.Endpoint = defaultAWSEndpoint
+	}
+	a.Endpoint = strings.TrimSuffix(a.Endpoint, "/")
+	if a.Timeout <= 0 {
+		a.Timeout = caddy.Duration(5 * time.Second)
+	}
+	a.client = &http.Client{Timeout: time.Duration(a.Timeout)}
+	a.token = new(awsToken)
+	return nil
+}
+
+// GetIPs gets the public addresses of this machine.
+func (a AWSIMDS) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return a.Filters.apply(a.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (a AWSIMDS) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	token, err := a.sessionToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting IMDSv2 token: %v", err)
+	}
+
+	var ips []net.IP
+	if versions.V4Enabled() {
+		ipv4, err := a.get(ctx, token, "meta-data/public-ipv4")
+		switch {
+		case errors.Is(err, errNotFound):
+			a.logger.Debug("instance has no public IPv4 address")
+		case err != nil:
+			return nil, err
+		default:
+			ip := net.ParseIP(ipv4)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", ipv4)
+			}
+			ips = append(ips, ip)
+		}
+	}
+
+	if versions.V6Enabled() {
+		mac, err := a.get(ctx, token, "meta-data/mac")
+		if err != nil {
+			return nil, err
+		}
+		ipv6s, err := a.get(ctx, token, "meta-data/network/interfaces/macs/"+mac+"/ipv6s")
+		switch {
+		case errors.Is(err, errNotFound):
+			a.logger.Debug("instance has no IPv6 address", zap.String("mac", mac))
+		case err != nil:
+			return nil, err
+		default:
+			parsed, err := parseIPList(ipv6s)
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, parsed...)
+		}
+	}
+
+	return ips, nil
+}
+
+// get gets the metadata at path using the session token.
+func (a AWSIMDS) get(ctx context.Context, token, path string) (string, error) {
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {token}}
+	return metadataRequest(ctx, a.client, http.MethodGet, a.Endpoint+"/latest/"+path, header)
+}
+
+// sessionToken returns the cached IMDSv2 session token,
+// or requests a new one if it is about to expire.
+func (a AWSIMDS) sessionToken(ctx context.Context) (string, error) {
+	a.token.mu.Lock()
+	defer a.token.mu.Unlock()
+
+	if a.token.value != "" && time.Now().Before(a.token.expires.Add(-time.Minute)) {
+		return a.token.value, nil
+	}
+
+	header := http.Header{
+		"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {strconv.Itoa(int(awsTokenTTL.Seconds()))},
+	}
+	token, err := metadataRequest(ctx, a.client, http.MethodPut, a.Endpoint+"/latest/api/token", header)
+	if err != nil {
+		return "", err
+	}
+	a.token.value = token
+	a.token.expires = time.Now().Add(awsTokenTTL)
+	return token, nil
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*AWSIMDS)(nil)
+	_ caddy.Provisioner     = (*AWSIMDS)(nil)
+	_ caddyfile.Unmarshaler = (*AWSIMDS)(nil)
+)
@@ -0,0 +1,295 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(AzureIMDS{})
+}
+
+// The defaults of the Azure instance metadata service.
+const (
+	defaultAzureEndpoint   = "http://169.254.169.254"
+	defaultAzureAPIVersion = "2021-02-01"
+)
+
+// AzureIMDS is an IP source that looks up the public IP addresses of
+// an Azure virtual machine from the instance metadata service.
+//
+// The addresses are the public addresses of the VM's network
+// interfaces. Standard SKU public IP addresses are not listed there,
+// so if there are none, the frontend addresses of the VM's standard
+// load balancer are used instead.
+type AzureIMDS struct {
+	// The endpoint of the metadata service.
+	// Default: http://169.254.169.254
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The API version of the metadata service to request. If the
+	// service does not support it, the newest version it supports
+	// is used instead. Default: 2021-02-01
+	APIVersion string `json:"api_version,omitempty"`
+
+	// How often to retry requests the metadata service
+	// rejects as throttled or unavailable. Default: 3
+	Retries int `json:"retries,omitempty"`
+
+	// How long to wait for the metadata service. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	client     *http.Client
+	apiVersion *azureAPIVersion
+	logger     *zap.Logger
+}
+
+// azureAPIVersion is the API version in use, which is
+// replaced if the metadata service does not support it.
+type azureAPIVersion struct {
+	mu      sync.Mutex
+	version string
+}
+
+// CaddyModule returns the Caddy module information.
+func (AzureIMDS) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.azure_imds",
+		New: func() caddy.Module { return new(AzureIMDS) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	azure_imds {
+//	    endpoint <url>
+//	    api_version <version>
+//	    retries <count>
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (a *AzureIMDS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "endpoint":
+				err = singleArg(d, &a.Endpoint)
+			case "api_version":
+				err = singleArg(d, &a.APIVersion)
+			case "retries":
+				err = intArg(d, &a.Retries)
+			case "timeout":
+				err = durationArg(d, &a.Timeout)
+			case "filter":
+				err = a.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (a *AzureIMDS) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+	if err := a.Filters.load(ctx); err != nil {
+		return err
+	}
+	if a.Endpoint == "" {
+		a.Endpoint = defaultAzureEndpoint
+	}
+	a.Endpoint = strings.TrimSuffix(a.Endpoint, "/")
+	if a.APIVersion == "" {
+		a.APIVersion = defaultAzureAPIVersion
+	}
+	if a.Retries == 0 {
+		a.Retries = 3
+	}
+	if a.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	if a.Timeout <= 0 {
+		a.Timeout = caddy.Duration(5 * time.Second)
+	}
+	a.client = &http.Client{
+		Timeout: time.Duration(a.Timeout),
+		// the metadata service must never be reached through a proxy
+		Transport: &http.Transport{Proxy: nil},
+	}
+	a.apiVersion = &azureAPIVersion{version: a.APIVersion}
+	return nil
+}
+
+// GetIPs gets the public addresses of this machine.
+func (a AzureIMDS) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return a.Filters.apply(a.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (a AzureIMDS) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	var network struct {
+		Interface []struct {
+			IPv4 struct {
+				IPAddress []struct {
+					PublicIPAddress string `json:"publicIpAddress"`
+				} `json:"ipAddress"`
+			} `json:"ipv4"`
+			IPv6 struct {
+				IPAddress []struct {
+					PublicIPAddress string `json:"publicIpAddress"`
+				} `json:"ipAddress"`
+			} `json:"ipv6"`
+		} `json:"interface"`
+	}
+	if err := a.get(ctx, "instance/network", &network); err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, iface := range network.Interface {
+		for _, addr := range iface.IPv4.IPAddress {
+			addrs = append(addrs, addr.PublicIPAddress)
+		}
+		for _, addr := range iface.IPv6.IPAddress {
+			addrs = append(addrs, addr.PublicIPAddress)
+		}
+	}
+
+	if strings.Join(addrs, "") == "" {
+		a.logger.Debug("no public addresses on network interfaces; trying load balancer")
+		var lb struct {
+			LoadBalancer struct {
+				PublicIPAddresses []struct {
+					FrontendIPAddress string `json:"frontendIpAddress"`
+				} `json:"publicIpAddresses"`
+			} `json:"loadbalancer"`
+		}
+		err := a.get(ctx, "loadbalancer", &lb)
+		if err != nil && !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+		for _, addr := range lb.LoadBalancer.PublicIPAddresses {
+			addrs = append(addrs, addr.FrontendIPAddress)
+		}
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", addr)
+		}
+		if !ipListContains(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// get gets the metadata at path and decodes it into v. Throttled
+// and failed requests are retried, and requests for an unsupported
+// API version are repeated with the newest supported one.
+func (a AzureIMDS) get(ctx context.Context, path string, v any) error {
+	header := http.Header{"Metadata": {"true"}}
+	delay := time.Second
+
+	for attempt := 0; ; attempt++ {
+		a.apiVersion.mu.Lock()
+		version := a.apiVersion.version
+		a.apiVersion.mu.Unlock()
+
+		query := url.Values{"api-version": {version}, "format": {"json"}}
+		body, err := metadataRequest(ctx, a.client, http.MethodGet, a.Endpoint+"/metadata/"+path+"?"+query.Encode(), header)
+		if err == nil {
+			if err := json.Unmarshal([]byte(body), v); err != nil {
+				return fmt.Errorf("decoding %s metadata: %v", path, err)
+			}
+			return nil
+		}
+
+		var se statusError
+		if !errors.As(err, &se) || attempt >= a.Retries {
+			return err
+		}
+		switch {
+		case se.code == http.StatusBadRequest:
+			newest := azureNewestVersion(se.body)
+			if newest == "" || newest == version {
+				return err
+			}
+			a.logger.Warn("api version not supported by metadata service; using newest supported version",
+				zap.String("api_version", version),
+				zap.String("newest_version", newest))
+			a.apiVersion.mu.Lock()
+			a.apiVersion.version = newest
+			a.apiVersion.mu.Unlock()
+			continue
+		case se.code == http.StatusGone, se.code == http.StatusTooManyRequests, se.code >= 500:
+		default:
+			return err
+		}
+
+		a.logger.Warn("metadata request failed; retrying",
+			zap.String("path", path),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("delay", delay),
+			zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// azureNewestVersion returns the newest API version listed in the
+// error the metadata service returns for unsupported versions.
+func azureNewestVersion(body []byte) string {
+	var resp struct {
+		NewestVersions []string `json:"newest-versions"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp.NewestVersions) == 0 {
+		return ""
+	}
+	return resp.NewestVersions[0]
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*AzureIMDS)(nil)
+	_ caddy.Provisioner     = (*AzureIMDS)(nil)
+	_ caddyfile.Unmarshaler = (*AzureIMDS)(nil)
+)
@@ -0,0 +1,152 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultBatchWindow is how long the result of a batched
+// command is shared by default.
+const defaultBatchWindow = caddy.Duration(10 * time.Second)
+
+// batches are the shared runs of batched commands,
+// by their command line.
+var batches = struct {
+	mu    sync.Mutex
+	byKey map[string]*batch
+}{byKey: make(map[string]*batch)}
+
+// batch is the last run of a batched command line.
+type batch struct {
+	// held while the command runs, so that the other
+	// sources wait for its result
+	mu sync.Mutex
+
+	done           time.Time
+	stdout, stderr []byte
+	err            error
+}
+
+// unmarshalBatch parses the batch subdirective. Syntax:
+//
+//	batch <key> [<window>]
+func (c *Command) unmarshalBatch(d *caddyfile.Dispenser) error {
+	if !d.Args(&c.Batch) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid batch window '%s': %v", d.Val(), err)
+		}
+		c.BatchWindow = caddy.Duration(dur)
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// provisionBatch sets the default window.
+func (c *Command) provisionBatch() error {
+	if c.Batch == "" {
+		if c.BatchWindow != 0 {
+			return fmt.Errorf("batch_window requires batch")
+		}
+		return nil
+	}
+	if c.Watch {
+		return fmt.Errorf("batch is not supported with watch")
+	}
+	if c.BatchWindow < 0 {
+		return fmt.Errorf("invalid batch_window %s", time.Duration(c.BatchWindow))
+	}
+	if c.BatchWindow == 0 {
+		c.BatchWindow = defaultBatchWindow
+	}
+	return nil
+}
+
+// runBatched returns the result of run, or of the run of another
+// source with the same command line that finished within the
+// batch window or is still running, so that several sources
+// picking their addresses from the same output run it once.
+func (c Command) runBatched(ctx context.Context, name string, args []string, dir string, stdin []byte, run func() ([]byte, []byte, error)) ([]byte, []byte, error) {
+	key := strings.Join(append([]string{dir, string(stdin), name}, args...), "\x00")
+	window := time.Duration(c.BatchWindow)
+
+	batches.mu.Lock()
+	for k, b := range batches.byKey {
+		// drop the expired runs of other command lines,
+		// unless they are running again
+		if k != key && b.mu.TryLock() {
+			if b.done.IsZero() || time.Since(b.done) > window {
+				delete(batches.byKey, k)
+			}
+			b.mu.Unlock()
+		}
+	}
+	b, ok := batches.byKey[key]
+	if !ok {
+		b = new(batch)
+		batches.byKey[key] = b
+	}
+	batches.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.done.IsZero() && time.Since(b.done) <= window {
+		c.logger.Debug("reusing output of batched command",
+			zap.String("command", name),
+			zap.String("batch", c.Batch),
+			zap.Time("ran_at", b.done))
+		return b.stdout, b.stderr, b.err
+	}
+
+	b.stdout, b.stderr, b.err = run()
+	b.done = time.Now()
+	if ctx.Err() != nil {
+		// canceled for this source, not for the others
+		b.done = time.Time{}
+	}
+	return b.stdout, b.stderr, b.err
+}
+
+// batchValue returns the value of the batch key in the output
+// of a batched command, a JSON object keyed by source. A list
+// of addresses becomes a comma separated one, and an object,
+// e.g. in the extended format, is returned as JSON.
+func (c Command) batchValue(output []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(output))
+	dec.UseNumber()
+	var results map[string]any
+	if err := dec.Decode(&results); err != nil {
+		return nil, fmt.Errorf("parsing batch output: %v", err)
+	}
+	val, ok := results[c.Batch]
+	if !ok {
+		return nil, fmt.Errorf("batch output has no key %s", c.Batch)
+	}
+	if obj, ok := val.(map[string]any); ok {
+		return json.Marshal(obj)
+	}
+	s, err := jsonValueString(val)
+	if err != nil {
+		return nil, fmt.Errorf("batch key %s: %v", c.Batch, err)
+	}
+	return []byte(s), nil
+}
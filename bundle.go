@@ -0,0 +1,236 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// bundleVersion is the version info of a support bundle.
+type bundleVersion struct {
+	Caddy   string `json:"caddy"`
+	Module  string `json:"module,omitempty"`
+	Go      string `json:"go"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Created string `json:"created"`
+}
+
+// bundleEnvironment is the environment summary of a support
+// bundle. It has only the names of the environment variables
+// of Caddy, as their values may be secret.
+type bundleEnvironment struct {
+	OS       string   `json:"os"`
+	Arch     string   `json:"arch"`
+	NumCPU   int      `json:"num_cpu"`
+	UID      int      `json:"uid"`
+	GID      int      `json:"gid"`
+	Hostname string   `json:"hostname,omitempty"`
+	Path     string   `json:"path"`
+	Env      []string `json:"env"`
+}
+
+// bundleFile is a file of a support bundle,
+// with the value it has as JSON.
+type bundleFile struct {
+	name string
+	v    any
+}
+
+// handleBundle writes a support bundle of the selected command
+// sources, a gzipped tarball with the version info, a summary of
+// the environment and, for each source, its config, with secrets
+// redacted, and its health, with the history of the recent runs
+// and the captured output.
+func (adminAPI) handleBundle(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	query := r.URL.Query()
+
+	instances.mu.Lock()
+	var cmds []Command
+	for _, c := range instances.byID {
+		if c.selected(query) {
+			cmds = append(cmds, c)
+		}
+	}
+	instances.mu.Unlock()
+
+	if len(cmds) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no command source found"),
+		}
+	}
+	// sorted, so that the same sources get the same directories
+	sort.Slice(cmds, func(i, j int) bool {
+		if cmds[i].Label != cmds[j].Label {
+			return cmds[i].Label < cmds[j].Label
+		}
+		return cmds[i].Cmd < cmds[j].Cmd
+	})
+
+	now := time.Now()
+	files := []bundleFile{
+		{"version.json", versionInfo(now)},
+		{"environment.json", environmentSummary()},
+	}
+	for i, c := range cmds {
+		config, err := c.redactedConfig()
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("redacting config of %s: %v", c.Cmd, err),
+			}
+		}
+		dir := fmt.Sprintf("sources/%d/", i)
+		files = append(files,
+			bundleFile{dir + "config.json", config},
+			bundleFile{dir + "health.json", c.healthResult()})
+	}
+
+	name := "dynamic-dns-command-bundle-" + now.UTC().Format("20060102T150405Z")
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, name))
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, f := range files {
+		data, err := json.MarshalIndent(f.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    name + "/" + f.name,
+			Mode:    0o600,
+			Size:    int64(len(data)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	cmds[0].logger.Info("support bundle requested",
+		zap.Int("sources", len(cmds)),
+		zap.String("remote_addr", r.RemoteAddr))
+	return nil
+}
+
+// versionInfo returns the version info of a support bundle.
+func versionInfo(now time.Time) bundleVersion {
+	_, caddyVersion := caddy.Version()
+	v := bundleVersion{
+		Caddy:   caddyVersion,
+		Go:      runtime.Version(),
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Created: now.UTC().Format(time.RFC3339),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		path := reflect.TypeOf(adminAPI{}).PkgPath()
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				v.Module = dep.Path + " " + dep.Version
+			}
+		}
+		if info.Main.Path == path {
+			v.Module = info.Main.Path + " " + info.Main.Version
+		}
+	}
+	return v
+}
+
+// environmentSummary returns the environment summary of a
+// support bundle.
+func environmentSummary() bundleEnvironment {
+	env := bundleEnvironment{
+		OS:     runtime.GOOS,
+		Arch:   runtime.GOARCH,
+		NumCPU: runtime.NumCPU(),
+		UID:    os.Getuid(),
+		GID:    os.Getgid(),
+		Path:   os.Getenv("PATH"),
+	}
+	env.Hostname, _ = os.Hostname()
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if name != "" {
+			env.Env = append(env.Env, name)
+		}
+	}
+	sort.Strings(env.Env)
+	return env
+}
+
+// redactedConfig returns the config of c, for a support bundle,
+// with the secret args and the values of all env vars, also the
+// ones of the hooks, replaced by Redacted, and the secrets
+// replaced wherever else they appear.
+func (c Command) redactedConfig() (map[string]any, error) {
+	secrets := c.secrets()
+	c.Args = c.redactArgs(c.Args)
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) > 0 {
+		data = []byte(newRedactor(secrets).Replace(string(data)))
+	}
+	var config map[string]any
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	redactEnv(config)
+	return config, nil
+}
+
+// redactEnv replaces the values of the env objects in v.
+func redactEnv(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if env, ok := value.(map[string]any); ok && key == "env" {
+				for name := range env {
+					env[name] = Redacted
+				}
+				continue
+			}
+			redactEnv(value)
+		}
+	case []any:
+		for _, value := range v {
+			redactEnv(value)
+		}
+	}
+}
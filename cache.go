@@ -0,0 +1,65 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"net"
+	"time"
+
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+)
+
+// perFamilyCache returns true if a family has its own cache TTL.
+func (c Command) perFamilyCache() bool {
+	return c.CacheTTLIPv4 > 0 || c.CacheTTLIPv6 > 0
+}
+
+// familyTTLs returns how long the addresses of each family
+// are reused: their own TTL, or else CacheTTL.
+func (c Command) familyTTLs() (ttl4, ttl6 time.Duration) {
+	ttl4, ttl6 = time.Duration(c.CacheTTL), time.Duration(c.CacheTTL)
+	if c.CacheTTLIPv4 > 0 {
+		ttl4 = time.Duration(c.CacheTTLIPv4)
+	}
+	if c.CacheTTLIPv6 > 0 {
+		ttl6 = time.Duration(c.CacheTTLIPv6)
+	}
+	return ttl4, ttl6
+}
+
+// cachedFamilies returns the cached addresses of versions if
+// all of their families are still fresh. Otherwise it returns
+// the versions with only the expired families enabled, which
+// have to be looked up again.
+func (c Command) cachedFamilies(versions dynamicdns.IPVersions) ([]net.IP, dynamicdns.IPVersions, bool) {
+	ttl4, ttl6 := c.familyTTLs()
+	fresh := func(at time.Time, ttl time.Duration) bool {
+		return ttl > 0 && !at.IsZero() && time.Since(at) <= ttl
+	}
+
+	c.state.cacheMu.Lock()
+	defer c.state.cacheMu.Unlock()
+	stale4 := versions.V4Enabled() && (c.state.cacheIPs == nil || !fresh(c.state.cachedAt4, ttl4))
+	stale6 := versions.V6Enabled() && (c.state.cacheIPs == nil || !fresh(c.state.cachedAt6, ttl6))
+	if !stale4 && !stale6 {
+		return filterVersions(c.state.cacheIPs, versions), versions, true
+	}
+	return nil, dynamicdns.IPVersions{IPv4: &stale4, IPv6: &stale6}, false
+}
+
+// keepFresh returns the addresses of versions that were looked
+// up, together with the cached addresses of the other families,
+// which were still fresh and so not looked up again.
+func (c Command) keepFresh(ips []net.IP, versions dynamicdns.IPVersions) []net.IP {
+	out := filterVersions(ips, versions)
+	cached, _ := c.state.cached(-1)
+	for _, ip := range cached {
+		if ip.To4() != nil && !versions.V4Enabled() || ip.To4() == nil && !versions.V6Enabled() {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
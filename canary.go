@@ -0,0 +1,275 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Canary{})
+}
+
+// canaryVars are the counters of the canary sources, published
+// by expvar next to the ones of the command sources. They are
+// keyed by the label of the canary source.
+var canaryVars = expvar.NewMap("dynamic_dns_canary")
+
+// canaries are the counters of the canary sources by label.
+var canaries = struct {
+	mu    sync.Mutex
+	byKey map[string]*canarySourceVars
+}{byKey: make(map[string]*canarySourceVars)}
+
+// canarySourceVars are the counters of a canary source.
+type canarySourceVars struct {
+	// results of both sources that were compared
+	comparisons expvar.Int
+
+	// comparisons that found different addresses
+	mismatches expvar.Int
+
+	// when the last mismatch was found, as Unix time
+	lastMismatchUnix expvar.Int
+
+	// lookups of the canary that failed while
+	// the one of the primary succeeded
+	canaryFailures expvar.Int
+
+	// lookups of the canary that were skipped, as
+	// the previous one was still running
+	skipped expvar.Int
+}
+
+// Canary is an IP source that returns the addresses of its primary
+// source, and compares them to the ones of a canary source, which
+// is run at the same time. Mismatches are logged and counted, but
+// never affect the result, to gain confidence in a new source
+// before switching to it.
+type Canary struct {
+	// The source whose addresses are returned.
+	PrimaryRaw json.RawMessage `json:"primary,omitempty" caddy:"namespace=dynamic_dns.ip_sources inline_key=source"`
+
+	// The source to compare the addresses to.
+	CanaryRaw json.RawMessage `json:"canary,omitempty" caddy:"namespace=dynamic_dns.ip_sources inline_key=source"`
+
+	// How long the canary may take, as it is not bound to
+	// the lookup, which returns without waiting for it.
+	// Default: 30s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// The key of the counters. Default: canary
+	Label string `json:"label,omitempty"`
+
+	// Filter modules applied to the addresses of the primary
+	// and of the canary, in order.
+	Filters
+
+	primary dynamicdns.IPSource
+	canary  dynamicdns.IPSource
+	running *atomic.Bool
+	vars    *canarySourceVars
+	logger  *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Canary) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.canary",
+		New: func() caddy.Module { return new(Canary) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	canary {
+//	    primary <name> ...
+//	    canary <name> ...
+//	    timeout <duration>
+//	    label <label>
+//	    filter <name> ...
+//	}
+func (c *Canary) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "primary":
+				c.PrimaryRaw, err = sourceArg(d)
+			case "canary":
+				c.CanaryRaw, err = sourceArg(d)
+			case "timeout":
+				err = durationArg(d, &c.Timeout)
+			case "label":
+				err = singleArg(d, &c.Label)
+			case "filter":
+				err = c.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (c *Canary) Provision(ctx caddy.Context) error {
+	c.logger = ctx.Logger(c)
+	if err := c.Filters.load(ctx); err != nil {
+		return err
+	}
+	if c.PrimaryRaw == nil || c.CanaryRaw == nil {
+		return fmt.Errorf("canary needs a primary and a canary source")
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = caddy.Duration(30 * time.Second)
+	}
+	if c.Label == "" {
+		c.Label = "canary"
+	}
+
+	mod, err := ctx.LoadModule(c, "PrimaryRaw")
+	if err != nil {
+		return fmt.Errorf("loading primary source: %v", err)
+	}
+	c.primary = mod.(dynamicdns.IPSource)
+	mod, err = ctx.LoadModule(c, "CanaryRaw")
+	if err != nil {
+		return fmt.Errorf("loading canary source: %v", err)
+	}
+	c.canary = mod.(dynamicdns.IPSource)
+
+	c.running = new(atomic.Bool)
+	c.provisionVars()
+	return nil
+}
+
+// provisionVars loads the counters, creating them for the first
+// canary source with this label. They are kept as long as Caddy
+// runs, across reloads.
+func (c *Canary) provisionVars() {
+	canaries.mu.Lock()
+	defer canaries.mu.Unlock()
+	if v, ok := canaries.byKey[c.Label]; ok {
+		c.vars = v
+		return
+	}
+	v := new(canarySourceVars)
+	m := new(expvar.Map).Init()
+	m.Set("comparisons", &v.comparisons)
+	m.Set("mismatches", &v.mismatches)
+	m.Set("last_mismatch_unix", &v.lastMismatchUnix)
+	m.Set("canary_failures", &v.canaryFailures)
+	m.Set("skipped", &v.skipped)
+	canaryVars.Set(c.Label, m)
+	canaries.byKey[c.Label] = v
+	c.vars = v
+}
+
+// GetIPs gets the addresses of the primary source and compares
+// them to the ones of the canary in the background.
+func (c Canary) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	canary := c.startCanary(versions)
+	ips, err := c.Filters.apply(c.primary.GetIPs(ctx, versions))
+	if canary != nil {
+		go c.compare(ips, err, versions, canary)
+	}
+	return ips, err
+}
+
+// canaryResult is the result of a lookup of the canary.
+type canaryResult struct {
+	ips []net.IP
+	err error
+}
+
+// startCanary starts a lookup of the canary and returns the
+// channel its result is sent on, or nil if the previous one
+// is still running.
+func (c Canary) startCanary(versions dynamicdns.IPVersions) <-chan canaryResult {
+	if !c.running.CompareAndSwap(false, true) {
+		c.vars.skipped.Add(1)
+		c.logger.Debug("skipping canary, the previous lookup is still running")
+		return nil
+	}
+	result := make(chan canaryResult, 1)
+	go func() {
+		defer c.running.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout))
+		defer cancel()
+		ips, err := c.Filters.apply(c.canary.GetIPs(ctx, versions))
+		result <- canaryResult{ips: ips, err: err}
+	}()
+	return result
+}
+
+// compare waits for the result of the canary and logs and
+// counts it if it differs from ips, the primary's result.
+// Nothing is compared if the primary failed.
+func (c Canary) compare(ips []net.IP, err error, versions dynamicdns.IPVersions, canary <-chan canaryResult) {
+	res := <-canary
+	if err != nil {
+		return
+	}
+	if res.err != nil {
+		c.vars.canaryFailures.Add(1)
+		c.logger.Warn("canary failed",
+			zap.Strings("primary", ipStrings(ips)),
+			zap.Error(res.err))
+		return
+	}
+
+	c.vars.comparisons.Add(1)
+	primary, other := filterVersions(ips, versions), filterVersions(res.ips, versions)
+	if sameIPs(primary, other) {
+		c.logger.Debug("canary matches",
+			zap.Strings("ips", ipStrings(primary)))
+		return
+	}
+	c.vars.mismatches.Add(1)
+	c.vars.lastMismatchUnix.Set(time.Now().Unix())
+	c.logger.Warn("canary mismatch",
+		zap.Strings("primary", ipStrings(primary)),
+		zap.Strings("canary", ipStrings(other)),
+		zap.Strings("only_primary", ipStrings(ipsMissing(primary, other))),
+		zap.Strings("only_canary", ipStrings(ipsMissing(other, primary))))
+}
+
+// ipsMissing returns the addresses of a that b does not have.
+func ipsMissing(a, b []net.IP) []net.IP {
+	var out []net.IP
+	for _, ip := range a {
+		if !ipListContains(b, ip) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*Canary)(nil)
+	_ caddy.Provisioner     = (*Canary)(nil)
+	_ caddyfile.Unmarshaler = (*Canary)(nil)
+)
@@ -0,0 +1,87 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How much of stdout and stderr CaptureOutput keeps by default.
+const defaultCaptureLimit = 4096
+
+// capturedOutput is what a command printed in the last lookup,
+// as the health endpoint returns it.
+type capturedOutput struct {
+	Time     time.Time `json:"time"`
+	RunID    string    `json:"run_id"`
+	Command  string    `json:"command"`
+	ExitCode int       `json:"exit_code"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr,omitempty"`
+
+	// whether stdout or stderr were cut at the limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// capture keeps the output of the commands of the last lookup.
+type capture struct {
+	mu      sync.Mutex
+	runID   string
+	outputs []capturedOutput
+}
+
+// add adds out, replacing the outputs of an earlier lookup.
+func (c *capture) add(out capturedOutput) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if out.RunID != c.runID {
+		c.runID, c.outputs = out.RunID, nil
+	}
+	c.outputs = append(c.outputs, out)
+}
+
+// get returns the outputs of the last lookup.
+func (c *capture) get() []capturedOutput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]capturedOutput(nil), c.outputs...)
+}
+
+// provisionCapture checks the size of the captured output.
+func (c *Command) provisionCapture() error {
+	if c.CaptureOutput < 0 {
+		return fmt.Errorf("invalid capture_output %d", c.CaptureOutput)
+	}
+	return nil
+}
+
+// captureOutput keeps what e printed, cut at CaptureOutput bytes
+// and with the secrets redacted, for the health endpoint.
+func (c Command) captureOutput(e Exec, exitCode int, stdout, stderr []byte) {
+	if c.CaptureOutput == 0 {
+		return
+	}
+	out := capturedOutput{
+		Time:     time.Now(),
+		RunID:    c.runID,
+		Command:  e.Cmd,
+		ExitCode: exitCode,
+	}
+	if len(stdout) > c.CaptureOutput {
+		stdout, out.Truncated = stdout[:c.CaptureOutput], true
+	}
+	if len(stderr) > c.CaptureOutput {
+		stderr, out.Truncated = stderr[:c.CaptureOutput], true
+	}
+	out.Stdout, out.Stderr = string(stdout), string(stderr)
+	if secrets := c.secrets(); len(secrets) > 0 {
+		r := newRedactor(secrets)
+		out.Stdout, out.Stderr = r.Replace(out.Stdout), r.Replace(out.Stderr)
+	}
+	c.state.capture.add(out)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// states holds the state of the command sources, keyed by the
+// fingerprint of their config. A config reload that keeps the
+// config of a source keeps its state too, like the cached
+// addresses and the running watch command, instead of starting
+// over. The state is released once no loaded config uses it.
+var states = caddy.NewUsagePool()
+
+// carriedState is the state shared by the command
+// sources with the same config, across reloads.
+type carriedState struct {
+	state *state
+
+	mu      sync.Mutex
+	watch   *watchState
+	owners  []*Command
+	started bool
+
+	// the watch command runs until the state is released
+	ctx       context.Context
+	stop      context.CancelFunc
+	watchDone chan struct{}
+}
+
+// provisionState loads the state of a source with the same
+// config, e.g. of the config that is being replaced, or
+// creates a new one.
+func (c *Command) provisionState() error {
+	config, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("fingerprinting config: %v", err)
+	}
+	sum := sha256.Sum256(config)
+	key := "state:" + hex.EncodeToString(sum[:])
+
+	val, loaded, err := states.LoadOrNew(key, func() (caddy.Destructor, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &carriedState{state: new(state), ctx: ctx, stop: cancel}, nil
+	})
+	if err != nil {
+		return err
+	}
+	c.carried = val.(*carriedState)
+	c.carriedKey = key
+	c.state = c.carried.state
+	if loaded {
+		c.logger.Debug("keeping state of previous config",
+			zap.String("command", c.Cmd))
+	}
+	c.stateCarried = loaded
+	return nil
+}
+
+// cleanupState releases the state, which is destroyed
+// if no other loaded config uses it.
+func (c *Command) cleanupState() error {
+	if c.carried == nil {
+		return nil
+	}
+	c.carried.removeOwner(c)
+	_, err := states.Delete(c.carriedKey)
+	return err
+}
+
+// watchState returns the state of the watch command, creating it
+// for the first source with this config.
+func (s *carriedState) watchState() *watchState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watch == nil {
+		s.watch = &watchState{
+			ready:       make(chan struct{}),
+			subscribers: make(map[int]func([]net.IP)),
+		}
+	}
+	return s.watch
+}
+
+// startWatch makes c announce the changes the watch command
+// reports and starts the command, unless a source with the
+// same config already did.
+func (s *carriedState) startWatch(c *Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.owners = append(s.owners, c)
+	if s.started {
+		c.logger.Info("keeping watch command of previous config",
+			zap.String("command", c.Cmd))
+		return
+	}
+	s.started = true
+	s.watchDone = make(chan struct{})
+	go func() {
+		defer close(s.watchDone)
+		c.watch(s.ctx)
+	}()
+}
+
+// owner returns the source loaded last that announces the
+// changes of the watch command, or nil if there is none.
+func (s *carriedState) owner() *Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.owners) == 0 {
+		return nil
+	}
+	return s.owners[len(s.owners)-1]
+}
+
+// removeOwner stops c from announcing changes.
+func (s *carriedState) removeOwner(c *Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, owner := range s.owners {
+		if owner == c {
+			s.owners = append(s.owners[:i], s.owners[i+1:]...)
+			return
+		}
+	}
+}
+
+// Destruct stops the watch command and waits until it exited.
+func (s *carriedState) Destruct() error {
+	s.stop()
+
+	s.mu.Lock()
+	done := s.watchDone
+	s.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	timer := time.NewTimer(childrenCleanupTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("watch command did not exit within %s", childrenCleanupTimeout)
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Destructor = (*carriedState)(nil)
+)
@@ -0,0 +1,56 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"go.uber.org/zap"
+)
+
+// The event emitted when the addresses changed.
+const EventIPsChanged = "ips_changed"
+
+// provisionEvents loads the events app, which the changes of
+// the addresses and of the health of the source are emitted to.
+func (c *Command) provisionEvents(ctx caddy.Context) error {
+	app, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("loading events app: %v", err)
+	}
+	c.events = app.(*caddyevents.App)
+	return nil
+}
+
+// recordChange logs, counts and emits that the addresses the
+// source returns changed from old to ips, so that the change is
+// attributed to the command, unlike in the logs of the updater.
+func (c Command) recordChange(old, ips []net.IP) {
+	c.logger.Info("addresses changed",
+		zap.String("command", c.Cmd),
+		zap.Strings("old_ips", ipStrings(old)),
+		zap.Strings("new_ips", ipStrings(ips)))
+	c.countChange()
+
+	// in watch mode, announced by the source of the config
+	// loaded last, which may not be the one that started it
+	emitter := &c
+	if c.Watch {
+		emitter = c.carried.owner()
+	}
+	if emitter == nil || emitter.events == nil {
+		return
+	}
+	emitter.events.Emit(emitter.ctx, EventIPsChanged, c.labeled(map[string]any{
+		"command": c.Cmd,
+		"run_id":  c.runID,
+		"old":     ipStrings(old),
+		"new":     ipStrings(ips),
+	}))
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// commandPath returns the path of the file that is executed for cmd
+// when run in dir: like exec.Command, names without a path separator
+// are looked up in PATH, while relative paths are relative to dir.
+// If a name is not found in PATH, but there is such a file in dir,
+// the error says how to run it instead.
+func commandPath(cmd, dir string) (string, error) {
+	if isBareName(cmd) {
+		path, err := exec.LookPath(cmd)
+		if err != nil && dir != "" {
+			if _, statErr := os.Stat(filepath.Join(dir, cmd)); statErr == nil {
+				return "", fmt.Errorf("%v; to run %s in dir %s, use ./%s", err, cmd, dir, cmd)
+			}
+		}
+		return path, err
+	}
+	if !filepath.IsAbs(cmd) && dir != "" {
+		return filepath.Abs(filepath.Join(dir, cmd))
+	}
+	return cmd, nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 checksum of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyChecksum returns an error if the checksum of the
+// command does not match the configured checksum.
+func (c Command) verifyChecksum() error {
+	if c.SHA256 == "" {
+		return nil
+	}
+	path, err := c.lookPath(c.Cmd, c.Dir)
+	if err != nil {
+		return fmt.Errorf("verifying checksum of command %s: %v", c.Cmd, err)
+	}
+	if c.Chroot != "" {
+		path = filepath.Join(c.Chroot, path)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return fmt.Errorf("verifying checksum of command %s: %v", c.Cmd, err)
+	}
+	if !strings.EqualFold(sum, c.SHA256) {
+		return fmt.Errorf("checksum mismatch for command %s: expected sha256 %s, got %s", path, c.SHA256, sum)
+	}
+	return nil
+}
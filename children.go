@@ -0,0 +1,102 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// childrenCleanupTimeout is how long Cleanup waits for the running
+// processes to exit after they were canceled. A process run through
+// a privilege wrapper gets privilegeWaitDelay to handle the interrupt.
+const childrenCleanupTimeout = privilegeWaitDelay + 5*time.Second
+
+// children are the processes a command source runs, like lookups,
+// hooks and the watch command. They are canceled on Cleanup, so that
+// a config reload does not leave a lookup that is still running, or
+// a lookup that was started by a goroutine of the old config, behind.
+type children struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+	cancels map[int]context.CancelFunc
+	nextID  int
+}
+
+// provisionChildren prepares tracking the processes.
+func (c *Command) provisionChildren() {
+	c.children = &children{cancels: make(map[int]context.CancelFunc)}
+}
+
+// cleanupChildren cancels the running processes and
+// waits until they exited or the timeout is over.
+func (c *Command) cleanupChildren() {
+	if c.children == nil {
+		return
+	}
+	if !c.children.stop(childrenCleanupTimeout) {
+		c.logger.Warn("processes did not exit on cleanup",
+			zap.String("command", c.Cmd),
+			zap.Duration("timeout", childrenCleanupTimeout))
+	}
+}
+
+// start returns a context for a process, which is also canceled on
+// cleanup, and a function to call when the process exited. Once the
+// source was cleaned up, the context is canceled right away.
+func (ch *children) start(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	if ch == nil {
+		return ctx, cancel
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed {
+		cancel()
+		return ctx, cancel
+	}
+	id := ch.nextID
+	ch.nextID++
+	ch.cancels[id] = cancel
+	ch.wg.Add(1)
+	return ctx, func() {
+		cancel()
+		ch.mu.Lock()
+		delete(ch.cancels, id)
+		ch.mu.Unlock()
+		ch.wg.Done()
+	}
+}
+
+// stop cancels the running processes and prevents new ones. It
+// returns false if they did not all exit within timeout.
+func (ch *children) stop(timeout time.Duration) bool {
+	ch.mu.Lock()
+	ch.closed = true
+	for _, cancel := range ch.cancels {
+		cancel()
+	}
+	ch.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ch.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// provisionChroot ensures the commands can be run in the chroot:
+// Caddy must run as root, and as the commands are not looked up
+// in PATH inside the chroot, their paths must be absolute.
+func (c *Command) provisionChroot() error {
+	if c.Chroot == "" {
+		return nil
+	}
+	if err := checkChroot(); err != nil {
+		return fmt.Errorf("chroot: %v", err)
+	}
+	if c.Mode != "" && c.Mode != ModeExec {
+		return fmt.Errorf("chroot is not supported in %s mode", c.Mode)
+	}
+	info, err := os.Stat(c.Chroot)
+	if err != nil {
+		return fmt.Errorf("chroot: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("chroot: %s is not a directory", c.Chroot)
+	}
+
+	check := func(name, cmd string) error {
+		if !filepath.IsAbs(cmd) {
+			return fmt.Errorf("chroot: %s %s is not an absolute path in the chroot", name, cmd)
+		}
+		return nil
+	}
+	if err := check("command", c.Cmd); err != nil {
+		return err
+	}
+	for _, e := range c.Commands {
+		if err := check("command", e.Cmd); err != nil {
+			return err
+		}
+	}
+	for _, e := range c.Pipeline {
+		if err := check("pipe command", e.Cmd); err != nil {
+			return err
+		}
+	}
+	if c.Before != nil {
+		if err := check("before hook", c.Before.Cmd); err != nil {
+			return err
+		}
+	}
+	if c.After != nil {
+		if err := check("after hook", c.After.Cmd); err != nil {
+			return err
+		}
+	}
+	if c.OnFailure != nil && c.OnFailure.Cmd != "" {
+		if err := check("on_failure command", c.OnFailure.Cmd); err != nil {
+			return err
+		}
+	}
+	if c.Probe != nil && c.Probe.Cmd != "" {
+		if err := check("probe command", c.Probe.Cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
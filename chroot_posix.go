@@ -0,0 +1,27 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !windows
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkChroot returns an error if the process may not chroot.
+func checkChroot() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("requires running Caddy as root")
+	}
+	return nil
+}
+
+// chrootAttr returns the attributes to start a process in dir as root.
+func chrootAttr(dir string) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Chroot: dir}
+}
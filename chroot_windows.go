@@ -0,0 +1,21 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// checkChroot fails, as Windows has no chroot.
+func checkChroot() error {
+	return fmt.Errorf("not supported on windows")
+}
+
+// chrootAttr is never called, as checkChroot fails.
+func chrootAttr(string) *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !windows
+
+package command
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// checkRawCommandLine fails, as processes get their args
+// one by one outside of Windows, so there is no quoting.
+func checkRawCommandLine() error {
+	return fmt.Errorf("only supported on windows")
+}
+
+// rawCommandLineAttr is never called, as checkRawCommandLine fails.
+func rawCommandLineAttr(string, []string) *syscall.SysProcAttr {
+	return nil
+}
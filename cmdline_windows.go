@@ -0,0 +1,27 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"strings"
+	"syscall"
+)
+
+// checkRawCommandLine succeeds, as only Windows passes
+// the command line to a process as a single string.
+func checkRawCommandLine() error {
+	return nil
+}
+
+// rawCommandLineAttr returns the attributes to start path with
+// args joined by spaces as they are, without quoting them.
+func rawCommandLineAttr(path string, args []string) *syscall.SysProcAttr {
+	line := syscall.EscapeArg(path)
+	if len(args) > 0 {
+		line += " " + strings.Join(args, " ")
+	}
+	return &syscall.SysProcAttr{CmdLine: line}
+}
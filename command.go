@@ -6,17 +6,29 @@
 package command
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/netip"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/fsnotify/fsnotify"
 	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -29,22 +41,632 @@ func init() {
 //
 // The command must return the IP addresses comma spreaded in plain text.
 type Command struct {
-	// The command to execute.
+	// The command to execute. In powershell mode, this
+	// is the PowerShell snippet to run.
 	Cmd string `json:"command,omitempty"`
 
 	// Arguments to the command. Placeholders are expanded
 	// in arguments, so use caution to not introduce any
 	// security vulnerabilities with the command.
+	//
+	// The {file.<path>} placeholder expands to the contents
+	// of the file at path when the command is run, which
+	// keeps secrets out of the config and the logs.
+	//
+	// The {output_file} placeholder expands to the path of a
+	// temporary file, which is parsed instead of the output
+	// of the command, for tools that can only write to a file.
 	Args []string `json:"args,omitempty"`
 
-	// The directory in which to run the command.
+	// An environment variable of Caddy with further args,
+	// split into words like a shell does, e.g. for a container
+	// that can only be given a single variable. They are read
+	// when the config is loaded and appended to the args.
+	ArgsFromEnv string `json:"args_from_env,omitempty"`
+
+	// The directory in which to run the command. Global
+	// placeholders, like {env.HOME}, are expanded.
 	Dir string `json:"dir,omitempty"`
 
+	// Create the dir of the command, the further commands, the
+	// pipe stages and the hooks with their missing parents when
+	// the config is loaded, if they do not exist, e.g. in the
+	// fresh state directory of a systemd dynamic user.
+	CreateDir bool `json:"create_dir,omitempty"`
+
+	// The octal permissions of the directories CreateDir
+	// creates. Default: 0700
+	DirMode string `json:"dir_mode,omitempty"`
+
 	// How long to wait for the command to terminate
 	// before forcefully closing it. Default: 30s
 	Timeout caddy.Duration `json:"timeout,omitempty"`
 
-	logger *zap.Logger
+	// Further commands to run after the command. The addresses
+	// of all commands are merged, without duplicates. The lookup
+	// fails if any of the commands fails.
+	Commands []Exec `json:"commands,omitempty"`
+
+	// Commands the output of the command is piped through, in
+	// order, like `curl ... | jq -r .ip` in a shell, but without
+	// one. Every stage gets the complete output of the previous
+	// one on stdin, and the addresses are parsed from the output
+	// of the last one. The lookup fails if any stage fails.
+	// Only supported in exec mode.
+	Pipeline []Exec `json:"pipeline,omitempty"`
+
+	// Text to write to the standard input of the command, e.g. the
+	// query of a lookup tool. Placeholders, including {file.<path>},
+	// are expanded as in args. Nothing is appended, so include the
+	// trailing newline a tool may expect.
+	Stdin string `json:"stdin,omitempty"`
+
+	// The key of this source in the output of a command shared by
+	// several sources, a JSON object with the addresses of each,
+	// e.g. one per zone. Sources with the same command, args, dir
+	// and stdin run it once within BatchWindow and pick their
+	// addresses by their key, before json_path.
+	Batch string `json:"batch,omitempty"`
+
+	// How long the output of a batched command is shared.
+	// Default: 10s
+	BatchWindow caddy.Duration `json:"batch_window,omitempty"`
+
+	// How long the whole lookup may take: the before hook, all
+	// commands, each of which is still limited by its own
+	// timeout, and processing their output. A lookup that took
+	// too long fails with an *ErrDeadline naming the phase it
+	// was in. The after hook is not limited by the deadline,
+	// so it can always clean up. Default: no deadline
+	Deadline caddy.Duration `json:"deadline,omitempty"`
+
+	// Return the addresses of the commands that finished if a
+	// further command times out or the deadline expires, with
+	// an *ErrPartial naming the families without addresses,
+	// so that e.g. the IPv4 address is published even if the
+	// IPv6 probe hangs. Default: the lookup fails
+	PartialResults bool `json:"partial_results,omitempty"`
+
+	// Return no addresses, or the ones of a partial result,
+	// with a warning instead of the error if the lookup fails,
+	// so that a source that is not critical cannot fail the
+	// check of the dynamic_dns app; it then tries the next of
+	// its sources. The failure still counts for the health.
+	Optional bool `json:"optional,omitempty"`
+
+	// How long each attempt of the lookup may take: all commands
+	// of one try, each of which is still limited by its own
+	// timeout. Every retry gets a fresh attempt timeout, while
+	// the deadline caps all attempts together, e.g. 10s for each
+	// try, but 25s at most. Default: no attempt timeout
+	AttemptTimeout caddy.Duration `json:"attempt_timeout,omitempty"`
+
+	// Only return the addresses in these subnets, e.g. the
+	// prefixes of the ISP, in CIDR notation. The addresses
+	// are filtered before they are checked against the
+	// requirements below. Default: all addresses
+	AllowedSubnets []string `json:"allowed_subnets,omitempty"`
+
+	// Never return the addresses in these subnets, e.g.
+	// 100.64.0.0/10 for CGNAT or the ranges of a VPN, in
+	// CIDR notation. Applied after AllowedSubnets.
+	DeniedSubnets []string `json:"denied_subnets,omitempty"`
+
+	// Accepted for configs written for sources that drop
+	// private, CGNAT or unique local addresses by default. The
+	// command source never filters address ranges by itself,
+	// so it has no effect. In the Caddyfile, no_range_filter
+	// is the same.
+	AllowPrivate bool `json:"allow_private,omitempty"`
+
+	// Prefer the addresses in these subnets, in CIDR notation:
+	// if any address of a family is in one of them, the other
+	// addresses of that family are dropped, so that e.g. the
+	// address of the ISP is published whenever there is one,
+	// and the address of a tunnel only as a fallback. Earlier
+	// subnets win over later ones. Applied after DeniedSubnets.
+	PreferSubnets []string `json:"prefer_subnets,omitempty"`
+
+	// An expression selecting the addresses to return, for what
+	// the subnets cannot express, e.g.
+	// `is_global && !in('2001:db8::/32') && prefix_len == 64`.
+	// See Selection for the syntax. SelectIPv4 and SelectIPv6
+	// only apply to the addresses of their family.
+	Select     string `json:"select,omitempty"`
+	SelectIPv4 string `json:"select_ipv4,omitempty"`
+	SelectIPv6 string `json:"select_ipv6,omitempty"`
+
+	// Return at most this many addresses of each family, e.g.
+	// to keep a host with several global IPv6 addresses from
+	// flooding the record set. Default: 0 (no limit)
+	MaxPerFamily int `json:"max_per_family,omitempty"`
+
+	// Which addresses to return if there are more than
+	// MaxPerFamily of a family. Except for first, the choice
+	// does not depend on the order of the output. Default: first
+	//
+	// - first: the ones the command printed first
+	// - lowest: the numerically lowest ones
+	// - eui64: IPv6 addresses with an interface identifier
+	//   derived from the MAC address (EUI-64), which are
+	//   stable, then the lowest ones
+	// - longest_lifetime: the ones with the longest preferred
+	//   lifetime, then the lowest ones; requires the iproute2
+	//   format
+	Prefer string `json:"prefer,omitempty"`
+
+	// Fail if the command does not return an IPv4 address.
+	// Only enforced if IPv4 is enabled in the dynamic_dns app.
+	RequireIPv4 bool `json:"require_ipv4,omitempty"`
+
+	// Fail if the command does not return an IPv6 address.
+	// Only enforced if IPv6 is enabled in the dynamic_dns app.
+	RequireIPv6 bool `json:"require_ipv6,omitempty"`
+
+	// The minimum number of addresses the command must return.
+	MinAddresses int `json:"min_addresses,omitempty"`
+
+	// How many consecutive runs in a row must return a changed
+	// set of addresses before it is reported. Until then, the
+	// previously reported addresses are returned. Default: 1
+	ConfirmChanges int `json:"confirm_changes,omitempty"`
+
+	// For how many consecutive runs the previous addresses are
+	// reported instead, if the command succeeds but returns no
+	// addresses, e.g. while a DHCP lease is renewed. Default: 0
+	EmptyResultGrace int `json:"empty_result_grace,omitempty"`
+
+	// How long a successful result is reused before the
+	// command is run again. Default: 0 (always run)
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// How long the addresses of each family are reused, if
+	// not for CacheTTL, e.g. for a static IPv4 address and a
+	// rotating IPv6 prefix. Only the families that expired
+	// are looked up again; the command learns which from
+	// CADDY_DDNS_IPV4 and CADDY_DDNS_IPV6.
+	CacheTTLIPv4 caddy.Duration `json:"cache_ttl_ipv4,omitempty"`
+	CacheTTLIPv6 caddy.Duration `json:"cache_ttl_ipv6,omitempty"`
+
+	// Delay every lookup by a random duration up to this long,
+	// e.g. so that many instances polling the same echo service
+	// at the same interval do not all query it at once. Lookups
+	// by the admin API are not delayed, and the delay does not
+	// count against the deadline. Default: 0 (no delay)
+	Jitter caddy.Duration `json:"jitter,omitempty"`
+
+	// How often the command may run at most, as <n>/<unit> with
+	// the unit s, m, h, d or a duration, e.g. 6/h, so that a
+	// short check interval, retries or refreshes by the admin API
+	// cannot hammer a third-party service. Up to n runs may happen
+	// in a burst. A lookup that is not allowed to run returns the
+	// last addresses, or ErrRateLimited if there are none yet.
+	// Sources with the same command line share the limit.
+	// Default: "" (no limit)
+	MaxRate string `json:"max_rate,omitempty"`
+
+	// An exit code by which a command reports that the addresses
+	// did not change since the last run. The previously returned
+	// addresses are returned again, and the run does not count as
+	// a failure. Default: 0 (disabled)
+	UnchangedExitCode int `json:"unchanged_exit_code,omitempty"`
+
+	// Recognize keywords the command may print instead of
+	// addresses: NOCHANGE as its whole output reports that the
+	// addresses did not change, like UnchangedExitCode, and NONE
+	// in place of an address, e.g. "ipv6: NONE" in the labeled
+	// format, explicitly reports none.
+	Sentinels bool `json:"sentinels,omitempty"`
+
+	// How often to retry a failed lookup. Default: 0
+	Retries int `json:"retries,omitempty"`
+
+	// How long to wait before retrying. Default: 0
+	RetryDelay caddy.Duration `json:"retry_delay,omitempty"`
+
+	// Only retry if a command exited with one of these
+	// exit codes, or, if RetryOnTimeout is set, it timed
+	// out. If neither is set, every failure is retried.
+	RetryOnExitCodes []int `json:"retry_on_exit_codes,omitempty"`
+
+	// Retry if a command timed out. See RetryOnExitCodes.
+	RetryOnTimeout bool `json:"retry_on_timeout,omitempty"`
+
+	// A command to run before the lookup. Unless it ignores
+	// errors, the lookup fails if this command fails.
+	Before *Hook `json:"before,omitempty"`
+
+	// A command to run after the lookup. It runs even if the
+	// lookup failed. Unless it ignores errors, the lookup
+	// fails if this command fails.
+	After *Hook `json:"after,omitempty"`
+
+	// Notifies about failed lookups.
+	OnFailure *OnFailure `json:"on_failure,omitempty"`
+
+	// If set, only these commands may be executed. They must be
+	// absolute paths, and so must the command, the hooks and the
+	// on_failure command, which is checked when the config is
+	// loaded.
+	AllowedCommands []string `json:"allowed_commands,omitempty"`
+
+	// The hex encoded SHA-256 checksum of the command's file.
+	// If set, the file is verified when the config is loaded
+	// and before every run, and the command is refused if the
+	// file was changed.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// How to execute the command. Default: exec
+	//
+	// - exec: execute the command directly
+	// - powershell: run the command as a PowerShell snippet with
+	//   pwsh or, if not installed, powershell; the args are
+	//   available to it in $args
+	// - wsl: execute the command in the Windows Subsystem for
+	//   Linux with wsl.exe
+	Mode string `json:"mode,omitempty"`
+
+	// The WSL distribution to execute the command in, in wsl
+	// mode. Default: the default distribution
+	Distro string `json:"distro,omitempty"`
+
+	// Pass the args on Windows as they are, joined by spaces,
+	// instead of quoting them the way most programs parse their
+	// command line, e.g. for cmd.exe builtins or vendor tools
+	// with their own parsing rules. Only supported on Windows in
+	// exec mode.
+	RawCommandLine bool `json:"raw_command_line,omitempty"`
+
+	// A directory to confine the commands to, including the
+	// hooks and the on_failure command. Their paths and dirs
+	// are then paths in this directory; the paths must be
+	// absolute. Requires running Caddy as root. Not supported
+	// on Windows.
+	Chroot string `json:"chroot,omitempty"`
+
+	// Run the commands, including the hooks and the on_failure
+	// command, through sudo or doas, e.g. to read counters only
+	// root may read. Either must run them without asking for a
+	// password, which is checked when the config is loaded; a
+	// prompt would otherwise only show up as a timeout. Not
+	// supported on Windows.
+	PrivilegeWrapper string `json:"privilege_wrapper,omitempty"`
+
+	// Further flags for the privilege wrapper, e.g. "-u nobody".
+	// The -n flag, which makes it fail instead of asking for a
+	// password, is always passed.
+	PrivilegeWrapperFlags []string `json:"privilege_wrapper_flags,omitempty"`
+
+	// Do not pass Caddy's environment on to the commands, which
+	// may contain secrets like the API token of the DNS provider.
+	// They only get the variables set by Env and the ones
+	// describing the lookup.
+	CleanEnv bool `json:"clean_env,omitempty"`
+
+	// Environment variables to set for the commands, including
+	// the hooks and the on_failure command. Global placeholders
+	// like {env.HOME} in the values are expanded.
+	Env map[string]string `json:"env,omitempty"`
+
+	// The positions of the args, starting at 0, that are secret,
+	// like a password. Their values are replaced with [REDACTED]
+	// wherever they appear in the logs, e.g. in the args or the
+	// output of a failed command.
+	SecretArgs []int `json:"secret_args,omitempty"`
+
+	// Environment variables whose values are secret, set by Env
+	// or inherited from Caddy. Their values are redacted like the
+	// ones of SecretArgs.
+	SecretEnv []string `json:"secret_env,omitempty"`
+
+	// The niceness to run the commands with, from -20 (the highest
+	// priority) to 19 (the lowest), so that frequent lookups do not
+	// compete with serving requests. Not supported on Windows.
+	// Default: 0 (the niceness of Caddy)
+	Nice int `json:"nice,omitempty"`
+
+	// The I/O scheduling class to run the commands with: realtime,
+	// best-effort or idle. Only supported on Linux.
+	IONiceClass string `json:"ionice_class,omitempty"`
+
+	// The level within the I/O scheduling class, from 0 (the
+	// highest priority) to 7 (the lowest). Not used by idle.
+	IONiceLevel int `json:"ionice_level,omitempty"`
+
+	// The CPUs, starting at 0, the commands may run on, e.g. to
+	// keep them off the CPU handling the network interrupts.
+	// Only supported on Linux.
+	CPUAffinity []int `json:"cpu_affinity,omitempty"`
+
+	// How the output of the command is encoded. It is decoded
+	// before anything else is done with it. Supported: base64
+	Decode string `json:"decode,omitempty"`
+
+	// How the output of the command is compressed: auto
+	// decompresses gzip output, recognized by its magic bytes,
+	// gzip requires it and none never decompresses. It is
+	// decompressed even before it is decoded. Default: auto
+	Compression string `json:"compression,omitempty"`
+
+	// Extract the addresses from JSON output of the command by
+	// a dot separated path of object keys and array indexes, e.g.
+	// "ip" for {"ip": "203.0.113.5"}. A "#" selects every element
+	// of an array, e.g. "addrs.#.ip". Arrays of values are turned
+	// into a comma separated list.
+	JSONPath string `json:"json_path,omitempty"`
+
+	// A Go text/template that transforms the output of the command
+	// before the addresses are parsed from it; it runs after the
+	// json_path was extracted. The output is
+	// available as {{.Stdout}}, and the functions of the sprig
+	// library (https://masterminds.github.io/sprig/) can be used,
+	// e.g. to pick the second column of the first line:
+	//
+	//	{{ index (splitList " " (first (splitList "\n" .Stdout))) 1 }}
+	TransformTemplate string `json:"transform_template,omitempty"`
+
+	// The format of the output. Default: list
+	//
+	// - list: a list of addresses, separated by the delimiter
+	// - labeled: one labeled address per line, like
+	//   "ipv4: 203.0.113.5" or "ipv6: 2001:db8::1"; an address
+	//   must belong to the family of its label
+	// - iproute2: the JSON output of `ip -j addr`; tentative
+	//   addresses are skipped
+	// - extended: a JSON object with the addresses in "ips",
+	//   and optionally a suggested "ttl" and the addresses of
+	//   specific "hosts", which are returned by Metadata
+	// - auto: any of the above, detected from the output, or
+	//   the addresses found in any other JSON document
+	Format string `json:"format,omitempty"`
+
+	// Only use the addresses of this interface,
+	// in the iproute2 format.
+	Interface string `json:"interface,omitempty"`
+
+	// Only use addresses of this scope, e.g. "global",
+	// in the iproute2 format.
+	Scope string `json:"scope,omitempty"`
+
+	// Skip deprecated addresses in the iproute2 format.
+	SkipDeprecated bool `json:"skip_deprecated,omitempty"`
+
+	// Skip temporary IPv6 addresses (RFC 4941 privacy
+	// addresses) in the iproute2 format, so that only the
+	// stable addresses are published.
+	SkipTemporary bool `json:"skip_temporary,omitempty"`
+
+	// What to do with lines without a label in the labeled
+	// format: reject them, failing the lookup, or ignore
+	// them. Default: reject
+	Unlabeled string `json:"unlabeled,omitempty"`
+
+	// What to do with tokens in the output that are not
+	// addresses, like a status word a router appends: fail
+	// the lookup, skip them, or skip them and log a warning.
+	// Output without any address still fails. Default: fail
+	OnParseError string `json:"on_parse_error,omitempty"`
+
+	// A regular expression matching the delimiter between the
+	// addresses in the output, e.g. "[\\s,;]+" to split at any
+	// mix of whitespace, commas and semicolons. Default: ","
+	Delimiter string `json:"delimiter,omitempty"`
+
+	// Create an OpenTelemetry span for every run of a command.
+	// Like Caddy's tracing handler, the exporter is configured
+	// by the OTEL_EXPORTER_OTLP_* environment variables. The
+	// trace context is passed on to the command in the
+	// TRACEPARENT environment variable.
+	Tracing bool `json:"tracing,omitempty"`
+
+	// Log how each command is run, after placeholders were
+	// expanded: the executable, args, directory, environment
+	// and output settings. This is logged at info level, so it
+	// does not require enabling debug logs for all of Caddy.
+	// Secrets are redacted.
+	Debug bool `json:"debug,omitempty"`
+
+	// Log the output of every successful run, truncated, at
+	// this level: debug or info. This shows what a command
+	// printed even if all of its addresses were filtered out.
+	// Default: "" (disabled)
+	LogOutput string `json:"log_output,omitempty"`
+
+	// Log identical warnings and errors, e.g. of a command that
+	// keeps failing while the WAN is down, only once within this
+	// interval. The repetitions are logged as a summary when the
+	// interval passed or a lookup succeeded again. Default: 0
+	// (log every failure)
+	LogDampening caddy.Duration `json:"log_dampening,omitempty"`
+
+	// A name appended to the name of the source's logger, e.g.
+	// "wan" for dynamic_dns.ip_sources.command.wan, to tell the
+	// logs of several sources apart and include or exclude them
+	// in Caddy's log config. Default: "" (the module's logger)
+	LoggerName string `json:"logger_name,omitempty"`
+
+	// A label telling the source apart from others, e.g. the
+	// WAN link it looks up in a multi-WAN setup. It is added to
+	// the logs, events, webhooks and metadata of the source and
+	// keys its counters instead of the command line.
+	Label string `json:"label,omitempty"`
+
+	// The minimum level of the source's logs: debug, info, warn
+	// or error, e.g. to quiet a noisy source. It can only raise
+	// the level of Caddy's logs; to see the debug logs of just
+	// one source, include its logger_name in a log at debug
+	// level. Default: "" (the level of Caddy's logs)
+	LogLevel string `json:"log_level,omitempty"`
+
+	// The maximum number of processes all command sources run
+	// at once, e.g. to avoid a burst of processes on a router
+	// with little memory. The limit is shared by every command
+	// source, and the one configured last applies to all of
+	// them. Hooks and on_failure commands count as well.
+	// Default: 0 (no limit)
+	MaxProcesses int `json:"max_processes,omitempty"`
+
+	// Run the lookup once when the config is loaded, including
+	// the hooks, and refuse the config if it fails or returns no
+	// addresses, so that mistakes show up right away instead of
+	// minutes later in the logs.
+	VerifyOnStart bool `json:"verify_on_start,omitempty"`
+
+	// Refuse the config if a command given by its name cannot
+	// be found in PATH when the config is loaded, instead of
+	// only logging a warning.
+	RequireCommand bool `json:"require_command,omitempty"`
+
+	// After how many failed lookups in a row the source is
+	// failing, which the health endpoint of the admin API
+	// reports, and a source_unhealthy event is emitted.
+	// Default: 0 (the source is never failing)
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+
+	// How many of the last lookups to keep in memory, with their
+	// time, duration, exit code, addresses and error, which the
+	// health endpoint of the admin API returns, so that failures
+	// can be diagnosed after the fact. Default: 0 (none)
+	History int `json:"history,omitempty"`
+
+	// Keep what the commands of the last lookup printed, up to
+	// this many bytes of stdout and stderr each, with secrets
+	// redacted, for the health endpoint of the admin API, so
+	// that it can be shared without running them again.
+	// Default: 0 (none)
+	CaptureOutput int `json:"capture_output,omitempty"`
+
+	// Run the lookup once in the background when the config is
+	// loaded, and return its result from the first call instead
+	// of running the command then, so that a slow command does
+	// not delay the first DNS update after a restart.
+	WarmUp bool `json:"warm_up,omitempty"`
+
+	// Run the lookups as usual, log their addresses and keep
+	// them for the admin API, but return ErrDryRun instead of
+	// them from GetIPs, so that the DNS records are not
+	// updated, e.g. to try a new command in production.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Keep a history of the addresses every successful lookup
+	// resolved, e.g. to track down how often an ISP changes them.
+	AuditLog *AuditLog `json:"audit_log,omitempty"`
+
+	// Save the last addresses and the history to Caddy's storage
+	// and restore them on start, e.g. for instances in a cluster
+	// or on ephemeral hosts, which would start over otherwise.
+	PersistState *PersistState `json:"persist_state,omitempty"`
+
+	// Caddy events that expire the cached result, so that the
+	// next lookup runs the command, e.g. events emitted by a
+	// plugin watching the network links.
+	RefreshOn []string `json:"refresh_on,omitempty"`
+
+	// A signal that expires the cached result, like RefreshOn:
+	// SIGUSR1, SIGUSR2 or SIGHUP. Not supported on Windows.
+	RefreshSignal string `json:"refresh_signal,omitempty"`
+
+	// A named pipe that expires the cached result, like RefreshOn,
+	// whenever a line is written to it, e.g. by an ops runbook
+	// with `echo > /run/caddy-ddns`. It is created if it does not
+	// exist. Not supported on Windows.
+	RefreshPipe string `json:"refresh_pipe,omitempty"`
+
+	// Run the lookup right away when RefreshOn, RefreshSignal or
+	// RefreshPipe expired the cached result, instead of on the
+	// next check of the dynamic_dns app, like WatchPaths. It is
+	// then ready for that check, and its changes are logged and
+	// emitted as events without waiting for it.
+	RefreshRun bool `json:"refresh_run,omitempty"`
+
+	// Files or directories whose changes expire the cached result
+	// and run the lookup again right away, e.g. the leases file of
+	// the DHCP client, so that interval polling is only a fallback.
+	WatchPaths []string `json:"watch_paths,omitempty"`
+
+	// Run the command as a long-running process, e.g. a script
+	// around `ip monitor`, that prints a line with the addresses
+	// every time they change, in the configured format. GetIPs
+	// returns the last addresses without running anything, and
+	// every change is announced by an ips_changed event. The
+	// dynamic_dns app still updates the records only at its next
+	// check, since it does not subscribe by the Watcher interface.
+	Watch bool `json:"watch,omitempty"`
+
+	// When to restart the watch command after it exited: always,
+	// on_failure (a non-zero exit) or never. Default: always
+	WatchRestart string `json:"watch_restart,omitempty"`
+
+	// How long to wait before restarting the watch command. The
+	// delay doubles with every restart up to the max delay, and
+	// starts over once the command ran for the max delay.
+	// Default: 1s, up to 1m
+	WatchRestartDelay    caddy.Duration `json:"watch_restart_delay,omitempty"`
+	WatchRestartMaxDelay caddy.Duration `json:"watch_restart_max_delay,omitempty"`
+
+	// Restart the watch command at most this often within an
+	// hour; further restarts wait. Default: 0 (no limit)
+	WatchMaxRestarts int `json:"watch_max_restarts,omitempty"`
+
+	// How often a consumer of the Scheduler interface should look
+	// up the addresses; the dynamic_dns app does not use it.
+	// Default: 1h in watch mode, which reports changes by itself,
+	// else cache_ttl, since lookups in between return the cached
+	// result, else none
+	PollInterval caddy.Duration `json:"poll_interval,omitempty"`
+
+	// Filter modules applied to the addresses, in order, after
+	// the subnets, selection and limits of the source.
+	Filters
+
+	// Go text/templates that derive further addresses from each
+	// address of the result, after the filters, e.g. the address
+	// of a server in the /64 of the router's IPv6 address:
+	//
+	//	{{ if .IPv6 }}{{ ipWithSuffix .IP 64 "::10" }}{{ end }}
+	//
+	// The address is available as {{.IP}}, all of them as
+	// {{.IPs}}, and besides the sprig functions, ipWithSuffix
+	// and ipNetwork combine an address with a suffix.
+	Synthesize []string `json:"synthesize,omitempty"`
+
+	// Derive the addresses of the other family from the ones
+	// of the result, after the filters, for tunnels like 6to4,
+	// 6rd or NAT64, so that one lookup yields both.
+	Translate []*Translation `json:"translate,omitempty"`
+
+	// Checks that the addresses are reachable and withholds
+	// the ones that are not.
+	Probe *Probe `json:"probe,omitempty"`
+
+	ctx            caddy.Context
+	vars           *sourceVars
+	limiter        *limiter
+	paths          map[string]string
+	allowedSubnets []*net.IPNet
+	deniedSubnets  []*net.IPNet
+	preferSubnets  []*net.IPNet
+	selection      *Selection
+	delimiter      *regexp.Regexp
+	events         *caddyevents.App
+	fileWatcher    *fsnotify.Watcher
+	interpreter    string
+	wrapper        string
+	semaphore      *semaphore
+	children       *children
+	carried        *carriedState
+	carriedKey     string
+	stateCarried   bool
+	dampener       *dampener
+	stopRefresh    chan struct{}
+	refreshPipe    *os.File
+	tracer         trace.Tracer
+	transform      *template.Template
+	synthesize     []*template.Template
+	state          *state
+	watchState     *watchState
+	logger         *zap.Logger
+	runID          string
 }
 
 // CaddyModule returns the Caddy module information.
@@ -57,7 +679,126 @@ func (Command) CaddyModule() caddy.ModuleInfo {
 
 // UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
 //
-//	exec <command> <args...>
+//	command <command> <args...> {
+//	    command <command> <args...> {
+//	        args <args...>
+//	        dir <path>
+//	        timeout <duration>
+//	    }
+//	    pipe <command> <args...> {
+//	        args <args...>
+//	        dir <path>
+//	        timeout <duration>
+//	    }
+//	    args <args...> {
+//	        <args...>
+//	    }
+//	    create_dir [<mode>]
+//	    args_from_env <name>
+//	    stdin <text>
+//	    batch <key> [<window>]
+//	    timeout <duration>
+//	    deadline <duration>
+//	    partial_results
+//	    optional
+//	    attempt_timeout <duration>
+//	    allowed_subnets <cidrs...>
+//	    denied_subnets <cidrs...>
+//	    allow_private
+//	    prefer_subnets <cidrs...>
+//	    select [ipv4|ipv6] <expression>
+//	    max_per_family <n>
+//	    prefer first|lowest|eui64|longest_lifetime
+//	    filter <name> ...
+//	    synthesize <template>
+//	    translate 6to4|6rd|nat64 [<prefix>] {
+//	        ipv4_prefix <cidr>
+//	        suffix <ip>
+//	    }
+//	    require_ipv4
+//	    require_ipv6
+//	    min_addresses <n>
+//	    confirm_changes <runs>
+//	    empty_result_grace <runs>
+//	    cache_ttl [ipv4|ipv6] <duration>
+//	    jitter <duration>
+//	    max_rate <n>/<unit>
+//	    unchanged_exit_code <code>
+//	    sentinels
+//	    retries <n>
+//	    retry_delay <duration>
+//	    retry_on_exit_codes <codes...>
+//	    retry_on_timeout
+//	    before <command> <args...> {
+//	        args <args...>
+//	        dir <path>
+//	        timeout <duration>
+//	        ignore_errors
+//	    }
+//	    after <command> <args...> {
+//	        ...
+//	    }
+//	    on_failure [<command> <args...>] {
+//	        webhook <url>
+//	        timeout <duration>
+//	    }
+//	    allowed_commands <paths...>
+//	    sha256 <checksum>
+//	    mode exec|powershell|wsl
+//	    distro <name>
+//	    raw_command_line
+//	    chroot <dir>
+//	    privilege_wrapper sudo|doas [<flags...>]
+//	    clean_env
+//	    env <name> <value>
+//	    secret_args <positions...>
+//	    secret_env <names...>
+//	    nice <n>
+//	    ionice realtime|best-effort|idle [<level>]
+//	    cpu_affinity <cpus...>
+//	    decode base64
+//	    compression auto|gzip|none
+//	    json_path <path>
+//	    transform_template <template>
+//	    delimiter <regexp>
+//	    format list|labeled|iproute2|extended|auto
+//	    interface <name>
+//	    scope <scope>
+//	    skip_deprecated
+//	    skip_temporary
+//	    unlabeled reject|ignore
+//	    on_parse_error fail|skip|skip_and_warn
+//	    tracing
+//	    debug
+//	    log_output [debug|info]
+//	    log_dampening <interval>
+//	    logger_name <name>
+//	    label <label>
+//	    log_level debug|info|warn|error
+//	    max_processes <n>
+//	    verify_on_start
+//	    require_command
+//	    warm_up
+//	    dry_run
+//	    failure_threshold <n>
+//	    history <n>
+//	    capture_output [<bytes>]
+//	    audit_log file|storage <path|key>
+//	    persist_state <key> [<interval>]
+//	    refresh_on <events...>
+//	    refresh_signal <signal>
+//	    refresh_pipe <path>
+//	    refresh_run
+//	    watch_paths <paths...>
+//	    watch {
+//	        restart always|on_failure|never
+//	        restart_delay <duration> [<max>]
+//	        max_restarts <n>
+//	    }
+//	    poll_interval <duration>
+//	}
+//
+// The legacy name exec works the same, with a deprecation warning.
 func (c *Command) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		if !d.NextArg() {
@@ -65,100 +806,1616 @@ func (c *Command) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		}
 		c.Cmd = d.Val()
 		c.Args = d.RemainingArgs()
+
+		for d.NextBlock(0) {
+			ok, err := c.unmarshalSharedOption(d)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+
+			switch d.Val() {
+			case "command":
+				e, err := unmarshalExec(d)
+				if err != nil {
+					return err
+				}
+				c.Commands = append(c.Commands, *e)
+
+			case "pipe":
+				e, err := unmarshalExec(d)
+				if err != nil {
+					return err
+				}
+				c.Pipeline = append(c.Pipeline, *e)
+
+			case "create_dir":
+				args := d.RemainingArgs()
+				if len(args) > 1 {
+					return d.ArgErr()
+				}
+				c.CreateDir = true
+				if len(args) == 1 {
+					c.DirMode = args[0]
+				}
+
+			case "args":
+				args, err := unmarshalArgs(d)
+				if err != nil {
+					return err
+				}
+				c.Args = append(c.Args, args...)
+
+			case "args_from_env":
+				if !d.AllArgs(&c.ArgsFromEnv) {
+					return d.ArgErr()
+				}
+
+			case "stdin":
+				if !d.AllArgs(&c.Stdin) {
+					return d.ArgErr()
+				}
+
+			case "batch":
+				if err := c.unmarshalBatch(d); err != nil {
+					return err
+				}
+
+			case "deadline":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid deadline '%s': %v", d.Val(), err)
+				}
+				c.Deadline = caddy.Duration(dur)
+
+			case "partial_results":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.PartialResults = true
+
+			case "optional":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.Optional = true
+
+			case "attempt_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid attempt_timeout '%s': %v", d.Val(), err)
+				}
+				c.AttemptTimeout = caddy.Duration(dur)
+
+			case "allowed_subnets":
+				c.AllowedSubnets = d.RemainingArgs()
+				if len(c.AllowedSubnets) == 0 {
+					return d.ArgErr()
+				}
+
+			case "denied_subnets":
+				c.DeniedSubnets = d.RemainingArgs()
+				if len(c.DeniedSubnets) == 0 {
+					return d.ArgErr()
+				}
+
+			case "allow_private", "no_range_filter":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.AllowPrivate = true
+
+			case "prefer_subnets":
+				c.PreferSubnets = d.RemainingArgs()
+				if len(c.PreferSubnets) == 0 {
+					return d.ArgErr()
+				}
+
+			case "select":
+				args := d.RemainingArgs()
+				target := &c.Select
+				if len(args) > 0 && (args[0] == "ipv4" || args[0] == "ipv6") {
+					if args[0] == "ipv4" {
+						target = &c.SelectIPv4
+					} else {
+						target = &c.SelectIPv6
+					}
+					args = args[1:]
+				}
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				*target = strings.Join(args, " ")
+
+			case "max_per_family":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_per_family '%s': %v", d.Val(), err)
+				}
+				c.MaxPerFamily = n
+
+			case "prefer":
+				if !d.AllArgs(&c.Prefer) {
+					return d.ArgErr()
+				}
+
+			case "filter":
+				if err := c.Filters.unmarshal(d); err != nil {
+					return err
+				}
+
+			case "synthesize":
+				var text string
+				if !d.AllArgs(&text) {
+					return d.ArgErr()
+				}
+				c.Synthesize = append(c.Synthesize, text)
+
+			case "translate":
+				t, err := unmarshalTranslation(d)
+				if err != nil {
+					return err
+				}
+				c.Translate = append(c.Translate, t)
+
+			case "probe":
+				p, err := unmarshalProbe(d)
+				if err != nil {
+					return err
+				}
+				c.Probe = p
+
+			case "require_ipv4":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.RequireIPv4 = true
+
+			case "require_ipv6":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.RequireIPv6 = true
+
+			case "min_addresses":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid min_addresses '%s': %v", d.Val(), err)
+				}
+				c.MinAddresses = n
+
+			case "confirm_changes":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid confirm_changes '%s': %v", d.Val(), err)
+				}
+				c.ConfirmChanges = n
+
+			case "empty_result_grace":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid empty_result_grace '%s': %v", d.Val(), err)
+				}
+				c.EmptyResultGrace = n
+
+			case "cache_ttl":
+				args := d.RemainingArgs()
+				target := &c.CacheTTL
+				if len(args) == 2 && (args[0] == "ipv4" || args[0] == "ipv6") {
+					if args[0] == "ipv4" {
+						target = &c.CacheTTLIPv4
+					} else {
+						target = &c.CacheTTLIPv6
+					}
+					args = args[1:]
+				}
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(args[0])
+				if err != nil {
+					return d.Errf("invalid cache_ttl '%s': %v", args[0], err)
+				}
+				*target = caddy.Duration(dur)
+
+			case "max_rate":
+				if err := singleArg(d, &c.MaxRate); err != nil {
+					return err
+				}
+
+			case "jitter":
+				if err := durationArg(d, &c.Jitter); err != nil {
+					return err
+				}
+
+			case "unchanged_exit_code":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				code, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid unchanged_exit_code '%s': %v", d.Val(), err)
+				}
+				c.UnchangedExitCode = code
+
+			case "sentinels":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.Sentinels = true
+
+			case "retry_on_exit_codes":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, arg := range args {
+					code, err := strconv.Atoi(arg)
+					if err != nil {
+						return d.Errf("invalid exit code '%s': %v", arg, err)
+					}
+					c.RetryOnExitCodes = append(c.RetryOnExitCodes, code)
+				}
+
+			case "retry_on_timeout":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.RetryOnTimeout = true
+
+			case "before":
+				h, err := unmarshalHook(d)
+				if err != nil {
+					return err
+				}
+				c.Before = h
+
+			case "after":
+				h, err := unmarshalHook(d)
+				if err != nil {
+					return err
+				}
+				c.After = h
+
+			case "on_failure":
+				f, err := unmarshalOnFailure(d)
+				if err != nil {
+					return err
+				}
+				c.OnFailure = f
+
+			case "sha256":
+				if !d.AllArgs(&c.SHA256) {
+					return d.ArgErr()
+				}
+
+			case "mode":
+				if !d.AllArgs(&c.Mode) {
+					return d.ArgErr()
+				}
+
+			case "distro":
+				if !d.AllArgs(&c.Distro) {
+					return d.ArgErr()
+				}
+
+			case "raw_command_line":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.RawCommandLine = true
+
+			case "secret_args":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, arg := range args {
+					i, err := strconv.Atoi(arg)
+					if err != nil {
+						return d.Errf("invalid secret_args '%s': %v", arg, err)
+					}
+					c.SecretArgs = append(c.SecretArgs, i)
+				}
+
+			case "secret_env":
+				c.SecretEnv = d.RemainingArgs()
+				if len(c.SecretEnv) == 0 {
+					return d.ArgErr()
+				}
+
+			case "nice":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid nice '%s': %v", d.Val(), err)
+				}
+				c.Nice = n
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "ionice":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.IONiceClass = d.Val()
+				if d.NextArg() {
+					n, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid ionice level '%s': %v", d.Val(), err)
+					}
+					c.IONiceLevel = n
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "cpu_affinity":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, arg := range args {
+					cpu, err := strconv.Atoi(arg)
+					if err != nil {
+						return d.Errf("invalid cpu_affinity '%s': %v", arg, err)
+					}
+					c.CPUAffinity = append(c.CPUAffinity, cpu)
+				}
+
+			case "decode":
+				if !d.AllArgs(&c.Decode) {
+					return d.ArgErr()
+				}
+
+			case "compression":
+				if !d.AllArgs(&c.Compression) {
+					return d.ArgErr()
+				}
+
+			case "json_path":
+				if !d.AllArgs(&c.JSONPath) {
+					return d.ArgErr()
+				}
+
+			case "transform_template":
+				if !d.AllArgs(&c.TransformTemplate) {
+					return d.ArgErr()
+				}
+
+			case "delimiter":
+				if !d.AllArgs(&c.Delimiter) {
+					return d.ArgErr()
+				}
+
+			case "format":
+				if !d.AllArgs(&c.Format) {
+					return d.ArgErr()
+				}
+
+			case "interface":
+				if !d.AllArgs(&c.Interface) {
+					return d.ArgErr()
+				}
+
+			case "scope":
+				if !d.AllArgs(&c.Scope) {
+					return d.ArgErr()
+				}
+
+			case "skip_deprecated":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.SkipDeprecated = true
+
+			case "skip_temporary":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.SkipTemporary = true
+
+			case "unlabeled":
+				if !d.AllArgs(&c.Unlabeled) {
+					return d.ArgErr()
+				}
+
+			case "on_parse_error":
+				if !d.AllArgs(&c.OnParseError) {
+					return d.ArgErr()
+				}
+
+			case "tracing":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.Tracing = true
+
+			case "debug":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.Debug = true
+
+			case "log_output":
+				c.LogOutput = LogOutputInfo
+				if d.NextArg() {
+					c.LogOutput = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "logger_name":
+				if err := singleArg(d, &c.LoggerName); err != nil {
+					return err
+				}
+
+			case "label":
+				if err := singleArg(d, &c.Label); err != nil {
+					return err
+				}
+
+			case "log_level":
+				if err := singleArg(d, &c.LogLevel); err != nil {
+					return err
+				}
+
+			case "log_dampening":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid log_dampening '%s': %v", d.Val(), err)
+				}
+				c.LogDampening = caddy.Duration(dur)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "max_processes":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_processes '%s': %v", d.Val(), err)
+				}
+				c.MaxProcesses = n
+
+			case "verify_on_start":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.VerifyOnStart = true
+
+			case "require_command":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.RequireCommand = true
+
+			case "warm_up":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.WarmUp = true
+
+			case "dry_run":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.DryRun = true
+
+			case "failure_threshold":
+				if err := intArg(d, &c.FailureThreshold); err != nil {
+					return err
+				}
+
+			case "history":
+				if err := intArg(d, &c.History); err != nil {
+					return err
+				}
+
+			case "capture_output":
+				c.CaptureOutput = defaultCaptureLimit
+				if d.NextArg() {
+					n, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid capture_output '%s': %v", d.Val(), err)
+					}
+					c.CaptureOutput = n
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "audit_log":
+				a, err := unmarshalAuditLog(d)
+				if err != nil {
+					return err
+				}
+				c.AuditLog = a
+
+			case "persist_state":
+				p, err := unmarshalPersistState(d)
+				if err != nil {
+					return err
+				}
+				c.PersistState = p
+
+			case "refresh_on":
+				c.RefreshOn = d.RemainingArgs()
+				if len(c.RefreshOn) == 0 {
+					return d.ArgErr()
+				}
+
+			case "refresh_signal":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.RefreshSignal = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "refresh_pipe":
+				if err := singleArg(d, &c.RefreshPipe); err != nil {
+					return err
+				}
+
+			case "refresh_run":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.RefreshRun = true
+
+			case "watch_paths":
+				c.WatchPaths = d.RemainingArgs()
+				if len(c.WatchPaths) == 0 {
+					return d.ArgErr()
+				}
+
+			case "watch":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.Watch = true
+				if err := c.unmarshalWatch(d); err != nil {
+					return err
+				}
+
+			case "poll_interval":
+				if err := durationArg(d, &c.PollInterval); err != nil {
+					return err
+				}
+
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
 	}
 	return nil
 }
 
+// unmarshalSharedOption parses the subdirective at the current
+// position of d, if it is one of the options that may also be
+// set for all sources in the global dynamic_dns_command block.
+// It returns true if it was.
+func (c *Command) unmarshalSharedOption(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "timeout":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid timeout '%s': %v", d.Val(), err)
+		}
+		c.Timeout = caddy.Duration(dur)
+
+	case "retries":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid retries '%s': %v", d.Val(), err)
+		}
+		c.Retries = n
+
+	case "retry_delay":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid retry_delay '%s': %v", d.Val(), err)
+		}
+		c.RetryDelay = caddy.Duration(dur)
+
+	case "allowed_commands":
+		paths := d.RemainingArgs()
+		if len(paths) == 0 {
+			return true, d.ArgErr()
+		}
+		c.AllowedCommands = append(c.AllowedCommands, paths...)
+
+	case "chroot":
+		if !d.AllArgs(&c.Chroot) {
+			return true, d.ArgErr()
+		}
+
+	case "privilege_wrapper":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.PrivilegeWrapper = d.Val()
+		c.PrivilegeWrapperFlags = d.RemainingArgs()
+
+	case "clean_env":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.CleanEnv = true
+
+	case "env":
+		var name, value string
+		if !d.AllArgs(&name, &value) {
+			return true, d.ArgErr()
+		}
+		if c.Env == nil {
+			c.Env = make(map[string]string)
+		}
+		c.Env[name] = value
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
 // Provision sets up the module.
 func (c *Command) Provision(ctx caddy.Context) error {
 	c.logger = ctx.Logger(c)
+	if err := c.provisionLogger(); err != nil {
+		return err
+	}
+	if err := c.provisionLabel(); err != nil {
+		return err
+	}
+	c.provisionChildren()
+	// the defaults are part of the fingerprint of the state
+	if err := c.provisionDefaults(ctx); err != nil {
+		return err
+	}
+	if err := c.provisionState(); err != nil {
+		return err
+	}
 
 	if c.Timeout <= 0 {
 		c.Timeout = caddy.Duration(30 * time.Second)
 	}
+	c.Dir = expandDir(c.Dir)
+	if err := c.provisionArgsFromEnv(); err != nil {
+		return err
+	}
+	if c.Jitter < 0 {
+		return fmt.Errorf("invalid jitter %s", time.Duration(c.Jitter))
+	}
+	if c.Deadline > 0 && c.AttemptTimeout > c.Deadline {
+		return fmt.Errorf("attempt_timeout %s exceeds the deadline %s",
+			time.Duration(c.AttemptTimeout), time.Duration(c.Deadline))
+	}
+	for i := range c.Commands {
+		c.Commands[i].provision()
+	}
+	if c.Before != nil {
+		c.Before.provision()
+	}
+	if c.After != nil {
+		c.After.provision()
+	}
+	if c.OnFailure != nil {
+		c.OnFailure.provision()
+	}
+	for _, t := range c.Translate {
+		if err := t.provision(); err != nil {
+			return fmt.Errorf("invalid translate: %v", err)
+		}
+	}
+	if c.Probe != nil {
+		if err := c.Probe.provision(); err != nil {
+			return err
+		}
+	}
+
+	err := c.provisionDampening()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionOutput()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionSynthesize()
+	if err != nil {
+		return err
+	}
 
+	err = c.provisionBatch()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionSecrets()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionPipeline()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionDirs()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionPriority()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionFilters()
+	if err != nil {
+		return err
+	}
+
+	err = c.Filters.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionMode()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionRawCommandLine()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionChroot()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionPrivilegeWrapper()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionPaths()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionSemaphore()
+	if err != nil {
+		return err
+	}
+
+	if c.AuditLog != nil {
+		if err := c.AuditLog.validate(); err != nil {
+			return err
+		}
+	}
+
+	err = c.provisionRefresh(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionOutputFile()
+	if err != nil {
+		return err
+	}
+
+	c.provisionVars()
+	err = c.provisionRateLimit()
+	if err != nil {
+		return err
+	}
+	err = c.provisionEvents(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.provisionHealth()
+	if err != nil {
+		return err
+	}
+	err = c.provisionHistory()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionCapture()
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionPersist(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionWatch(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.provisionWatchPaths(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.ctx = ctx
+	return c.provisionTracing(ctx)
+}
+
+// Cleanup stops the processes that are still running, like a
+// lookup, and releases the resources of the module. The watch
+// command keeps running if the new config has the same source.
+func (c *Command) Cleanup() error {
+	c.cleanupChildren()
+	c.unregister()
+	c.dampener.flush()
+	c.cleanupRefresh()
+	c.cleanupWatchPaths()
+	err := c.cleanupSemaphore()
+	if limiterErr := c.cleanupRateLimit(); err == nil {
+		err = limiterErr
+	}
+	if tracingErr := c.cleanupTracing(); err == nil {
+		err = tracingErr
+	}
+	if stateErr := c.cleanupState(); err == nil {
+		err = stateErr
+	}
+	return err
+}
+
+// Validate ensures that the configured commands respect
+// AllowedCommands and match the configured checksum, and
+// runs the lookup once if VerifyOnStart is set. Then it
+// starts the warm-up or the watch command, if enabled, and
+// makes the source reachable by the admin API.
+func (c *Command) Validate() error {
+	if c.SHA256 != "" {
+		if c.Mode != "" && c.Mode != ModeExec {
+			return fmt.Errorf("sha256 is not supported in %s mode", c.Mode)
+		}
+		if sum, err := hex.DecodeString(c.SHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("invalid sha256 checksum %s", c.SHA256)
+		}
+		if err := c.verifyChecksum(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.checkAllowedCommands(); err != nil {
+		return err
+	}
+
+	if c.VerifyOnStart {
+		if err := c.verifyOnStart(); err != nil {
+			return err
+		}
+	}
+
+	// only now that the commands were checked, they may run;
+	// with the state of the previous config, they already did
+	if c.WarmUp && !c.stateCarried {
+		go c.warmUp(c.ctx)
+	}
+	if c.Watch {
+		c.carried.startWatch(c)
+	}
+	c.startPersist()
+	c.register()
+	return nil
+}
+
+// checkAllowedCommands ensures that the configured
+// commands respect AllowedCommands.
+func (c *Command) checkAllowedCommands() error {
+	if len(c.AllowedCommands) == 0 {
+		return nil
+	}
+	for _, allowed := range c.AllowedCommands {
+		if !filepath.IsAbs(allowed) {
+			return fmt.Errorf("allowed command %s is not an absolute path", allowed)
+		}
+	}
+
+	check := func(name, cmd string) error {
+		if !filepath.IsAbs(cmd) {
+			return fmt.Errorf("%s %s is not an absolute path", name, cmd)
+		}
+		for _, allowed := range c.AllowedCommands {
+			if filepath.Clean(cmd) == filepath.Clean(allowed) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s %s is not an allowed command", name, cmd)
+	}
+
+	if name, _ := c.commandLine(c.Cmd, nil); name != c.Cmd {
+		// the interpreter of the mode is executed
+		if err := check("interpreter", name); err != nil {
+			return err
+		}
+	} else if err := check("command", c.Cmd); err != nil {
+		return err
+	}
+	for _, e := range c.Commands {
+		if name, _ := c.commandLine(e.Cmd, nil); name == e.Cmd {
+			if err := check("command", e.Cmd); err != nil {
+				return err
+			}
+		}
+	}
+	for _, e := range c.Pipeline {
+		if err := check("pipe command", e.Cmd); err != nil {
+			return err
+		}
+	}
+	if c.Before != nil {
+		if err := check("before hook", c.Before.Cmd); err != nil {
+			return err
+		}
+	}
+	if c.After != nil {
+		if err := check("after hook", c.After.Cmd); err != nil {
+			return err
+		}
+	}
+	if c.OnFailure != nil && c.OnFailure.Cmd != "" {
+		if err := check("on_failure command", c.OnFailure.Cmd); err != nil {
+			return err
+		}
+	}
+	if c.Probe != nil && c.Probe.Cmd != "" {
+		if err := check("probe command", c.Probe.Cmd); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// GetIPs gets the public addresses of this machine.
+// GetIPs gets the public addresses of this machine. If a previous
+// call is still running the command, its result is shared instead
+// of running the command again. Results are reused for CacheTTL,
+// or per family for CacheTTLIPv4 and CacheTTLIPv6.
+// In watch mode, the last addresses of the watch command are
+// returned. With DryRun, they are logged and ErrDryRun is
+// returned instead. With Optional, errors are logged instead.
 func (c Command) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
-	out := []net.IP{}
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	var cancel context.CancelFunc
+	if c.logger == nil {
+		c.provisionStandalone()
+	}
+	ips, err := c.getIPs(ctx, versions)
+	if err != nil && c.Optional {
+		c.logger.Warn("optional source failed; returning no error",
+			zap.String("command", c.Cmd),
+			zap.Strings("ips", ipStrings(ips)),
+			zap.Error(err))
+		err = nil
+	}
+	if err != nil || !c.DryRun {
+		return ips, err
+	}
+	c.logger.Info("dry run; not returning addresses",
+		zap.String("command", c.Cmd),
+		zap.Strings("ips", ipStrings(ips)))
+	return nil, ErrDryRun
+}
 
-	replacer := caddy.NewReplacer()
+// getIPs gets the addresses like GetIPs, regardless of DryRun.
+func (c Command) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	if c.Watch {
+		return c.watchIPs(ctx, versions)
+	}
+	if ips, ok := c.state.takeWarm(); ok {
+		c.logger.Debug("using addresses of warm-up",
+			zap.String("command", c.Cmd),
+			zap.Strings("ips", ipStrings(ips)))
+		return filterVersions(ips, versions), nil
+	}
+	if c.perFamilyCache() {
+		ips, stale, ok := c.cachedFamilies(versions)
+		if ok {
+			c.logger.Debug("using cached addresses",
+				zap.String("command", c.Cmd),
+				zap.Strings("ips", ipStrings(ips)))
+			return ips, nil
+		}
+		ips, err := c.state.shared(ctx, stale, func() ([]net.IP, error) {
+			if err := c.waitJitter(ctx); err != nil {
+				return nil, err
+			}
+			return c.resolve(ctx, stale)
+		})
+		return filterVersions(ips, versions), err
+	}
+	if c.CacheTTL > 0 {
+		if ips, ok := c.state.cached(time.Duration(c.CacheTTL)); ok {
+			c.logger.Debug("using cached addresses",
+				zap.String("command", c.Cmd),
+				zap.Strings("ips", ipStrings(ips)))
+			return filterVersions(ips, versions), nil
+		}
+	}
+	return c.state.shared(ctx, versions, func() ([]net.IP, error) {
+		if err := c.waitJitter(ctx); err != nil {
+			return nil, err
+		}
+		return c.resolve(ctx, versions)
+	})
+}
 
-	// expand placeholders in command args;
-	// notably, we do not expand placeholders
-	// in the command itself for safety reasons
-	expandedArgs := make([]string, len(c.Args))
-	for i := range c.Args {
-		expandedArgs[i] = replacer.ReplaceAll(c.Args[i], "")
+// waitJitter delays a lookup by a random duration up to Jitter.
+func (c Command) waitJitter(ctx context.Context) error {
+	if c.Jitter <= 0 {
+		return nil
 	}
+	delay := time.Duration(rand.Int63n(int64(c.Jitter)))
+	c.logger.Debug("delaying lookup by jitter",
+		zap.String("command", c.Cmd),
+		zap.Duration("delay", delay))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	if c.Timeout > 0 {
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.Timeout))
+// resolve runs the lookup and applies the unchanged exit
+// code, failure notifications, confirmation and caching.
+func (c Command) resolve(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	c = c.redactingLogger().withRunID()
+	start := time.Now()
+	ips, err := c.lookupWithHooks(ctx, versions)
+	if errors.Is(err, ErrRateLimited) {
+		if ips, ok := c.state.cached(-1); ok {
+			c.logger.Debug("rate limited; reusing addresses",
+				zap.String("command", c.Cmd),
+				zap.Strings("ips", ipStrings(ips)))
+			return ips, nil
+		}
+	}
+	var partialErr *ErrPartial
+	if errors.As(err, &partialErr) {
+		// returned, but neither confirmed nor cached
+		c.countLookup(time.Since(start), err)
+		c.recordRun(start, ips, err)
+		c.recordFailure(err)
+		c.notifyFailure(err)
+		return ips, err
+	}
+	if errors.Is(err, ErrUnchanged) {
+		if ips, ok := c.state.cached(-1); ok {
+			c.logger.Debug("command reported no change; reusing addresses",
+				zap.String("command", c.Cmd),
+				zap.Strings("ips", ipStrings(ips)))
+			c.state.cache(ips, versions)
+			c.countLookup(time.Since(start), nil)
+			c.recordRun(start, ips, nil)
+			c.audit(ips, time.Since(start), AuditSourceUnchanged)
+			return ips, nil
+		}
+		err = fmt.Errorf("command %s reported no change, but there are no previous addresses", c.Cmd)
+	}
+	graced := false
+	if errors.Is(err, ErrEmptyOutput) && c.EmptyResultGrace > 0 {
+		// the command succeeded without printing anything, an
+		// empty result the grace covers, but still a failure
+		// once the grace is over
+		if previous := c.graceEmpty(nil); len(previous) > 0 {
+			ips, err, graced = previous, nil, true
+		}
 	}
+	if err != nil {
+		c.countLookup(time.Since(start), err)
+		c.recordRun(start, nil, err)
+		c.recordFailure(err)
+		c.notifyFailure(err)
+		return nil, err
+	}
+	c.countLookup(time.Since(start), nil)
+	c.recordSuccess()
+	if c.perFamilyCache() {
+		ips = c.keepFresh(ips, versions)
+	}
+	if !graced {
+		ips = c.graceEmpty(ips)
+	}
+	ips = c.confirm(ips)
+	c.recordRun(start, ips, nil)
+	if previous, _ := c.state.cached(-1); !sameIPs(previous, ips) {
+		c.recordChange(previous, ips)
+	}
+	c.state.cache(ips, versions)
+	c.audit(ips, time.Since(start), AuditSourceCommand)
+	c.dampener.flush()
+	return ips, nil
+}
+
+// lookupWithHooks runs the before hook, the lookup
+// and the after hook, in this order. The deadline
+// covers all but the after hook.
+func (c Command) lookupWithHooks(ctx context.Context, versions dynamicdns.IPVersions) (ips []net.IP, err error) {
+	if err := c.allowRun(); err != nil {
+		return nil, err
+	}
+	env := c.requestEnv(versions)
 
-	cmd := exec.CommandContext(ctx, c.Cmd, expandedArgs...)
-	cmd.Dir = c.Dir
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	defer func() {
+		afterErr := c.runHook(ctx, "after", c.After, env)
+		if err == nil && afterErr != nil {
+			ips, err = nil, afterErr
+		}
+	}()
 
-	if cancel != nil {
+	if c.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.Deadline))
 		defer cancel()
 	}
 
-	c.logger.Debug("running command",
-		zap.String("command", c.Cmd),
-		zap.Strings("args", expandedArgs),
-		zap.String("dir", c.Dir),
-		zap.Int64("timeout", int64(time.Duration(c.Timeout))),
-	)
+	err = c.runHook(ctx, "before", c.Before, env)
+	if err != nil {
+		return nil, deadlineError(ctx, "running before hook", err)
+	}
 
-	err := cmd.Run()
+	return c.lookupWithRetries(ctx, versions)
+}
+
+// lookup runs the command and any further commands,
+// and parses the addresses from their output.
+func (c Command) lookup(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	err := c.verifyChecksum()
 	if err != nil {
+		c.logger.Error("refusing to run command",
+			zap.String("command", c.Cmd),
+			zap.String("dir", c.Dir),
+			zap.Error(err))
 		return nil, err
 	}
 
-	exitCode := cmd.ProcessState.ExitCode()
-	if exitCode != 0 || len(stderr.String()) > 0 {
-		c.logger.Error("command execution failed",
+	meta := new(Metadata)
+	out, err := c.runCommand(ctx, versions, Exec{
+		Cmd:     c.Cmd,
+		Args:    c.Args,
+		Dir:     c.Dir,
+		Timeout: c.Timeout,
+		main:    true,
+	}, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range c.Commands {
+		if err := ctx.Err(); err != nil {
+			return c.partialResult(out, versions, deadlineError(ctx, "starting command "+e.Cmd, err))
+		}
+		ips, err := c.runCommand(ctx, versions, e, meta)
+		if err != nil {
+			return c.partialResult(out, versions, err)
+		}
+		for _, ip := range ips {
+			if !ipListContains(out, ip) {
+				out = append(out, ip)
+			}
+		}
+	}
+
+	out, err = c.processAddresses(ctx, out)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkAddresses(out, versions)
+	if err != nil {
+		c.logger.Error("command returned too few addresses",
 			zap.String("command", c.Cmd),
-			zap.Strings("args", expandedArgs),
-			zap.String("dir", c.Dir),
-			zap.String("stdout", stdout.String()),
-			zap.String("stderr", stderr.String()),
-			zap.Int("exit code", exitCode))
-		return nil, fmt.Errorf("command %s exited with: %d", c.Cmd, exitCode)
+			zap.Strings("ips", ipStrings(out)),
+			zap.Error(err))
+		return nil, err
 	}
 
-	ipArr := strings.Split(stdout.String(), ",")
+	if c.hasMetadata() {
+		c.state.setMetadata(meta)
+	}
+	return out, nil
+}
 
-	for i := 0; i < len(ipArr); i++ {
-		ip := net.ParseIP(strings.TrimSpace(ipArr[i]))
-		if ip == nil {
-			c.logger.Error("parsing ip failed",
-				zap.String("command", c.Cmd),
-				zap.Strings("args", expandedArgs),
-				zap.String("stdout", stdout.String()),
-				zap.String("ip", ipArr[i]))
-			return nil, fmt.Errorf("invalid IP: %s", ipArr[i])
+// runCommand runs e and parses the addresses from its output.
+// The metadata of the extended format is merged into meta.
+func (c Command) runCommand(ctx context.Context, versions dynamicdns.IPVersions, e Exec, meta *Metadata) (out []net.IP, err error) {
+	out = []net.IP{}
+
+	cmdArgs := e.Args
+	var outputPath string
+	if usesOutputFile(cmdArgs) {
+		var arg string
+		outputPath, arg, err = c.outputFile()
+		if err != nil {
+			c.logger.Error("creating output file failed",
+				zap.String("command", e.Cmd),
+				zap.Error(err))
+			return nil, fmt.Errorf("creating output file of command %s: %v", e.Cmd, err)
+		}
+		defer os.Remove(outputPath)
+		cmdArgs = withOutputFile(cmdArgs, arg)
+	}
+
+	// expand placeholders in command args;
+	// notably, we do not expand placeholders
+	// in the command itself for safety reasons
+	expandedArgs, loggedArgs, err := expandArgs(cmdArgs)
+	if err != nil {
+		c.logger.Error("expanding args failed",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", e.Args),
+			zap.Error(err))
+		return nil, fmt.Errorf("expanding args of command %s: %v", e.Cmd, err)
+	}
+
+	c.logger.Debug("running command",
+		zap.String("command", e.Cmd),
+		zap.Strings("args", loggedArgs),
+		zap.String("dir", e.Dir),
+		zap.Int64("timeout", int64(time.Duration(e.Timeout))),
+	)
+
+	ctx, span, traceEnv := c.startSpan(ctx, e.Cmd, loggedArgs)
+	var exitCode int
+	defer func() {
+		endSpan(span, exitCode, len(out), err)
+	}()
+
+	name, args := c.commandLine(e.Cmd, expandedArgs)
+	env := append(c.requestEnv(versions), traceEnv...)
+	if c.Debug {
+		c.logResolved(e, name, loggedArgs, env)
+	}
+	var stdin []byte
+	if e.main && c.Stdin != "" {
+		stdin, err = c.stdin()
+		if err != nil {
+			c.logger.Error("expanding stdin failed",
+				zap.String("command", e.Cmd),
+				zap.Error(err))
+			return nil, fmt.Errorf("expanding stdin of command %s: %v", e.Cmd, err)
+		}
+	}
+	run := func() ([]byte, []byte, error) {
+		return c.runInput(ctx, name, args, e.Dir, env, time.Duration(e.Timeout), stdin)
+	}
+	var stdout, stderr []byte
+	if e.main && c.Batch != "" {
+		// keyed by the configured command line, as the expanded
+		// one differs every time with {cache_bust}
+		stdout, stderr, err = c.runBatched(ctx, e.Cmd, e.Args, e.Dir, []byte(c.Stdin), run)
+	} else {
+		stdout, stderr, err = run()
+	}
+	raw := stdout
+	stdout, stderr = c.decodeOutput(stdout), c.decodeOutput(stderr)
+	if err != nil || len(stderr) > 0 {
+		cmdErr := &commandError{cmd: e.Cmd, stderr: string(stderr), err: deadlineError(ctx, "running command "+e.Cmd, err)}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			cmdErr.exitCode = exitErr.ExitCode()
+		}
+		exitCode = cmdErr.exitCode
+		c.captureOutput(e, exitCode, stdout, stderr)
+		if c.UnchangedExitCode != 0 && exitCode == c.UnchangedExitCode {
+			return nil, ErrUnchanged
+		}
+		c.logger.Error("command execution failed",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("dir", e.Dir),
+			zap.String("stdout", string(stdout)),
+			zap.String("stderr", string(stderr)),
+			zap.Int("exit code", cmdErr.exitCode),
+			zap.Error(err))
+		return nil, cmdErr
+	}
+
+	if outputPath != "" {
+		// the command wrote its output to the file instead
+		output, err := os.ReadFile(outputPath)
+		if err != nil {
+			c.logger.Error("reading output file failed",
+				zap.String("command", e.Cmd),
+				zap.Strings("args", loggedArgs),
+				zap.String("stdout", string(stdout)),
+				zap.Error(err))
+			return nil, fmt.Errorf("reading output file of command %s: %v", e.Cmd, err)
 		}
-		out = append(out, ip)
+		raw, stdout = output, c.decodeOutput(output)
+	}
+
+	decompressed, err := withinDeadline(ctx, "decompressing output of "+e.Cmd, func() ([]byte, error) {
+		out, ok, err := c.decompressOutput(raw)
+		if !ok {
+			return nil, err
+		}
+		return out, err
+	})
+	if err != nil {
+		c.logger.Error("decompressing output failed",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.Error(err))
+		return nil, fmt.Errorf("command %s: %w", e.Cmd, err)
+	}
+	if decompressed != nil {
+		stdout = c.decodeOutput(decompressed)
+	}
+	c.captureOutput(e, 0, stdout, stderr)
+
+	if e.main && len(c.Pipeline) > 0 {
+		stdout, err = c.runPipeline(ctx, e, stdout, env)
+		if err != nil {
+			err = deadlineError(ctx, "running pipeline of "+e.Cmd, err)
+			var cmdErr *commandError
+			if errors.As(err, &cmdErr) {
+				exitCode = cmdErr.exitCode
+			}
+			return nil, err
+		}
+	}
+
+	if e.main && c.Batch != "" {
+		stdout, err = c.batchValue(stdout)
+		if err != nil {
+			c.logger.Error("picking batch key failed",
+				zap.String("command", e.Cmd),
+				zap.Strings("args", loggedArgs),
+				zap.String("stdout", string(stdout)),
+				zap.Error(err))
+			return nil, fmt.Errorf("command %s: %v", e.Cmd, err)
+		}
+	}
+
+	c.logOutput(e, loggedArgs, stdout)
+	return c.parseOutput(ctx, e, loggedArgs, stdout, meta)
+}
+
+// parseOutput parses the addresses from the output of e, giving
+// up once the deadline of ctx expired. The metadata of the
+// extended format is merged into meta.
+func (c Command) parseOutput(ctx context.Context, e Exec, loggedArgs []string, stdout []byte, meta *Metadata) ([]net.IP, error) {
+	out := []net.IP{}
+
+	output, err := withinDeadline(ctx, "transforming output of "+e.Cmd, func() (string, error) {
+		return c.transformOutput(stdout)
+	})
+	if err != nil {
+		c.logger.Error("transforming output failed",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("stdout", string(stdout)),
+			zap.Error(err))
+		return nil, err
+	}
+
+	// a parse that is given up on may still write to meta and
+	// skipped, which are then not used, as the lookup failed
+	var skipped []string
+	opts := c.parseOptions(meta)
+	opts.Skipped = &skipped
+	addrs, err := withinDeadline(ctx, "parsing output of "+e.Cmd, func() ([]netip.Addr, error) {
+		return ParseOutput([]byte(output), opts)
+	})
+	var invalidErr *ErrInvalidIP
+	switch {
+	case errors.Is(err, ErrUnchanged):
+		c.logger.Debug("command printed "+SentinelNoChange,
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs))
+		return nil, err
+	case errors.Is(err, ErrEmptyOutput):
+		c.logger.Error("command printed no output",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs))
+		return nil, err
+	case errors.As(err, &invalidErr):
+		c.logger.Error("parsing ip failed",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("stdout", string(stdout)),
+			zap.String("ip", invalidErr.Token))
+		return nil, err
+	case err != nil:
+		c.logger.Error("parsing output failed",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("stdout", string(stdout)),
+			zap.Error(err))
+		return nil, err
+	}
+
+	if len(skipped) > 0 {
+		log := c.logger.Debug
+		if c.OnParseError == ParseErrorSkipAndWarn {
+			log = c.logger.Warn
+		}
+		log("skipped tokens that are not addresses",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("stdout", string(stdout)),
+			zap.Strings("tokens", skipped))
+	}
+
+	for _, addr := range addrs {
+		out = append(out, net.IP(addr.AsSlice()))
 		c.logger.Debug("parsed ip succesfull",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("stdout", string(stdout)),
+			zap.String("ip", addr.String()))
+	}
+	return out, nil
+}
+
+// graceEmpty returns the addresses to report for the freshly
+// looked up ips. If they are empty, the last non-empty ones
+// are returned instead for up to EmptyResultGrace runs.
+func (c Command) graceEmpty(ips []net.IP) []net.IP {
+	if c.EmptyResultGrace <= 0 {
+		return ips
+	}
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if len(ips) > 0 {
+		c.state.nonEmpty = ips
+		c.state.emptyRuns = 0
+		return ips
+	}
+	if c.state.nonEmpty == nil {
+		return ips
+	}
+
+	c.state.emptyRuns++
+	if c.state.emptyRuns > c.EmptyResultGrace {
+		if c.state.emptyRuns > c.EmptyResultGrace+1 {
+			return ips
+		}
+		c.logger.Warn("grace for empty result is over; reporting no addresses",
 			zap.String("command", c.Cmd),
-			zap.Strings("args", expandedArgs),
-			zap.String("stdout", stdout.String()),
-			zap.String("ip", ip.String()))
+			zap.Int("runs", c.state.emptyRuns))
+		return ips
+	}
+	c.logger.Info("command returned no addresses; reporting previous ones",
+		zap.String("command", c.Cmd),
+		zap.Strings("ips", ipStrings(c.state.nonEmpty)),
+		zap.Int("run", c.state.emptyRuns),
+		zap.Int("grace", c.EmptyResultGrace))
+	return c.state.nonEmpty
+}
+
+// confirm returns the addresses to report for the freshly
+// looked up ips. A change is held back, and the previously
+// reported addresses are returned instead, until the same
+// change was seen ConfirmChanges times in a row.
+func (c Command) confirm(ips []net.IP) []net.IP {
+	if c.ConfirmChanges <= 1 {
+		return ips
+	}
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if c.state.reported == nil || sameIPs(ips, c.state.reported) {
+		c.state.reported = ips
+		c.state.pending = nil
+		c.state.pendingCount = 0
+		return ips
 	}
-	return out, err
+
+	if sameIPs(ips, c.state.pending) {
+		c.state.pendingCount++
+	} else {
+		c.state.pending = ips
+		c.state.pendingCount = 1
+	}
+
+	if c.state.pendingCount < c.ConfirmChanges {
+		c.logger.Info("holding back address change until confirmed",
+			zap.String("command", c.Cmd),
+			zap.Strings("reported_ips", ipStrings(c.state.reported)),
+			zap.Strings("pending_ips", ipStrings(ips)),
+			zap.Int("seen", c.state.pendingCount),
+			zap.Int("required", c.ConfirmChanges))
+		return c.state.reported
+	}
+
+	c.logger.Info("address change confirmed",
+		zap.String("command", c.Cmd),
+		zap.Strings("old_ips", ipStrings(c.state.reported)),
+		zap.Strings("new_ips", ipStrings(ips)))
+	c.state.reported = ips
+	c.state.pending = nil
+	c.state.pendingCount = 0
+	return ips
+}
+
+// checkAddresses returns an error if ips does not satisfy
+// the configured address requirements.
+func (c Command) checkAddresses(ips []net.IP, versions dynamicdns.IPVersions) error {
+	var hasV4, hasV6 bool
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			hasV4 = true
+		} else {
+			hasV6 = true
+		}
+	}
+	if c.RequireIPv4 && versions.V4Enabled() && !hasV4 {
+		return fmt.Errorf("command %s returned no IPv4 address", c.Cmd)
+	}
+	if c.RequireIPv6 && versions.V6Enabled() && !hasV6 {
+		return fmt.Errorf("command %s returned no IPv6 address", c.Cmd)
+	}
+	if len(ips) < c.MinAddresses {
+		return fmt.Errorf("command %s returned %d addresses, need at least %d", c.Cmd, len(ips), c.MinAddresses)
+	}
+	return nil
 }
 
 // Interface guards
 var (
 	_ dynamicdns.IPSource   = (*Command)(nil)
 	_ caddy.Provisioner     = (*Command)(nil)
+	_ caddy.Validator       = (*Command)(nil)
+	_ caddy.CleanerUpper    = (*Command)(nil)
 	_ caddyfile.Unmarshaler = (*Command)(nil)
 )
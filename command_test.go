@@ -0,0 +1,127 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+)
+
+func TestEmptyResultGraceNoOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs cat")
+	}
+	cat, err := exec.LookPath("cat")
+	if err != nil {
+		t.Skip(err)
+	}
+	// the command prints what is in the file, nothing while
+	// it is empty, like during a DHCP renew
+	path := filepath.Join(t.TempDir(), "ip")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewCommand(cat, path)
+	c.EmptyResultGrace = 2
+
+	write("203.0.113.1\n")
+	ips, err := c.GetIPs(context.Background(), dynamicdns.IPVersions{})
+	if err != nil || len(ips) != 1 || ips[0].String() != "203.0.113.1" {
+		t.Fatalf("first lookup: got %v, %v", ips, err)
+	}
+
+	write("")
+	for run := 1; run <= 2; run++ {
+		ips, err := c.GetIPs(context.Background(), dynamicdns.IPVersions{})
+		if err != nil {
+			t.Fatalf("empty run %d: %v", run, err)
+		}
+		if len(ips) != 1 || ips[0].String() != "203.0.113.1" {
+			t.Errorf("empty run %d: got %v, want the previous addresses", run, ips)
+		}
+	}
+	_, err = c.GetIPs(context.Background(), dynamicdns.IPVersions{})
+	if !errors.Is(err, ErrEmptyOutput) {
+		t.Errorf("after the grace: got %v, want %v", err, ErrEmptyOutput)
+	}
+
+	write("203.0.113.2\n")
+	ips, err = c.GetIPs(context.Background(), dynamicdns.IPVersions{})
+	if err != nil || len(ips) != 1 || ips[0].String() != "203.0.113.2" {
+		t.Fatalf("lookup after the grace: got %v, %v", ips, err)
+	}
+	write("")
+	ips, err = c.GetIPs(context.Background(), dynamicdns.IPVersions{})
+	if err != nil || len(ips) != 1 || ips[0].String() != "203.0.113.2" {
+		t.Errorf("grace starts over after a result: got %v, %v", ips, err)
+	}
+}
+
+func TestCacheTTLVersions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs echo")
+	}
+	echo, err := exec.LookPath("echo")
+	if err != nil {
+		t.Skip(err)
+	}
+	c := NewCommand(echo, "203.0.113.1,2001:db8::1")
+	c.CacheTTL = caddy.Duration(time.Hour)
+
+	ips, err := c.GetIPs(context.Background(), dynamicdns.IPVersions{})
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("first lookup: got %v, %v", ips, err)
+	}
+	v4, v6 := true, false
+	ips, err = c.GetIPs(context.Background(), dynamicdns.IPVersions{IPv4: &v4, IPv6: &v6})
+	if err != nil || len(ips) != 1 || ips[0].String() != "203.0.113.1" {
+		t.Errorf("cached lookup of IPv4: got %v, %v, want [203.0.113.1]", ips, err)
+	}
+}
+
+func TestUnmarshalCaddyfileArgs(t *testing.T) {
+	// heredocs need the Caddyfile lexer of Caddy 2.7 or newer
+	input := "command sh -c <<SCRIPT\n" +
+		"\tcurl -s https://router.lan/status | head -n 1\n" +
+		"\tSCRIPT\n" +
+		"command sh -c \"curl -s host | head -1\" `echo '.ip'`\n"
+	tokens, err := caddyfile.Tokenize([]byte(input), "Caddyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := caddyfile.NewDispenser(tokens)
+
+	want := [][]string{
+		{"-c", "curl -s https://router.lan/status | head -n 1"},
+		{"-c", "curl -s host | head -1", "echo '.ip'"},
+	}
+	for i, args := range want {
+		if !d.Next() {
+			t.Fatalf("source %d: missing", i)
+		}
+		var c Command
+		if err := c.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			t.Fatalf("source %d: %v", i, err)
+		}
+		if c.Cmd != "sh" || !reflect.DeepEqual(c.Args, args) {
+			t.Errorf("source %d: got %q %q, want \"sh\" %q", i, c.Cmd, c.Args, args)
+		}
+	}
+}
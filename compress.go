@@ -0,0 +1,65 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Output compressions.
+const (
+	// CompressionAuto decompresses gzip output,
+	// recognized by its magic bytes.
+	CompressionAuto = "auto"
+
+	// CompressionGzip requires gzip output.
+	CompressionGzip = "gzip"
+
+	// CompressionNone never decompresses the output.
+	CompressionNone = "none"
+)
+
+// How large decompressed output may become, so that a small
+// compressed output cannot exhaust the memory.
+const maxDecompressedOutput = 64 << 20
+
+// gzipMagic are the first bytes of gzip data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressOutput decompresses the raw output of the command as
+// configured by Compression, and returns false if it was not
+// compressed.
+func (c Command) decompressOutput(out []byte) ([]byte, bool, error) {
+	switch c.Compression {
+	case CompressionNone:
+		return out, false, nil
+	case CompressionGzip:
+		if !bytes.HasPrefix(out, gzipMagic) {
+			return nil, false, fmt.Errorf("output is not gzip compressed")
+		}
+	default:
+		if !bytes.HasPrefix(out, gzipMagic) {
+			return out, false, nil
+		}
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(out))
+	if err != nil {
+		return nil, false, fmt.Errorf("decompressing output: %v", err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, maxDecompressedOutput+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("decompressing output: %v", err)
+	}
+	if len(data) > maxDecompressedOutput {
+		return nil, false, fmt.Errorf("decompressed output exceeds %d bytes", maxDecompressedOutput)
+	}
+	return data, true, nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/mietzen/caddy-dynamicdns-cmd-source/executil"
+)
+
+// CredentialProvider looks up secrets, like the passwords and
+// API tokens of the sources, by a reference, e.g. the name of an
+// environment variable or the path of a file. The sources get
+// them by credential placeholders in their secret options, like
+// {credential.file./run/secrets/router}, so that every source
+// handles secrets the same way, and tests can register a provider
+// of their own.
+type CredentialProvider interface {
+	// Credential returns the secret that ref refers to.
+	Credential(ctx context.Context, ref string) (string, error)
+}
+
+// CredentialProviderFunc is a function that is a CredentialProvider.
+type CredentialProviderFunc func(ctx context.Context, ref string) (string, error)
+
+// Credential calls f.
+func (f CredentialProviderFunc) Credential(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+// credentialProviders are the registered providers, by name.
+var credentialProviders = struct {
+	mu     sync.RWMutex
+	byName map[string]CredentialProvider
+}{byName: make(map[string]CredentialProvider)}
+
+// credentialPlaceholderPrefix is the prefix of the placeholders
+// of credentials, e.g. {credential.env.ROUTER_PASSWORD}.
+const credentialPlaceholderPrefix = "credential."
+
+// credentialExecTimeout is how long the command of an exec
+// credential may run.
+const credentialExecTimeout = 10 * time.Second
+
+func init() {
+	RegisterCredentialProvider("env", CredentialProviderFunc(envCredential))
+	RegisterCredentialProvider("file", CredentialProviderFunc(fileCredential))
+	RegisterCredentialProvider("storage", CredentialProviderFunc(storageCredential))
+	RegisterCredentialProvider("exec", CredentialProviderFunc(execCredential))
+}
+
+// RegisterCredentialProvider registers p by name, which the
+// placeholders {credential.<name>.<ref>} then look up secrets
+// with. It panics if the name is invalid or already registered,
+// so it should be called in init.
+func RegisterCredentialProvider(name string, p CredentialProvider) {
+	if name == "" || strings.ContainsAny(name, ".{}") {
+		panic(fmt.Sprintf("invalid credential provider name %q", name))
+	}
+	credentialProviders.mu.Lock()
+	defer credentialProviders.mu.Unlock()
+	if _, ok := credentialProviders.byName[name]; ok {
+		panic(fmt.Sprintf("credential provider %s already registered", name))
+	}
+	credentialProviders.byName[name] = p
+}
+
+// secret replaces the global placeholders in s, like
+// {env.ROUTER_PASSWORD}, and the credential placeholders, like
+// {credential.exec.pass show router}, by looking them up with
+// the registered providers. It fails if any credential cannot be
+// looked up, which then expands to an empty string.
+func secret(ctx context.Context, s string) (string, error) {
+	if !strings.Contains(s, "{") {
+		return s, nil
+	}
+	var firstErr error
+	repl := caddy.NewReplacer()
+	repl.Map(func(key string) (any, bool) {
+		ref, ok := strings.CutPrefix(key, credentialPlaceholderPrefix)
+		if !ok {
+			return nil, false
+		}
+		value, err := lookupCredential(ctx, ref)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return value, true
+	})
+	return repl.ReplaceKnown(s, ""), firstErr
+}
+
+// lookupCredential looks up the credential <name>.<ref>
+// with the provider of that name.
+func lookupCredential(ctx context.Context, key string) (string, error) {
+	name, ref, ok := strings.Cut(key, ".")
+	if !ok || ref == "" {
+		return "", fmt.Errorf("invalid credential placeholder {credential.%s}: needs {credential.<provider>.<ref>}", key)
+	}
+	credentialProviders.mu.RLock()
+	p, ok := credentialProviders.byName[name]
+	credentialProviders.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown credential provider %s", name)
+	}
+	value, err := p.Credential(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("looking up %s credential: %v", name, err)
+	}
+	return value, nil
+}
+
+// envCredential returns the value of the environment variable
+// ref, like {env.<name>}, but fails if it is not set.
+func envCredential(_ context.Context, ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return value, nil
+}
+
+// fileCredential returns the content of the file ref, trimmed of
+// whitespace, like the secrets files of Docker and systemd.
+func fileCredential(_ context.Context, ref string) (string, error) {
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// storageCredential returns the value of the key ref in Caddy's
+// storage, trimmed of whitespace, e.g. to share the secrets of a
+// cluster.
+func storageCredential(ctx context.Context, ref string) (string, error) {
+	load := caddy.DefaultStorage.Load
+	if active := caddy.ActiveContext(); active.Context != nil {
+		load = active.Storage().Load
+	}
+	data, err := load(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// execCredential returns what the command line ref prints,
+// trimmed of whitespace, e.g. of a password manager. The
+// command line is split at whitespace, without a shell.
+func execCredential(ctx context.Context, ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	stdout, _, err := executil.Run(ctx, executil.Command{
+		Path:      args[0],
+		Args:      args[1:],
+		Timeout:   credentialExecTimeout,
+		MaxOutput: 64 << 10,
+	})
+	if err != nil {
+		return "", fmt.Errorf("running %s: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(stdout)), nil
+}
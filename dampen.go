@@ -0,0 +1,194 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// dampenedKeys are the fields that tell failures apart. The
+// output of a command is left out, as it may differ every
+// time, e.g. by a timestamp, for the very same failure.
+var dampenedKeys = map[string]bool{
+	"command":       true,
+	"stage_command": true,
+	"hook":          true,
+	"error":         true,
+}
+
+// provisionDampening wraps the logger, so that repeated
+// warnings and errors are summarized.
+func (c *Command) provisionDampening() error {
+	if c.LogDampening < 0 {
+		return fmt.Errorf("invalid log_dampening %s", time.Duration(c.LogDampening))
+	}
+	if c.LogDampening == 0 {
+		return nil
+	}
+	d := &dampener{
+		window:   time.Duration(c.LogDampening),
+		repeated: make(map[string]*repetition),
+	}
+	c.dampener = d
+	c.logger = c.logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return dampeningCore{core, d}
+	}))
+	return nil
+}
+
+// dampener remembers the warnings and errors logged within the
+// last window. Only the first of identical ones is logged, the
+// repetitions are counted and logged as a summary once the
+// window passed or a lookup succeeded again.
+type dampener struct {
+	mu       sync.Mutex
+	window   time.Duration
+	repeated map[string]*repetition
+}
+
+// repetition is a warning or error logged in the current window.
+type repetition struct {
+	core   zapcore.Core
+	entry  zapcore.Entry
+	fields []zapcore.Field
+	start  time.Time
+	count  int
+}
+
+// summary returns the entry and the fields summarizing
+// the repetitions, if any.
+func (r *repetition) summary() (zapcore.Entry, []zapcore.Field, bool) {
+	if r.count == 0 {
+		return zapcore.Entry{}, nil, false
+	}
+	e := r.entry
+	e.Time = time.Now()
+	e.Message = fmt.Sprintf("%s (repeated %d times in %s)", r.entry.Message, r.count, e.Time.Sub(r.start).Round(time.Second))
+	return e, append(r.fields, zap.Int("repetitions", r.count)), true
+}
+
+// log decides whether the entry is logged. The summaries of
+// the windows that passed are logged first.
+func (d *dampener) log(core zapcore.Core, e zapcore.Entry, fields []zapcore.Field) error {
+	key := dampenedKey(e, fields)
+
+	d.mu.Lock()
+	var passed []*repetition
+	for k, r := range d.repeated {
+		if e.Time.Sub(r.start) >= d.window {
+			passed = append(passed, r)
+			delete(d.repeated, k)
+		}
+	}
+	r, repeated := d.repeated[key]
+	if repeated {
+		r.count++
+		r.fields = dampenedFields(fields)
+	} else {
+		d.repeated[key] = &repetition{core: core, entry: e, fields: dampenedFields(fields), start: e.Time}
+	}
+	d.mu.Unlock()
+
+	for _, r := range passed {
+		if summary, summaryFields, ok := r.summary(); ok {
+			if err := r.core.Write(summary, summaryFields); err != nil {
+				return err
+			}
+		}
+	}
+	if repeated {
+		return nil
+	}
+	return core.Write(e, fields)
+}
+
+// flush logs the summaries of all repetitions and forgets
+// them, so that the next failure is logged in full again.
+func (d *dampener) flush() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	repeated := d.repeated
+	d.repeated = make(map[string]*repetition)
+	d.mu.Unlock()
+
+	for _, r := range repeated {
+		if summary, fields, ok := r.summary(); ok {
+			_ = r.core.Write(summary, fields)
+		}
+	}
+}
+
+// dampenedKey returns the key identifying the failure of e.
+func dampenedKey(e zapcore.Entry, fields []zapcore.Field) string {
+	parts := []string{e.Level.String(), e.Message}
+	for _, f := range dampenedFields(fields) {
+		parts = append(parts, f.Key+"="+f.String)
+	}
+	sort.Strings(parts[2:])
+	return strings.Join(parts, "\x00")
+}
+
+// dampenedFields returns the fields identifying a failure,
+// with errors turned into strings.
+func dampenedFields(fields []zapcore.Field) []zapcore.Field {
+	var out []zapcore.Field
+	for _, f := range fields {
+		if !dampenedKeys[f.Key] {
+			continue
+		}
+		switch f.Type {
+		case zapcore.StringType:
+			out = append(out, f)
+		case zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok && err != nil {
+				out = append(out, zap.String(f.Key, err.Error()))
+			}
+		}
+	}
+	return out
+}
+
+// dampeningCore is a zapcore.Core that passes warnings and
+// errors on to Core through the dampener.
+type dampeningCore struct {
+	zapcore.Core
+	d *dampener
+}
+
+// With implements zapcore.Core.
+func (c dampeningCore) With(fields []zapcore.Field) zapcore.Core {
+	return dampeningCore{c.Core.With(fields), c.d}
+}
+
+// Check implements zapcore.Core.
+func (c dampeningCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+// Write implements zapcore.Core.
+func (c dampeningCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	if e.Level < zapcore.WarnLevel {
+		return c.Core.Write(e, fields)
+	}
+	return c.d.log(c.Core, e, fields)
+}
+
+// Interface guards
+var (
+	_ zapcore.Core = (*dampeningCore)(nil)
+)
@@ -0,0 +1,101 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+// deadlineError returns err as an *ErrDeadline of phase if the
+// deadline of ctx expired, and else err as it is.
+func deadlineError(ctx context.Context, phase string, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	var deadlineErr *ErrDeadline
+	if errors.As(err, &deadlineErr) {
+		// expired in a nested phase
+		return err
+	}
+	return &ErrDeadline{Phase: phase, Err: err}
+}
+
+// withinDeadline runs fn, a phase of the lookup that does not take
+// a context, like transforming or parsing the output, and gives up
+// on it with an *ErrDeadline once the deadline of ctx expired, so
+// that no phase can hang the lookup. fn keeps running until it
+// returns, so it must not have effects beyond its result then.
+func withinDeadline[T any](ctx context.Context, phase string, fn func() (T, error)) (T, error) {
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	type result struct {
+		val T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		val, err := fn()
+		done <- result{val, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.val, r.err
+	case <-ctx.Done():
+		var zero T
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return zero, &ErrDeadline{Phase: phase}
+		}
+		return zero, ctx.Err()
+	}
+}
+
+// partialResult returns the addresses out of the commands that
+// finished with an *ErrPartial wrapping err, if PartialResults is
+// set, err is a timeout and there are any. Otherwise it fails the
+// lookup with err.
+func (c Command) partialResult(out []net.IP, versions dynamicdns.IPVersions, err error) ([]net.IP, error) {
+	if !c.PartialResults || !(errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrTimeout)) {
+		return nil, err
+	}
+	// the lookup is out of time, but the probes have their own
+	out, synthErr := c.processAddresses(context.Background(), out)
+	if synthErr != nil {
+		return nil, synthErr
+	}
+	if len(out) == 0 {
+		return nil, err
+	}
+
+	var hasV4, hasV6 bool
+	for _, ip := range out {
+		if ip.To4() != nil {
+			hasV4 = true
+		} else {
+			hasV6 = true
+		}
+	}
+	partial := &ErrPartial{Err: err}
+	if versions.V4Enabled() && !hasV4 {
+		partial.Missing = append(partial.Missing, "ipv4")
+	}
+	if versions.V6Enabled() && !hasV6 {
+		partial.Missing = append(partial.Missing, "ipv6")
+	}
+	c.logger.Warn("lookup did not finish; returning partial result",
+		zap.String("command", c.Cmd),
+		zap.Strings("ips", ipStrings(out)),
+		zap.Strings("missing", partial.Missing),
+		zap.Error(err))
+	return out, partial
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// logResolved logs how e is about to be run, after all
+// placeholders were expanded. Only the names of the
+// variables inherited from Caddy's environment and of
+// the configured ones are logged, and args are redacted
+// as usual.
+func (c Command) logResolved(e Exec, executable string, loggedArgs []string, env []string) {
+	dir := e.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	} else if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	if c.Chroot == "" {
+		if path, err := commandPath(executable, e.Dir); err == nil {
+			executable = path
+		}
+	}
+
+	var inherited []string
+	if !c.CleanEnv {
+		for _, kv := range os.Environ() {
+			name, _, _ := strings.Cut(kv, "=")
+			inherited = append(inherited, name)
+		}
+	}
+	configured := make([]string, 0, len(c.Env))
+	for name := range c.Env {
+		configured = append(configured, name)
+	}
+	sort.Strings(configured)
+
+	c.logger.Info("resolved command",
+		zap.String("command", e.Cmd),
+		zap.String("executable", executable),
+		zap.Strings("args", loggedArgs),
+		zap.String("dir", dir),
+		zap.Duration("timeout", time.Duration(e.Timeout)),
+		zap.Strings("env", env),
+		zap.Strings("inherited_env", inherited),
+		zap.Strings("configured_env", configured),
+		zap.String("mode", c.Mode),
+		zap.String("privilege_wrapper", c.PrivilegeWrapper),
+		zap.String("decode", c.Decode),
+		zap.String("json_path", c.JSONPath),
+		zap.String("transform_template", c.TransformTemplate),
+	)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/libdns/libdns"
+)
+
+// How long to wait for the records of an end-to-end test.
+const e2eTimeout = 10 * time.Second
+
+// e2eTests are the end-to-end tests: the ip_source and other
+// options of the dynamic_dns app, and the records it must set,
+// like "A 203.0.113.1". The dynamic_dns app remembers the
+// addresses of the previous config, so every test must use
+// addresses of its own.
+var e2eTests = []struct {
+	name    string
+	options string
+	want    []string
+}{
+	{
+		name:    "list",
+		options: `ip_source command echo 203.0.113.10,2001:db8::10`,
+		want:    []string{"A 203.0.113.10", "AAAA 2001:db8::10"},
+	},
+	{
+		name: "labeled",
+		options: `ip_source command printf "ipv4: 203.0.113.11\nipv6: 2001:db8::11\n" {
+			format labeled
+		}`,
+		want: []string{"A 203.0.113.11", "AAAA 2001:db8::11"},
+	},
+	{
+		name: "max_per_family",
+		options: `ip_source command echo 203.0.113.12,203.0.113.112 {
+			max_per_family 1
+		}`,
+		want: []string{"A 203.0.113.12"},
+	},
+	{
+		name: "fallback",
+		options: `ip_source command false
+		ip_source command echo 203.0.113.13`,
+		want: []string{"A 203.0.113.13"},
+	},
+	{
+		name: "denied_subnets",
+		options: `ip_source command echo 10.0.0.14,203.0.113.14 {
+			denied_subnets 10.0.0.0/8
+		}`,
+		want: []string{"A 203.0.113.14"},
+	},
+	{
+		name: "watch",
+		options: `ip_source command sh -c "echo 203.0.113.15; exec sleep 60" {
+			watch
+		}`,
+		want: []string{"A 203.0.113.15"},
+	},
+}
+
+// TestE2E runs the dynamic_dns app inside Caddy with command
+// sources and the debug provider, and checks that the addresses
+// the commands print end up in the records it is asked to set.
+func TestE2E(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh, echo, printf and false")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip(err)
+	}
+	// Caddy 2.7 only loads the modules of a config, like the
+	// provider of the dynamic_dns app, if json.RawMessage comes
+	// from encoding/json, which is not the case with json v2
+	if pkg := reflect.TypeOf(json.RawMessage(nil)).PkgPath(); pkg != "encoding/json" {
+		t.Fatalf("json.RawMessage is from %s, so Caddy cannot load the modules of a config; "+
+			"use Go 1.20 to 1.26, or build with GOEXPERIMENT=nojsonv2", pkg)
+	}
+
+	for _, test := range e2eTests {
+		t.Run(test.name, func(t *testing.T) {
+			config := fmt.Sprintf(`{
+	admin off
+	dynamic_dns {
+		provider debug
+		domains {
+			example.com @
+		}
+		check_interval 1h
+		%s
+	}
+}`, test.options)
+			cfgJSON, err := adaptConfig([]byte(config), "caddyfile")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			var got []string
+			done := make(chan struct{})
+			recordsSet = func(zone string, recs []libdns.Record) {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, r := range recs {
+					got = append(got, r.Type+" "+r.Value)
+				}
+				if len(got) >= len(test.want) {
+					select {
+					case <-done:
+					default:
+						close(done)
+					}
+				}
+			}
+			defer func() { recordsSet = nil }()
+
+			if err := caddy.Load(cfgJSON, true); err != nil {
+				t.Fatalf("loading config: %v", err)
+			}
+			select {
+			case <-done:
+			case <-time.After(e2eTimeout):
+			}
+			if err := caddy.Stop(); err != nil {
+				t.Errorf("stopping config: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			sort.Strings(got)
+			want := append([]string(nil), test.want...)
+			sort.Strings(want)
+			if strings.Join(got, ", ") != strings.Join(want, ", ") {
+				t.Errorf("got records [%s], want [%s]",
+					strings.Join(got, ", "), strings.Join(want, ", "))
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+// Command debug is a Caddy build with the command IP sources, to
+// reproduce issues without building a custom Caddy with xcaddy.
+//
+// Without flags of its own, it behaves like caddy:
+//
+//	go run ./debug run --config Caddyfile
+//
+// With flags, it runs a config, given by -config or by the name of
+// one of the embedded fixtures, which -fixtures lists:
+//
+//	go run ./debug -fixture command.caddyfile
+//	go run ./debug -once -config Caddyfile
+//
+// -once runs a single check of the IP sources of the dynamic_dns app
+// instead, prints the addresses of every source and exits with 1 if
+// one of them failed.
+//
+// The end-to-end tests, which need the integration tag, load configs
+// with the dynamic_dns app, the debug DNS provider and command
+// sources, and check that the addresses the commands print end up
+// in records:
+//
+//	go test -tags integration ./debug
+//
+// The build includes the debug DNS provider, which only logs the
+// records it is asked to set, and the standard Caddy modules,
+// unless built with the nostandard tag.
+// To reproduce an issue with a real DNS provider, add a file like
+//
+//	//go:build cloudflare
+//
+//	package main
+//
+//	import _ "github.com/caddy-dns/cloudflare"
+//
+// and build with -tags cloudflare.
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+
+	_ "github.com/mholt/caddy-dynamicdns"
+	_ "github.com/mietzen/caddy-dynamicdns-cmd-source"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+func main() {
+	if len(os.Args) < 2 || !strings.HasPrefix(os.Args[1], "-") {
+		caddycmd.Main()
+		return
+	}
+
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	once := flags.Bool("once", false, "run a single check of the IP sources and exit")
+	config := flags.String("config", "", "the config file to run")
+	adapter := flags.String("adapter", "", "the config adapter; by default derived from the file name")
+	fixture := flags.String("fixture", "", "the embedded fixture to run instead of -config")
+	list := flags.Bool("fixtures", false, "list the embedded fixtures and exit")
+	flags.Parse(os.Args[1:])
+
+	if *list {
+		entries, _ := fs.ReadDir(fixtures, "fixtures")
+		for _, e := range entries {
+			fmt.Println(e.Name())
+		}
+		return
+	}
+
+	name, body, err := readConfig(*config, *fixture)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *adapter == "" {
+		*adapter = adapterFor(name)
+	}
+
+	if !*once {
+		// hand the fixture over to caddy run, which exits
+		// without returning, so the file is reused instead
+		if *fixture != "" {
+			name = filepath.Join(os.TempDir(), "caddy-debug-"+name)
+			if err := os.WriteFile(name, body, 0o600); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+		os.Args = []string{os.Args[0], "run", "--config", name}
+		if *adapter != "json" {
+			os.Args = append(os.Args, "--adapter", *adapter)
+		}
+		caddycmd.Main()
+		return
+	}
+
+	cfgJSON, err := adaptConfig(body, *adapter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	os.Exit(checkOnce(cfgJSON))
+}
+
+// readConfig reads the config file or the embedded fixture.
+func readConfig(config, fixture string) (string, []byte, error) {
+	switch {
+	case config != "" && fixture != "":
+		return "", nil, fmt.Errorf("-config and -fixture are mutually exclusive")
+	case fixture != "":
+		body, err := fixtures.ReadFile("fixtures/" + fixture)
+		if err != nil {
+			return "", nil, fmt.Errorf("unknown fixture '%s'; see -fixtures", fixture)
+		}
+		return fixture, body, nil
+	case config != "":
+		body, err := os.ReadFile(config)
+		return config, body, err
+	}
+	return "", nil, fmt.Errorf("-config or -fixture is required")
+}
+
+// adapterFor returns the adapter of a config file by its name.
+func adapterFor(name string) string {
+	if filepath.Ext(name) == ".json" {
+		return "json"
+	}
+	return "caddyfile"
+}
+
+// adaptConfig adapts a config to JSON.
+func adaptConfig(body []byte, adapter string) ([]byte, error) {
+	if adapter == "json" {
+		return body, nil
+	}
+	a := caddyconfig.GetAdapter(adapter)
+	if a == nil {
+		return nil, fmt.Errorf("unknown adapter '%s'", adapter)
+	}
+	cfgJSON, warnings, err := a.Adapt(body, nil)
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("adapting config: %v", err)
+	}
+	return cfgJSON, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+)
+
+func init() {
+	caddy.RegisterModule(onceApp{})
+}
+
+// onceApp stands in for the dynamic_dns app in -once mode. It
+// loads the same IP sources, so that they are provisioned within
+// a real config, and asks every one of them for the addresses once.
+type onceApp struct {
+	IPSourcesRaw []json.RawMessage     `json:"ip_sources,omitempty" caddy:"namespace=dynamic_dns.ip_sources inline_key=source"`
+	Versions     dynamicdns.IPVersions `json:"versions,omitempty"`
+
+	sources []dynamicdns.IPSource
+	ctx     caddy.Context
+}
+
+// onceResult is the result of asking an IP source once.
+type onceResult struct {
+	source string
+	ips    []net.IP
+	err    error
+}
+
+// onceResults are the results of the last start of onceApp.
+var onceResults []onceResult
+
+// CaddyModule returns the Caddy module information.
+func (onceApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns_once",
+		New: func() caddy.Module { return new(onceApp) },
+	}
+}
+
+// Provision loads the IP sources.
+func (a *onceApp) Provision(ctx caddy.Context) error {
+	a.ctx = ctx
+	if len(a.IPSourcesRaw) == 0 {
+		return fmt.Errorf("the dynamic_dns app has no ip_source")
+	}
+	vals, err := ctx.LoadModule(a, "IPSourcesRaw")
+	if err != nil {
+		return fmt.Errorf("loading IP source modules: %v", err)
+	}
+	for _, v := range vals.([]any) {
+		a.sources = append(a.sources, v.(dynamicdns.IPSource))
+	}
+	return nil
+}
+
+// Start asks every IP source for the addresses.
+func (a *onceApp) Start() error {
+	onceResults = nil
+	for _, src := range a.sources {
+		ips, err := src.GetIPs(a.ctx, a.Versions)
+		if err == nil && len(ips) == 0 {
+			err = fmt.Errorf("no IP addresses returned")
+		}
+		onceResults = append(onceResults, onceResult{
+			source: src.(caddy.Module).CaddyModule().ID.Name(),
+			ips:    ips,
+			err:    err,
+		})
+	}
+	return nil
+}
+
+// Stop does nothing.
+func (a *onceApp) Stop() error {
+	return nil
+}
+
+// checkOnce runs the config with the dynamic_dns app replaced by
+// onceApp, and only the apps the IP sources may depend on. It
+// prints the results and returns the exit code.
+func checkOnce(cfgJSON []byte) int {
+	var cfg caddy.Config
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "decoding config: %v\n", err)
+		return 2
+	}
+	raw, ok := cfg.AppsRaw["dynamic_dns"]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "the config has no dynamic_dns app")
+		return 2
+	}
+	var app dynamicdns.App
+	if err := json.Unmarshal(raw, &app); err != nil {
+		fmt.Fprintf(os.Stderr, "decoding dynamic_dns app: %v\n", err)
+		return 2
+	}
+	apps := caddy.ModuleMap{"dynamic_dns_once": caddyconfig.JSON(onceApp{
+		IPSourcesRaw: app.IPSourcesRaw,
+		Versions:     app.Versions,
+	}, nil)}
+	if events, ok := cfg.AppsRaw["events"]; ok {
+		apps["events"] = events
+	}
+	cfg.AppsRaw = apps
+	cfg.Admin = &caddy.AdminConfig{Disabled: true}
+
+	cfgJSON, err := json.Marshal(cfg)
+	if err == nil {
+		err = caddy.Load(cfgJSON, true)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loading config: %v\n", err)
+		return 2
+	}
+	if err := caddy.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "stopping config: %v\n", err)
+	}
+
+	code := 0
+	for _, r := range onceResults {
+		if r.err != nil {
+			fmt.Printf("%s: error: %v\n", r.source, r.err)
+			code = 1
+			continue
+		}
+		ips := make([]string, len(r.ips))
+		for i, ip := range r.ips {
+			ips[i] = ip.String()
+		}
+		fmt.Printf("%s: %s\n", r.source, strings.Join(ips, " "))
+	}
+	return code
+}
+
+// Interface guards
+var (
+	_ caddy.App         = (*onceApp)(nil)
+	_ caddy.Provisioner = (*onceApp)(nil)
+)
@@ -0,0 +1,84 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"context"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Provider{})
+}
+
+// recordsSet, if set, is called with the records
+// the provider is asked to set, e.g. by the end-to-end tests.
+var recordsSet func(zone string, recs []libdns.Record)
+
+// Provider is a DNS provider that only logs the records
+// it is asked to set, so that configs can be run without
+// credentials of a real provider.
+type Provider struct {
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Provider) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dns.providers.debug",
+		New: func() caddy.Module { return new(Provider) },
+	}
+}
+
+// Provision sets up the logger.
+func (p *Provider) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger()
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the provider from Caddyfile tokens. Syntax:
+//
+//	provider debug
+func (p *Provider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// GetRecords returns no records.
+func (p Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	return nil, nil
+}
+
+// SetRecords logs the records and returns them.
+func (p Provider) SetRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	for _, r := range recs {
+		p.logger.Info("setting record",
+			zap.String("zone", zone),
+			zap.String("name", r.Name),
+			zap.String("type", r.Type),
+			zap.String("value", r.Value))
+	}
+	if recordsSet != nil {
+		recordsSet(zone, recs)
+	}
+	return recs, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Provider)(nil)
+	_ caddyfile.Unmarshaler = (*Provider)(nil)
+	_ libdns.RecordGetter   = (*Provider)(nil)
+	_ libdns.RecordSetter   = (*Provider)(nil)
+)
@@ -0,0 +1,11 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !nostandard
+
+package main
+
+// the standard modules, e.g. for configs with a site block
+import _ "github.com/caddyserver/caddy/v2/modules/standard"
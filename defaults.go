@@ -0,0 +1,163 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(Defaults{})
+	httpcaddyfile.RegisterGlobalOption("dynamic_dns_command", parseDefaults)
+}
+
+// Defaults is an app holding the defaults of all command sources,
+// so that sites sharing the same options don't repeat them. An
+// option a source sets itself takes precedence; the environment
+// variables are merged.
+type Defaults struct {
+	// The default timeout of the commands.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// The default number of retries and the delay between them.
+	Retries    int            `json:"retries,omitempty"`
+	RetryDelay caddy.Duration `json:"retry_delay,omitempty"`
+
+	// The commands that sources without allowed_commands may run.
+	AllowedCommands []string `json:"allowed_commands,omitempty"`
+
+	// The default chroot of the commands.
+	Chroot string `json:"chroot,omitempty"`
+
+	// The default privilege wrapper and its flags.
+	PrivilegeWrapper      string   `json:"privilege_wrapper,omitempty"`
+	PrivilegeWrapperFlags []string `json:"privilege_wrapper_flags,omitempty"`
+
+	// Run all commands without Caddy's environment.
+	CleanEnv bool `json:"clean_env,omitempty"`
+
+	// Environment variables for all commands.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Defaults) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns_command",
+		New: func() caddy.Module { return new(Defaults) },
+	}
+}
+
+// Start implements caddy.App; the defaults do not run anything.
+func (Defaults) Start() error { return nil }
+
+// Stop implements caddy.App.
+func (Defaults) Stop() error { return nil }
+
+// UnmarshalCaddyfile parses the global option. Syntax:
+//
+//	dynamic_dns_command {
+//	    timeout <duration>
+//	    retries <n>
+//	    retry_delay <duration>
+//	    allowed_commands <paths...>
+//	    chroot <dir>
+//	    privilege_wrapper sudo|doas [<flags...>]
+//	    clean_env
+//	    env <name> <value>
+//	}
+func (def *Defaults) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	var c Command
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			ok, err := c.unmarshalSharedOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized or per-source subdirective '%s'", d.Val())
+			}
+		}
+	}
+
+	def.Timeout = c.Timeout
+	def.Retries = c.Retries
+	def.RetryDelay = c.RetryDelay
+	def.AllowedCommands = c.AllowedCommands
+	def.Chroot = c.Chroot
+	def.PrivilegeWrapper = c.PrivilegeWrapper
+	def.PrivilegeWrapperFlags = c.PrivilegeWrapperFlags
+	def.CleanEnv = c.CleanEnv
+	def.Env = c.Env
+	return nil
+}
+
+// parseDefaults configures the dynamic_dns_command
+// app from the global option of the same name.
+func parseDefaults(d *caddyfile.Dispenser, _ any) (any, error) {
+	def := new(Defaults)
+	if err := def.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	return httpcaddyfile.App{
+		Name:  "dynamic_dns_command",
+		Value: caddyconfig.JSON(def, nil),
+	}, nil
+}
+
+// provisionDefaults applies the defaults of the
+// dynamic_dns_command app, if configured.
+func (c *Command) provisionDefaults(ctx caddy.Context) error {
+	app, err := ctx.App("dynamic_dns_command")
+	if err != nil {
+		return err
+	}
+	def := app.(*Defaults)
+
+	if c.Timeout == 0 {
+		c.Timeout = def.Timeout
+	}
+	if c.Retries == 0 {
+		c.Retries = def.Retries
+	}
+	if c.RetryDelay == 0 {
+		c.RetryDelay = def.RetryDelay
+	}
+	if len(c.AllowedCommands) == 0 {
+		c.AllowedCommands = def.AllowedCommands
+	}
+	if c.Chroot == "" {
+		c.Chroot = def.Chroot
+	}
+	if c.PrivilegeWrapper == "" {
+		c.PrivilegeWrapper = def.PrivilegeWrapper
+		c.PrivilegeWrapperFlags = def.PrivilegeWrapperFlags
+	}
+	c.CleanEnv = c.CleanEnv || def.CleanEnv
+	if len(def.Env) > 0 {
+		env := make(map[string]string, len(def.Env)+len(c.Env))
+		for name, value := range def.Env {
+			env[name] = value
+		}
+		for name, value := range c.Env {
+			env[name] = value
+		}
+		c.Env = env
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.App             = (*Defaults)(nil)
+	_ caddyfile.Unmarshaler = (*Defaults)(nil)
+)
@@ -0,0 +1,90 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// The mode of the directories created by CreateDir, by default.
+const defaultDirMode = 0o700
+
+// provisionDirs creates the missing dirs of the command, the
+// further commands, the pipe stages and the hooks, if CreateDir
+// is set, so that e.g. a fresh state directory of a systemd
+// dynamic user works right away. Existing dirs are left as
+// they are.
+func (c *Command) provisionDirs() error {
+	if !c.CreateDir {
+		if c.DirMode != "" {
+			return fmt.Errorf("dir_mode requires create_dir")
+		}
+		return nil
+	}
+	mode := fs.FileMode(defaultDirMode)
+	if c.DirMode != "" {
+		m, err := strconv.ParseUint(c.DirMode, 8, 32)
+		if err != nil || m > 0o777 {
+			return fmt.Errorf("invalid dir_mode %s: must be octal permissions like 0750", c.DirMode)
+		}
+		mode = fs.FileMode(m)
+	}
+
+	dirs := []string{c.Dir}
+	for _, e := range c.Commands {
+		dirs = append(dirs, e.Dir)
+	}
+	for _, e := range c.Pipeline {
+		dirs = append(dirs, e.Dir)
+	}
+	if c.Before != nil {
+		dirs = append(dirs, c.Before.Dir)
+	}
+	if c.After != nil {
+		dirs = append(dirs, c.After.Dir)
+	}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if c.Chroot != "" {
+			dir = filepath.Join(c.Chroot, dir)
+		}
+		if err := c.createDir(dir, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDir creates dir and its missing parents with mode,
+// regardless of the umask, unless it exists already.
+func (c Command) createDir(dir string, mode fs.FileMode) error {
+	_, err := os.Stat(dir)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("create_dir: %v", err)
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return fmt.Errorf("create_dir: %v", err)
+	}
+	if err := os.Chmod(dir, mode); err != nil {
+		return fmt.Errorf("create_dir: %v", err)
+	}
+	c.logger.Info("created dir",
+		zap.String("dir", dir),
+		zap.String("mode", mode.String()))
+	return nil
+}
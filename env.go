@@ -0,0 +1,94 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"github.com/mietzen/caddy-dynamicdns-cmd-source/executil"
+)
+
+// Environment variables passed to the command on every run.
+const (
+	// "on" if IPv4 addresses are requested, "off" otherwise.
+	EnvIPv4 = "CADDY_DDNS_IPV4"
+
+	// "on" if IPv6 addresses are requested, "off" otherwise.
+	EnvIPv6 = "CADDY_DDNS_IPV6"
+
+	// The timeout of the command, e.g. "30s".
+	EnvTimeout = "CADDY_DDNS_TIMEOUT"
+
+	// The version of Caddy running the command.
+	EnvVersion = "CADDY_DDNS_VERSION"
+
+	// The IPv4 addresses the previous lookup returned,
+	// separated by commas; empty before the first one.
+	EnvLastIPv4 = "CADDY_DDNS_LAST_IPV4"
+
+	// The IPv6 addresses the previous lookup returned,
+	// separated by commas; empty before the first one.
+	EnvLastIPv6 = "CADDY_DDNS_LAST_IPV6"
+
+	// The ID of the run, which the log entries, events and
+	// history entries of the run carry too.
+	EnvRunID = "CADDY_DDNS_RUN_ID"
+
+	// The label of the source; empty if it has none.
+	EnvLabel = "CADDY_DDNS_LABEL"
+
+	// The latest version of the protocol the source
+	// understands, see ProtocolVersion.
+	EnvProto = "CADDY_DDNS_PROTO"
+)
+
+// requestEnv returns the environment variables
+// describing the lookup to the command.
+func (c Command) requestEnv(versions dynamicdns.IPVersions) []string {
+	version, _ := caddy.Version()
+	var last4, last6 []string
+	last, _ := c.state.cached(-1)
+	for _, ip := range last {
+		if ip.To4() != nil {
+			last4 = append(last4, ip.String())
+		} else {
+			last6 = append(last6, ip.String())
+		}
+	}
+	return []string{
+		EnvIPv4 + "=" + onOff(versions.V4Enabled()),
+		EnvIPv6 + "=" + onOff(versions.V6Enabled()),
+		EnvTimeout + "=" + time.Duration(c.Timeout).String(),
+		EnvVersion + "=" + version,
+		EnvLastIPv4 + "=" + strings.Join(last4, ","),
+		EnvLastIPv6 + "=" + strings.Join(last6, ","),
+		EnvRunID + "=" + c.runID,
+		EnvLabel + "=" + c.Label,
+		EnvProto + "=" + strconv.Itoa(ProtocolVersion),
+	}
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// processEnv returns the environment of a process: Caddy's own
+// environment, unless CleanEnv is set, the configured variables
+// with global placeholders expanded, and env.
+func (c Command) processEnv(env []string) []string {
+	vars := make(map[string]string, len(c.Env))
+	for name, value := range c.Env {
+		vars[name] = expandSecret(value)
+	}
+	return executil.MergeEnv(c.CleanEnv, vars, env...)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mietzen/caddy-dynamicdns-cmd-source/executil"
+)
+
+// The errors GetIPs returns, so that modules wrapping a command
+// source can tell failures apart with errors.Is and errors.As.
+var (
+	// ErrTimeout is returned if a command was killed
+	// because it did not finish within its timeout.
+	ErrTimeout = executil.ErrTimeout
+
+	// ErrEmptyOutput is returned if a command succeeded, but
+	// printed nothing the addresses could be parsed from.
+	ErrEmptyOutput = errors.New("command printed no output")
+)
+
+// ErrDryRun is returned by GetIPs instead of the addresses of
+// a source with dry_run, so that the records are not updated.
+var ErrDryRun = errors.New("dry run: addresses are not returned")
+
+// ErrRateLimited is returned if the command may not run yet by
+// max_rate and there are no previous addresses to return instead.
+var ErrRateLimited = errors.New("max_rate exceeded")
+
+// ErrUnchanged is returned if a command reports by its exit code
+// or the NOCHANGE sentinel that the addresses did not change. GetIPs
+// returns the previous addresses instead.
+var ErrUnchanged = errors.New("addresses unchanged")
+
+// ErrNonZeroExit is returned if a command exited with
+// a non-zero exit code.
+type ErrNonZeroExit struct {
+	// The command that failed.
+	Cmd string
+
+	// Its exit code.
+	Code int
+
+	// What it printed to stderr.
+	Stderr string
+}
+
+func (e *ErrNonZeroExit) Error() string {
+	return fmt.Sprintf("command %s exited with: %d", e.Cmd, e.Code)
+}
+
+// ErrInvalidIP is returned if a command printed
+// something that is not an IP address.
+type ErrInvalidIP struct {
+	// The text that should have been an address.
+	Token string
+}
+
+func (e *ErrInvalidIP) Error() string {
+	return "invalid IP: " + e.Token
+}
+
+// ErrDeadline is returned if the deadline of the lookup, its
+// attempt timeout or the context of GetIPs expired, with the
+// phase of the lookup that did not finish in time. It matches
+// context.DeadlineExceeded with errors.Is.
+type ErrDeadline struct {
+	// The phase, e.g. "running command ip"
+	// or "parsing output of ip".
+	Phase string
+
+	// The error the phase failed with, if it returned.
+	Err error
+}
+
+func (e *ErrDeadline) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("deadline exceeded while %s: %v", e.Phase, e.Err)
+	}
+	return "deadline exceeded while " + e.Phase
+}
+
+func (e *ErrDeadline) Unwrap() []error {
+	if e.Err != nil {
+		return []error{context.DeadlineExceeded, e.Err}
+	}
+	return []error{context.DeadlineExceeded}
+}
+
+// ErrPartial is returned with partial_results together with the
+// addresses of the commands that finished, if a further command
+// timed out or the deadline expired, so that the families that
+// did resolve can still be published. It wraps the error the
+// lookup stopped with.
+type ErrPartial struct {
+	// The requested families without any address,
+	// "ipv4" or "ipv6".
+	Missing []string
+
+	// The error the lookup stopped with.
+	Err error
+}
+
+func (e *ErrPartial) Error() string {
+	if len(e.Missing) > 0 {
+		return fmt.Sprintf("partial result without %s: %v", strings.Join(e.Missing, " and "), e.Err)
+	}
+	return fmt.Sprintf("partial result: %v", e.Err)
+}
+
+func (e *ErrPartial) Unwrap() error {
+	return e.Err
+}
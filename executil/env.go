@@ -0,0 +1,32 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package executil
+
+import (
+	"os"
+	"sort"
+)
+
+// MergeEnv returns the environment of a process: Caddy's own
+// environment, unless clean is set, the variables of vars,
+// sorted by name, and extra, like "NAME=value". A later
+// value of a variable takes precedence.
+func MergeEnv(clean bool, vars map[string]string, extra ...string) []string {
+	// not nil, so that a clean environment stays empty
+	out := []string{}
+	if !clean {
+		out = os.Environ()
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out = append(out, name+"="+vars[name])
+	}
+	return append(out, extra...)
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+// Package executil runs the processes of the command IP source, so
+// that other IP sources and Caddy modules can run processes the same
+// way: killed after a timeout, optionally by an interrupt first,
+// with every process they started, by a process group or on Windows
+// a Job Object, and with the captured output limited in size.
+package executil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrTimeout is returned if a process was killed
+// because it did not finish within its timeout.
+var ErrTimeout = errors.New("command timed out")
+
+// Command is a process to run.
+type Command struct {
+	// The path of the executable.
+	Path string
+
+	// The arguments, without the path.
+	Args []string
+
+	// The working directory. Default: the one of Caddy
+	Dir string
+
+	// The complete environment, e.g. returned by MergeEnv.
+	// If nil, the process gets Caddy's environment.
+	Env []string
+
+	// What the process reads from stdin, if not nil.
+	Stdin []byte
+
+	// How long Run lets the process run before killing it.
+	// Default: no timeout
+	Timeout time.Duration
+
+	// How many bytes of stdout and of stderr Run keeps each.
+	// The rest is discarded, without blocking the process.
+	// Default: no limit
+	MaxOutput int
+
+	// Send an interrupt instead of killing the process when it is
+	// canceled, e.g. for a wrapper like sudo, which passes it on
+	// to a process of another user that it could not kill.
+	Interrupt bool
+
+	// How long to wait for the process to exit after it was
+	// canceled before it is killed and its output is closed.
+	// Default: wait indefinitely
+	WaitDelay time.Duration
+
+	// Attributes of the process, e.g. a chroot. On Unix,
+	// the process is always put in a process group of its own.
+	SysProcAttr *syscall.SysProcAttr
+
+	// Called with the pid of the process once it was started,
+	// e.g. to change its priority.
+	Started func(pid int)
+
+	// Called with the state of the process once it exited,
+	// e.g. to report the resources it used.
+	Exited func(state *os.ProcessState)
+
+	// Logs failures that do not keep the process from running,
+	// like the Windows Job Object that could not be created.
+	Logger *zap.Logger
+}
+
+// Process is a started or yet to be started process of a Command.
+type Process struct {
+	// The process. Its stdin, stdout and stderr may
+	// be changed until the process is started.
+	Cmd *exec.Cmd
+
+	c    Command
+	tree *processTree
+}
+
+// Process prepares the process of c, which is canceled once
+// ctx is done. Timeout and MaxOutput are only applied by Run.
+func (c Command) Process(ctx context.Context) *Process {
+	if c.Logger == nil {
+		c.Logger = zap.NewNop()
+	}
+
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Dir = c.Dir
+	cmd.Env = c.Env
+	if c.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(c.Stdin)
+	}
+	if c.Interrupt {
+		cmd.Cancel = func() error {
+			return cmd.Process.Signal(os.Interrupt)
+		}
+	}
+	cmd.WaitDelay = c.WaitDelay
+	cmd.SysProcAttr = c.SysProcAttr
+	return &Process{Cmd: cmd, c: c}
+}
+
+// Start starts the process.
+func (p *Process) Start() error {
+	p.tree = newProcessTree(p.Cmd, p.c.Interrupt, p.c.Logger)
+	if err := p.Cmd.Start(); err != nil {
+		p.tree.close()
+		return err
+	}
+	p.tree.add(p.Cmd.Process.Pid)
+	if p.c.Started != nil {
+		p.c.Started(p.Cmd.Process.Pid)
+	}
+	return nil
+}
+
+// Wait waits for the process to exit. The processes it
+// started that are still running are killed.
+func (p *Process) Wait() error {
+	defer p.tree.close()
+	err := p.Cmd.Wait()
+	if p.c.Exited != nil && p.Cmd.ProcessState != nil {
+		p.c.Exited(p.Cmd.ProcessState)
+	}
+	return err
+}
+
+// Run runs c and returns what it wrote to stdout and stderr. If it
+// is killed because of Timeout, the error wraps ErrTimeout.
+func Run(ctx context.Context, c Command) ([]byte, []byte, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	stdout := &limitedBuffer{limit: c.MaxOutput}
+	stderr := &limitedBuffer{limit: c.MaxOutput}
+	p := c.Process(ctx)
+	p.Cmd.Stdout = stdout
+	p.Cmd.Stderr = stderr
+
+	err := p.Start()
+	if err == nil {
+		err = p.Wait()
+	}
+	if err != nil && ctx.Err() != nil {
+		// the process was killed because it took too long
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %w: %w", ErrTimeout, ctx.Err(), err)
+		} else {
+			err = fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// limitedBuffer is a buffer that keeps up to limit bytes, if
+// limit > 0, and silently discards the rest. It does not embed
+// bytes.Buffer, as io.Copy would bypass Write by its ReadFrom.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+// Write implements io.Writer.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 && b.buf.Len()+len(p) > b.limit {
+		p = p[:b.limit-b.buf.Len()]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// Bytes returns the bytes kept.
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// Interface guards
+var (
+	_ io.Writer = (*limitedBuffer)(nil)
+)
@@ -0,0 +1,157 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package executil
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shell returns a Command running script with sh.
+func shell(t *testing.T, script string) Command {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	path, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	return Command{Path: path, Args: []string{"-c", script}}
+}
+
+func TestRun(t *testing.T) {
+	c := shell(t, `read line; echo "$line $GREETING"; echo oops >&2`)
+	c.Stdin = []byte("hello\n")
+	c.Env = MergeEnv(true, map[string]string{"GREETING": "world"})
+	var started int
+	c.Started = func(pid int) { started = pid }
+	var exited *os.ProcessState
+	c.Exited = func(state *os.ProcessState) { exited = state }
+
+	stdout, stderr, err := Run(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(stdout); got != "hello world\n" {
+		t.Errorf("stdout = %q", got)
+	}
+	if got := string(stderr); got != "oops\n" {
+		t.Errorf("stderr = %q", got)
+	}
+	if started == 0 {
+		t.Error("Started was not called")
+	}
+	if exited == nil || exited.Pid() != started {
+		t.Errorf("Exited was called with %v", exited)
+	}
+}
+
+func TestRunExitCode(t *testing.T) {
+	_, _, err := Run(context.Background(), shell(t, "exit 3"))
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("err = %v, want exit code 3", err)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	c := shell(t, "echo started; exec sleep 10")
+	c.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	stdout, _, err := Run(context.Background(), c)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want ErrTimeout", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("took %s", time.Since(start))
+	}
+	if got := string(stdout); got != "started\n" {
+		t.Errorf("stdout = %q", got)
+	}
+}
+
+func TestRunTimeoutKillsChildren(t *testing.T) {
+	// sleep is a child of sh, holding stdout open if only sh is killed
+	c := shell(t, "sleep 10; echo done")
+	c.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, _, err := Run(context.Background(), c)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("err = %v, want ErrTimeout", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("took %s, the child was not killed", time.Since(start))
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := Run(ctx, shell(t, "exec sleep 10"))
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestRunInterrupt(t *testing.T) {
+	c := shell(t, `trap 'echo interrupted; exit 0' INT; echo ready; while :; do sleep 0.05; done`)
+	c.Timeout = 500 * time.Millisecond
+	c.Interrupt = true
+	c.WaitDelay = 5 * time.Second
+
+	stdout, _, err := Run(context.Background(), c)
+	if !strings.Contains(string(stdout), "interrupted") {
+		t.Errorf("stdout = %q, err = %v; want the trap to run", stdout, err)
+	}
+}
+
+func TestRunMaxOutput(t *testing.T) {
+	c := shell(t, `i=0; while [ $i -lt 1000 ]; do echo 0123456789; i=$((i+1)); done`)
+	c.MaxOutput = 25
+
+	stdout, _, err := Run(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(stdout); got != "0123456789\n0123456789\n012" {
+		t.Errorf("stdout = %q", got)
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	t.Setenv("EXECUTIL_TEST", "inherited")
+
+	env := MergeEnv(false, map[string]string{"B": "2", "A": "1"}, "C=3")
+	if !contains(env, "EXECUTIL_TEST=inherited") {
+		t.Errorf("%v does not inherit the environment", env)
+	}
+	if tail := strings.Join(env[len(env)-3:], " "); tail != "A=1 B=2 C=3" {
+		t.Errorf("env ends with %s", tail)
+	}
+
+	clean := MergeEnv(true, nil)
+	if clean == nil || len(clean) != 0 {
+		t.Errorf("clean env = %#v, want empty and not nil", clean)
+	}
+}
+
+func contains(env []string, kv string) bool {
+	for _, e := range env {
+		if e == kv {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !windows
+
+package executil
+
+import (
+	"os/exec"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// processTree is the process group of a command, so that killing
+// it also kills the processes it started, like the ones of a
+// timed-out `sh -c` pipeline, which would otherwise keep running
+// and keep its output open.
+type processTree struct {
+	pid int
+}
+
+// newProcessTree puts cmd in a process group of its own, which is
+// killed when cmd is canceled, unless it is to be interrupted.
+func newProcessTree(cmd *exec.Cmd, interrupt bool, _ *zap.Logger) *processTree {
+	var attr syscall.SysProcAttr
+	if cmd.SysProcAttr != nil {
+		attr = *cmd.SysProcAttr
+	}
+	attr.Setpgid = true
+	cmd.SysProcAttr = &attr
+
+	t := new(processTree)
+	if !interrupt {
+		cmd.Cancel = func() error {
+			err := cmd.Process.Kill()
+			t.close()
+			return err
+		}
+	}
+	return t
+}
+
+// add remembers the started process pid, which leads the group.
+func (t *processTree) add(pid int) {
+	if t == nil {
+		return
+	}
+	t.pid = pid
+}
+
+// close kills the processes still running in the group.
+func (t *processTree) close() {
+	if t == nil || t.pid == 0 {
+		return
+	}
+	_ = syscall.Kill(-t.pid, syscall.SIGKILL)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package executil
+
+import (
+	"os/exec"
+	"sync"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/windows"
+)
+
+// processTree is a Job Object that kills all processes started
+// by a command, like the ones of a timed-out cmd /c pipeline,
+// when it is closed. Windows has no process groups, so without
+// it, killing the command leaves its children running.
+type processTree struct {
+	job    windows.Handle
+	once   sync.Once
+	path   string
+	logger *zap.Logger
+}
+
+// newProcessTree creates the Job Object for cmd, which is closed,
+// killing every process in it, when cmd is canceled, even if it is
+// to be interrupted, as Windows cannot interrupt a process. If it cannot
+// be created, a warning is logged and nil is returned, so that cmd
+// still runs, but only the command itself is killed on timeout.
+func newProcessTree(cmd *exec.Cmd, _ bool, logger *zap.Logger) *processTree {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err == nil {
+		info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+			BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+				LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+			},
+		}
+		_, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+			uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+		if err != nil {
+			windows.CloseHandle(job)
+		}
+	}
+	if err != nil {
+		logger.Warn("creating job object failed",
+			zap.String("command", cmd.Path),
+			zap.Error(err))
+		return nil
+	}
+
+	t := &processTree{job: job, path: cmd.Path, logger: logger}
+	cmd.Cancel = func() error {
+		err := cmd.Process.Kill()
+		t.close()
+		return err
+	}
+	return t
+}
+
+// add assigns the started process pid to the Job Object. Processes
+// it starts from then on are in the Job Object too.
+func (t *processTree) add(pid int) {
+	if t == nil {
+		return
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(pid))
+	if err == nil {
+		err = windows.AssignProcessToJobObject(t.job, process)
+		windows.CloseHandle(process)
+	}
+	if err != nil {
+		t.logger.Warn("assigning process to job object failed",
+			zap.String("command", t.path),
+			zap.Int("pid", pid),
+			zap.Error(err))
+	}
+}
+
+// close closes the Job Object, which kills the processes
+// still running in it.
+func (t *processTree) close() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		windows.CloseHandle(t.job)
+	})
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !windows
+
+package command
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// openPipe opens the named pipe at path for reading,
+// creating it if it does not exist.
+func openPipe(path string) (*os.File, error) {
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := syscall.Mkfifo(path, 0o600); err != nil && !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case info.Mode()&fs.ModeNamedPipe == 0:
+		return nil, fmt.Errorf("not a named pipe")
+	}
+	// opened for writing too, so that opening does not block
+	// until a writer opened it, and reading does not end when
+	// a writer closed it
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"os"
+)
+
+// openPipe fails, as Windows has no named pipes in the
+// file system.
+func openPipe(string) (*os.File, error) {
+	return nil, fmt.Errorf("not supported on windows")
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+// How long to wait for further changes before running the
+// lookup, as files are often written in several steps.
+const watchPathsDelay = 500 * time.Millisecond
+
+// provisionWatchPaths starts watching the paths of WatchPaths.
+// Files are watched through their directory, so that a file
+// replaced by a rename is still watched afterwards.
+func (c *Command) provisionWatchPaths(ctx context.Context) error {
+	if len(c.WatchPaths) == 0 {
+		return nil
+	}
+	if c.Watch {
+		return fmt.Errorf("watch_paths is not supported with watch")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watching watch_paths: %v", err)
+	}
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, path := range c.WatchPaths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			watcher.Close()
+			return fmt.Errorf("invalid watch_paths '%s': %v", path, err)
+		}
+		dir := filepath.Dir(path)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dir = path
+			dirs[path] = true
+		} else {
+			files[path] = true
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("invalid watch_paths '%s': %v", path, err)
+		}
+	}
+	c.fileWatcher = watcher
+
+	matches := func(name string) bool {
+		return files[name] || dirs[filepath.Dir(name)]
+	}
+	go c.watchPaths(ctx, watcher, matches)
+	return nil
+}
+
+// watchPaths expires the cached result and runs the lookup
+// again every time a watched path changed, until the watcher
+// is closed.
+func (c *Command) watchPaths(ctx context.Context, watcher *fsnotify.Watcher, matches func(string) bool) {
+	h := refreshHandler{state: c.state, logger: c.logger}
+	timer := time.NewTimer(watchPathsDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	var changed []string
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod || !matches(event.Name) {
+				continue
+			}
+			c.logger.Debug("watched path changed",
+				zap.String("path", event.Name),
+				zap.String("op", event.Op.String()))
+			if len(changed) == 0 {
+				timer.Reset(watchPathsDelay)
+			}
+			changed = append(changed, event.Name)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			c.logger.Warn("watching watch_paths failed",
+				zap.String("command", c.Cmd),
+				zap.Error(err))
+
+		case <-timer.C:
+			h.refresh("path", strings.Join(uniqueStrings(changed), ", "))
+			changed = nil
+			ips, err := c.state.shared(ctx, dynamicdns.IPVersions{}, func() ([]net.IP, error) {
+				return c.resolve(ctx, dynamicdns.IPVersions{})
+			})
+			if err != nil {
+				c.logger.Warn("lookup after watched path changed failed",
+					zap.String("command", c.Cmd),
+					zap.Error(err))
+				continue
+			}
+			c.logger.Debug("looked up after watched path changed",
+				zap.String("command", c.Cmd),
+				zap.Strings("ips", ipStrings(ips)))
+		}
+	}
+}
+
+// cleanupWatchPaths stops watching the paths.
+func (c *Command) cleanupWatchPaths() {
+	if c.fileWatcher != nil {
+		c.fileWatcher.Close()
+		c.fileWatcher = nil
+	}
+}
+
+// uniqueStrings returns s without duplicates, in order.
+func uniqueStrings(s []string) []string {
+	seen := make(map[string]bool, len(s))
+	var out []string
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
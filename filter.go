@@ -0,0 +1,280 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// Policies selecting which addresses are returned
+// if there are more than MaxPerFamily of a family.
+const (
+	// PreferFirst prefers the addresses the command
+	// printed first. This is the default.
+	PreferFirst = "first"
+
+	// PreferLowest prefers the numerically lowest addresses.
+	PreferLowest = "lowest"
+
+	// PreferEUI64 prefers IPv6 addresses with an interface
+	// identifier derived from the MAC address, then the
+	// lowest addresses.
+	PreferEUI64 = "eui64"
+
+	// PreferLongestLifetime prefers the addresses with the
+	// longest preferred lifetime, then the lowest addresses.
+	// Only the iproute2 format has the lifetimes.
+	PreferLongestLifetime = "longest_lifetime"
+)
+
+// provisionFilters parses the subnets and the selection
+// the addresses are filtered by.
+func (c *Command) provisionFilters() error {
+	subnets, err := parseSubnets(c.AllowedSubnets)
+	if err != nil {
+		return fmt.Errorf("invalid allowed_subnets: %v", err)
+	}
+	c.allowedSubnets = subnets
+
+	subnets, err = parseSubnets(c.DeniedSubnets)
+	if err != nil {
+		return fmt.Errorf("invalid denied_subnets: %v", err)
+	}
+	c.deniedSubnets = subnets
+
+	subnets, err = parseSubnets(c.PreferSubnets)
+	if err != nil {
+		return fmt.Errorf("invalid prefer_subnets: %v", err)
+	}
+	c.preferSubnets = subnets
+
+	selection, err := familySelection(c.Select, c.SelectIPv4, c.SelectIPv6)
+	if err != nil {
+		return err
+	}
+	c.selection = selection
+
+	if c.MaxPerFamily < 0 {
+		return fmt.Errorf("invalid max_per_family %d", c.MaxPerFamily)
+	}
+	switch c.Prefer {
+	case "", PreferFirst, PreferLowest, PreferEUI64:
+	case PreferLongestLifetime:
+		if c.Format != FormatIPRoute2 {
+			return fmt.Errorf("prefer %s requires the %s format", c.Prefer, FormatIPRoute2)
+		}
+	default:
+		return fmt.Errorf("unknown prefer policy %s", c.Prefer)
+	}
+	return nil
+}
+
+// parseSubnets parses a list of CIDR prefixes.
+func parseSubnets(list []string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, s := range list {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// subnetsContain returns true if ip is in any of subnets.
+func subnetsContain(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAddresses drops the addresses outside of the
+// allowed subnets and those in the denied subnets, then
+// the ones that lose to addresses in preferred subnets.
+func (c Command) filterAddresses(ips []net.IP) []net.IP {
+	if len(c.allowedSubnets) == 0 && len(c.deniedSubnets) == 0 {
+		return c.preferAddresses(ips)
+	}
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if len(c.allowedSubnets) > 0 && !subnetsContain(c.allowedSubnets, ip) {
+			c.logger.Debug("dropping address outside of allowed subnets",
+				zap.String("command", c.Cmd),
+				zap.String("ip", ip.String()))
+			continue
+		}
+		if subnetsContain(c.deniedSubnets, ip) {
+			c.logger.Debug("dropping address in denied subnets",
+				zap.String("command", c.Cmd),
+				zap.String("ip", ip.String()))
+			continue
+		}
+		out = append(out, ip)
+	}
+	return c.preferAddresses(out)
+}
+
+// processAddresses applies the subnet filters, the limits per
+// family and the filter modules to the parsed addresses, adds
+// the translated and synthesized ones and withholds the
+// unreachable ones.
+func (c Command) processAddresses(ctx context.Context, ips []net.IP) ([]net.IP, error) {
+	ips, err := c.synthesizeAddresses(c.translateAddresses(c.Filters.filter(c.limitAddresses(c.filterAddresses(ips)))))
+	if err != nil {
+		return nil, err
+	}
+	return c.probeAddresses(ctx, ips), nil
+}
+
+// preferAddresses keeps, for each family, only the addresses in
+// the first of the preferred subnets that has any of them. If no
+// address of a family is in a preferred subnet, all are kept.
+func (c Command) preferAddresses(ips []net.IP) []net.IP {
+	if len(c.preferSubnets) == 0 {
+		return ips
+	}
+
+	// the rank of each address, len(c.preferSubnets) if none
+	rank := func(ip net.IP) int {
+		for i, subnet := range c.preferSubnets {
+			if subnet.Contains(ip) {
+				return i
+			}
+		}
+		return len(c.preferSubnets)
+	}
+	best := map[bool]int{true: len(c.preferSubnets), false: len(c.preferSubnets)}
+	for _, ip := range ips {
+		if r := rank(ip); r < best[ip.To4() != nil] {
+			best[ip.To4() != nil] = r
+		}
+	}
+
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if r := best[ip.To4() != nil]; r < len(c.preferSubnets) && rank(ip) != r {
+			c.logger.Debug("dropping address outside of preferred subnet",
+				zap.String("command", c.Cmd),
+				zap.String("ip", ip.String()),
+				zap.String("preferred", c.preferSubnets[r].String()))
+			continue
+		}
+		out = append(out, ip)
+	}
+	return out
+}
+
+// limitAddresses returns at most MaxPerFamily addresses of each
+// family, selected by the Prefer policy. The order of the
+// families in ips is kept.
+func (c Command) limitAddresses(ips []net.IP) []net.IP {
+	if c.MaxPerFamily == 0 {
+		return ips
+	}
+
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	v4, v6 = c.selectAddresses(v4), c.selectAddresses(v6)
+
+	out := make([]net.IP, 0, len(v4)+len(v6))
+	for _, ip := range ips {
+		if ipListContains(v4, ip) || ipListContains(v6, ip) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// selectAddresses returns the MaxPerFamily preferred
+// addresses of ips, which are all of the same family.
+func (c Command) selectAddresses(ips []net.IP) []net.IP {
+	if len(ips) <= c.MaxPerFamily {
+		return ips
+	}
+
+	// with longest_lifetime, each command's addresses
+	// were already sorted when they were parsed
+	candidates := append([]net.IP(nil), ips...)
+	switch c.Prefer {
+	case PreferLowest:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return lowerIP(candidates[i], candidates[j])
+		})
+	case PreferEUI64:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			a, b := isEUI64(candidates[i]), isEUI64(candidates[j])
+			if a != b {
+				return a
+			}
+			return lowerIP(candidates[i], candidates[j])
+		})
+	}
+	selected := candidates[:c.MaxPerFamily]
+
+	c.logger.Debug("dropping addresses above max_per_family",
+		zap.String("command", c.Cmd),
+		zap.Strings("selected", ipStrings(selected)),
+		zap.Strings("dropped", ipStrings(candidates[c.MaxPerFamily:])))
+	return selected
+}
+
+// sortByLifetime sorts ips by their preferred lifetimes, the
+// longest first, and by address if the lifetimes are equal.
+func sortByLifetime(ips []net.IP, lifetimes []uint64) {
+	sort.Sort(byLifetime{ips, lifetimes})
+}
+
+// byLifetime sorts addresses by their preferred lifetimes.
+type byLifetime struct {
+	ips       []net.IP
+	lifetimes []uint64
+}
+
+func (b byLifetime) Len() int { return len(b.ips) }
+
+func (b byLifetime) Less(i, j int) bool {
+	if b.lifetimes[i] != b.lifetimes[j] {
+		return b.lifetimes[i] > b.lifetimes[j]
+	}
+	return lowerIP(b.ips[i], b.ips[j])
+}
+
+func (b byLifetime) Swap(i, j int) {
+	b.ips[i], b.ips[j] = b.ips[j], b.ips[i]
+	b.lifetimes[i], b.lifetimes[j] = b.lifetimes[j], b.lifetimes[i]
+}
+
+// lowerIP returns true if a is numerically lower than b.
+func lowerIP(a, b net.IP) bool {
+	return bytes.Compare(a.To16(), b.To16()) < 0
+}
+
+// isEUI64 returns true if ip is an IPv6 address with a
+// modified EUI-64 interface identifier, i.e. one derived
+// from a MAC address, which has ff:fe in its middle.
+func isEUI64(ip net.IP) bool {
+	if ip.To4() != nil {
+		return false
+	}
+	ip = ip.To16()
+	return ip[11] == 0xff && ip[12] == 0xfe
+}
@@ -0,0 +1,399 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(SubnetFilter{})
+	caddy.RegisterModule(FamilyFilter{})
+	caddy.RegisterModule(StableFilter{})
+	caddy.RegisterModule(DedupeFilter{})
+}
+
+// Filter is a module in the dynamic_dns.ip_sources.filters namespace
+// that filters the addresses an IP source looked up. Every IP source
+// of this package applies its filters, in order, after its own.
+type Filter interface {
+	// FilterIPs returns the addresses of ips to keep.
+	FilterIPs(ips []net.IP) []net.IP
+}
+
+// Filters are the filter modules of an IP source.
+type Filters struct {
+	// The filter modules, applied in order to the addresses.
+	FiltersRaw []json.RawMessage `json:"filters,omitempty" caddy:"namespace=dynamic_dns.ip_sources.filters inline_key=filter"`
+
+	filters []Filter
+}
+
+// unmarshal parses a filter subdirective. Syntax:
+//
+//	filter <name> {
+//	    ...
+//	}
+func (f *Filters) unmarshal(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, "dynamic_dns.ip_sources.filters."+name)
+	if err != nil {
+		return err
+	}
+	f.FiltersRaw = append(f.FiltersRaw, caddyconfig.JSONModuleObject(unm, "filter", name, nil))
+	return nil
+}
+
+// load loads the filter modules.
+func (f *Filters) load(ctx caddy.Context) error {
+	if len(f.FiltersRaw) == 0 {
+		return nil
+	}
+	mods, err := ctx.LoadModule(f, "FiltersRaw")
+	if err != nil {
+		return fmt.Errorf("loading filters: %v", err)
+	}
+	list, ok := mods.([]any)
+	if !ok {
+		return fmt.Errorf("loading filters: got %T, want a list of modules", mods)
+	}
+	for _, mod := range list {
+		filter, ok := mod.(Filter)
+		if !ok {
+			return fmt.Errorf("loading filters: module %T is not a filter", mod)
+		}
+		f.filters = append(f.filters, filter)
+	}
+	return nil
+}
+
+// filter applies the filter modules to ips, in order.
+func (f Filters) filter(ips []net.IP) []net.IP {
+	for _, filter := range f.filters {
+		ips = filter.FilterIPs(ips)
+	}
+	return ips
+}
+
+// apply applies the filter modules to the result of a
+// lookup, also to the addresses of a partial result.
+func (f Filters) apply(ips []net.IP, err error) ([]net.IP, error) {
+	if len(ips) == 0 {
+		return ips, err
+	}
+	return f.filter(ips), err
+}
+
+// SubnetFilter drops the addresses outside of the allowed subnets
+// and those in the denied subnets, like the allowed_subnets and
+// denied_subnets of the command source.
+type SubnetFilter struct {
+	// If set, only addresses in these CIDR prefixes are kept.
+	Allow []string `json:"allow,omitempty"`
+
+	// Addresses in these CIDR prefixes are dropped.
+	Deny []string `json:"deny,omitempty"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// CaddyModule returns the Caddy module information.
+func (SubnetFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.filters.subnets",
+		New: func() caddy.Module { return new(SubnetFilter) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	subnets {
+//	    allow <cidrs...>
+//	    deny <cidrs...>
+//	}
+func (s *SubnetFilter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var list *[]string
+			switch d.Val() {
+			case "allow":
+				list = &s.Allow
+			case "deny":
+				list = &s.Deny
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			*list = append(*list, args...)
+		}
+	}
+	return nil
+}
+
+// Provision parses the subnets.
+func (s *SubnetFilter) Provision(ctx caddy.Context) error {
+	var err error
+	s.allow, err = parseSubnets(s.Allow)
+	if err != nil {
+		return fmt.Errorf("invalid allow: %v", err)
+	}
+	s.deny, err = parseSubnets(s.Deny)
+	if err != nil {
+		return fmt.Errorf("invalid deny: %v", err)
+	}
+	return nil
+}
+
+// FilterIPs returns the addresses of ips in the allowed
+// subnets, if any, and in none of the denied ones.
+func (s SubnetFilter) FilterIPs(ips []net.IP) []net.IP {
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if len(s.allow) > 0 && !subnetsContain(s.allow, ip) {
+			continue
+		}
+		if subnetsContain(s.deny, ip) {
+			continue
+		}
+		out = append(out, ip)
+	}
+	return out
+}
+
+// FamilyFilter keeps at most a number of addresses of each family,
+// the first ones. Put it after a stable filter to keep the ones
+// that were returned before.
+type FamilyFilter struct {
+	// How many addresses of each family are kept at most.
+	// Default: 0 (all)
+	MaxPerFamily int `json:"max_per_family,omitempty"`
+
+	// How many IPv4 or IPv6 addresses are kept at most,
+	// if not MaxPerFamily.
+	MaxIPv4 int `json:"max_ipv4,omitempty"`
+	MaxIPv6 int `json:"max_ipv6,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (FamilyFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.filters.family",
+		New: func() caddy.Module { return new(FamilyFilter) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	family {
+//	    max_per_family <n>
+//	    max_ipv4 <n>
+//	    max_ipv6 <n>
+//	}
+func (f *FamilyFilter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "max_per_family":
+				err = intArg(d, &f.MaxPerFamily)
+			case "max_ipv4":
+				err = intArg(d, &f.MaxIPv4)
+			case "max_ipv6":
+				err = intArg(d, &f.MaxIPv6)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the limits.
+func (f FamilyFilter) Validate() error {
+	if f.MaxPerFamily < 0 || f.MaxIPv4 < 0 || f.MaxIPv6 < 0 {
+		return fmt.Errorf("invalid limit: must not be negative")
+	}
+	return nil
+}
+
+// FilterIPs returns the first addresses of each family of ips,
+// up to the limit of the family.
+func (f FamilyFilter) FilterIPs(ips []net.IP) []net.IP {
+	max4, max6 := f.MaxPerFamily, f.MaxPerFamily
+	if f.MaxIPv4 > 0 {
+		max4 = f.MaxIPv4
+	}
+	if f.MaxIPv6 > 0 {
+		max6 = f.MaxIPv6
+	}
+
+	var n4, n6 int
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if max4 > 0 && n4 >= max4 {
+				continue
+			}
+			n4++
+		} else {
+			if max6 > 0 && n6 >= max6 {
+				continue
+			}
+			n6++
+		}
+		out = append(out, ip)
+	}
+	return out
+}
+
+// StableFilter orders the addresses so that the stable ones come
+// first: the ones it returned before, in their previous order, then
+// IPv6 addresses with an interface identifier derived from the MAC
+// address, which unlike temporary addresses do not rotate. Followed
+// by a family filter, the same address keeps being returned while it
+// is there. It remembers the addresses until the config is reloaded.
+type StableFilter struct {
+	mu   *sync.Mutex
+	last *[]net.IP
+}
+
+// CaddyModule returns the Caddy module information.
+func (StableFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.filters.stable",
+		New: func() caddy.Module { return new(StableFilter) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	stable
+func (s *StableFilter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if d.NextBlock(0) {
+			return d.Errf("unrecognized subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (s *StableFilter) Provision(ctx caddy.Context) error {
+	s.mu = new(sync.Mutex)
+	s.last = new([]net.IP)
+	return nil
+}
+
+// FilterIPs returns ips with the stable addresses first.
+func (s StableFilter) FilterIPs(ips []net.IP) []net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the rank of each address: its position in the last
+	// result, else after all of them, EUI-64 ones first
+	last := *s.last
+	rank := func(ip net.IP) int {
+		for i, prev := range last {
+			if prev.Equal(ip) {
+				return i
+			}
+		}
+		if isEUI64(ip) {
+			return len(last)
+		}
+		return len(last) + 1
+	}
+	out := append([]net.IP(nil), ips...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return rank(out[i]) < rank(out[j])
+	})
+	*s.last = out
+	return out
+}
+
+// DedupeFilter drops duplicate addresses, also an IPv4 address
+// and the same address mapped into IPv6 (::ffff:a.b.c.d), and
+// returns the IPv4 ones in their 4-byte form.
+type DedupeFilter struct{}
+
+// CaddyModule returns the Caddy module information.
+func (DedupeFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.filters.dedupe",
+		New: func() caddy.Module { return new(DedupeFilter) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	dedupe
+func (*DedupeFilter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if d.NextBlock(0) {
+			return d.Errf("unrecognized subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// FilterIPs returns ips without duplicates.
+func (DedupeFilter) FilterIPs(ips []net.IP) []net.IP {
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if !ipListContains(out, ip) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// Interface guards
+var (
+	_ Filter                = (*SubnetFilter)(nil)
+	_ caddy.Provisioner     = (*SubnetFilter)(nil)
+	_ caddyfile.Unmarshaler = (*SubnetFilter)(nil)
+	_ Filter                = (*FamilyFilter)(nil)
+	_ caddy.Validator       = (*FamilyFilter)(nil)
+	_ caddyfile.Unmarshaler = (*FamilyFilter)(nil)
+	_ Filter                = (*StableFilter)(nil)
+	_ caddy.Provisioner     = (*StableFilter)(nil)
+	_ caddyfile.Unmarshaler = (*StableFilter)(nil)
+	_ Filter                = (*DedupeFilter)(nil)
+	_ caddyfile.Unmarshaler = (*DedupeFilter)(nil)
+)
@@ -0,0 +1,54 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+)
+
+func TestProvisionFilters(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs echo")
+	}
+	// the source needs the app of a running config
+	err := caddy.Load([]byte(`{"admin":{"disabled":true,"config":{"persist":false}},"apps":{"dynamic_dns_command":{}}}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+	ctx, cancel := caddy.NewContext(caddy.ActiveContext())
+	defer cancel()
+
+	mod, err := ctx.LoadModuleByID("dynamic_dns.ip_sources.command", []byte(`{
+		"command": "echo",
+		"args": ["10.0.0.1,203.0.113.1"],
+		"filters": [{"filter": "subnets", "deny": ["10.0.0.0/8"]}]
+	}`))
+	// Caddy 2.7 cannot load the modules of a config if
+	// json.RawMessage is not from encoding/json, like with
+	// json v2, which must fail instead of panicking
+	if reflect.TypeOf(json.RawMessage(nil)).PkgPath() != "encoding/json" {
+		if err == nil {
+			t.Fatal("loading the filters succeeded without encoding/json")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, err := mod.(*Command).GetIPs(context.Background(), dynamicdns.IPVersions{})
+	if err != nil || len(ips) != 1 || ips[0].String() != "203.0.113.1" {
+		t.Errorf("got %v, %v, want [203.0.113.1]", ips, err)
+	}
+}
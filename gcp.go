@@ -0,0 +1,195 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(GCPMetadata{})
+}
+
+// The default endpoint of the GCE metadata server.
+const defaultGCPEndpoint = "http://metadata.google.internal"
+
+// GCPMetadata is an IP source that looks up the public IP addresses
+// of a Compute Engine VM from the metadata server.
+//
+// The addresses are the external IPv4 addresses of the access configs
+// and the external IPv6 addresses of the IPv6 access configs of the
+// VM's network interfaces. A VM without external addresses has none,
+// which is not an error, so that the next IP source is tried.
+type GCPMetadata struct {
+	// The endpoint of the metadata server. The GCE_METADATA_HOST
+	// environment variable overrides the default, like it does
+	// for Google's client libraries.
+	// Default: http://metadata.google.internal
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The index of the network interface to use, e.g. 0 for
+	// nic0. Default: all network interfaces
+	Interface *int `json:"interface,omitempty"`
+
+	// How long to wait for the metadata server. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	client *http.Client
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (GCPMetadata) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.gcp_metadata",
+		New: func() caddy.Module { return new(GCPMetadata) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	gcp_metadata {
+//	    endpoint <url>
+//	    interface <index>
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (g *GCPMetadata) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "endpoint":
+				err = singleArg(d, &g.Endpoint)
+			case "interface":
+				var index int
+				err = intArg(d, &index)
+				g.Interface = &index
+			case "timeout":
+				err = durationArg(d, &g.Timeout)
+			case "filter":
+				err = g.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (g *GCPMetadata) Provision(ctx caddy.Context) error {
+	g.logger = ctx.Logger(g)
+	if err := g.Filters.load(ctx); err != nil {
+		return err
+	}
+	if g.Endpoint == "" {
+		g.Endpoint = defaultGCPEndpoint
+		if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+			g.Endpoint = "http://" + host
+		}
+	}
+	g.Endpoint = strings.TrimSuffix(g.Endpoint, "/")
+	if g.Interface != nil && *g.Interface < 0 {
+		return fmt.Errorf("invalid interface index %d", *g.Interface)
+	}
+	if g.Timeout <= 0 {
+		g.Timeout = caddy.Duration(5 * time.Second)
+	}
+	g.client = &http.Client{
+		Timeout: time.Duration(g.Timeout),
+		// the metadata server must never be reached through a proxy
+		Transport: &http.Transport{Proxy: nil},
+	}
+	return nil
+}
+
+// GetIPs gets the public addresses of this machine.
+func (g GCPMetadata) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return g.Filters.apply(g.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (g GCPMetadata) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	header := http.Header{"Metadata-Flavor": {"Google"}}
+	body, err := metadataRequest(ctx, g.client, http.MethodGet,
+		g.Endpoint+"/computeMetadata/v1/instance/network-interfaces/?recursive=true", header)
+	if err != nil {
+		return nil, err
+	}
+
+	var interfaces []struct {
+		AccessConfigs []struct {
+			ExternalIP string `json:"externalIp"`
+		} `json:"accessConfigs"`
+		IPv6AccessConfigs []struct {
+			ExternalIPv6 string `json:"externalIpv6"`
+		} `json:"ipv6AccessConfigs"`
+	}
+	if err := json.Unmarshal([]byte(body), &interfaces); err != nil {
+		return nil, fmt.Errorf("decoding network interfaces: %v", err)
+	}
+	if g.Interface != nil {
+		if *g.Interface >= len(interfaces) {
+			return nil, fmt.Errorf("no network interface nic%d, the VM has %d", *g.Interface, len(interfaces))
+		}
+		interfaces = interfaces[*g.Interface : *g.Interface+1]
+	}
+
+	var addrs []string
+	for _, iface := range interfaces {
+		for _, ac := range iface.AccessConfigs {
+			addrs = append(addrs, ac.ExternalIP)
+		}
+		for _, ac := range iface.IPv6AccessConfigs {
+			addrs = append(addrs, ac.ExternalIPv6)
+		}
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", addr)
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		g.logger.Debug("no external IP address assigned to the VM")
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*GCPMetadata)(nil)
+	_ caddy.Provisioner     = (*GCPMetadata)(nil)
+	_ caddyfile.Unmarshaler = (*GCPMetadata)(nil)
+)
@@ -0,0 +1,430 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func init() {
+	caddy.RegisterModule(GRPC{})
+}
+
+// grpcGetIPs is the method the GRPC source calls,
+// as defined in ipsource.proto.
+const grpcGetIPs = "/caddy.dynamicdns.v1.IPSource/GetIPs"
+
+// GRPC is an IP source that looks up the public IP addresses by
+// calling an external resolver, a gRPC service implementing the
+// IPSource service of ipsource.proto. Unlike a command, the
+// resolver is a long-lived service, written in any language,
+// that is asked on every lookup.
+type GRPC struct {
+	// The address of the resolver: host:port, or
+	// unix:<path> for a unix socket.
+	Address string `json:"address,omitempty"`
+
+	// Connect with TLS. Implied by the other TLS settings.
+	TLS bool `json:"tls,omitempty"`
+
+	// A PEM file with the CA certificate(s) to trust
+	// in addition to the system's.
+	CA string `json:"ca,omitempty"`
+
+	// A PEM certificate and key file to authenticate
+	// with to the resolver (mutual TLS).
+	ClientCertificate string `json:"client_certificate,omitempty"`
+	ClientKey         string `json:"client_key,omitempty"`
+
+	// The name to verify the resolver's certificate against.
+	// Default: the host of the address
+	ServerName string `json:"server_name,omitempty"`
+
+	// Do not verify the resolver's certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// Metadata sent with every call, e.g. an authorization
+	// token. Global placeholders like {env.RESOLVER_TOKEN}
+	// in the values are expanded.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// How long to wait for the resolver. Default: 10s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	conn   *grpc.ClientConn
+	last   *grpcLast
+	logger *zap.Logger
+}
+
+// grpcLast holds the addresses the previous lookup returned.
+type grpcLast struct {
+	mu  sync.Mutex
+	ips []net.IP
+}
+
+// CaddyModule returns the Caddy module information.
+func (GRPC) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.grpc",
+		New: func() caddy.Module { return new(GRPC) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	grpc <address> {
+//	    tls
+//	    ca <file>
+//	    client_certificate <cert_file> <key_file>
+//	    server_name <name>
+//	    insecure_skip_verify
+//	    metadata <key> <value>
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (g *GRPC) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&g.Address) {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "tls":
+				g.TLS = true
+				if d.NextArg() {
+					err = d.ArgErr()
+				}
+			case "ca":
+				err = singleArg(d, &g.CA)
+			case "client_certificate":
+				if !d.AllArgs(&g.ClientCertificate, &g.ClientKey) {
+					err = d.ArgErr()
+				}
+			case "server_name":
+				err = singleArg(d, &g.ServerName)
+			case "insecure_skip_verify":
+				g.InsecureSkipVerify = true
+				if d.NextArg() {
+					err = d.ArgErr()
+				}
+			case "metadata":
+				var key, value string
+				if !d.AllArgs(&key, &value) {
+					return d.ArgErr()
+				}
+				if g.Metadata == nil {
+					g.Metadata = make(map[string]string)
+				}
+				g.Metadata[key] = value
+			case "timeout":
+				err = durationArg(d, &g.Timeout)
+			case "filter":
+				err = g.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the connection to the resolver, which
+// is established on the first lookup and kept open.
+func (g *GRPC) Provision(ctx caddy.Context) error {
+	g.logger = ctx.Logger(g)
+	if err := g.Filters.load(ctx); err != nil {
+		return err
+	}
+	if g.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if g.Timeout <= 0 {
+		g.Timeout = caddy.Duration(10 * time.Second)
+	}
+	if (g.ClientCertificate == "") != (g.ClientKey == "") {
+		return fmt.Errorf("client_certificate needs both a certificate and a key file")
+	}
+
+	creds := insecure.NewCredentials()
+	if g.TLS || g.CA != "" || g.ClientCertificate != "" || g.ServerName != "" || g.InsecureSkipVerify {
+		tlsConfig, err := g.tlsConfig()
+		if err != nil {
+			return err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	// grpc dials unix:<path> addresses itself
+	conn, err := grpc.Dial(g.Address,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUserAgent("caddy-dynamicdns-cmd-source"))
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %v", g.Address, err)
+	}
+	g.conn = conn
+	g.last = new(grpcLast)
+	return nil
+}
+
+// tlsConfig returns the TLS config to connect to the resolver with.
+func (g GRPC) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         g.ServerName,
+		InsecureSkipVerify: g.InsecureSkipVerify,
+	}
+	if g.CA != "" {
+		pem, err := os.ReadFile(g.CA)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA %s", g.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if g.ClientCertificate != "" {
+		cert, err := tls.LoadX509KeyPair(g.ClientCertificate, g.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Cleanup closes the connection to the resolver.
+func (g *GRPC) Cleanup() error {
+	if g.conn == nil {
+		return nil
+	}
+	return g.conn.Close()
+}
+
+// GetIPs gets the public addresses from the resolver.
+func (g GRPC) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return g.Filters.apply(g.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (g GRPC) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(g.Timeout))
+	defer cancel()
+	if len(g.Metadata) > 0 {
+		keys := make([]string, 0, len(g.Metadata))
+		for key := range g.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var kv []string
+		for _, key := range keys {
+			value, err := secret(ctx, g.Metadata[key])
+			if err != nil {
+				return nil, fmt.Errorf("metadata %s: %v", key, err)
+			}
+			kv = append(kv, key, value)
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, kv...)
+	}
+
+	req := &ipSettingsRequest{
+		ipv4: versions.V4Enabled(),
+		ipv6: versions.V6Enabled(),
+	}
+	g.last.mu.Lock()
+	req.lastAddresses = ipStrings(g.last.ips)
+	g.last.mu.Unlock()
+
+	resp := new(addressList)
+	err := g.conn.Invoke(ctx, grpcGetIPs, req, resp, grpc.ForceCodec(protoCodec{}))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("%w: %w", ErrTimeout, err)
+		}
+		g.logger.Error("calling resolver failed",
+			zap.String("address", g.Address),
+			zap.Error(err))
+		return nil, fmt.Errorf("calling resolver %s: %w", g.Address, err)
+	}
+
+	ips := make([]net.IP, 0, len(resp.addresses))
+	for _, addr := range resp.addresses {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			g.logger.Error("resolver returned an invalid address",
+				zap.String("address", g.Address),
+				zap.Strings("addresses", resp.addresses))
+			return nil, fmt.Errorf("invalid IP: %s", addr)
+		}
+		ips = append(ips, ip)
+	}
+	ips = filterVersions(ips, versions)
+
+	g.last.mu.Lock()
+	g.last.ips = ips
+	g.last.mu.Unlock()
+	return ips, nil
+}
+
+// ipSettingsRequest is the IPSettingsRequest message of ipsource.proto.
+type ipSettingsRequest struct {
+	ipv4          bool
+	ipv6          bool
+	lastAddresses []string
+}
+
+func (r *ipSettingsRequest) marshal() []byte {
+	var b []byte
+	if r.ipv4 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if r.ipv6 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	for _, addr := range r.lastAddresses {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, addr)
+	}
+	return b
+}
+
+func (r *ipSettingsRequest) unmarshal(b []byte) error {
+	*r = ipSettingsRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case (num == 1 || num == 2) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if num == 1 {
+				r.ipv4 = v != 0
+			} else {
+				r.ipv6 = v != 0
+			}
+			return n, nil
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			r.lastAddresses = append(r.lastAddresses, v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// addressList is the AddressList message of ipsource.proto.
+type addressList struct {
+	addresses []string
+}
+
+func (l *addressList) marshal() []byte {
+	var b []byte
+	for _, addr := range l.addresses {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, addr)
+	}
+	return b
+}
+
+func (l *addressList) unmarshal(b []byte) error {
+	*l = addressList{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			l.addresses = append(l.addresses, v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// consumeFields calls field for every field of the protobuf
+// message b, which returns the length of the field's value.
+func consumeFields(b []byte, field func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// protoMessage is a message of ipsource.proto.
+type protoMessage interface {
+	marshal() []byte
+	unmarshal([]byte) error
+}
+
+// protoCodec encodes the messages of ipsource.proto in the
+// protobuf wire format, without generated code.
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(protoMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return msg.marshal(), nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v any) error {
+	msg, ok := v.(protoMessage)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	return msg.unmarshal(data)
+}
+
+// Name is the content subtype, the same as
+// of the generated code of other languages.
+func (protoCodec) Name() string { return "proto" }
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*GRPC)(nil)
+	_ caddy.Provisioner     = (*GRPC)(nil)
+	_ caddy.CleanerUpper    = (*GRPC)(nil)
+	_ caddyfile.Unmarshaler = (*GRPC)(nil)
+)
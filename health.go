@@ -0,0 +1,246 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// The events emitted when a source crossed its failure
+// threshold and when it succeeded again afterwards.
+const (
+	EventSourceUnhealthy = "source_unhealthy"
+	EventSourceHealthy   = "source_healthy"
+)
+
+// HealthStatus is the status of a source.
+type HealthStatus string
+
+const (
+	// The last lookup succeeded, or none ran yet.
+	HealthHealthy HealthStatus = "healthy"
+
+	// The last lookup failed, but fewer lookups in a row
+	// than the failure threshold.
+	HealthDegraded HealthStatus = "degraded"
+
+	// As many lookups in a row as the failure threshold failed.
+	HealthFailing HealthStatus = "failing"
+)
+
+// Health is the health of a source.
+type Health struct {
+	Status HealthStatus `json:"status"`
+
+	// How many lookups in a row failed.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	// When the last lookup succeeded and failed, if ever.
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+
+	// The error of the last failed lookup.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// HealthReporter is an IP source that tracks its health,
+// which other modules may query, e.g. to report it.
+type HealthReporter interface {
+	Health() Health
+}
+
+// health tracks the outcomes of the lookups of a source.
+type health struct {
+	mu          sync.Mutex
+	failures    int
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+// success records a successful lookup and reports whether the
+// source recovered from failing by threshold failures in a row.
+func (h *health) success(threshold int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	recovered := threshold > 0 && h.failures >= threshold
+	h.failures = 0
+	h.lastSuccess = time.Now()
+	return recovered
+}
+
+// failure records a failed lookup and reports whether it made
+// threshold lookups in a row fail.
+func (h *health) failure(err error, threshold int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	h.lastFailure = time.Now()
+	h.lastError = err.Error()
+	return threshold > 0 && h.failures == threshold
+}
+
+// get returns the health by the failure threshold.
+func (h *health) get(threshold int) Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := Health{
+		Status:              HealthHealthy,
+		ConsecutiveFailures: h.failures,
+		LastError:           h.lastError,
+	}
+	switch {
+	case threshold > 0 && h.failures >= threshold:
+		out.Status = HealthFailing
+	case h.failures > 0:
+		out.Status = HealthDegraded
+	}
+	if !h.lastSuccess.IsZero() {
+		t := h.lastSuccess
+		out.LastSuccess = &t
+	}
+	if !h.lastFailure.IsZero() {
+		t := h.lastFailure
+		out.LastFailure = &t
+	}
+	return out
+}
+
+// Health returns the health of the source. It is kept
+// across reloads, like the cached addresses.
+func (c Command) Health() Health {
+	return c.state.health.get(c.FailureThreshold)
+}
+
+// provisionHealth checks the failure threshold.
+func (c *Command) provisionHealth() error {
+	if c.FailureThreshold < 0 {
+		return fmt.Errorf("invalid failure_threshold %d", c.FailureThreshold)
+	}
+	return nil
+}
+
+// recordSuccess records a successful lookup.
+func (c Command) recordSuccess() {
+	if !c.state.health.success(c.FailureThreshold) {
+		return
+	}
+	c.logger.Info("source is healthy again",
+		zap.String("command", c.Cmd))
+	c.emitHealth(EventSourceHealthy, nil)
+}
+
+// recordFailure records a failed lookup.
+func (c Command) recordFailure(err error) {
+	if !c.state.health.failure(err, c.FailureThreshold) {
+		return
+	}
+	c.logger.Error("source is unhealthy",
+		zap.String("command", c.Cmd),
+		zap.Int("consecutive_failures", c.FailureThreshold),
+		zap.Error(err))
+	c.emitHealth(EventSourceUnhealthy, err)
+}
+
+// emitHealth announces a change of the health. In watch mode, it
+// is announced by the source of the config loaded last, like the
+// addresses.
+func (c Command) emitHealth(event string, err error) {
+	emitter := &c
+	if c.Watch {
+		emitter = c.carried.owner()
+	}
+	if emitter == nil || emitter.events == nil {
+		return
+	}
+	data := map[string]any{
+		"command":              c.Cmd,
+		"consecutive_failures": c.FailureThreshold,
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	emitter.events.Emit(emitter.ctx, event, c.labeled(data))
+}
+
+// healthResult is the health of a command source.
+type healthResult struct {
+	Label   string   `json:"label,omitempty"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Health
+	History []run             `json:"history,omitempty"`
+	Output  []capturedOutput  `json:"output,omitempty"`
+	Watch   *SupervisorStatus `json:"watch,omitempty"`
+}
+
+// healthResult returns the health of c, with its history,
+// the captured output and the status of the watch command.
+func (c Command) healthResult() healthResult {
+	result := healthResult{
+		Label:   c.Label,
+		Command: c.Cmd,
+		Args:    c.redactArgs(c.Args),
+		Health:  c.Health(),
+		History: c.state.history.get(),
+		Output:  c.state.capture.get(),
+	}
+	if c.Watch {
+		status := c.watchState.supervisor.status()
+		result.Watch = &status
+	}
+	return result
+}
+
+// handleHealth returns the health of the command sources,
+// with status 503 if one of them is failing.
+func (adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	query := r.URL.Query()
+
+	instances.mu.Lock()
+	var results []healthResult
+	for _, c := range instances.byID {
+		if c.selected(query) {
+			results = append(results, c.healthResult())
+		}
+	}
+	instances.mu.Unlock()
+
+	if len(results) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no command source found"),
+		}
+	}
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Status == HealthFailing {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(results)
+}
+
+// Interface guards
+var (
+	_ HealthReporter = (*Command)(nil)
+)
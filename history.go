@@ -0,0 +1,87 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// run is the outcome of a lookup, as kept in the history.
+type run struct {
+	Time       time.Time `json:"time"`
+	RunID      string    `json:"run_id"`
+	DurationMS int64     `json:"duration_ms"`
+
+	// the exit code of the failed command, 0 if the lookup
+	// succeeded, and nil if it failed without one, e.g.
+	// because the output could not be parsed
+	ExitCode *int `json:"exit_code,omitempty"`
+
+	IPs   []string `json:"ips,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// history is a ring buffer of the last lookups of a source.
+type history struct {
+	mu   sync.Mutex
+	runs []run
+}
+
+// add adds r, dropping the oldest runs beyond size.
+func (h *history) add(r run, size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.runs) >= size {
+		// the size may have shrunk by a reload
+		n := copy(h.runs, h.runs[len(h.runs)-size+1:])
+		h.runs = h.runs[:n]
+	}
+	h.runs = append(h.runs, r)
+}
+
+// get returns the runs, the oldest first.
+func (h *history) get() []run {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]run(nil), h.runs...)
+}
+
+// provisionHistory checks the size of the history.
+func (c *Command) provisionHistory() error {
+	if c.History < 0 {
+		return fmt.Errorf("invalid history %d", c.History)
+	}
+	return nil
+}
+
+// recordRun adds the lookup that started at start and returned
+// ips or failed with err to the history, if it is kept.
+func (c Command) recordRun(start time.Time, ips []net.IP, err error) {
+	if c.History == 0 {
+		return
+	}
+	r := run{
+		Time:       start,
+		RunID:      c.runID,
+		DurationMS: time.Since(start).Milliseconds(),
+		IPs:        ipStrings(ips),
+	}
+	var cmdErr *commandError
+	switch {
+	case err == nil:
+		r.ExitCode = new(int)
+	case errors.As(err, &cmdErr):
+		r.ExitCode = &cmdErr.exitCode
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	c.state.history.add(r, c.History)
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/mietzen/caddy-dynamicdns-cmd-source/executil"
+	"go.uber.org/zap"
+)
+
+// Exec is a command to execute.
+type Exec struct {
+	// The command to execute.
+	Cmd string `json:"command,omitempty"`
+
+	// Arguments to the command. Placeholders, including
+	// {file.<path>}, are expanded in arguments.
+	Args []string `json:"args,omitempty"`
+
+	// The directory in which to run the command. Global
+	// placeholders, like {env.HOME}, are expanded.
+	Dir string `json:"dir,omitempty"`
+
+	// How long to wait for the command to terminate
+	// before forcefully closing it. Default: 30s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// whether this is the main command, whose output is passed
+	// through the pipeline and which gets the stdin payload
+	main bool
+}
+
+// Hook is a command that runs before or after the lookup,
+// e.g. to bring up a route that is required for the lookup
+// and tear it down afterwards.
+type Hook struct {
+	Exec
+
+	// If true, a failing hook is logged but does
+	// not fail the lookup.
+	IgnoreErrors bool `json:"ignore_errors,omitempty"`
+}
+
+// unmarshalExec parses a command from the current
+// position of d. Syntax:
+//
+//	<command> <args...> {
+//	    args <args...>
+//	    dir <path>
+//	    timeout <duration>
+//	}
+func unmarshalExec(d *caddyfile.Dispenser) (*Exec, error) {
+	e := new(Exec)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	e.Cmd = d.Val()
+	e.Args = d.RemainingArgs()
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		ok, err := e.unmarshalSubdirective(d)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, d.Errf("unrecognized subdirective '%s'", d.Val())
+		}
+	}
+	return e, nil
+}
+
+// unmarshalSubdirective parses the subdirective at the current
+// position of d, if it is one of e's. It returns true if it was.
+func (e *Exec) unmarshalSubdirective(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "args":
+		args, err := unmarshalArgs(d)
+		if err != nil {
+			return true, err
+		}
+		e.Args = append(e.Args, args...)
+
+	case "dir":
+		if !d.AllArgs(&e.Dir) {
+			return true, d.ArgErr()
+		}
+
+	case "timeout":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid timeout '%s': %v", d.Val(), err)
+		}
+		e.Timeout = caddy.Duration(dur)
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// provision sets the defaults of the command
+// and expands the placeholders in its dir.
+func (e *Exec) provision() {
+	e.Dir = expandDir(e.Dir)
+	if e.Timeout <= 0 {
+		e.Timeout = caddy.Duration(30 * time.Second)
+	}
+}
+
+// unmarshalHook parses a hook from the current position
+// of d. Syntax:
+//
+//	<command> <args...> {
+//	    args <args...>
+//	    dir <path>
+//	    timeout <duration>
+//	    ignore_errors
+//	}
+func unmarshalHook(d *caddyfile.Dispenser) (*Hook, error) {
+	h := new(Hook)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	h.Cmd = d.Val()
+	h.Args = d.RemainingArgs()
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		ok, err := h.unmarshalSubdirective(d)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+
+		switch d.Val() {
+		case "ignore_errors":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			h.IgnoreErrors = true
+
+		default:
+			return nil, d.Errf("unrecognized hook subdirective '%s'", d.Val())
+		}
+	}
+	return h, nil
+}
+
+// runHook runs the hook h named name. The error is only
+// returned if the hook must not fail.
+func (c Command) runHook(ctx context.Context, name string, h *Hook, env []string) error {
+	if h == nil {
+		return nil
+	}
+
+	expandedArgs, loggedArgs, err := expandArgs(h.Args)
+	if err == nil {
+		c.logger.Debug("running hook",
+			zap.String("hook", name),
+			zap.String("command", h.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("dir", h.Dir))
+	}
+
+	var stdout, stderr []byte
+	if err == nil {
+		stdout, stderr, err = c.run(ctx, h.Cmd, expandedArgs, h.Dir, env, time.Duration(h.Timeout))
+	}
+	if err == nil {
+		return nil
+	}
+
+	c.logger.Error("hook failed",
+		zap.String("hook", name),
+		zap.String("command", h.Cmd),
+		zap.Strings("args", loggedArgs),
+		zap.String("dir", h.Dir),
+		zap.String("stdout", string(stdout)),
+		zap.String("stderr", string(stderr)),
+		zap.Bool("ignored", h.IgnoreErrors),
+		zap.Error(err))
+	if h.IgnoreErrors {
+		return nil
+	}
+	return fmt.Errorf("%s hook %s: %v", name, h.Cmd, err)
+}
+
+// run executes name with args in dir and returns what it wrote to
+// stdout and stderr. The process is killed after timeout, if > 0.
+// The environment is the one of processEnv, extended by env. If
+// MaxProcesses is set, it first waits until the process may be
+// started.
+func (c Command) run(ctx context.Context, name string, args []string, dir string, env []string, timeout time.Duration) ([]byte, []byte, error) {
+	return c.runInput(ctx, name, args, dir, env, timeout, nil)
+}
+
+// runInput is like run, but passes stdin to the process.
+func (c Command) runInput(ctx context.Context, name string, args []string, dir string, env []string, timeout time.Duration, stdin []byte) ([]byte, []byte, error) {
+	ctx, done := c.children.start(ctx)
+	defer done()
+
+	release, err := c.semaphore.acquire(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("waiting to start %s: %w", name, err)
+	}
+	defer release()
+
+	ec, err := c.command(name, args, dir, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	ec.Stdin = stdin
+	ec.Timeout = timeout
+	return executil.Run(ctx, ec)
+}
+
+// command prepares the process running name in dir with env
+// added to its environment, and in the chroot, through the
+// privilege wrapper or with the raw command line, if configured.
+func (c Command) command(name string, args []string, dir string, env []string) (executil.Command, error) {
+	// resolve relative paths against dir ourselves, so that
+	// errors and logs name the file that is actually run
+	path := name
+	if c.Chroot == "" {
+		var err error
+		path, err = c.lookPath(name, dir)
+		if err != nil {
+			return executil.Command{}, err
+		}
+	}
+
+	path, args = c.wrap(path, args)
+	ec := executil.Command{
+		Path: path,
+		Args: args,
+		Dir:  dir,
+		Env:  c.processEnv(env),
+		Started: func(pid int) {
+			c.applyPriority(name, pid)
+		},
+		Exited: func(state *os.ProcessState) {
+			c.reportUsage(name, state)
+		},
+		Logger: c.logger,
+	}
+	if c.wrapper != "" {
+		// the wrapper passes an interrupt on to the command, which
+		// runs as another user, while killing it would leave the
+		// command running
+		ec.Interrupt = true
+		ec.WaitDelay = privilegeWaitDelay
+	}
+	if c.RawCommandLine {
+		ec.SysProcAttr = rawCommandLineAttr(path, args)
+	}
+	if c.Chroot != "" {
+		ec.SysProcAttr = chrootAttr(c.Chroot)
+		if dir == "" {
+			// the working directory must be in the chroot
+			ec.Dir = "/"
+		}
+	}
+	return ec, nil
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(HTTP{})
+}
+
+// httpPreset describes a public service that returns
+// the address a request comes from.
+type httpPreset struct {
+	ipv4Endpoint string
+	ipv6Endpoint string
+	jsonPath     string
+}
+
+// httpPresets are the services selectable by Provider.
+var httpPresets = map[string]httpPreset{
+	"ipify": {
+		ipv4Endpoint: "https://api.ipify.org",
+		ipv6Endpoint: "https://api6.ipify.org",
+	},
+	"icanhazip": {
+		ipv4Endpoint: "https://ipv4.icanhazip.com",
+		ipv6Endpoint: "https://ipv6.icanhazip.com",
+	},
+	"ifconfig_co": {
+		ipv4Endpoint: "https://ifconfig.co/json",
+		ipv6Endpoint: "https://ifconfig.co/json",
+		jsonPath:     "ip",
+	},
+	"seeip": {
+		ipv4Endpoint: "https://api.seeip.org/jsonip",
+		ipv6Endpoint: "https://api.seeip.org/jsonip",
+		jsonPath:     "ip",
+	},
+}
+
+// HTTP is an IP source that looks up the public IP addresses by
+// asking a web service which address a request comes from.
+//
+// The IPv4 and the IPv6 address are looked up separately, each by
+// a request that is only sent over the respective IP version, so
+// services that answer on both return the right address. If only
+// one of them can be looked up, e.g. because there is no IPv6
+// connectivity, the other one is returned and a warning is logged.
+type HTTP struct {
+	// A well-known service to use, which sets the endpoints and
+	// how to parse the responses: ipify, icanhazip, ifconfig_co
+	// or seeip. The settings below override the ones of the
+	// provider.
+	Provider string `json:"provider,omitempty"`
+
+	// The URL that returns the IPv4 address.
+	IPv4Endpoint string `json:"ipv4_endpoint,omitempty"`
+
+	// The URL that returns the IPv6 address.
+	IPv6Endpoint string `json:"ipv6_endpoint,omitempty"`
+
+	// Extract the address from a JSON response by a dot separated
+	// path of object keys and array indexes, like the json_path of
+	// the command source. Default: the response is the address
+	JSONPath string `json:"json_path,omitempty"`
+
+	// How long to wait for each request. Default: 10s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Add a random query parameter to every request and ask
+	// caches not to answer it, so that a CDN in front of the
+	// service does not return the address of an earlier request.
+	CacheBust bool `json:"cache_bust,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	clients map[string]*http.Client
+	logger  *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (HTTP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.http",
+		New: func() caddy.Module { return new(HTTP) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	http [<provider>] {
+//	    provider ipify|icanhazip|ifconfig_co|seeip
+//	    ipv4_endpoint <url>
+//	    ipv6_endpoint <url>
+//	    json_path <path>
+//	    timeout <duration>
+//	    cache_bust
+//	    filter <name> ...
+//	}
+func (h *HTTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			h.Provider = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "provider":
+				err = singleArg(d, &h.Provider)
+			case "ipv4_endpoint":
+				err = singleArg(d, &h.IPv4Endpoint)
+			case "ipv6_endpoint":
+				err = singleArg(d, &h.IPv6Endpoint)
+			case "json_path":
+				err = singleArg(d, &h.JSONPath)
+			case "timeout":
+				err = durationArg(d, &h.Timeout)
+			case "cache_bust":
+				if d.NextArg() {
+					err = d.ArgErr()
+				}
+				h.CacheBust = true
+			case "filter":
+				err = h.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (h *HTTP) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	if err := h.Filters.load(ctx); err != nil {
+		return err
+	}
+	if h.Provider != "" {
+		preset, ok := httpPresets[h.Provider]
+		if !ok {
+			var names []string
+			for name := range httpPresets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown provider %s, must be one of %s", h.Provider, strings.Join(names, ", "))
+		}
+		if h.IPv4Endpoint == "" {
+			h.IPv4Endpoint = preset.ipv4Endpoint
+		}
+		if h.IPv6Endpoint == "" {
+			h.IPv6Endpoint = preset.ipv6Endpoint
+		}
+		if h.JSONPath == "" {
+			h.JSONPath = preset.jsonPath
+		}
+	}
+	if h.IPv4Endpoint == "" && h.IPv6Endpoint == "" {
+		return fmt.Errorf("a provider or an endpoint is required")
+	}
+	for _, endpoint := range []string{h.IPv4Endpoint, h.IPv6Endpoint} {
+		if endpoint == "" {
+			continue
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid endpoint %s: must be an http or https URL", endpoint)
+		}
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = caddy.Duration(10 * time.Second)
+	}
+
+	h.clients = make(map[string]*http.Client)
+	for _, network := range []string{"tcp4", "tcp6"} {
+		network := network
+		dialer := &net.Dialer{}
+		h.clients[network] = &http.Client{
+			Timeout: time.Duration(h.Timeout),
+			Transport: &http.Transport{
+				// a proxy would see the request coming
+				// from this machine, not the service
+				Proxy: nil,
+				DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+			},
+		}
+	}
+	return nil
+}
+
+// GetIPs gets the public addresses of this machine.
+func (h HTTP) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return h.Filters.apply(h.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (h HTTP) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	var ips []net.IP
+	var lastErr error
+	for _, family := range []struct {
+		enabled  bool
+		network  string
+		endpoint string
+	}{
+		{versions.V4Enabled(), "tcp4", h.IPv4Endpoint},
+		{versions.V6Enabled(), "tcp6", h.IPv6Endpoint},
+	} {
+		if !family.enabled || family.endpoint == "" {
+			continue
+		}
+		ip, err := h.lookup(ctx, family.network, family.endpoint)
+		if err != nil {
+			h.logger.Warn("looking up address failed",
+				zap.String("endpoint", family.endpoint),
+				zap.String("network", family.network),
+				zap.Error(err))
+			lastErr = err
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return ips, nil
+}
+
+// lookup requests endpoint over network and returns the
+// address in the response, which must be of that network.
+func (h HTTP) lookup(ctx context.Context, network, endpoint string) (net.IP, error) {
+	reqURL := endpoint
+	var header http.Header
+	if h.CacheBust {
+		reqURL = withCacheBust(endpoint)
+		header = http.Header{
+			"Cache-Control": {"no-cache"},
+			"Pragma":        {"no-cache"},
+		}
+	}
+	body, err := apiRequest(ctx, h.clients[network], http.MethodGet, reqURL, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := string(body)
+	if h.JSONPath != "" {
+		addr, err = extractJSONPath(body, h.JSONPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: json_path %s: %v", endpoint, h.JSONPath, err)
+		}
+	}
+	addrs, err := ParseOutput([]byte(addr), ParseOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", endpoint, err)
+	}
+	if len(addrs) != 1 {
+		return nil, fmt.Errorf("%s: returned %d addresses instead of one", endpoint, len(addrs))
+	}
+	ip := net.IP(addrs[0].AsSlice())
+	if addrs[0].Is4() != (network == "tcp4") {
+		return nil, fmt.Errorf("%s: returned %s for a request over %s", endpoint, ip, network)
+	}
+	return ip, nil
+}
+
+// withCacheBust returns endpoint with a random value in
+// the _ query parameter, which no cache has an answer for.
+func withCacheBust(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		// checked when provisioning
+		return endpoint
+	}
+	q := u.Query()
+	q.Set("_", newRunID())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*HTTP)(nil)
+	_ caddy.Provisioner     = (*HTTP)(nil)
+	_ caddyfile.Unmarshaler = (*HTTP)(nil)
+)
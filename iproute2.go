@@ -0,0 +1,63 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ipLink is an interface in the JSON output of `ip -j addr`.
+type ipLink struct {
+	IfName   string       `json:"ifname"`
+	AddrInfo []ipAddrInfo `json:"addr_info"`
+}
+
+// ipAddrInfo is an address in the JSON output of `ip -j addr`.
+type ipAddrInfo struct {
+	Family     string `json:"family"`
+	Local      string `json:"local"`
+	PrefixLen  int    `json:"prefixlen"`
+	Scope      string `json:"scope"`
+	Deprecated bool   `json:"deprecated"`
+	Tentative  bool   `json:"tentative"`
+	Temporary  bool   `json:"temporary"`
+
+	// in seconds, 4294967295 meaning forever
+	PreferredLifeTime uint64 `json:"preferred_life_time"`
+}
+
+// iproute2Tokens returns the addresses in the JSON output of
+// iproute2's `ip -j addr`, filtered by interface, scope and
+// the flags of the addresses.
+func (o ParseOptions) iproute2Tokens(output string) ([]token, error) {
+	var links []ipLink
+	if err := json.Unmarshal([]byte(output), &links); err != nil {
+		return nil, fmt.Errorf("parsing ip -j addr output: %v", err)
+	}
+
+	var tokens []token
+	for _, link := range links {
+		if o.Interface != "" && link.IfName != o.Interface {
+			continue
+		}
+		for _, addr := range link.AddrInfo {
+			if o.Scope != "" && addr.Scope != o.Scope {
+				continue
+			}
+			if addr.Tentative || (o.SkipDeprecated && addr.Deprecated) || (o.SkipTemporary && addr.Temporary) {
+				continue
+			}
+			switch addr.Family {
+			case "inet":
+				tokens = append(tokens, token{value: addr.Local, label: "ipv4", lifetime: addr.PreferredLifeTime, prefixLen: addr.PrefixLen})
+			case "inet6":
+				tokens = append(tokens, token{value: addr.Local, label: "ipv6", lifetime: addr.PreferredLifeTime, prefixLen: addr.PrefixLen})
+			}
+		}
+	}
+	return tokens, nil
+}
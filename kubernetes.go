@@ -0,0 +1,587 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	caddy.RegisterModule(Kubernetes{})
+}
+
+// The files of the service account mounted into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Kubernetes is an IP source that looks up the public IP addresses by
+// executing a command inside a Kubernetes pod, e.g. an egress gateway
+// which is the only workload that sees the real public address. The
+// command is executed through the API server, like `kubectl exec`.
+//
+// The command must return the IP addresses comma or whitespace
+// separated in plain text.
+type Kubernetes struct {
+	// The command to execute in the pod.
+	Cmd string `json:"command,omitempty"`
+
+	// Arguments to the command.
+	Args []string `json:"args,omitempty"`
+
+	// The kubeconfig file to authenticate with. If empty, the
+	// service account of the pod Caddy runs in is used, if any,
+	// or else $KUBECONFIG or ~/.kube/config.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+
+	// The context of the kubeconfig to use.
+	// Default: the current context
+	Context string `json:"context,omitempty"`
+
+	// The namespace of the pod. Default: the namespace of the
+	// kubeconfig context or service account, or "default"
+	Namespace string `json:"namespace,omitempty"`
+
+	// The name of the pod.
+	Pod string `json:"pod,omitempty"`
+
+	// A label selector, like "app=egress-gateway", to select
+	// the pod by, instead of its name. The first running pod
+	// matching it is used.
+	Selector string `json:"selector,omitempty"`
+
+	// The container of the pod to execute the command in.
+	// Default: the default container of the pod
+	Container string `json:"container,omitempty"`
+
+	// How long to wait for the command to terminate. Default: 30s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	cluster *kubeCluster
+	client  *http.Client
+	logger  *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Kubernetes) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.kubernetes",
+		New: func() caddy.Module { return new(Kubernetes) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	kubernetes <command> <args...> {
+//	    kubeconfig <path>
+//	    context <name>
+//	    namespace <namespace>
+//	    pod <name>
+//	    selector <label selector>
+//	    container <name>
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (k *Kubernetes) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		k.Cmd = d.Val()
+		k.Args = d.RemainingArgs()
+
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "kubeconfig":
+				err = singleArg(d, &k.Kubeconfig)
+			case "context":
+				err = singleArg(d, &k.Context)
+			case "namespace":
+				err = singleArg(d, &k.Namespace)
+			case "pod":
+				err = singleArg(d, &k.Pod)
+			case "selector":
+				err = singleArg(d, &k.Selector)
+			case "container":
+				err = singleArg(d, &k.Container)
+			case "timeout":
+				err = durationArg(d, &k.Timeout)
+			case "filter":
+				err = k.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (k *Kubernetes) Provision(ctx caddy.Context) error {
+	k.logger = ctx.Logger(k)
+	if err := k.Filters.load(ctx); err != nil {
+		return err
+	}
+
+	if k.Timeout <= 0 {
+		k.Timeout = caddy.Duration(30 * time.Second)
+	}
+	if (k.Pod == "") == (k.Selector == "") {
+		return fmt.Errorf("either pod or selector must be set")
+	}
+
+	cluster, err := loadKubeCluster(k.Kubeconfig, k.Context)
+	if err != nil {
+		return err
+	}
+	k.cluster = cluster
+	if k.Namespace == "" {
+		k.Namespace = cluster.namespace
+	}
+	k.client = &http.Client{Transport: &http.Transport{TLSClientConfig: cluster.tlsConfig}}
+
+	return nil
+}
+
+// Cleanup closes the idle connections to the API server.
+func (k *Kubernetes) Cleanup() error {
+	if k.client != nil {
+		k.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// GetIPs gets the public addresses of this machine.
+func (k Kubernetes) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return k.Filters.apply(k.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (k Kubernetes) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(k.Timeout))
+	defer cancel()
+
+	pod := k.Pod
+	if pod == "" {
+		var err error
+		pod, err = k.selectPod(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	k.logger.Debug("executing command in pod",
+		zap.String("namespace", k.Namespace),
+		zap.String("pod", pod),
+		zap.String("container", k.Container),
+		zap.String("command", k.Cmd),
+		zap.Strings("args", k.Args))
+
+	stdout, stderr, err := k.exec(ctx, pod)
+	if err != nil || len(stderr) > 0 {
+		k.logger.Error("command execution failed",
+			zap.String("namespace", k.Namespace),
+			zap.String("pod", pod),
+			zap.String("command", k.Cmd),
+			zap.Strings("args", k.Args),
+			zap.String("stdout", string(stdout)),
+			zap.String("stderr", string(stderr)),
+			zap.Error(err))
+		if err == nil {
+			err = fmt.Errorf("command %s wrote to stderr", k.Cmd)
+		}
+		return nil, err
+	}
+
+	ips, err := parseIPList(string(stdout))
+	if err != nil {
+		k.logger.Error("parsing ip failed",
+			zap.String("pod", pod),
+			zap.String("command", k.Cmd),
+			zap.String("stdout", string(stdout)),
+			zap.Error(err))
+		return nil, err
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// selectPod returns the name of the first running
+// pod that matches the label selector.
+func (k Kubernetes) selectPod(ctx context.Context) (string, error) {
+	query := url.Values{
+		"labelSelector": {k.Selector},
+		"fieldSelector": {"status.phase=Running"},
+	}
+	endpoint := k.cluster.server + "/api/v1/namespaces/" + url.PathEscape(k.Namespace) + "/pods?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	k.cluster.authorize(req.Header)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("listing pods: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("listing pods: %s: %s", resp.Status, body)
+	}
+
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("decoding pod list: %v", err)
+	}
+	if len(list.Items) == 0 {
+		return "", fmt.Errorf("no running pod in namespace %s matches %s", k.Namespace, k.Selector)
+	}
+	return list.Items[0].Metadata.Name, nil
+}
+
+// The channels of the Kubernetes streaming protocol.
+const (
+	kubeStdout = 1
+	kubeStderr = 2
+	kubeError  = 3
+)
+
+// exec executes the command in pod and returns its output.
+func (k Kubernetes) exec(ctx context.Context, pod string) ([]byte, []byte, error) {
+	query := url.Values{
+		"command": append([]string{k.Cmd}, k.Args...),
+		"stdout":  {"true"},
+		"stderr":  {"true"},
+	}
+	if k.Container != "" {
+		query.Set("container", k.Container)
+	}
+	endpoint := k.cluster.server + "/api/v1/namespaces/" + url.PathEscape(k.Namespace) +
+		"/pods/" + url.PathEscape(pod) + "/exec?" + query.Encode()
+	wsEndpoint := "wss" + strings.TrimPrefix(endpoint, "https")
+	if strings.HasPrefix(endpoint, "http:") {
+		wsEndpoint = "ws" + strings.TrimPrefix(endpoint, "http")
+	}
+
+	config, err := websocket.NewConfig(wsEndpoint, k.cluster.server)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Protocol = []string{"v4.channel.k8s.io"}
+	config.TlsConfig = k.cluster.tlsConfig
+	config.Header = http.Header{}
+	k.cluster.authorize(config.Header)
+	if deadline, ok := ctx.Deadline(); ok {
+		config.Dialer = &net.Dialer{Deadline: deadline}
+	}
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to pod %s: %v", pod, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var stdout, stderr bytes.Buffer
+	var status []byte
+	for {
+		var msg []byte
+		err := websocket.Message.Receive(conn, &msg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stdout.Bytes(), stderr.Bytes(), fmt.Errorf("reading from pod %s: %v", pod, err)
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case kubeStdout:
+			stdout.Write(msg[1:])
+		case kubeStderr:
+			stderr.Write(msg[1:])
+		case kubeError:
+			status = append(status, msg[1:]...)
+		}
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), kubeStatusError(status)
+}
+
+// kubeStatusError returns the error described by the
+// status the API server sends when the command exits.
+func kubeStatusError(status []byte) error {
+	if len(status) == 0 {
+		return nil
+	}
+	var s struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(status, &s); err != nil {
+		return fmt.Errorf("decoding exec status: %v", err)
+	}
+	if s.Status == "Success" {
+		return nil
+	}
+	return errors.New(s.Message)
+}
+
+// kubeCluster is how to connect to a Kubernetes API server.
+type kubeCluster struct {
+	server    string
+	tlsConfig *tls.Config
+	token     string
+	tokenFile string
+	namespace string
+}
+
+// authorize adds the bearer token, if any, to header.
+func (kc *kubeCluster) authorize(header http.Header) {
+	token := kc.token
+	if kc.tokenFile != "" {
+		// service account tokens are rotated, so always read the current one
+		if b, err := os.ReadFile(kc.tokenFile); err == nil {
+			token = strings.TrimSpace(string(b))
+		}
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// loadKubeCluster loads the connection to the API server
+// from kubeconfig, or from the service account of the pod
+// if kubeconfig is empty and Caddy runs in a cluster.
+func loadKubeCluster(kubeconfig, context string) (*kubeCluster, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if kubeconfig == "" && host != "" && port != "" {
+		return loadInClusterConfig(host, port)
+	}
+	if kubeconfig == "" {
+		kubeconfig = os.Getenv("KUBECONFIG")
+	}
+	if kubeconfig == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("no kubeconfig: %v", err)
+		}
+		kubeconfig = filepath.Join(home, ".kube", "config")
+	}
+	return loadKubeconfig(kubeconfig, context)
+}
+
+// loadInClusterConfig loads the connection to
+// the API server from the pod's service account.
+func loadInClusterConfig(host, port string) (*kubeCluster, error) {
+	caCert, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates in service account CA")
+	}
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		namespace = []byte("default")
+	}
+	return &kubeCluster{
+		server:    "https://" + net.JoinHostPort(host, port),
+		tlsConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		namespace: strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+// kubeconfig is the subset of a kubeconfig file that is supported.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Exec                  any    `yaml:"exec"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// loadKubeconfig loads the connection to the API server from
+// the kubeconfig file at path, using the given context or, if
+// empty, the current context. Only token and client certificate
+// authentication are supported.
+func loadKubeconfig(path, context string) (*kubeCluster, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading kubeconfig: %v", err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("parsing kubeconfig %s: %v", path, err)
+	}
+	// relative paths in a kubeconfig are relative to the file
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	if context == "" {
+		context = kc.CurrentContext
+	}
+	cluster := &kubeCluster{namespace: "default"}
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == context {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			if c.Context.Namespace != "" {
+				cluster.namespace = c.Context.Namespace
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in kubeconfig %s", context, path)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		cluster.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+
+		caPEM, err := kubeconfigData(c.Cluster.CertificateAuthorityData, resolve(c.Cluster.CertificateAuthority))
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate authority of cluster %s: %v", clusterName, err)
+		}
+		if caPEM != nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no certificates in certificate authority of cluster %s", clusterName)
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig %s", clusterName, path)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.Exec != nil {
+			return nil, fmt.Errorf("exec credential plugins of user %s are not supported", userName)
+		}
+		cluster.token = u.User.Token
+		cluster.tokenFile = resolve(u.User.TokenFile)
+
+		certPEM, err := kubeconfigData(u.User.ClientCertificateData, resolve(u.User.ClientCertificate))
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate of user %s: %v", userName, err)
+		}
+		keyPEM, err := kubeconfigData(u.User.ClientKeyData, resolve(u.User.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("loading client key of user %s: %v", userName, err)
+		}
+		if certPEM != nil && keyPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate of user %s: %v", userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	cluster.tlsConfig = tlsConfig
+	return cluster, nil
+}
+
+// kubeconfigData returns the base64 encoded data or, if
+// empty, the contents of the file at path, if any.
+func kubeconfigData(data, path string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	return nil, nil
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*Kubernetes)(nil)
+	_ caddy.Provisioner     = (*Kubernetes)(nil)
+	_ caddy.CleanerUpper    = (*Kubernetes)(nil)
+	_ caddyfile.Unmarshaler = (*Kubernetes)(nil)
+)
@@ -0,0 +1,36 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// provisionLabel checks the label and adds it to the log
+// entries of the source.
+func (c *Command) provisionLabel() error {
+	if c.Label == "" {
+		return nil
+	}
+	if strings.IndexFunc(c.Label, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("invalid label %q: must not contain whitespace", c.Label)
+	}
+	c.logger = c.logger.With(zap.String("label", c.Label))
+	return nil
+}
+
+// labeled adds the label of the source, if any,
+// to the data of an event or webhook.
+func (c Command) labeled(data map[string]any) map[string]any {
+	if c.Label != "" {
+		data["label"] = c.Label
+	}
+	return data
+}
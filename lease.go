@@ -0,0 +1,280 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Lease{})
+}
+
+// The supported lease file formats.
+const (
+	LeaseDhclient = "dhclient"
+	LeaseDhcpcd   = "dhcpcd"
+	LeasePPP      = "ppp"
+)
+
+// Lease is an IP source that reads the WAN address from the state
+// a DHCP or PPP client leaves on disk, which is instant and works
+// offline, unlike asking an HTTP echo service.
+//
+// The supported formats are:
+//
+//   - dhclient: the fixed-address of the newest unexpired lease
+//     in an ISC dhclient lease file.
+//   - dhcpcd: the address in a dhcpcd lease file, which holds the
+//     DHCP message of the lease. Only IPv4 leases are supported.
+//   - ppp: the addresses of the interface named in a pppd pid file.
+type Lease struct {
+	// The format of the lease file.
+	Format string `json:"format,omitempty"`
+
+	// The lease file. Default: /var/lib/dhcp/dhclient.leases for
+	// dhclient, /var/lib/dhcpcd/<interface>.lease for dhcpcd and
+	// /var/run/ppp0.pid for ppp
+	Path string `json:"path,omitempty"`
+
+	// Only use leases of this interface. Required for dhcpcd
+	// if no path is set.
+	Interface string `json:"interface,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Lease) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.lease",
+		New: func() caddy.Module { return new(Lease) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	lease <dhclient|dhcpcd|ppp> [<path>] {
+//	    interface <name>
+//	    filter <name> ...
+//	}
+func (l *Lease) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		l.Format = d.Val()
+		if d.NextArg() {
+			l.Path = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "interface":
+				err = singleArg(d, &l.Interface)
+			case "filter":
+				err = l.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (l *Lease) Provision(ctx caddy.Context) error {
+	l.logger = ctx.Logger(l)
+	if err := l.Filters.load(ctx); err != nil {
+		return err
+	}
+
+	switch l.Format {
+	case LeaseDhclient:
+		if l.Path == "" {
+			l.Path = "/var/lib/dhcp/dhclient.leases"
+		}
+	case LeaseDhcpcd:
+		if l.Path == "" {
+			if l.Interface == "" {
+				return fmt.Errorf("dhcpcd lease requires a path or an interface")
+			}
+			l.Path = "/var/lib/dhcpcd/" + l.Interface + ".lease"
+		}
+	case LeasePPP:
+		if l.Path == "" {
+			l.Path = "/var/run/ppp0.pid"
+		}
+	default:
+		return fmt.Errorf("unsupported lease format '%s'", l.Format)
+	}
+	return nil
+}
+
+// GetIPs gets the WAN addresses of this machine.
+func (l Lease) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return l.Filters.apply(l.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (l Lease) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	data, err := os.ReadFile(l.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	switch l.Format {
+	case LeaseDhclient:
+		ips, err = l.dhclientLease(data, time.Now())
+	case LeaseDhcpcd:
+		ips, err = dhcpcdLease(data)
+	case LeasePPP:
+		ips, err = pppAddresses(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading lease %s: %v", l.Path, err)
+	}
+
+	l.logger.Debug("read lease",
+		zap.String("format", l.Format),
+		zap.String("path", l.Path),
+		zap.Strings("ips", ipStrings(ips)))
+	return filterVersions(ips, versions), nil
+}
+
+// dhclientLease returns the fixed-address of the newest lease in
+// the dhclient lease file data which is not expired at now.
+func (l Lease) dhclientLease(data []byte, now time.Time) ([]net.IP, error) {
+	type lease struct {
+		iface   string
+		address net.IP
+		expire  time.Time
+	}
+	var leases []lease
+	var cur *lease
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "lease" || fields[0] == "lease6":
+			cur = &lease{}
+		case fields[0] == "}" && cur != nil:
+			leases = append(leases, *cur)
+			cur = nil
+		case cur == nil:
+		case fields[0] == "interface" && len(fields) == 2:
+			cur.iface = strings.Trim(fields[1], `"`)
+		case fields[0] == "fixed-address" && len(fields) == 2:
+			cur.address = net.ParseIP(fields[1])
+		case fields[0] == "iaaddr" && len(fields) >= 2:
+			// DHCPv6 leases nest the address in an ia-na block
+			cur.address = net.ParseIP(fields[1])
+		case fields[0] == "expire" && len(fields) >= 4:
+			// expire <weekday> <yyyy/mm/dd> <hh:mm:ss>, in UTC
+			expire, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3])
+			if err == nil {
+				cur.expire = expire
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// newer leases are appended to the file
+	for i := len(leases) - 1; i >= 0; i-- {
+		lease := leases[i]
+		if lease.address == nil {
+			continue
+		}
+		if l.Interface != "" && lease.iface != l.Interface {
+			continue
+		}
+		if !lease.expire.IsZero() && lease.expire.Before(now) {
+			l.logger.Debug("skipping expired lease",
+				zap.String("interface", lease.iface),
+				zap.String("address", lease.address.String()),
+				zap.Time("expire", lease.expire))
+			continue
+		}
+		return []net.IP{lease.address}, nil
+	}
+	return nil, fmt.Errorf("no unexpired lease")
+}
+
+// dhcpcdLease returns the address a dhcpcd lease file, which
+// holds the DHCP message of the lease, assigns.
+func dhcpcdLease(data []byte) ([]net.IP, error) {
+	// the your IP address (yiaddr) field of the BOOTP header
+	if len(data) < 240 || data[0] != 2 {
+		return nil, fmt.Errorf("not a DHCP reply")
+	}
+	ip := net.IP(append([]byte(nil), data[16:20]...))
+	if ip.IsUnspecified() {
+		return nil, fmt.Errorf("lease has no address")
+	}
+	return []net.IP{ip}, nil
+}
+
+// pppAddresses returns the addresses of the interface
+// named in the pppd pid file data.
+func pppAddresses(data []byte) ([]net.IP, error) {
+	// the pid file holds the pid and, once the link is up, the interface
+	lines := strings.Fields(string(data))
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("link is not up")
+	}
+	iface, err := net.InterfaceByName(lines[1])
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	return ips, nil
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*Lease)(nil)
+	_ caddy.Provisioner     = (*Lease)(nil)
+	_ caddyfile.Unmarshaler = (*Lease)(nil)
+)
@@ -0,0 +1,122 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"go.uber.org/zap"
+)
+
+// legacyNames are the names the command source had before,
+// by the name that replaces them. They still work, as aliases
+// that log a deprecation warning.
+var legacyNames = map[string]string{
+	"exec": "command",
+}
+
+func init() {
+	for name := range legacyNames {
+		caddy.RegisterModule(legacyCommand{name: name})
+	}
+
+	fs := flag.NewFlagSet("dynamic-dns-command-migrate", flag.ExitOnError)
+	fs.String("config", "", "Caddyfile to migrate")
+	fs.Bool("overwrite", false, "Overwrite the Caddyfile instead of printing it")
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "dynamic-dns-command-migrate",
+		Usage: "--config <path> [--overwrite]",
+		Short: "Replaces the legacy names of the command source in a Caddyfile",
+		Long: `
+Replaces the legacy names of the command source, like exec, with the
+preferred ones in a Caddyfile, in ip_source, ip_sources and in the
+sources of race and canary, and prints the result, or with --overwrite
+writes it back to the file. The config is the same either way; only
+the deprecation warnings go away.`,
+		Flags: fs,
+		Func: func(fl caddycmd.Flags) (int, error) {
+			path := fl.String("config")
+			if path == "" {
+				return caddy.ExitCodeFailedStartup, fmt.Errorf("--config is required")
+			}
+			body, err := os.ReadFile(path)
+			if err != nil {
+				return caddy.ExitCodeFailedStartup, err
+			}
+			migrated, n := MigrateCaddyfile(body)
+			if !fl.Bool("overwrite") {
+				_, err = os.Stdout.Write(migrated)
+				return caddy.ExitCodeSuccess, err
+			}
+			if n > 0 {
+				if err := os.WriteFile(path, migrated, 0o644); err != nil {
+					return caddy.ExitCodeFailedStartup, err
+				}
+			}
+			fmt.Fprintf(os.Stderr, "%s: replaced %d legacy names\n", path, n)
+			return caddy.ExitCodeSuccess, nil
+		},
+	})
+}
+
+// legacyDirective matches the name of an IP source
+// where the Caddyfile of the dynamic_dns app, race
+// and canary take one.
+var legacyDirective = regexp.MustCompile(`(?m)^(\s*(?:ip_sources?|source|primary|canary)\s+)(\S+)`)
+
+// MigrateCaddyfile returns body with the legacy names of the
+// command source, like exec, replaced by the preferred ones,
+// and how many it replaced. Everything else is kept as it is.
+func MigrateCaddyfile(body []byte) ([]byte, int) {
+	n := 0
+	migrated := legacyDirective.ReplaceAllFunc(body, func(match []byte) []byte {
+		sub := legacyDirective.FindSubmatch(match)
+		preferred, ok := legacyNames[string(sub[2])]
+		if !ok {
+			return match
+		}
+		n++
+		return append(append([]byte(nil), sub[1]...), preferred...)
+	})
+	return migrated, n
+}
+
+// legacyCommand is the command source by a legacy name. Its
+// config is the one of the command source, and it works the
+// same, but it logs a warning with the preferred name.
+type legacyCommand struct {
+	Command
+
+	name string
+}
+
+// CaddyModule returns the Caddy module information.
+func (c legacyCommand) CaddyModule() caddy.ModuleInfo {
+	name := c.name
+	return caddy.ModuleInfo{
+		ID:  caddy.ModuleID("dynamic_dns.ip_sources." + name),
+		New: func() caddy.Module { return &legacyCommand{name: name} },
+	}
+}
+
+// Provision warns about the legacy name and
+// sets up the command source.
+func (c *legacyCommand) Provision(ctx caddy.Context) error {
+	ctx.Logger(c).Warn("deprecated name of the command source, use the preferred one",
+		zap.String("name", c.name),
+		zap.String("preferred", legacyNames[c.name]))
+	return c.Command.Provision(ctx)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner = (*legacyCommand)(nil)
+)
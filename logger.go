@@ -0,0 +1,33 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// provisionLogger names the logger of the source after
+// LoggerName and raises its level to LogLevel, if set.
+func (c *Command) provisionLogger() error {
+	if c.LoggerName != "" {
+		if strings.ContainsAny(c.LoggerName, " \t") {
+			return fmt.Errorf("invalid logger_name %q", c.LoggerName)
+		}
+		c.logger = c.logger.Named(c.LoggerName)
+	}
+	if c.LogLevel != "" {
+		level, err := zapcore.ParseLevel(c.LogLevel)
+		if err != nil {
+			return fmt.Errorf("invalid log_level: %v", err)
+		}
+		c.logger = c.logger.WithOptions(zap.IncreaseLevel(level))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// provisionPaths looks up the commands given by a bare name in
+// PATH when the config is loaded, and keeps their paths for the
+// runs. As the PATH of Caddy's service often differs from the one
+// of a shell, a command that cannot be found is reported right
+// away, by a warning or, with RequireCommand, an error; it is then
+// looked up again on every run, in case it is installed later.
+func (c *Command) provisionPaths() error {
+	if c.Chroot != "" {
+		// PATH is that of the chroot, and the commands are absolute
+		return nil
+	}
+
+	var cmds []Exec
+	if name, _ := c.commandLine(c.Cmd, nil); name == c.Cmd {
+		// the interpreter of the mode was looked up already
+		cmds = append(cmds, Exec{Cmd: c.Cmd, Dir: c.Dir})
+	}
+	for _, e := range c.Commands {
+		if name, _ := c.commandLine(e.Cmd, nil); name == e.Cmd {
+			cmds = append(cmds, e)
+		}
+	}
+	cmds = append(cmds, c.Pipeline...)
+	if c.Before != nil {
+		cmds = append(cmds, c.Before.Exec)
+	}
+	if c.After != nil {
+		cmds = append(cmds, c.After.Exec)
+	}
+	if c.OnFailure != nil && c.OnFailure.Cmd != "" {
+		cmds = append(cmds, Exec{Cmd: c.OnFailure.Cmd})
+	}
+	if c.Probe != nil && c.Probe.Cmd != "" {
+		cmds = append(cmds, Exec{Cmd: c.Probe.Cmd})
+	}
+
+	c.paths = make(map[string]string)
+	for _, e := range cmds {
+		name := e.Cmd
+		if !isBareName(name) {
+			continue
+		}
+		if _, ok := c.paths[name]; ok {
+			continue
+		}
+		path, err := commandPath(name, e.Dir)
+		if err != nil {
+			if c.RequireCommand {
+				return fmt.Errorf("command %s: %v (PATH=%s)", name, err, os.Getenv("PATH"))
+			}
+			c.logger.Warn("command not found in PATH; it may differ from the one of your shell",
+				zap.String("command", name),
+				zap.String("PATH", os.Getenv("PATH")),
+				zap.Error(err))
+			continue
+		}
+		c.paths[name] = path
+	}
+	if len(c.paths) > 0 {
+		c.logger.Debug("resolved commands",
+			zap.Any("paths", c.paths))
+	}
+	return nil
+}
+
+// isBareName returns true if cmd has no path separator,
+// so that it is looked up in PATH.
+func isBareName(cmd string) bool {
+	return !strings.ContainsRune(cmd, filepath.Separator) && !strings.Contains(cmd, "/")
+}
+
+// lookPath returns the path of the file that is executed for
+// name when run in dir, using the path found when the config
+// was loaded, if any.
+func (c Command) lookPath(name, dir string) (string, error) {
+	if path, ok := c.paths[name]; ok {
+		return path, nil
+	}
+	return commandPath(name, dir)
+}
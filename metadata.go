@@ -0,0 +1,156 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+)
+
+// Metadata is information a command returned along with the
+// addresses, in the extended format.
+type Metadata struct {
+	// The TTL the command suggests for the records.
+	// Zero if it did not suggest one.
+	TTL time.Duration
+
+	// The addresses of specific hosts, by name, which
+	// may differ from the addresses of all others.
+	Hosts map[string][]net.IP
+
+	// The label of the source, to tell the results of
+	// several sources apart. Empty if it has none.
+	Label string
+}
+
+// MetadataSource is an IP source that returns metadata along
+// with the addresses. A consumer like the dynamic_dns app may
+// call Metadata after GetIPs to get the metadata of the result
+// GetIPs returned.
+type MetadataSource interface {
+	dynamicdns.IPSource
+
+	// Metadata returns the metadata of the last result
+	// and false if there is none.
+	Metadata() (Metadata, bool)
+}
+
+// extendedOutput is the output of a command in the extended format.
+type extendedOutput struct {
+	// the addresses, like in the list format
+	IPs []string `json:"ips"`
+
+	// a duration string like "5m" or a number of seconds
+	TTL json.RawMessage `json:"ttl"`
+
+	// the addresses of specific hosts
+	Hosts map[string][]string `json:"hosts"`
+}
+
+// extendedTokens returns the addresses in the extended format
+// and merges the metadata of the output into meta.
+func extendedTokens(output string, meta *Metadata) ([]token, error) {
+	var ext extendedOutput
+	if err := json.Unmarshal([]byte(output), &ext); err != nil {
+		return nil, fmt.Errorf("parsing extended output: %v", err)
+	}
+
+	var tokens []token
+	for _, ip := range ext.IPs {
+		tokens = append(tokens, token{value: ip})
+	}
+
+	if len(ext.TTL) > 0 && string(ext.TTL) != "null" {
+		ttl, err := parseTTL(ext.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl %s: %v", ext.TTL, err)
+		}
+		// with several commands, the shortest TTL wins
+		if meta.TTL == 0 || ttl < meta.TTL {
+			meta.TTL = ttl
+		}
+	}
+
+	// sorted, so that errors do not depend on map order
+	hosts := make([]string, 0, len(ext.Hosts))
+	for host := range ext.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		for _, s := range ext.Hosts[host] {
+			ip := net.ParseIP(stripZone(s))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP of host %s: %s", host, s)
+			}
+			if meta.Hosts == nil {
+				meta.Hosts = make(map[string][]net.IP)
+			}
+			if !ipListContains(meta.Hosts[host], ip) {
+				meta.Hosts[host] = append(meta.Hosts[host], ip)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// parseTTL parses a TTL given as duration string or in seconds,
+// also as a string of digits, like "300".
+func parseTTL(raw json.RawMessage) (time.Duration, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		s = strings.TrimSpace(s)
+		if seconds, err := strconv.ParseUint(s, 10, 32); err == nil {
+			return time.Duration(seconds) * time.Second, nil
+		}
+		return caddy.ParseDuration(s)
+	}
+	var seconds uint32
+	if err := json.Unmarshal(raw, &seconds); err != nil {
+		return 0, fmt.Errorf("must be a duration or a number of seconds")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// hasMetadata returns true if the output may be in the
+// extended format or an envelope, which have metadata, or
+// if the source has a label, which is part of the metadata.
+func (c Command) hasMetadata() bool {
+	switch c.Format {
+	case "", FormatList, FormatExtended, FormatAuto:
+		return true
+	}
+	return c.Label != ""
+}
+
+// Metadata returns the metadata of the last result, if the
+// command may print metadata or the source has a label.
+func (c Command) Metadata() (Metadata, bool) {
+	if !c.hasMetadata() || c.state == nil {
+		return Metadata{}, false
+	}
+	c.state.cacheMu.Lock()
+	defer c.state.cacheMu.Unlock()
+	if c.state.metadata == nil {
+		return Metadata{}, false
+	}
+	meta := *c.state.metadata
+	meta.Label = c.Label
+	return meta, true
+}
+
+// Interface guards
+var (
+	_ MetadataSource = (*Command)(nil)
+)
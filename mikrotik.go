@@ -0,0 +1,225 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(MikroTik{})
+}
+
+// MikroTik is an IP source that reads the addresses of a WAN
+// interface of a MikroTik router using the REST API of RouterOS 7.
+//
+// Disabled and invalid addresses are skipped, as are IPv6
+// link-local addresses.
+type MikroTik struct {
+	// The URL of the router, e.g. https://192.168.88.1.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The user to authenticate as. A user of the read group
+	// with the rest-api policy suffices.
+	Username string `json:"username,omitempty"`
+
+	// The password of the user. Global placeholders like
+	// {env.ROUTEROS_PASSWORD} are expanded.
+	Password string `json:"password,omitempty"`
+
+	// The WAN interface, e.g. ether1 or pppoe-out1.
+	Interface string `json:"interface,omitempty"`
+
+	// A PEM file with the CA certificate(s) to trust, e.g. the
+	// router's self-signed certificate.
+	CA string `json:"ca,omitempty"`
+
+	// Do not verify the router's certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// How long to wait for the router. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	client *http.Client
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (MikroTik) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.mikrotik",
+		New: func() caddy.Module { return new(MikroTik) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	mikrotik <url> {
+//	    username <user>
+//	    password <password>
+//	    interface <name>
+//	    ca <pem file>
+//	    insecure_skip_verify
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (m *MikroTik) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&m.Endpoint) {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "username":
+				err = singleArg(d, &m.Username)
+			case "password":
+				err = singleArg(d, &m.Password)
+			case "interface":
+				err = singleArg(d, &m.Interface)
+			case "ca":
+				err = singleArg(d, &m.CA)
+			case "insecure_skip_verify":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.InsecureSkipVerify = true
+			case "timeout":
+				err = durationArg(d, &m.Timeout)
+			case "filter":
+				err = m.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (m *MikroTik) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+	if err := m.Filters.load(ctx); err != nil {
+		return err
+	}
+	if m.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	m.Endpoint = strings.TrimSuffix(m.Endpoint, "/")
+	if m.Interface == "" {
+		return fmt.Errorf("interface is required")
+	}
+	if m.Timeout <= 0 {
+		m.Timeout = caddy.Duration(5 * time.Second)
+	}
+	client, err := apiClient(m.Timeout, m.CA, m.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	m.client = client
+	return nil
+}
+
+// GetIPs gets the addresses of the WAN interface.
+func (m MikroTik) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return m.Filters.apply(m.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (m MikroTik) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	var ips []net.IP
+	if versions.V4Enabled() {
+		addrs, err := m.addresses(ctx, "ip")
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, addrs...)
+	}
+	if versions.V6Enabled() {
+		addrs, err := m.addresses(ctx, "ipv6")
+		// the ipv6 menu is missing if IPv6 is disabled
+		if err != nil && !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+		ips = append(ips, addrs...)
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// addresses returns the addresses of the WAN
+// interface from the ip or ipv6 address list.
+func (m MikroTik) addresses(ctx context.Context, family string) ([]net.IP, error) {
+	query := url.Values{"interface": {m.Interface}}
+	endpoint := m.Endpoint + "/rest/" + family + "/address?" + query.Encode()
+
+	username, err := secret(ctx, m.Username)
+	if err != nil {
+		return nil, err
+	}
+	password, err := secret(ctx, m.Password)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Authorization": {basicAuth(username, password)}}
+	body, err := apiRequest(ctx, m.client, http.MethodGet, endpoint, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// RouterOS returns every value as a string
+	var entries []struct {
+		Address   string `json:"address"`
+		Disabled  string `json:"disabled"`
+		Invalid   string `json:"invalid"`
+		LinkLocal string `json:"link-local"`
+	}
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("decoding %s addresses: %v", family, err)
+	}
+
+	var ips []net.IP
+	for _, entry := range entries {
+		if entry.Disabled == "true" || entry.Invalid == "true" || entry.LinkLocal == "true" {
+			continue
+		}
+		ip := interfaceAddress(entry.Address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", entry.Address)
+		}
+		ips = append(ips, ip)
+	}
+	m.logger.Debug("interface addresses",
+		zap.String("interface", m.Interface),
+		zap.String("family", family),
+		zap.Strings("ips", ipStrings(ips)))
+	return ips, nil
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*MikroTik)(nil)
+	_ caddy.Provisioner     = (*MikroTik)(nil)
+	_ caddyfile.Unmarshaler = (*MikroTik)(nil)
+)
@@ -0,0 +1,199 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os/exec"
+	"strings"
+	"unicode/utf16"
+)
+
+// Execution modes.
+const (
+	// ModeExec executes the command directly. This is the default.
+	ModeExec = "exec"
+
+	// ModePowerShell runs the command as a PowerShell snippet.
+	ModePowerShell = "powershell"
+
+	// ModeWSL runs the command in the Windows Subsystem for Linux.
+	ModeWSL = "wsl"
+)
+
+// provisionMode checks the execution mode and
+// resolves the interpreter it needs, if any.
+func (c *Command) provisionMode() error {
+	switch c.Mode {
+	case "", ModeExec:
+		return nil
+	case ModePowerShell:
+		path, err := powershellPath()
+		if err != nil {
+			return err
+		}
+		c.interpreter = path
+		return nil
+	case ModeWSL:
+		path, err := exec.LookPath("wsl")
+		if err != nil {
+			return fmt.Errorf("wsl not found: %v", err)
+		}
+		c.interpreter = path
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %s", c.Mode)
+	}
+}
+
+// provisionRawCommandLine ensures that the command line
+// can be passed on as it is.
+func (c *Command) provisionRawCommandLine() error {
+	if !c.RawCommandLine {
+		return nil
+	}
+	if err := checkRawCommandLine(); err != nil {
+		return fmt.Errorf("raw_command_line: %v", err)
+	}
+	if c.Mode != "" && c.Mode != ModeExec {
+		return fmt.Errorf("raw_command_line is not supported in %s mode", c.Mode)
+	}
+	return nil
+}
+
+// commandLine returns the executable and the arguments
+// that run cmd with args in the configured mode.
+func (c Command) commandLine(cmd string, args []string) (string, []string) {
+	switch c.Mode {
+	case ModePowerShell:
+		return c.interpreter, powershellArgs(cmd, args)
+	case ModeWSL:
+		return c.interpreter, wslArgs(c.Distro, cmd, args)
+	default:
+		return cmd, args
+	}
+}
+
+// decodeOutput decodes the output of the command as needed
+// for the configured mode, and normalizes its encoding.
+func (c Command) decodeOutput(out []byte) []byte {
+	switch c.Mode {
+	case ModePowerShell:
+		out = decodeUTF16LE(out)
+	case ModeWSL:
+		// wsl.exe writes its own messages, e.g. if
+		// the distribution does not exist, in UTF-16LE
+		if looksLikeUTF16LE(out) {
+			out = decodeUTF16LE(append([]byte{0xFF, 0xFE}, out...))
+		}
+	}
+	return normalizeOutput(out)
+}
+
+// utf8BOM is the byte order mark some Windows tools
+// write in front of UTF-8 output.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// normalizeOutput decodes UTF-16LE output with a byte order
+// mark, as PowerShell and other Windows tools write it in any
+// mode, removes UTF-8 byte order marks and replaces CRLF line
+// endings with LF, so that none of them ends up in an address.
+func normalizeOutput(out []byte) []byte {
+	out = decodeUTF16LE(out)
+	if bytes.Contains(out, utf8BOM) {
+		out = bytes.ReplaceAll(out, utf8BOM, nil)
+	}
+	if bytes.Contains(out, []byte("\r\n")) {
+		out = bytes.ReplaceAll(out, []byte("\r\n"), []byte("\n"))
+	}
+	return out
+}
+
+// powershellPath returns the path of PowerShell,
+// preferring PowerShell 7 (pwsh) if it is installed.
+func powershellPath() (string, error) {
+	if path, err := exec.LookPath("pwsh"); err == nil {
+		return path, nil
+	}
+	path, err := exec.LookPath("powershell")
+	if err != nil {
+		return "", fmt.Errorf("neither pwsh nor powershell found: %v", err)
+	}
+	return path, nil
+}
+
+// powershellArgs returns the arguments for PowerShell to run
+// script with args, which are available to it in $args. The
+// script is passed encoded, which avoids any quoting issues,
+// and writes its output in UTF-8.
+func powershellArgs(script string, args []string) []string {
+	var sb strings.Builder
+	sb.WriteString("[Console]::OutputEncoding = [System.Text.Encoding]::UTF8\n")
+	sb.WriteString("& {\n")
+	sb.WriteString(script)
+	sb.WriteString("\n}")
+	for _, arg := range args {
+		sb.WriteString(" '")
+		sb.WriteString(strings.ReplaceAll(arg, "'", "''"))
+		sb.WriteString("'")
+	}
+
+	encoded := utf16.Encode([]rune(sb.String()))
+	buf := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(buf[2*i:], r)
+	}
+
+	return []string{
+		"-NoProfile",
+		"-NonInteractive",
+		"-EncodedCommand", base64.StdEncoding.EncodeToString(buf),
+	}
+}
+
+// wslArgs returns the arguments for wsl.exe to execute cmd with
+// args in distro, or the default distribution if empty. The
+// command is executed without a shell, so the args are passed
+// exactly as given.
+func wslArgs(distro, cmd string, args []string) []string {
+	var wslArgs []string
+	if distro != "" {
+		wslArgs = append(wslArgs, "--distribution", distro)
+	}
+	wslArgs = append(wslArgs, "--exec", cmd)
+	return append(wslArgs, args...)
+}
+
+// looksLikeUTF16LE returns true if b looks like UTF-16LE encoded
+// ASCII text without a byte order mark: every second byte is 0.
+func looksLikeUTF16LE(b []byte) bool {
+	if len(b) < 2 || len(b)%2 != 0 {
+		return false
+	}
+	for i := 1; i < len(b); i += 2 {
+		if b[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeUTF16LE decodes b to UTF-8 if it
+// starts with a UTF-16LE byte order mark.
+func decodeUTF16LE(b []byte) []byte {
+	if len(b) < 2 || b[0] != 0xFF || b[1] != 0xFE {
+		return b
+	}
+	b = b[2:]
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return []byte(string(utf16.Decode(u)))
+}
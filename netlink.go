@@ -0,0 +1,339 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Netlink{})
+}
+
+// Netlink is an IP source that returns the addresses of a network
+// interface, read from the kernel by netlink, for the common case
+// of the WAN being a local interface, without running `ip addr`.
+// Only supported on Linux.
+//
+// Tentative addresses and the ones that failed duplicate address
+// detection are always skipped. The addresses are ordered by their
+// preferred lifetimes, the longest first, so that the addresses of
+// a prefix that is being phased out come last.
+type Netlink struct {
+	// The interface, e.g. ppp0.
+	Interface string `json:"interface,omitempty"`
+
+	// Only use addresses of this scope: global, site,
+	// link or host. Default: global
+	Scope string `json:"scope,omitempty"`
+
+	// Skip deprecated addresses, whose preferred lifetime is over,
+	// e.g. of a prefix the ISP replaced.
+	SkipDeprecated bool `json:"skip_deprecated,omitempty"`
+
+	// Skip temporary IPv6 addresses (RFC 4941 privacy addresses).
+	SkipTemporary bool `json:"skip_temporary,omitempty"`
+
+	// Subscribe to address changes and keep the addresses in
+	// memory, instead of reading them on every lookup. Every
+	// change is announced like in the watch mode of the
+	// command source.
+	Watch bool `json:"watch,omitempty"`
+
+	// How often a consumer of the Scheduler interface should look
+	// up the addresses; the dynamic_dns app does not use it.
+	// Default: 1h with watch, none otherwise
+	PollInterval caddy.Duration `json:"poll_interval,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	ctx    caddy.Context
+	events *caddyevents.App
+	stop   context.CancelFunc
+	hot    *hotAddrs
+	logger *zap.Logger
+}
+
+// linkAddr is an address of an interface.
+type linkAddr struct {
+	ip         net.IP
+	scope      string
+	temporary  bool
+	deprecated bool
+	tentative  bool
+
+	// in seconds, 4294967295 meaning forever
+	preferred uint32
+}
+
+// hotAddrs are the addresses kept in memory in watch mode.
+type hotAddrs struct {
+	mu          sync.Mutex
+	ips         []net.IP
+	err         error
+	subscribers map[int]func([]net.IP)
+	nextID      int
+}
+
+// CaddyModule returns the Caddy module information.
+func (Netlink) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.netlink",
+		New: func() caddy.Module { return new(Netlink) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	netlink <interface> {
+//	    scope global|site|link|host
+//	    skip_deprecated
+//	    skip_temporary
+//	    watch
+//	    poll_interval <duration>
+//	    filter <name> ...
+//	}
+func (n *Netlink) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&n.Interface) {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "scope":
+				err = singleArg(d, &n.Scope)
+			case "skip_deprecated":
+				n.SkipDeprecated = true
+				if d.NextArg() {
+					err = d.ArgErr()
+				}
+			case "skip_temporary":
+				n.SkipTemporary = true
+				if d.NextArg() {
+					err = d.ArgErr()
+				}
+			case "watch":
+				n.Watch = true
+				if d.NextArg() {
+					err = d.ArgErr()
+				}
+			case "poll_interval":
+				err = durationArg(d, &n.PollInterval)
+			case "filter":
+				err = n.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module and subscribes to
+// address changes in watch mode.
+func (n *Netlink) Provision(ctx caddy.Context) error {
+	n.logger = ctx.Logger(n)
+	if err := n.Filters.load(ctx); err != nil {
+		return err
+	}
+	n.ctx = ctx
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("only supported on linux")
+	}
+	if n.Interface == "" {
+		return fmt.Errorf("interface is required")
+	}
+	switch n.Scope {
+	case "":
+		n.Scope = "global"
+	case "global", "site", "link", "host":
+	default:
+		return fmt.Errorf("unknown scope %s", n.Scope)
+	}
+	if !n.Watch {
+		return nil
+	}
+
+	app, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("loading events app: %v", err)
+	}
+	n.events = app.(*caddyevents.App)
+	n.hot = &hotAddrs{subscribers: make(map[int]func([]net.IP))}
+
+	// subscribe before the first read, so that no change is missed
+	watchCtx, stop := context.WithCancel(context.Background())
+	changes, err := subscribeAddrChanges(watchCtx)
+	if err != nil {
+		stop()
+		return fmt.Errorf("subscribing to address changes: %v", err)
+	}
+	n.stop = stop
+	n.refresh()
+	go func() {
+		for range changes {
+			n.refresh()
+		}
+	}()
+	return nil
+}
+
+// Cleanup stops the subscription to address changes.
+func (n *Netlink) Cleanup() error {
+	if n.stop != nil {
+		n.stop()
+	}
+	return nil
+}
+
+// GetIPs gets the addresses of the interface.
+func (n Netlink) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return n.Filters.apply(n.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (n Netlink) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	if n.hot != nil {
+		n.hot.mu.Lock()
+		ips, err := n.hot.ips, n.hot.err
+		n.hot.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return filterVersions(ips, versions), nil
+	}
+
+	ips, err := n.lookup()
+	if err != nil {
+		return nil, err
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// lookup reads the addresses of the interface and filters them.
+func (n Netlink) lookup() ([]net.IP, error) {
+	addrs, err := interfaceAddrs(n.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("reading addresses of %s: %v", n.Interface, err)
+	}
+
+	var selected []linkAddr
+	for _, addr := range addrs {
+		if addr.tentative || addr.scope != n.Scope {
+			continue
+		}
+		if (n.SkipDeprecated && addr.deprecated) || (n.SkipTemporary && addr.temporary) {
+			continue
+		}
+		selected = append(selected, addr)
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].preferred > selected[j].preferred
+	})
+
+	ips := make([]net.IP, 0, len(selected))
+	for _, addr := range selected {
+		ips = append(ips, addr.ip)
+	}
+	n.logger.Debug("interface addresses",
+		zap.String("interface", n.Interface),
+		zap.Strings("ips", ipStrings(ips)))
+	return ips, nil
+}
+
+// refresh reads the addresses again in watch mode
+// and announces them if they changed.
+func (n Netlink) refresh() {
+	ips, err := n.lookup()
+
+	n.hot.mu.Lock()
+	old := n.hot.ips
+	changed := err == nil && !sameIPs(old, ips)
+	if err == nil {
+		n.hot.ips = ips
+	}
+	n.hot.err = err
+	var subscribers []func([]net.IP)
+	if changed {
+		for _, fn := range n.hot.subscribers {
+			subscribers = append(subscribers, fn)
+		}
+	}
+	n.hot.mu.Unlock()
+
+	if err != nil {
+		n.logger.Error("reading addresses failed",
+			zap.String("interface", n.Interface),
+			zap.Error(err))
+		return
+	}
+	if !changed {
+		return
+	}
+	n.logger.Info("interface addresses changed",
+		zap.String("interface", n.Interface),
+		zap.Strings("old_ips", ipStrings(old)),
+		zap.Strings("new_ips", ipStrings(ips)))
+	n.events.Emit(n.ctx, EventIPsChanged, map[string]any{
+		"interface": n.Interface,
+		"old":       ipStrings(old),
+		"new":       ipStrings(ips),
+	})
+	for _, fn := range subscribers {
+		fn(ips)
+	}
+}
+
+// Subscribe calls fn with the new addresses of the families in
+// versions, after the filters, every time they changed, until the
+// returned function is called. Without watch, fn is never called.
+func (n Netlink) Subscribe(versions dynamicdns.IPVersions, fn func([]net.IP)) func() {
+	if n.hot == nil {
+		return func() {}
+	}
+	h := n.hot
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := h.nextID
+	h.nextID++
+	h.subscribers[id] = subscriber(versions, n.Filters, fn)
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers, id)
+	}
+}
+
+// netlinkDebounce is how long to wait for further notifications
+// before reading the addresses, as a change, like a new prefix,
+// usually comes as a burst of them.
+const netlinkDebounce = 100 * time.Millisecond
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*Netlink)(nil)
+	_ Watcher               = (*Netlink)(nil)
+	_ caddy.Provisioner     = (*Netlink)(nil)
+	_ caddy.CleanerUpper    = (*Netlink)(nil)
+	_ caddyfile.Unmarshaler = (*Netlink)(nil)
+)
@@ -0,0 +1,174 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// rtScopes are the names of the address scopes, like iproute2's.
+var rtScopes = map[uint8]string{
+	unix.RT_SCOPE_UNIVERSE: "global",
+	unix.RT_SCOPE_SITE:     "site",
+	unix.RT_SCOPE_LINK:     "link",
+	unix.RT_SCOPE_HOST:     "host",
+}
+
+// interfaceAddrs returns the addresses of the interface name.
+func interfaceAddrs(name string) ([]linkAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, os.NewSyscallError("netlinkrib", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, os.NewSyscallError("parsenetlinkmessage", err)
+	}
+
+	var addrs []linkAddr
+	for _, m := range msgs {
+		if m.Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		if int(ifa.Index) != iface.Index {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, os.NewSyscallError("parsenetlinkrouteattr", err)
+		}
+
+		addr := linkAddr{scope: rtScopes[ifa.Scope], preferred: ^uint32(0)}
+		flags := uint32(ifa.Flags)
+		var address, local net.IP
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case unix.IFA_ADDRESS:
+				address = net.IP(a.Value)
+			case unix.IFA_LOCAL:
+				local = net.IP(a.Value)
+			case unix.IFA_FLAGS:
+				if len(a.Value) >= 4 {
+					flags = hostEndian.Uint32(a.Value)
+				}
+			case unix.IFA_CACHEINFO:
+				if len(a.Value) >= unix.SizeofIfaCacheinfo {
+					info := (*unix.IfaCacheinfo)(unsafe.Pointer(&a.Value[0]))
+					addr.preferred = info.Prefered
+				}
+			}
+		}
+		// on point-to-point links, IFA_ADDRESS is the peer's address
+		addr.ip = local
+		if addr.ip == nil {
+			addr.ip = address
+		}
+		if addr.ip == nil {
+			continue
+		}
+		addr.ip = append(net.IP(nil), addr.ip...)
+		addr.temporary = flags&unix.IFA_F_TEMPORARY != 0
+		addr.deprecated = flags&unix.IFA_F_DEPRECATED != 0
+		addr.tentative = flags&(unix.IFA_F_TENTATIVE|unix.IFA_F_DADFAILED) != 0
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// hostEndian is the byte order of the netlink attributes.
+var hostEndian = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}()
+
+// subscribeAddrChanges subscribes to the notifications about
+// changed addresses. Every burst of them is reported on the
+// returned channel, which is closed once ctx is done.
+func subscribeAddrChanges(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// reading through the runtime poller, closing the file
+	// unblocks the read
+	f := os.NewFile(uintptr(fd), "netlink")
+
+	notifications := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := f.Read(buf); err != nil {
+				close(notifications)
+				return
+			}
+			select {
+			case notifications <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	changes := make(chan struct{})
+	go func() {
+		defer close(changes)
+		defer f.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-notifications:
+				if !ok {
+					return
+				}
+			}
+			// wait for the rest of the burst
+			timer := time.NewTimer(netlinkDebounce)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			select {
+			case <-notifications:
+			default:
+			}
+			select {
+			case changes <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
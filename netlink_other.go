@@ -0,0 +1,23 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !linux
+
+package command
+
+import (
+	"context"
+	"errors"
+)
+
+var errNetlinkUnsupported = errors.New("netlink is only supported on linux")
+
+func interfaceAddrs(string) ([]linkAddr, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func subscribeAddrChanges(context.Context) (<-chan struct{}, error) {
+	return nil, errNetlinkUnsupported
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"strings"
+	"unicode"
+)
+
+// normalizeText rewrites the characters that localized CLIs,
+// e.g. of routers set to a Japanese locale, print instead of their
+// ASCII equivalents, so that the addresses parse regardless of the
+// locale:
+//
+//   - line breaks of Windows (\r\n) and old Macs (\r) become \n;
+//   - other whitespace, like the no-break space (U+00A0) or the
+//     ideographic space (U+3000), becomes a space;
+//   - invisible characters, like the zero-width space (U+200B)
+//     or a byte order mark (U+FEFF), are dropped;
+//   - full-width forms, like ２０３．０．１１３．５ or ：,
+//     become their ASCII equivalents, and the ideographic full
+//     stop and comma (。、) a dot and a comma.
+func normalizeText(output string) string {
+	if isPlainASCII(output) {
+		return output
+	}
+	output = strings.ReplaceAll(output, "\r\n", "\n")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\r':
+			return '\n'
+		case r == '\n' || r == '\t':
+			return r
+		case r >= 0xFF01 && r <= 0xFF5E:
+			// the full-width forms of ! to ~
+			return r - 0xFF01 + '!'
+		case r == '。' || r == '｡':
+			return '.'
+		case r == '、' || r == '､':
+			return ','
+		case unicode.IsSpace(r):
+			return ' '
+		case unicode.Is(unicode.Cf, r):
+			// format characters, like zero-width spaces
+			return -1
+		}
+		return r
+	}, output)
+}
+
+// isPlainASCII returns true if s only has printable ASCII
+// characters, tabs and \n, which need no normalization.
+func isPlainASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' && c != '\t' && c != '\n') || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Environment variables passed to the on_failure command.
+const (
+	// The error message of the failed lookup.
+	EnvError = "CADDY_DDNS_ERROR"
+
+	// The exit code of the failed command, if it ran.
+	EnvExitCode = "CADDY_DDNS_EXIT_CODE"
+
+	// What the failed command wrote to stderr.
+	EnvStderr = "CADDY_DDNS_STDERR"
+)
+
+// OnFailure notifies about a failed lookup by running a command,
+// calling a webhook, or both. The command gets the details of the
+// failure in the CADDY_DDNS_ERROR, CADDY_DDNS_EXIT_CODE and
+// CADDY_DDNS_STDERR environment variables; the webhook gets them
+// POSTed as a JSON object with the keys "command", "error",
+// "exit_code" and "stderr".
+type OnFailure struct {
+	// The command to execute.
+	Cmd string `json:"command,omitempty"`
+
+	// Arguments to the command. Placeholders, including
+	// {file.<path>}, are expanded in arguments.
+	Args []string `json:"args,omitempty"`
+
+	// The URL to POST the failure to.
+	Webhook string `json:"webhook,omitempty"`
+
+	// How long to wait for the command or the webhook
+	// to finish. Default: 30s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// unmarshalOnFailure parses the on_failure subdirective
+// from the current position of d. Syntax:
+//
+//	[<command> <args...>] {
+//	    webhook <url>
+//	    timeout <duration>
+//	}
+func unmarshalOnFailure(d *caddyfile.Dispenser) (*OnFailure, error) {
+	f := new(OnFailure)
+	if d.NextArg() {
+		f.Cmd = d.Val()
+		f.Args = d.RemainingArgs()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "webhook":
+			if !d.AllArgs(&f.Webhook) {
+				return nil, d.ArgErr()
+			}
+
+		case "timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid timeout '%s': %v", d.Val(), err)
+			}
+			f.Timeout = caddy.Duration(dur)
+
+		default:
+			return nil, d.Errf("unrecognized on_failure subdirective '%s'", d.Val())
+		}
+	}
+
+	if f.Cmd == "" && f.Webhook == "" {
+		return nil, d.Err("on_failure needs a command or a webhook")
+	}
+	return f, nil
+}
+
+// provision sets the defaults of f.
+func (f *OnFailure) provision() {
+	if f.Timeout <= 0 {
+		f.Timeout = caddy.Duration(30 * time.Second)
+	}
+}
+
+// commandError is returned if the command fails.
+type commandError struct {
+	cmd      string
+	exitCode int
+	stderr   string
+	err      error
+}
+
+func (e *commandError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("command %s exited with: %d", e.cmd, e.exitCode)
+}
+
+// Unwrap returns the underlying error and, for a
+// non-zero exit code, an *ErrNonZeroExit.
+func (e *commandError) Unwrap() []error {
+	var errs []error
+	if e.err != nil {
+		errs = append(errs, e.err)
+	}
+	if e.exitCode > 0 {
+		errs = append(errs, e.nonZeroExit())
+	}
+	return errs
+}
+
+func (e *commandError) nonZeroExit() *ErrNonZeroExit {
+	return &ErrNonZeroExit{Cmd: e.cmd, Code: e.exitCode, Stderr: e.stderr}
+}
+
+// notifyFailure notifies about err in the background,
+// if configured to do so.
+func (c Command) notifyFailure(err error) {
+	if c.OnFailure == nil {
+		return
+	}
+
+	exitCode := -1
+	var stderr string
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		exitCode = cmdErr.exitCode
+		stderr = cmdErr.stderr
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.OnFailure.Timeout))
+		defer cancel()
+
+		if c.OnFailure.Cmd != "" {
+			env := []string{
+				EnvError + "=" + err.Error(),
+				EnvExitCode + "=" + strconv.Itoa(exitCode),
+				EnvStderr + "=" + stderr,
+				EnvRunID + "=" + c.runID,
+				EnvLabel + "=" + c.Label,
+			}
+			expandedArgs, loggedArgs, runErr := expandArgs(c.OnFailure.Args)
+			var stdout, stderr []byte
+			if runErr == nil {
+				stdout, stderr, runErr = c.run(ctx, c.OnFailure.Cmd, expandedArgs, "", env, 0)
+			}
+			if runErr != nil {
+				c.logger.Error("on_failure command failed",
+					zap.String("command", c.OnFailure.Cmd),
+					zap.Strings("args", loggedArgs),
+					zap.String("stdout", string(stdout)),
+					zap.String("stderr", string(stderr)),
+					zap.Error(runErr))
+			}
+		}
+
+		if c.OnFailure.Webhook != "" {
+			webhookErr := c.callWebhook(ctx, c.labeled(map[string]any{
+				"command":   c.Cmd,
+				"run_id":    c.runID,
+				"error":     err.Error(),
+				"exit_code": exitCode,
+				"stderr":    stderr,
+			}))
+			if webhookErr != nil {
+				c.logger.Error("on_failure webhook failed",
+					zap.String("webhook", c.OnFailure.Webhook),
+					zap.Error(webhookErr))
+			}
+		}
+	}()
+}
+
+// callWebhook POSTs body as JSON to the on_failure webhook.
+func (c Command) callWebhook(ctx context.Context, body map[string]any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.OnFailure.Webhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(OpenWrt{})
+}
+
+// The ubus session used to log in.
+const ubusNullSession = "00000000000000000000000000000000"
+
+// The ubus status codes that matter here.
+const (
+	ubusNotFound         = 4
+	ubusPermissionDenied = 6
+)
+
+// OpenWrt is an IP source that reads the addresses of the WAN
+// interfaces of an OpenWrt router by calling ubus over HTTP
+// (uhttpd-mod-ubus), like LuCI does.
+//
+// Optionally, the address of a LAN host in each IPv6 prefix
+// delegated to the router is returned as well, e.g. to publish
+// a server behind the router.
+type OpenWrt struct {
+	// The URL of the router, e.g. https://192.168.1.1.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The user to log in as. Default: root
+	Username string `json:"username,omitempty"`
+
+	// The password of the user. Global placeholders
+	// like {env.OPENWRT_PASSWORD} are expanded.
+	Password string `json:"password,omitempty"`
+
+	// The logical WAN interfaces. Interfaces that do not
+	// exist are skipped. Default: wan, wan6
+	Interfaces []string `json:"interfaces,omitempty"`
+
+	// The interface identifier of a host, like ::1234, whose
+	// address in each delegated IPv6 prefix is returned too.
+	PrefixHost string `json:"prefix_host,omitempty"`
+
+	// Do not return the addresses of the WAN interfaces
+	// themselves, only those in the delegated prefixes.
+	PrefixOnly bool `json:"prefix_only,omitempty"`
+
+	// A PEM file with the CA certificate(s) to trust, e.g.
+	// the router's self-signed certificate.
+	CA string `json:"ca,omitempty"`
+
+	// Do not verify the router's certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// How long to wait for the router. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	prefixHost net.IP
+	client     *http.Client
+	session    *ubusSession
+	logger     *zap.Logger
+}
+
+// ubusSession is the login session with ubus.
+type ubusSession struct {
+	mu sync.Mutex
+	id string
+}
+
+// CaddyModule returns the Caddy module information.
+func (OpenWrt) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.openwrt",
+		New: func() caddy.Module { return new(OpenWrt) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	openwrt <url> {
+//	    username <user>
+//	    password <password>
+//	    interfaces <names...>
+//	    prefix_host <interface identifier>
+//	    prefix_only
+//	    ca <pem file>
+//	    insecure_skip_verify
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (o *OpenWrt) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&o.Endpoint) {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "username":
+				err = singleArg(d, &o.Username)
+			case "password":
+				err = singleArg(d, &o.Password)
+			case "interfaces":
+				o.Interfaces = d.RemainingArgs()
+				if len(o.Interfaces) == 0 {
+					return d.ArgErr()
+				}
+			case "prefix_host":
+				err = singleArg(d, &o.PrefixHost)
+			case "prefix_only":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				o.PrefixOnly = true
+			case "ca":
+				err = singleArg(d, &o.CA)
+			case "insecure_skip_verify":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				o.InsecureSkipVerify = true
+			case "timeout":
+				err = durationArg(d, &o.Timeout)
+			case "filter":
+				err = o.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (o *OpenWrt) Provision(ctx caddy.Context) error {
+	o.logger = ctx.Logger(o)
+	if err := o.Filters.load(ctx); err != nil {
+		return err
+	}
+	if o.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	o.Endpoint = strings.TrimSuffix(o.Endpoint, "/")
+	if o.Username == "" {
+		o.Username = "root"
+	}
+	if len(o.Interfaces) == 0 {
+		o.Interfaces = []string{"wan", "wan6"}
+	}
+	if o.PrefixHost != "" {
+		o.prefixHost = net.ParseIP(o.PrefixHost)
+		if o.prefixHost == nil || o.prefixHost.To4() != nil {
+			return fmt.Errorf("invalid prefix_host '%s': not an IPv6 interface identifier", o.PrefixHost)
+		}
+	}
+	if o.PrefixOnly && o.prefixHost == nil {
+		return fmt.Errorf("prefix_only requires prefix_host")
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = caddy.Duration(5 * time.Second)
+	}
+	client, err := apiClient(o.Timeout, o.CA, o.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	o.client = client
+	o.session = new(ubusSession)
+	return nil
+}
+
+// ubusAddress is an address or prefix in an interface status.
+type ubusAddress struct {
+	Address string `json:"address"`
+	Mask    int    `json:"mask"`
+}
+
+// GetIPs gets the addresses of the WAN interfaces.
+func (o OpenWrt) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return o.Filters.apply(o.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (o OpenWrt) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	var ips []net.IP
+	for _, iface := range o.Interfaces {
+		var status struct {
+			Up           bool          `json:"up"`
+			IPv4Address  []ubusAddress `json:"ipv4-address"`
+			IPv6Address  []ubusAddress `json:"ipv6-address"`
+			IPv6Prefixes []ubusAddress `json:"ipv6-prefix"`
+		}
+		found, err := o.call(ctx, "network.interface."+iface, "status", &status)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			o.logger.Debug("skipping missing interface", zap.String("interface", iface))
+			continue
+		}
+		if !status.Up {
+			o.logger.Debug("skipping interface which is down", zap.String("interface", iface))
+			continue
+		}
+
+		if !o.PrefixOnly {
+			for _, addr := range append(status.IPv4Address, status.IPv6Address...) {
+				ip := net.ParseIP(addr.Address)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid IP: %s", addr.Address)
+				}
+				if !ipListContains(ips, ip) {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		if o.prefixHost != nil {
+			for _, prefix := range status.IPv6Prefixes {
+				ip, err := prefixAddress(prefix, o.prefixHost)
+				if err != nil {
+					return nil, err
+				}
+				if !ipListContains(ips, ip) {
+					ips = append(ips, ip)
+				}
+			}
+		}
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// prefixAddress returns the address of the host
+// with the interface identifier host in prefix.
+func prefixAddress(prefix ubusAddress, host net.IP) (net.IP, error) {
+	network := net.ParseIP(prefix.Address).To16()
+	if network == nil || network.To4() != nil || prefix.Mask < 0 || prefix.Mask > 128 {
+		return nil, fmt.Errorf("invalid prefix: %s/%d", prefix.Address, prefix.Mask)
+	}
+	mask := net.CIDRMask(prefix.Mask, 128)
+	ip := make(net.IP, net.IPv6len)
+	for i := range ip {
+		ip[i] = network[i]&mask[i] | host[i]&^mask[i]
+	}
+	return ip, nil
+}
+
+// call calls method of the ubus object and decodes the result into
+// v. It logs in first if needed, and once more if the session was
+// rejected. It returns false if the object does not exist.
+func (o OpenWrt) call(ctx context.Context, object, method string, v any) (bool, error) {
+	o.session.mu.Lock()
+	defer o.session.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if o.session.id == "" {
+			if err := o.login(ctx); err != nil {
+				return false, err
+			}
+		}
+		code, err := o.rpc(ctx, o.session.id, object, method, map[string]any{}, v)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case code == 0:
+			return true, nil
+		case code == ubusNotFound:
+			return false, nil
+		case code == ubusPermissionDenied && attempt == 0:
+			o.logger.Debug("session expired; logging in again")
+			o.session.id = ""
+			continue
+		case code == ubusPermissionDenied:
+			return false, fmt.Errorf("calling %s %s: permission denied, check the ACLs of %s", object, method, o.Username)
+		default:
+			return false, fmt.Errorf("calling %s %s: ubus status %d", object, method, code)
+		}
+	}
+}
+
+// login logs in and stores the session.
+func (o OpenWrt) login(ctx context.Context) error {
+	var result struct {
+		Session string `json:"ubus_rpc_session"`
+	}
+	password, err := secret(ctx, o.Password)
+	if err != nil {
+		return err
+	}
+	params := map[string]any{
+		"username": o.Username,
+		"password": password,
+	}
+	code, err := o.rpc(ctx, ubusNullSession, "session", "login", params, &result)
+	if err != nil {
+		return err
+	}
+	if code != 0 || result.Session == "" {
+		return fmt.Errorf("logging in to router as %s: ubus status %d", o.Username, code)
+	}
+	o.session.id = result.Session
+	return nil
+}
+
+// rpc sends a ubus call as JSON-RPC request, decodes its
+// result into v and returns the ubus status code.
+func (o OpenWrt) rpc(ctx context.Context, session, object, method string, params, v any) (int, error) {
+	req, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "call",
+		"params":  []any{session, object, method, params},
+	})
+	if err != nil {
+		return 0, err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	body, err := apiRequest(ctx, o.client, http.MethodPost, o.Endpoint+"/ubus", header, req)
+	if err != nil {
+		return 0, err
+	}
+
+	var resp struct {
+		Result []json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, fmt.Errorf("decoding ubus response: %v", err)
+	}
+	if resp.Error != nil {
+		// an expired session is reported as JSON-RPC error
+		if resp.Error.Code == -32002 {
+			return ubusPermissionDenied, nil
+		}
+		return 0, fmt.Errorf("calling %s %s: %s", object, method, resp.Error.Message)
+	}
+	if len(resp.Result) == 0 {
+		return 0, fmt.Errorf("calling %s %s: empty result", object, method)
+	}
+
+	var code int
+	if err := json.Unmarshal(resp.Result[0], &code); err != nil {
+		return 0, fmt.Errorf("decoding ubus status: %v", err)
+	}
+	if code == 0 && len(resp.Result) > 1 {
+		if err := json.Unmarshal(resp.Result[1], v); err != nil {
+			return 0, fmt.Errorf("decoding %s %s result: %v", object, method, err)
+		}
+	}
+	return code, nil
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*OpenWrt)(nil)
+	_ caddy.Provisioner     = (*OpenWrt)(nil)
+	_ caddyfile.Unmarshaler = (*OpenWrt)(nil)
+)
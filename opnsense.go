@@ -0,0 +1,209 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(OPNsense{})
+}
+
+// OPNsense is an IP source that reads the addresses of the WAN
+// interface of an OPNsense firewall using its REST API.
+//
+// IPv6 link-local addresses and tunnel addresses are skipped.
+type OPNsense struct {
+	// The URL of the firewall, e.g. https://192.168.1.1.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The key of the API key. Global placeholders like
+	// {env.OPNSENSE_KEY} are expanded.
+	Key string `json:"key,omitempty"`
+
+	// The secret of the API key. Global placeholders like
+	// {env.OPNSENSE_SECRET} are expanded.
+	Secret string `json:"secret,omitempty"`
+
+	// The device of the WAN interface, e.g. igb0 or pppoe0.
+	Interface string `json:"interface,omitempty"`
+
+	// A PEM file with the CA certificate(s) to trust, e.g.
+	// the firewall's self-signed certificate.
+	CA string `json:"ca,omitempty"`
+
+	// Do not verify the firewall's certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// How long to wait for the firewall. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	client *http.Client
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (OPNsense) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.opnsense",
+		New: func() caddy.Module { return new(OPNsense) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	opnsense <url> {
+//	    key <key>
+//	    secret <secret>
+//	    interface <device>
+//	    ca <pem file>
+//	    insecure_skip_verify
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (o *OPNsense) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&o.Endpoint) {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "key":
+				err = singleArg(d, &o.Key)
+			case "secret":
+				err = singleArg(d, &o.Secret)
+			case "interface":
+				err = singleArg(d, &o.Interface)
+			case "ca":
+				err = singleArg(d, &o.CA)
+			case "insecure_skip_verify":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				o.InsecureSkipVerify = true
+			case "timeout":
+				err = durationArg(d, &o.Timeout)
+			case "filter":
+				err = o.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (o *OPNsense) Provision(ctx caddy.Context) error {
+	o.logger = ctx.Logger(o)
+	if err := o.Filters.load(ctx); err != nil {
+		return err
+	}
+	if o.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	o.Endpoint = strings.TrimSuffix(o.Endpoint, "/")
+	if o.Key == "" || o.Secret == "" {
+		return fmt.Errorf("key and secret are required")
+	}
+	if o.Interface == "" {
+		return fmt.Errorf("interface is required")
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = caddy.Duration(5 * time.Second)
+	}
+	client, err := apiClient(o.Timeout, o.CA, o.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	o.client = client
+	return nil
+}
+
+// GetIPs gets the addresses of the WAN interface.
+func (o OPNsense) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return o.Filters.apply(o.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (o OPNsense) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	key, err := secret(ctx, o.Key)
+	if err != nil {
+		return nil, err
+	}
+	apiSecret, err := secret(ctx, o.Secret)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Authorization": {basicAuth(key, apiSecret)}}
+	body, err := apiRequest(ctx, o.client, http.MethodGet,
+		o.Endpoint+"/api/diagnostics/interface/getInterfaceConfig", header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	type address struct {
+		IPAddr    string `json:"ipaddr"`
+		Tunnel    bool   `json:"tunnel"`
+		LinkLocal bool   `json:"link-local"`
+	}
+	var interfaces map[string]struct {
+		IPv4 []address `json:"ipv4"`
+		IPv6 []address `json:"ipv6"`
+	}
+	if err := json.Unmarshal(body, &interfaces); err != nil {
+		return nil, fmt.Errorf("decoding interface config: %v", err)
+	}
+	iface, ok := interfaces[o.Interface]
+	if !ok {
+		return nil, fmt.Errorf("firewall has no interface %s", o.Interface)
+	}
+
+	var ips []net.IP
+	for _, addr := range append(iface.IPv4, iface.IPv6...) {
+		if addr.Tunnel || addr.LinkLocal {
+			continue
+		}
+		ip := interfaceAddress(addr.IPAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", addr.IPAddr)
+		}
+		if ip.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	o.logger.Debug("interface addresses",
+		zap.String("interface", o.Interface),
+		zap.Strings("ips", ipStrings(ips)))
+	return filterVersions(ips, versions), nil
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*OPNsense)(nil)
+	_ caddy.Provisioner     = (*OPNsense)(nil)
+	_ caddyfile.Unmarshaler = (*OPNsense)(nil)
+)
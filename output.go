@@ -0,0 +1,388 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"go.uber.org/zap"
+)
+
+// templateData is the data the transform template is executed with.
+type templateData struct {
+	// The output of the command.
+	Stdout string
+}
+
+// Output formats.
+const (
+	// FormatList is a list of addresses, separated by
+	// the delimiter. This is the default.
+	FormatList = "list"
+
+	// FormatLabeled is one labeled address per line,
+	// like "ipv4: 203.0.113.5".
+	FormatLabeled = "labeled"
+
+	// FormatIPRoute2 is the JSON output of `ip -j addr`.
+	FormatIPRoute2 = "iproute2"
+
+	// FormatExtended is a JSON object with the addresses
+	// and metadata like a suggested TTL.
+	FormatExtended = "extended"
+
+	// FormatAuto detects which of the formats above the output
+	// is in, or finds the addresses in any JSON document.
+	FormatAuto = "auto"
+)
+
+// Policies for lines without a label in the labeled format.
+const (
+	UnlabeledReject = "reject"
+	UnlabeledIgnore = "ignore"
+)
+
+// Policies for tokens that are not addresses.
+const (
+	ParseErrorFail        = "fail"
+	ParseErrorSkip        = "skip"
+	ParseErrorSkipAndWarn = "skip_and_warn"
+)
+
+// Levels to log the output at.
+const (
+	LogOutputDebug = "debug"
+	LogOutputInfo  = "info"
+)
+
+// How much of the output is logged by LogOutput.
+const logOutputLimit = 2048
+
+// Keywords a command may print instead of addresses, if
+// Sentinels is set.
+const (
+	// SentinelNoChange as the whole output reports that
+	// the addresses did not change since the last run.
+	SentinelNoChange = "NOCHANGE"
+
+	// SentinelNone in place of an address explicitly
+	// reports that there is none.
+	SentinelNone = "NONE"
+)
+
+// Output decodings.
+const (
+	// DecodeBase64 decodes base64 encoded output.
+	DecodeBase64 = "base64"
+)
+
+// provisionOutput prepares the processing of the command's output.
+func (c *Command) provisionOutput() error {
+	switch c.Decode {
+	case "", DecodeBase64:
+	default:
+		return fmt.Errorf("unknown decode %s", c.Decode)
+	}
+	switch c.Compression {
+	case "", CompressionAuto, CompressionGzip, CompressionNone:
+	default:
+		return fmt.Errorf("unknown compression %s", c.Compression)
+	}
+
+	switch c.Format {
+	case "", FormatList, FormatLabeled, FormatIPRoute2, FormatExtended, FormatAuto:
+	default:
+		return fmt.Errorf("unknown format %s", c.Format)
+	}
+	switch c.Unlabeled {
+	case "", UnlabeledReject, UnlabeledIgnore:
+	default:
+		return fmt.Errorf("unknown unlabeled policy %s", c.Unlabeled)
+	}
+	switch c.OnParseError {
+	case "", ParseErrorFail, ParseErrorSkip, ParseErrorSkipAndWarn:
+	default:
+		return fmt.Errorf("unknown on_parse_error policy %s", c.OnParseError)
+	}
+
+	switch c.LogOutput {
+	case "", LogOutputDebug, LogOutputInfo:
+	default:
+		return fmt.Errorf("unknown log_output level %s", c.LogOutput)
+	}
+
+	if c.Delimiter != "" {
+		re, err := regexp.Compile(c.Delimiter)
+		if err != nil {
+			return fmt.Errorf("parsing delimiter: %v", err)
+		}
+		c.delimiter = re
+	}
+
+	if c.TransformTemplate != "" {
+		tmpl, err := template.New("transform_template").
+			Funcs(sprig.TxtFuncMap()).
+			Parse(c.TransformTemplate)
+		if err != nil {
+			return fmt.Errorf("parsing transform_template: %v", err)
+		}
+		c.transform = tmpl
+	}
+	return nil
+}
+
+// logOutput logs the output of a successful run of e,
+// truncated, if LogOutput is set.
+func (c Command) logOutput(e Exec, loggedArgs []string, stdout []byte) {
+	level := zap.DebugLevel
+	switch c.LogOutput {
+	case "":
+		return
+	case LogOutputInfo:
+		level = zap.InfoLevel
+	}
+	if ce := c.logger.Check(level, "command output"); ce != nil {
+		truncated := len(stdout) > logOutputLimit
+		if truncated {
+			stdout = stdout[:logOutputLimit]
+		}
+		ce.Write(
+			zap.String("command", e.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("stdout", string(stdout)),
+			zap.Bool("truncated", truncated))
+	}
+}
+
+// transformOutput transforms the output of the
+// command into the text the addresses are parsed from.
+func (c Command) transformOutput(stdout []byte) (string, error) {
+	if c.Decode == DecodeBase64 {
+		decoded, err := decodeBase64(stdout)
+		if err != nil {
+			return "", fmt.Errorf("decoding base64 output: %v", err)
+		}
+		stdout = decoded
+	}
+
+	output := string(stdout)
+
+	if c.JSONPath != "" {
+		extracted, err := extractJSONPath(stdout, c.JSONPath)
+		if err != nil {
+			return "", fmt.Errorf("extracting json_path %s: %v", c.JSONPath, err)
+		}
+		output = extracted
+	}
+
+	if c.transform != nil {
+		var sb strings.Builder
+		err := c.transform.Execute(&sb, templateData{Stdout: output})
+		if err != nil {
+			return "", fmt.Errorf("executing transform_template: %v", err)
+		}
+		output = sb.String()
+	}
+
+	return output, nil
+}
+
+// token is a part of the output that should be an address.
+type token struct {
+	value string
+
+	// the family the address is labeled with, if any
+	label string
+
+	// the preferred lifetime of the address in seconds,
+	// if the output has it
+	lifetime uint64
+
+	// the length of the prefix of the address,
+	// if the output has it
+	prefixLen int
+}
+
+// matches returns true if ip belongs to the family
+// the token is labeled with, if any.
+func (t token) matches(ip net.IP) bool {
+	switch t.label {
+	case "ipv4":
+		return ip.To4() != nil
+	case "ipv6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// tokenize splits the output into the tokens the addresses are
+// parsed from. The metadata of the extended format is merged
+// into o.Metadata.
+func (o ParseOptions) tokenize(output string) ([]token, error) {
+	switch o.Format {
+	case FormatLabeled:
+	case FormatIPRoute2:
+		return o.iproute2Tokens(output)
+	case FormatExtended:
+		if isEnvelope(output) {
+			return envelopeTokens(output, o.metadata())
+		}
+		return extendedTokens(output, o.metadata())
+	case FormatAuto:
+		return o.autoTokens(output)
+	default:
+		if isEnvelope(output) {
+			return envelopeTokens(output, o.metadata())
+		}
+		var tokens []token
+		for _, value := range o.splitOutput(output) {
+			tokens = append(tokens, token{value: value})
+		}
+		return tokens, nil
+	}
+
+	var tokens []token
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		label, value, ok := strings.Cut(line, ":")
+		label = strings.ToLower(strings.TrimSpace(label))
+		if !ok || (label != "ipv4" && label != "ipv6") {
+			if o.Unlabeled == UnlabeledIgnore {
+				continue
+			}
+			return nil, fmt.Errorf("line without ipv4 or ipv6 label: %s", line)
+		}
+		for _, v := range o.splitOutput(value) {
+			tokens = append(tokens, token{value: v, label: label})
+		}
+	}
+	return tokens, nil
+}
+
+// metadata returns the metadata to merge the metadata
+// of the output into, which is discarded if not set.
+func (o ParseOptions) metadata() *Metadata {
+	if o.Metadata == nil {
+		return new(Metadata)
+	}
+	return o.Metadata
+}
+
+// splitOutput splits the output into the tokens the addresses are
+// parsed from. By default, it is split at commas. With a custom
+// delimiter, empty tokens are dropped, so that e.g. trailing
+// newlines are harmless.
+func (o ParseOptions) splitOutput(output string) []string {
+	if o.Delimiter == nil {
+		return strings.Split(output, ",")
+	}
+	var tokens []string
+	for _, token := range o.Delimiter.Split(output, -1) {
+		if strings.TrimSpace(token) != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// extractJSONPath returns the value at path in the JSON document data.
+// The path is a dot separated list of object keys and array indexes,
+// like "interfaces.0.address"; "#" selects every element of an array,
+// like "addresses.#.ip". Strings and numbers are returned as they are,
+// arrays as a comma separated list of their values.
+func extractJSONPath(data []byte, path string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return "", err
+	}
+
+	val, err := selectJSONPath(doc, strings.Split(path, "."))
+	if err != nil {
+		return "", err
+	}
+	return jsonValueString(val)
+}
+
+// selectJSONPath returns the value at the path made of keys in val.
+func selectJSONPath(val any, keys []string) (any, error) {
+	if len(keys) == 0 {
+		return val, nil
+	}
+	key := keys[0]
+
+	switch v := val.(type) {
+	case map[string]any:
+		child, ok := v[key]
+		if !ok {
+			return nil, fmt.Errorf("no key %q", key)
+		}
+		return selectJSONPath(child, keys[1:])
+
+	case []any:
+		if key == "#" {
+			all := make([]any, 0, len(v))
+			for _, elem := range v {
+				child, err := selectJSONPath(elem, keys[1:])
+				if err != nil {
+					return nil, err
+				}
+				all = append(all, child)
+			}
+			return all, nil
+		}
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, fmt.Errorf("no index %q in array of length %d", key, len(v))
+		}
+		return selectJSONPath(v[i], keys[1:])
+
+	default:
+		return nil, fmt.Errorf("cannot select %q from %T", key, val)
+	}
+}
+
+// jsonValueString returns the string representation of a selected value.
+func jsonValueString(val any) (string, error) {
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case []any:
+		strs := make([]string, 0, len(v))
+		for _, elem := range v {
+			str, err := jsonValueString(elem)
+			if err != nil {
+				return "", err
+			}
+			strs = append(strs, str)
+		}
+		return strings.Join(strs, ","), nil
+	default:
+		return "", fmt.Errorf("value of type %T is not a string", val)
+	}
+}
+
+// decodeBase64 decodes the standard base64 encoded data,
+// ignoring any whitespace and missing padding.
+func decodeBase64(data []byte) ([]byte, error) {
+	encoded := strings.Join(strings.Fields(string(data)), "")
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// outputFilePlaceholder expands to the path of a temporary file.
+// If the args of a command contain it, the addresses are read
+// from that file after the command exited, instead of from its
+// stdout, for tools that can only write their results to a file.
+const outputFilePlaceholder = "{output_file}"
+
+// usesOutputFile returns true if args contain the
+// output file placeholder.
+func usesOutputFile(args []string) bool {
+	for _, arg := range args {
+		if strings.Contains(arg, outputFilePlaceholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// provisionOutputFile ensures that the output file
+// placeholder is only used where it can be read.
+func (c *Command) provisionOutputFile() error {
+	uses := usesOutputFile(c.Args)
+	for _, e := range c.Commands {
+		uses = uses || usesOutputFile(e.Args)
+	}
+	if !uses {
+		return nil
+	}
+	if c.Watch {
+		return fmt.Errorf("%s is not supported with watch", outputFilePlaceholder)
+	}
+	if c.Mode == ModeWSL {
+		return fmt.Errorf("%s is not supported in %s mode", outputFilePlaceholder, c.Mode)
+	}
+	return nil
+}
+
+// outputFile creates an empty temporary file for a command to
+// write its output to. It returns the path of the file and the
+// path to pass to the command, which is the path in the chroot,
+// if configured. The caller must remove the file.
+func (c Command) outputFile() (path, arg string, err error) {
+	dir := os.TempDir()
+	if c.Chroot != "" {
+		dir = filepath.Join(c.Chroot, "tmp")
+	}
+	f, err := os.CreateTemp(dir, "caddy-dynamicdns-output-*")
+	if err != nil {
+		return "", "", err
+	}
+	path = f.Name()
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", "", err
+	}
+	if c.Chroot != "" {
+		return path, "/tmp/" + filepath.Base(path), nil
+	}
+	return path, path, nil
+}
+
+// withOutputFile returns args with the output
+// file placeholder replaced by path.
+func withOutputFile(args []string, path string) []string {
+	replaced := make([]string, len(args))
+	for i, arg := range args {
+		replaced[i] = strings.ReplaceAll(arg, outputFilePlaceholder, path)
+	}
+	return replaced
+}
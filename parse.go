@@ -0,0 +1,160 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// ParseOptions control how ParseOutput parses the addresses
+// from the output of a command. The zero value parses a comma
+// separated list, like a command without further options.
+type ParseOptions struct {
+	// The format of the output, one of the Format* constants.
+	// Default: FormatList
+	Format string
+
+	// The delimiter between the addresses in the list and
+	// labeled formats. Default: ","
+	Delimiter *regexp.Regexp
+
+	// What to do with lines without a label in the labeled
+	// format, one of the Unlabeled* constants.
+	// Default: UnlabeledReject
+	Unlabeled string
+
+	// Only use the addresses of this interface and this
+	// scope, in the iproute2 format.
+	Interface string
+	Scope     string
+
+	// Skip deprecated and temporary addresses,
+	// in the iproute2 format.
+	SkipDeprecated bool
+	SkipTemporary  bool
+
+	// What to do with tokens that are not addresses, one of
+	// the ParseError* constants. If all tokens are skipped,
+	// the output is still invalid. Default: ParseErrorFail
+	OnParseError string
+
+	// If set, the tokens skipped by OnParseError are appended to it.
+	Skipped *[]string
+
+	// Recognize the SentinelNoChange and SentinelNone keywords.
+	Sentinels bool
+
+	// How to order the addresses; only PreferLongestLifetime
+	// changes the order, in the iproute2 format.
+	Prefer string
+
+	// If set, the metadata of the extended format is merged into it.
+	Metadata *Metadata
+
+	// If set, only the addresses it selects are returned.
+	Select *Selection
+}
+
+// parseOptions returns the options to parse the output
+// of the command with, merging metadata into meta.
+func (c Command) parseOptions(meta *Metadata) ParseOptions {
+	return ParseOptions{
+		Format:         c.Format,
+		Delimiter:      c.delimiter,
+		Unlabeled:      c.Unlabeled,
+		OnParseError:   c.OnParseError,
+		Interface:      c.Interface,
+		Scope:          c.Scope,
+		SkipDeprecated: c.SkipDeprecated,
+		SkipTemporary:  c.SkipTemporary,
+		Sentinels:      c.Sentinels,
+		Prefer:         c.Prefer,
+		Metadata:       meta,
+		Select:         c.selection,
+	}
+}
+
+// ParseOutput parses the addresses from data, the (transformed)
+// output of a command, so that other IP sources can accept the
+// same formats. IPv4-mapped IPv6 addresses are returned as IPv4,
+// and the zones of scoped addresses, like fe80::1%eth0, dropped.
+// Whitespace, line breaks and full-width characters of localized
+// output are normalized first, see normalizeText.
+//
+// It returns ErrUnchanged if the output is the SentinelNoChange,
+// ErrEmptyOutput if it is empty, and an *ErrInvalidIP for a token
+// that is not an address.
+func ParseOutput(data []byte, opts ParseOptions) ([]netip.Addr, error) {
+	output := normalizeText(string(data))
+
+	if opts.Sentinels && strings.TrimSpace(output) == SentinelNoChange {
+		return nil, ErrUnchanged
+	}
+	if strings.TrimSpace(output) == "" && (opts.Format == FormatIPRoute2 || opts.Format == FormatExtended) {
+		// the JSON formats cannot be parsed from nothing
+		return nil, ErrEmptyOutput
+	}
+
+	tokens, err := opts.tokenize(output)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(tokens))
+	lifetimes := make([]uint64, 0, len(tokens))
+	var parsed int
+	var invalidErr error
+	for _, t := range tokens {
+		value := strings.TrimSpace(t.value)
+		if opts.Sentinels && value == SentinelNone {
+			continue
+		}
+		ip := net.ParseIP(stripZone(value))
+		if ip == nil && strings.TrimSpace(output) == "" {
+			return nil, ErrEmptyOutput
+		}
+		if ip == nil {
+			if opts.OnParseError != ParseErrorSkip && opts.OnParseError != ParseErrorSkipAndWarn {
+				return nil, &ErrInvalidIP{Token: t.value}
+			}
+			if invalidErr == nil {
+				invalidErr = &ErrInvalidIP{Token: t.value}
+			}
+			if opts.Skipped != nil {
+				*opts.Skipped = append(*opts.Skipped, t.value)
+			}
+			continue
+		}
+		if !t.matches(ip) {
+			return nil, fmt.Errorf("%s labeled as %s", ip, t.label)
+		}
+		parsed++
+		if opts.Select != nil && !opts.Select.match(candidate{ip: ip, prefixLen: t.prefixLen, lifetime: t.lifetime}) {
+			continue
+		}
+		ips = append(ips, ip)
+		lifetimes = append(lifetimes, t.lifetime)
+	}
+	if parsed == 0 && invalidErr != nil {
+		// nothing but garbage
+		return nil, invalidErr
+	}
+
+	if opts.Prefer == PreferLongestLifetime {
+		sortByLifetime(ips, lifetimes)
+	}
+
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		addr, _ := netip.AddrFromSlice(ip)
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseOutputLocalized(t *testing.T) {
+	split := regexp.MustCompile(`[\s,;]+`)
+	for _, tt := range []struct {
+		name   string
+		output string
+		opts   ParseOptions
+		want   []string
+	}{
+		{"crlf", "203.0.113.5\r\n", ParseOptions{}, []string{"203.0.113.5"}},
+		{"cr", "203.0.113.5\r198.51.100.7\r", ParseOptions{Delimiter: regexp.MustCompile(`\n`)}, []string{"203.0.113.5", "198.51.100.7"}},
+		{"tabs", "\t203.0.113.5\t,\t2001:db8::1\t", ParseOptions{}, []string{"203.0.113.5", "2001:db8::1"}},
+		{"nbsp", "203.0.113.5\u00a0198.51.100.7\u00a0", ParseOptions{Format: FormatAuto}, []string{"203.0.113.5", "198.51.100.7"}},
+		{"ideographic space", "203.0.113.5\u3000198.51.100.7", ParseOptions{Delimiter: split}, []string{"203.0.113.5", "198.51.100.7"}},
+		{"zero-width space", "\u200b203.0.113.5\u200b,2001:db8::1\u200d", ParseOptions{}, []string{"203.0.113.5", "2001:db8::1"}},
+		{"bom", "\ufeff203.0.113.5", ParseOptions{}, []string{"203.0.113.5"}},
+		{"full-width", "２０３．０．１１３．５，２００１：ｄｂ８：：１", ParseOptions{}, []string{"203.0.113.5", "2001:db8::1"}},
+		{"ideographic punctuation", "203。0。113。5、198.51.100.7", ParseOptions{}, []string{"203.0.113.5", "198.51.100.7"}},
+		{"labeled", "IPv4：\u00a0203.0.113.5\r\nIPv6\u3000:\t2001:db8::1\r\n", ParseOptions{Format: FormatLabeled}, []string{"203.0.113.5", "2001:db8::1"}},
+		{"auto labeled", "ipv4：203.0.113.5\r\n", ParseOptions{Format: FormatAuto}, []string{"203.0.113.5"}},
+		{"extended", "{\"ips\":[\"２０３．０．１１３．５\"],\u00a0\"ttl\":\"300\"}\r\n", ParseOptions{Format: FormatExtended}, []string{"203.0.113.5"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := ParseOutput([]byte(tt.output), tt.opts)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", tt.output, err)
+			}
+			if len(addrs) != len(tt.want) {
+				t.Fatalf("parsed %v from %q, want %v", addrs, tt.output, tt.want)
+			}
+			for i, addr := range addrs {
+				if addr.String() != tt.want[i] {
+					t.Fatalf("parsed %v from %q, want %v", addrs, tt.output, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseOutputEnvelope(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		output  string
+		format  string
+		want    []string
+		ttl     time.Duration
+		wantErr error
+		invalid bool
+	}{
+		{name: "v1 list", output: "203.0.113.5,2001:db8::1\n", want: []string{"203.0.113.5", "2001:db8::1"}},
+		{name: "v2", output: `{"proto":2,"ips":["203.0.113.5","2001:db8::1"]}`, want: []string{"203.0.113.5", "2001:db8::1"}},
+		{name: "v2 metadata", output: `{"proto":2,"ips":["203.0.113.5"],"ttl":"5m"}`, want: []string{"203.0.113.5"}, ttl: 5 * time.Minute},
+		{name: "v2 unknown keys", output: `{"proto":2,"ips":["203.0.113.5"],"zones":{"example.com":[]}}`, want: []string{"203.0.113.5"}},
+		{name: "v2 auto", output: `{"proto":2,"ips":["203.0.113.5"]}`, format: FormatAuto, want: []string{"203.0.113.5"}},
+		{name: "v2 extended", output: `{"proto":2,"status":"none"}`, format: FormatExtended, want: []string{}},
+		{name: "v2 quoted proto", output: `{"proto":"2","ips":["203.0.113.5"]}`, want: []string{"203.0.113.5"}},
+		{name: "unchanged", output: `{"proto":2,"status":"unchanged"}`, wantErr: ErrUnchanged},
+		{name: "none", output: `{"proto":2,"status":"none"}`, want: []string{}},
+		{name: "invalid status", output: `{"proto":2,"status":"maybe"}`, invalid: true},
+		{name: "newer proto", output: `{"proto":3,"ips":["203.0.113.5"]}`, invalid: true},
+		{name: "v1 envelope", output: `{"proto":1,"ips":["203.0.113.5"]}`, invalid: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := new(Metadata)
+			addrs, err := ParseOutput([]byte(tt.output), ParseOptions{Format: tt.format, Metadata: meta})
+			switch {
+			case tt.wantErr != nil || tt.invalid:
+				if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+					t.Fatalf("parsing %q: got error %v, want %v", tt.output, err, tt.wantErr)
+				}
+				return
+			case err != nil:
+				t.Fatalf("parsing %q: %v", tt.output, err)
+			}
+			if len(addrs) != len(tt.want) {
+				t.Fatalf("parsed %v from %q, want %v", addrs, tt.output, tt.want)
+			}
+			for i, addr := range addrs {
+				if addr.String() != tt.want[i] {
+					t.Fatalf("parsed %v from %q, want %v", addrs, tt.output, tt.want)
+				}
+			}
+			if meta.TTL != tt.ttl {
+				t.Errorf("parsed TTL %s from %q, want %s", meta.TTL, tt.output, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	for raw, want := range map[string]time.Duration{
+		`300`:     300 * time.Second,
+		`"300"`:   300 * time.Second,
+		`" 300 "`: 300 * time.Second,
+		`"5m"`:    5 * time.Minute,
+	} {
+		ttl, err := parseTTL([]byte(raw))
+		if err != nil {
+			t.Errorf("parsing %s: %v", raw, err)
+		} else if ttl != want {
+			t.Errorf("parsed %s as %s, want %s", raw, ttl, want)
+		}
+	}
+}
+
+var fuzzFormats = []string{FormatList, FormatLabeled, FormatIPRoute2, FormatExtended, FormatAuto}
+
+func FuzzParseOutput(f *testing.F) {
+	f.Add([]byte("203.0.113.5,2001:db8::1"), uint8(0), false)
+	f.Add([]byte("203.0.113.5 2001:db8::1\n"), uint8(0), true)
+	f.Add([]byte("NONE,::ffff:203.0.113.5"), uint8(0), false)
+	f.Add([]byte("fe80::1%eth0,2001:db8::1%12"), uint8(0), false)
+	f.Add([]byte("NOCHANGE\n"), uint8(0), false)
+	f.Add([]byte("ipv4: 203.0.113.5\nipv6: 2001:db8::1\nfoo\n"), uint8(1), false)
+	f.Add([]byte(`[{"ifname":"eth0","addr_info":[{"family":"inet6","local":"2001:db8::1","scope":"global","preferred_life_time":300}]}]`), uint8(2), false)
+	f.Add([]byte(`{"ips":["203.0.113.5"],"ttl":60}`), uint8(3), false)
+	f.Add([]byte(""), uint8(3), false)
+	f.Add([]byte(`{"ip":"203.0.113.5","geo":{"v6":["2001:db8::1"]}}`), uint8(4), false)
+	f.Add([]byte("203.0.113.5\n2001:db8::1; 198.51.100.7\n"), uint8(4), false)
+	f.Add([]byte("ipv4:\u00a0２０３．０．１１３．５\r\nipv6：\u200b2001:db8::1\r\n"), uint8(1), false)
+	f.Add([]byte("\ufeff203.0.113.5\u3000198.51.100.7\r"), uint8(4), true)
+	f.Add([]byte(`{"proto":2,"ips":["203.0.113.5"],"ttl":"5m"}`), uint8(0), false)
+	f.Add([]byte(`{"proto":2,"status":"unchanged"}`), uint8(4), false)
+
+	delimiter := regexp.MustCompile(`[\s,;]+`)
+	f.Fuzz(func(t *testing.T, data []byte, format uint8, split bool) {
+		opts := ParseOptions{
+			Format:    fuzzFormats[int(format)%len(fuzzFormats)],
+			Unlabeled: UnlabeledIgnore,
+			Sentinels: true,
+			Prefer:    PreferLongestLifetime,
+			Metadata:  new(Metadata),
+		}
+		if split {
+			opts.Delimiter = delimiter
+		}
+		addrs, err := ParseOutput(data, opts)
+		if err != nil {
+			if addrs != nil {
+				t.Errorf("returned addresses %v with error %v", addrs, err)
+			}
+			var invalidErr *ErrInvalidIP
+			if errors.As(err, &invalidErr) && invalidErr.Token == "" && opts.Format == FormatList && split {
+				t.Errorf("empty token with a custom delimiter in %q", data)
+			}
+			return
+		}
+		for _, addr := range addrs {
+			if !addr.IsValid() {
+				t.Errorf("invalid address in %v parsed from %q", addrs, data)
+			}
+			if addr.Is4In6() {
+				t.Errorf("IPv4-mapped address %s parsed from %q", addr, data)
+			}
+		}
+
+		// the addresses parse back to themselves
+		var list []byte
+		for i, addr := range addrs {
+			if i > 0 {
+				list = append(list, ',')
+			}
+			list = append(list, addr.String()...)
+		}
+		if len(addrs) == 0 {
+			return
+		}
+		again, err := ParseOutput(list, ParseOptions{})
+		if err != nil {
+			t.Fatalf("parsing %q again: %v", list, err)
+		}
+		if len(again) != len(addrs) {
+			t.Fatalf("parsed %v from %q, then %v", addrs, data, again)
+		}
+		for i := range addrs {
+			if again[i] != addrs[i] {
+				t.Fatalf("parsed %v from %q, then %v", addrs, data, again)
+			}
+		}
+	})
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultPersistInterval is how often the state is saved by default.
+const defaultPersistInterval = caddy.Duration(time.Minute)
+
+// persistTimeout is how long saving the state may take
+// when the config is unloaded.
+const persistTimeout = 10 * time.Second
+
+// PersistState saves the last addresses and the history of
+// the source to Caddy's storage, so that another instance
+// sharing the storage, or this one after a restart on a fresh
+// host, can pick them up.
+type PersistState struct {
+	// The key in Caddy's storage to save the state to.
+	StorageKey string `json:"storage_key,omitempty"`
+
+	// How often the state is saved, if it changed. It is
+	// also saved when the config is unloaded. Default: 1m
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+// persistedState is the state saved to the storage.
+type persistedState struct {
+	Command string   `json:"command"`
+	Label   string   `json:"label,omitempty"`
+	IPs     []string `json:"ips"`
+	History []run    `json:"history,omitempty"`
+}
+
+// unmarshalPersistState parses the persist_state subdirective. Syntax:
+//
+//	persist_state <key> [<interval>]
+func unmarshalPersistState(d *caddyfile.Dispenser) (*PersistState, error) {
+	p := new(PersistState)
+	if !d.Args(&p.StorageKey) {
+		return nil, d.ArgErr()
+	}
+	if d.NextArg() {
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return nil, d.Errf("invalid persist_state interval '%s': %v", d.Val(), err)
+		}
+		p.Interval = caddy.Duration(dur)
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	return p, nil
+}
+
+// provisionPersist checks the storage key and restores the
+// saved state, unless the state of the previous config is
+// kept, which is newer.
+func (c *Command) provisionPersist(ctx caddy.Context) error {
+	if c.PersistState == nil {
+		return nil
+	}
+	if c.PersistState.StorageKey == "" {
+		return fmt.Errorf("persist_state needs a storage key")
+	}
+	if c.PersistState.Interval < 0 {
+		return fmt.Errorf("invalid persist_state interval %s", time.Duration(c.PersistState.Interval))
+	}
+	if c.PersistState.Interval == 0 {
+		c.PersistState.Interval = defaultPersistInterval
+	}
+	if c.stateCarried {
+		return nil
+	}
+
+	data, err := ctx.Storage().Load(ctx, c.PersistState.StorageKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	var saved persistedState
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		// a fresh start is better than none
+		c.logger.Warn("restoring saved state failed",
+			zap.String("storage_key", c.PersistState.StorageKey),
+			zap.Error(err))
+		return nil
+	}
+	c.restore(saved)
+	return nil
+}
+
+// restore takes over the addresses and the history of saved.
+func (c Command) restore(saved persistedState) {
+	var ips []net.IP
+	for _, s := range saved.IPs {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	c.state.restore(ips)
+	if c.History > 0 {
+		for _, r := range saved.History {
+			c.state.history.add(r, c.History)
+		}
+	}
+	c.logger.Info("restored saved state",
+		zap.String("storage_key", c.PersistState.StorageKey),
+		zap.Strings("ips", ipStrings(ips)),
+		zap.Int("runs", len(saved.History)))
+}
+
+// startPersist saves the state every interval until the
+// config is unloaded, then once more.
+func (c Command) startPersist() {
+	if c.PersistState == nil {
+		return
+	}
+	go func(ctx caddy.Context) {
+		ticker := time.NewTicker(time.Duration(c.PersistState.Interval))
+		defer ticker.Stop()
+		var last []byte
+		for {
+			select {
+			case <-ticker.C:
+				last = c.persist(ctx, last)
+			case <-ctx.Done():
+				saveCtx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+				c.persist(saveCtx, last)
+				cancel()
+				return
+			}
+		}
+	}(c.ctx)
+}
+
+// persist saves the state, unless it is the same as last,
+// which was saved before, and returns what it saved.
+func (c Command) persist(ctx context.Context, last []byte) []byte {
+	ips, _ := c.state.cached(-1)
+	if c.Watch {
+		ips = c.watchState.get()
+	}
+	data, err := json.Marshal(persistedState{
+		Command: c.Cmd,
+		Label:   c.Label,
+		IPs:     ipStrings(ips),
+		History: c.state.history.get(),
+	})
+	if err != nil || bytes.Equal(data, last) {
+		return last
+	}
+	if err := c.ctx.Storage().Store(ctx, c.PersistState.StorageKey, data); err != nil {
+		c.logger.Error("saving state failed",
+			zap.String("storage_key", c.PersistState.StorageKey),
+			zap.Error(err))
+		return last
+	}
+	return data
+}
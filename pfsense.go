@@ -0,0 +1,196 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(PfSense{})
+}
+
+// PfSense is an IP source that reads the addresses of the WAN
+// interface of a pfSense firewall using the REST API package
+// (pfSense-pkg-RESTAPI, v2), as pfSense has no API of its own.
+type PfSense struct {
+	// The URL of the firewall, e.g. https://192.168.1.1.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The API key. Global placeholders like
+	// {env.PFSENSE_API_KEY} are expanded.
+	APIKey string `json:"api_key,omitempty"`
+
+	// The WAN interface, by its name (e.g. wan), description
+	// (e.g. WAN) or device (e.g. igb0). Default: wan
+	Interface string `json:"interface,omitempty"`
+
+	// A PEM file with the CA certificate(s) to trust, e.g.
+	// the firewall's self-signed certificate.
+	CA string `json:"ca,omitempty"`
+
+	// Do not verify the firewall's certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// How long to wait for the firewall. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	client *http.Client
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (PfSense) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.pfsense",
+		New: func() caddy.Module { return new(PfSense) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	pfsense <url> {
+//	    api_key <key>
+//	    interface <name>
+//	    ca <pem file>
+//	    insecure_skip_verify
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (p *PfSense) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&p.Endpoint) {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "api_key":
+				err = singleArg(d, &p.APIKey)
+			case "interface":
+				err = singleArg(d, &p.Interface)
+			case "ca":
+				err = singleArg(d, &p.CA)
+			case "insecure_skip_verify":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				p.InsecureSkipVerify = true
+			case "timeout":
+				err = durationArg(d, &p.Timeout)
+			case "filter":
+				err = p.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (p *PfSense) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger(p)
+	if err := p.Filters.load(ctx); err != nil {
+		return err
+	}
+	if p.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	p.Endpoint = strings.TrimSuffix(p.Endpoint, "/")
+	if p.APIKey == "" {
+		return fmt.Errorf("api_key is required")
+	}
+	if p.Interface == "" {
+		p.Interface = "wan"
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = caddy.Duration(5 * time.Second)
+	}
+	client, err := apiClient(p.Timeout, p.CA, p.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	p.client = client
+	return nil
+}
+
+// GetIPs gets the addresses of the WAN interface.
+func (p PfSense) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return p.Filters.apply(p.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (p PfSense) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	apiKey, err := secret(ctx, p.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"X-Api-Key": {apiKey}}
+	body, err := apiRequest(ctx, p.client, http.MethodGet, p.Endpoint+"/api/v2/status/interfaces", header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var status struct {
+		Data []struct {
+			Name     string `json:"name"`
+			Descr    string `json:"descr"`
+			HWIf     string `json:"hwif"`
+			IPAddr   string `json:"ipaddr"`
+			IPAddrV6 string `json:"ipaddrv6"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("decoding interface status: %v", err)
+	}
+
+	for _, iface := range status.Data {
+		if iface.Name != p.Interface && iface.Descr != p.Interface && iface.HWIf != p.Interface {
+			continue
+		}
+		var ips []net.IP
+		for _, addr := range []string{iface.IPAddr, iface.IPAddrV6} {
+			if addr == "" {
+				continue
+			}
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", addr)
+			}
+			ips = append(ips, ip)
+		}
+		p.logger.Debug("interface addresses",
+			zap.String("interface", iface.Name),
+			zap.Strings("ips", ipStrings(ips)))
+		return filterVersions(ips, versions), nil
+	}
+	return nil, fmt.Errorf("firewall has no interface %s", p.Interface)
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*PfSense)(nil)
+	_ caddy.Provisioner     = (*PfSense)(nil)
+	_ caddyfile.Unmarshaler = (*PfSense)(nil)
+)
@@ -0,0 +1,93 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// provisionPipeline sets the defaults of the pipeline stages.
+func (c *Command) provisionPipeline() error {
+	if len(c.Pipeline) == 0 {
+		return nil
+	}
+	if c.Mode != "" && c.Mode != ModeExec {
+		return fmt.Errorf("pipe is not supported in %s mode", c.Mode)
+	}
+	for i := range c.Pipeline {
+		c.Pipeline[i].provision()
+	}
+	return nil
+}
+
+// runPipeline passes the output of the command through the stages
+// of the pipeline, one after another, and returns the output of the
+// last one. Every stage gets the complete output of the previous
+// one on stdin and must succeed without writing to stderr.
+func (c Command) runPipeline(ctx context.Context, e Exec, stdout []byte, env []string) ([]byte, error) {
+	for i, stage := range c.Pipeline {
+		expandedArgs, loggedArgs, err := expandArgs(stage.Args)
+		if err != nil {
+			c.logger.Error("expanding args failed",
+				zap.String("command", e.Cmd),
+				zap.Int("stage", i+1),
+				zap.String("stage_command", stage.Cmd),
+				zap.Strings("args", stage.Args),
+				zap.Error(err))
+			return nil, fmt.Errorf("expanding args of pipeline stage %d (%s): %v", i+1, stage.Cmd, err)
+		}
+
+		c.logger.Debug("running pipeline stage",
+			zap.String("command", e.Cmd),
+			zap.Int("stage", i+1),
+			zap.String("stage_command", stage.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("dir", stage.Dir),
+			zap.Int64("timeout", int64(time.Duration(stage.Timeout))))
+
+		var stderr []byte
+		input := stdout
+		stdout, stderr, err = c.runInput(ctx, stage.Cmd, expandedArgs, stage.Dir, env, time.Duration(stage.Timeout), input)
+		stdout, stderr = normalizeOutput(stdout), normalizeOutput(stderr)
+		if err != nil || len(stderr) > 0 {
+			cmdErr := &commandError{cmd: stage.Cmd, stderr: string(stderr), err: err}
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				cmdErr.exitCode = exitErr.ExitCode()
+			}
+			c.logger.Error("pipeline stage failed",
+				zap.String("command", e.Cmd),
+				zap.Int("stage", i+1),
+				zap.String("stage_command", stage.Cmd),
+				zap.Strings("args", loggedArgs),
+				zap.String("stdin", string(input)),
+				zap.String("stdout", string(stdout)),
+				zap.String("stderr", string(stderr)),
+				zap.Int("exit code", cmdErr.exitCode),
+				zap.Error(err))
+			return nil, &pipelineError{stage: i + 1, commandError: cmdErr}
+		}
+	}
+	return stdout, nil
+}
+
+// pipelineError is returned if a stage of the pipeline fails.
+type pipelineError struct {
+	stage int
+	*commandError
+}
+
+func (e *pipelineError) Error() string {
+	return fmt.Sprintf("pipeline stage %d (%s): %v", e.stage, e.cmd, e.commandError)
+}
+
+func (e *pipelineError) Unwrap() error { return e.commandError }
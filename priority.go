@@ -0,0 +1,91 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"runtime"
+
+	"go.uber.org/zap"
+)
+
+// I/O scheduling classes of IONiceClass.
+const (
+	IONiceRealtime   = "realtime"
+	IONiceBestEffort = "best-effort"
+	IONiceIdle       = "idle"
+)
+
+// provisionPriority checks the scheduling options.
+func (c *Command) provisionPriority() error {
+	if c.Nice != 0 {
+		if !niceSupported {
+			return fmt.Errorf("nice is not supported on %s", runtime.GOOS)
+		}
+		if c.Nice < -20 || c.Nice > 19 {
+			return fmt.Errorf("invalid nice %d: must be between -20 and 19", c.Nice)
+		}
+	}
+
+	if c.IONiceClass != "" || len(c.CPUAffinity) > 0 {
+		if !ioniceSupported {
+			return fmt.Errorf("ionice and cpu_affinity are not supported on %s", runtime.GOOS)
+		}
+	}
+	switch c.IONiceClass {
+	case "", IONiceIdle:
+		if c.IONiceLevel != 0 {
+			return fmt.Errorf("the ionice class %s has no levels", c.IONiceClass)
+		}
+	case IONiceRealtime, IONiceBestEffort:
+		if c.IONiceLevel < 0 || c.IONiceLevel > 7 {
+			return fmt.Errorf("invalid ionice level %d: must be between 0 and 7", c.IONiceLevel)
+		}
+	default:
+		return fmt.Errorf("unknown ionice class %s", c.IONiceClass)
+	}
+
+	for _, cpu := range c.CPUAffinity {
+		if cpu < 0 || cpu >= runtime.NumCPU() {
+			return fmt.Errorf("invalid cpu_affinity %d: there are %d CPUs", cpu, runtime.NumCPU())
+		}
+	}
+	return nil
+}
+
+// applyPriority applies the scheduling options to the started
+// process pid. Failures are logged, but do not stop the process,
+// as it runs fine, if only with more priority than it should.
+func (c Command) applyPriority(name string, pid int) {
+	if c.Nice != 0 {
+		if err := setNice(pid, c.Nice); err != nil {
+			c.logger.Warn("setting nice failed",
+				zap.String("command", name),
+				zap.Int("pid", pid),
+				zap.Int("nice", c.Nice),
+				zap.Error(err))
+		}
+	}
+	if c.IONiceClass != "" {
+		if err := setIONice(pid, c.IONiceClass, c.IONiceLevel); err != nil {
+			c.logger.Warn("setting ionice failed",
+				zap.String("command", name),
+				zap.Int("pid", pid),
+				zap.String("class", c.IONiceClass),
+				zap.Int("level", c.IONiceLevel),
+				zap.Error(err))
+		}
+	}
+	if len(c.CPUAffinity) > 0 {
+		if err := setCPUAffinity(pid, c.CPUAffinity); err != nil {
+			c.logger.Warn("setting cpu_affinity failed",
+				zap.String("command", name),
+				zap.Int("pid", pid),
+				zap.Ints("cpus", c.CPUAffinity),
+				zap.Error(err))
+		}
+	}
+}
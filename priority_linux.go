@@ -0,0 +1,44 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const ioniceSupported = true
+
+// The arguments of the ioprio_set system call.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// ioprioClasses are the I/O scheduling classes by name.
+var ioprioClasses = map[string]int{
+	IONiceRealtime:   1,
+	IONiceBestEffort: 2,
+	IONiceIdle:       3,
+}
+
+// setIONice sets the I/O scheduling class and level of the process pid.
+func setIONice(pid int, class string, level int) error {
+	prio := ioprioClasses[class]<<ioprioClassShift | level
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(prio))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setCPUAffinity restricts the process pid to the cpus.
+func setCPUAffinity(pid int, cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(pid, &set)
+}
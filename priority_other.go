@@ -0,0 +1,25 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !linux
+
+package command
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const ioniceSupported = false
+
+// setIONice is only supported on Linux.
+func setIONice(pid int, class string, level int) error {
+	return fmt.Errorf("not supported on %s", runtime.GOOS)
+}
+
+// setCPUAffinity is only supported on Linux.
+func setCPUAffinity(pid int, cpus []int) error {
+	return fmt.Errorf("not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !windows
+
+package command
+
+import "syscall"
+
+const niceSupported = true
+
+// setNice sets the niceness of the process pid.
+func setNice(pid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice)
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import "fmt"
+
+const niceSupported = false
+
+// setNice is not supported on Windows.
+func setNice(pid, nice int) error {
+	return fmt.Errorf("not supported on windows")
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Privilege wrappers of PrivilegeWrapper.
+const (
+	WrapperSudo = "sudo"
+	WrapperDoas = "doas"
+)
+
+// privilegeCheckTimeout is how long checking whether a command
+// may be run with the privilege wrapper may take.
+const privilegeCheckTimeout = 10 * time.Second
+
+// privilegeWaitDelay is how long a wrapper gets to pass on the
+// interrupt to the command when it timed out before it is killed.
+const privilegeWaitDelay = 5 * time.Second
+
+// doasConfigs are the usual paths of the configuration of doas.
+var doasConfigs = []string{"/etc/doas.conf", "/usr/local/etc/doas.conf"}
+
+// provisionPrivilegeWrapper resolves the privilege wrapper and
+// ensures that it runs every command without asking for a
+// password, which would otherwise only show up as a timeout.
+func (c *Command) provisionPrivilegeWrapper() error {
+	if c.PrivilegeWrapper == "" {
+		if len(c.PrivilegeWrapperFlags) > 0 {
+			return fmt.Errorf("privilege_wrapper flags require a privilege_wrapper")
+		}
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("privilege_wrapper is not supported on windows")
+	}
+	if c.PrivilegeWrapper != WrapperSudo && c.PrivilegeWrapper != WrapperDoas {
+		return fmt.Errorf("unknown privilege_wrapper %s", c.PrivilegeWrapper)
+	}
+	if c.Mode != "" && c.Mode != ModeExec {
+		return fmt.Errorf("privilege_wrapper is not supported in %s mode", c.Mode)
+	}
+	if c.Chroot != "" {
+		return fmt.Errorf("privilege_wrapper is not supported with chroot")
+	}
+	path, err := exec.LookPath(c.PrivilegeWrapper)
+	if err != nil {
+		return fmt.Errorf("privilege_wrapper: %v", err)
+	}
+	c.wrapper = path
+
+	check := func(name string, e Exec) error {
+		if err := c.checkPrivilege(e.Cmd, e.Dir); err != nil {
+			return fmt.Errorf("privilege_wrapper: %s %s: %v", name, e.Cmd, err)
+		}
+		return nil
+	}
+	if err := check("command", Exec{Cmd: c.Cmd, Dir: c.Dir}); err != nil {
+		return err
+	}
+	for _, e := range c.Commands {
+		if err := check("command", e); err != nil {
+			return err
+		}
+	}
+	for _, e := range c.Pipeline {
+		if err := check("pipe command", e); err != nil {
+			return err
+		}
+	}
+	if c.Before != nil {
+		if err := check("before hook", c.Before.Exec); err != nil {
+			return err
+		}
+	}
+	if c.After != nil {
+		if err := check("after hook", c.After.Exec); err != nil {
+			return err
+		}
+	}
+	if c.OnFailure != nil && c.OnFailure.Cmd != "" {
+		if err := check("on_failure command", Exec{Cmd: c.OnFailure.Cmd}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPrivilege returns an error if the privilege wrapper would
+// ask for a password to run cmd in dir. It asks sudo to list the
+// command, or doas to match it against its configuration; neither
+// runs it.
+func (c Command) checkPrivilege(cmd, dir string) error {
+	path, err := commandPath(cmd, dir)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), privilegeCheckTimeout)
+	defer cancel()
+
+	var args []string
+	switch c.PrivilegeWrapper {
+	case WrapperSudo:
+		args = append([]string{"-n", "-l"}, c.PrivilegeWrapperFlags...)
+		args = append(args, "--", path)
+	case WrapperDoas:
+		config, err := doasConfig()
+		if err != nil {
+			return err
+		}
+		args = append([]string{"-n", "-C", config}, c.PrivilegeWrapperFlags...)
+		args = append(args, "--", path)
+	}
+
+	var stdout, stderr bytes.Buffer
+	check := exec.CommandContext(ctx, c.wrapper, args...)
+	check.Stdout = &stdout
+	check.Stderr = &stderr
+	err = check.Run()
+
+	// doas prints the matching rule, permit, permit nopass or
+	// deny, and exits with 1 unless it permits the command
+	if rule := strings.TrimSpace(stdout.String()); c.PrivilegeWrapper == WrapperDoas && rule != "" {
+		if rule != "permit nopass" {
+			return fmt.Errorf("doas must permit it with nopass, but the rule is: %s", rule)
+		}
+		return nil
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// wrap returns the executable and the arguments that run path
+// with args through the privilege wrapper, if configured. The
+// wrapper must never ask for a password, so it fails instead.
+func (c Command) wrap(path string, args []string) (string, []string) {
+	if c.wrapper == "" {
+		return path, args
+	}
+	wrapped := append([]string{"-n"}, c.PrivilegeWrapperFlags...)
+	wrapped = append(wrapped, "--", path)
+	return c.wrapper, append(wrapped, args...)
+}
+
+// doasConfig returns the path of the configuration of doas.
+func doasConfig() (string, error) {
+	for _, path := range doasConfigs {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no doas configuration found in %s", strings.Join(doasConfigs, ", "))
+}
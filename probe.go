@@ -0,0 +1,186 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Environment variables passed to the probe command.
+const (
+	// The address to probe.
+	EnvProbeIP = "CADDY_DDNS_PROBE_IP"
+)
+
+// Probe checks that the addresses the source found are reachable,
+// and withholds the ones that are not, as publishing an address
+// nobody can reach is worse than publishing none. An address is
+// reachable if a TCP connection to the port succeeds, the command
+// exits with 0, or both, if both are set. The command gets the
+// address in the CADDY_DDNS_PROBE_IP environment variable, e.g. to
+// ask an external service to connect back to it, as connecting to
+// the own public address from behind a NAT may fail even if it is
+// reachable from outside, or succeed even if it is not.
+type Probe struct {
+	// The command to execute for every address.
+	Cmd string `json:"command,omitempty"`
+
+	// Arguments to the command. Placeholders, including
+	// {file.<path>}, are expanded in arguments.
+	Args []string `json:"args,omitempty"`
+
+	// The TCP port to connect to on every address.
+	Port int `json:"port,omitempty"`
+
+	// How long to wait for the probe of an address,
+	// before it is considered unreachable. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// unmarshalProbe parses the probe subdirective from the
+// current position of d. Syntax:
+//
+//	probe [<command> <args...>] {
+//	    tcp <port>
+//	    timeout <duration>
+//	}
+func unmarshalProbe(d *caddyfile.Dispenser) (*Probe, error) {
+	p := new(Probe)
+	if d.NextArg() {
+		p.Cmd = d.Val()
+		p.Args = d.RemainingArgs()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "tcp":
+			var port string
+			if !d.AllArgs(&port) {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, d.Errf("invalid probe port '%s': %v", port, err)
+			}
+			p.Port = n
+
+		case "timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid timeout '%s': %v", d.Val(), err)
+			}
+			p.Timeout = caddy.Duration(dur)
+
+		default:
+			return nil, d.Errf("unrecognized probe subdirective '%s'", d.Val())
+		}
+	}
+
+	if p.Cmd == "" && p.Port == 0 {
+		return nil, d.Err("probe needs a command or a tcp port")
+	}
+	return p, nil
+}
+
+// provision checks p and sets its defaults.
+func (p *Probe) provision() error {
+	if p.Cmd == "" && p.Port == 0 {
+		return fmt.Errorf("probe needs a command or a tcp port")
+	}
+	if p.Port < 0 || p.Port > 65535 {
+		return fmt.Errorf("invalid probe port %d", p.Port)
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = caddy.Duration(5 * time.Second)
+	}
+	return nil
+}
+
+// probeAddresses probes all of ips at once and returns the
+// reachable ones, in order.
+func (c Command) probeAddresses(ctx context.Context, ips []net.IP) []net.IP {
+	if c.Probe == nil || len(ips) == 0 {
+		return ips
+	}
+
+	reachable := make([]bool, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip net.IP) {
+			defer wg.Done()
+			err := c.probe(ctx, ip)
+			if err != nil {
+				c.logger.Warn("withholding unreachable address",
+					zap.String("command", c.Cmd),
+					zap.String("ip", ip.String()),
+					zap.Error(err))
+				c.countProbeFailure()
+				return
+			}
+			reachable[i] = true
+		}(i, ip)
+	}
+	wg.Wait()
+
+	out := make([]net.IP, 0, len(ips))
+	for i, ip := range ips {
+		if reachable[i] {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// probe returns an error if ip is not reachable.
+func (c Command) probe(ctx context.Context, ip net.IP) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.Probe.Timeout))
+	defer cancel()
+
+	if c.Probe.Port != 0 {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(c.Probe.Port)))
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+
+	if c.Probe.Cmd != "" {
+		expandedArgs, loggedArgs, err := expandArgs(c.Probe.Args)
+		if err != nil {
+			return err
+		}
+		env := []string{
+			EnvProbeIP + "=" + ip.String(),
+			EnvRunID + "=" + c.runID,
+			EnvLabel + "=" + c.Label,
+		}
+		stdout, stderr, err := c.run(ctx, c.Probe.Cmd, expandedArgs, "", env, 0)
+		if err != nil {
+			return fmt.Errorf("probe command %s: %w", c.Probe.Cmd, err)
+		}
+		c.logger.Debug("probe command succeeded",
+			zap.String("command", c.Probe.Cmd),
+			zap.Strings("args", loggedArgs),
+			zap.String("ip", ip.String()),
+			zap.String("stdout", string(stdout)),
+			zap.String("stderr", string(stderr)))
+	}
+	return nil
+}
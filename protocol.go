@@ -0,0 +1,98 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the latest version of the protocol between
+// the source and its commands that the source understands. It
+// is passed to the commands as CADDY_DDNS_PROTO, so that a script
+// can print the newest envelope the source can parse:
+//
+//   - 1: the addresses, separated by commas, as printed by the
+//     scripts written before there was an envelope, and the
+//     other formats;
+//   - 2: the envelope, a JSON object with a "proto" key, see
+//     envelope.
+const ProtocolVersion = 2
+
+// The statuses of an envelope.
+const (
+	// The addresses did not change, like SentinelNoChange.
+	EnvelopeUnchanged = "unchanged"
+
+	// There are no addresses, like SentinelNone.
+	EnvelopeNone = "none"
+)
+
+// envelope is the output of a command in version 2 of the
+// protocol. Keys that are unknown to this version are ignored,
+// so that an envelope may carry extensions for later versions
+// as long as its proto stays at 2.
+type envelope struct {
+	// the version of the protocol, 2
+	Proto json.Number `json:"proto"`
+
+	// what the command found; "" for addresses
+	Status string `json:"status"`
+
+	// the addresses and their metadata,
+	// like in the extended format
+	extendedOutput
+}
+
+// isEnvelope returns true if output is a JSON object with
+// a proto key, i.e. not in version 1 of the protocol.
+func isEnvelope(output string) bool {
+	trimmed := strings.TrimSpace(output)
+	if !strings.HasPrefix(trimmed, "{") {
+		return false
+	}
+	var probe struct {
+		Proto json.RawMessage `json:"proto"`
+	}
+	return json.Unmarshal([]byte(trimmed), &probe) == nil && probe.Proto != nil
+}
+
+// envelopeTokens returns the addresses of an envelope and
+// merges its metadata into meta. It returns ErrUnchanged for
+// the unchanged status and no tokens for the none status.
+func envelopeTokens(output string, meta *Metadata) ([]token, error) {
+	var env envelope
+	if err := json.Unmarshal([]byte(output), &env); err != nil {
+		return nil, fmt.Errorf("parsing envelope: %v", err)
+	}
+	proto, err := strconv.Atoi(env.Proto.String())
+	if err != nil || proto < 2 {
+		return nil, fmt.Errorf("invalid envelope proto %s", env.Proto)
+	}
+	if proto > ProtocolVersion {
+		return nil, fmt.Errorf("unsupported envelope proto %d: the newest supported is %d", proto, ProtocolVersion)
+	}
+
+	switch env.Status {
+	case "":
+	case EnvelopeUnchanged:
+		return nil, ErrUnchanged
+	case EnvelopeNone:
+		return []token{}, nil
+	default:
+		return nil, fmt.Errorf("invalid envelope status %s", env.Status)
+	}
+
+	// the rest is the extended format, from which the
+	// metadata is taken the same way
+	ext, err := json.Marshal(env.extendedOutput)
+	if err != nil {
+		return nil, err
+	}
+	return extendedTokens(string(ext), meta)
+}
@@ -0,0 +1,441 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(PushHandler{})
+	caddy.RegisterModule(Push{})
+	httpcaddyfile.RegisterHandlerDirective("ddns_push", parsePushHandler)
+}
+
+// pushes holds the addresses pushed to the ddns_push handlers, by
+// name, for the push sources of the same name. They are kept
+// across reloads, as long as a loaded config uses them.
+var pushes = caddy.NewUsagePool()
+
+// pushState holds the addresses last pushed under a name.
+type pushState struct {
+	mu     sync.Mutex
+	ips    []net.IP
+	pushed time.Time
+
+	subscribers map[int]func([]net.IP)
+	nextID      int
+}
+
+// loadPushState returns the pushed addresses of name and the
+// key to release them with.
+func loadPushState(name string) (*pushState, string, error) {
+	key := "push:" + name
+	val, _, err := pushes.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return &pushState{subscribers: make(map[int]func([]net.IP))}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return val.(*pushState), key, nil
+}
+
+// Destruct implements caddy.Destructor; there is nothing to release.
+func (*pushState) Destruct() error { return nil }
+
+// PushHandler is an HTTP handler that accepts the current public
+// addresses pushed to it, e.g. by a router that can call a custom
+// DDNS URL when its address changed, but cannot run scripts. The
+// push source of the same name returns them.
+//
+// The addresses are read from the ip, myip, ipv4 and ipv6 query
+// or form parameters, comma separated, or else from a plain text
+// body. If there are none, the address of the client is used, like
+// by the dyndns2 protocol. The response is "good <addresses>", or
+// "nochg <addresses>" if they did not change.
+type PushHandler struct {
+	// The name the addresses are pushed under. Default: default
+	Name string `json:"name,omitempty"`
+
+	// A token the client must send as bearer token in the
+	// Authorization header or as token query parameter. Global
+	// placeholders like {env.PUSH_TOKEN} are expanded.
+	Token string `json:"token,omitempty"`
+
+	// The credentials the client may send by HTTP Basic
+	// authentication instead, as many routers only support
+	// these. Global placeholders in the password are expanded.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	state  *pushState
+	key    string
+	ctx    caddy.Context
+	events *caddyevents.App
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (PushHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.ddns_push",
+		New: func() caddy.Module { return new(PushHandler) },
+	}
+}
+
+// UnmarshalCaddyfile parses the handler's Caddyfile config. Syntax:
+//
+//	ddns_push [<name>] {
+//	    token <token>
+//	    basic_auth <username> <password>
+//	}
+func (p *PushHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			p.Name = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "token":
+				err = singleArg(d, &p.Token)
+			case "basic_auth":
+				if !d.AllArgs(&p.Username, &p.Password) {
+					err = d.ArgErr()
+				}
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parsePushHandler sets up the handler from the
+// ddns_push directive of the Caddyfile.
+func parsePushHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	p := new(PushHandler)
+	err := p.UnmarshalCaddyfile(h.Dispenser)
+	return p, err
+}
+
+// Provision sets up the handler.
+func (p *PushHandler) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger(p)
+	p.ctx = ctx
+	if p.Name == "" {
+		p.Name = "default"
+	}
+	if p.Token == "" && p.Username == "" {
+		return fmt.Errorf("token or basic_auth is required")
+	}
+
+	app, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("loading events app: %v", err)
+	}
+	p.events = app.(*caddyevents.App)
+	p.state, p.key, err = loadPushState(p.Name)
+	return err
+}
+
+// Cleanup releases the pushed addresses, which are
+// dropped if no loaded config uses them.
+func (p *PushHandler) Cleanup() error {
+	if p.state == nil {
+		return nil
+	}
+	_, err := pushes.Delete(p.key)
+	return err
+}
+
+// ServeHTTP takes the pushed addresses.
+func (p PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+	if !p.authorized(r) {
+		p.logger.Warn("unauthorized push",
+			zap.String("name", p.Name),
+			zap.String("remote_addr", r.RemoteAddr))
+		w.Header().Set("WWW-Authenticate", `Basic realm="ddns_push"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, err := io.WriteString(w, "badauth\n")
+		return err
+	}
+
+	ips, err := pushedIPs(r)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	s := p.state
+	s.mu.Lock()
+	old := s.ips
+	changed := !sameIPs(old, ips)
+	s.ips = ips
+	s.pushed = time.Now()
+	var subscribers []func([]net.IP)
+	if changed {
+		for _, fn := range s.subscribers {
+			subscribers = append(subscribers, fn)
+		}
+	}
+	s.mu.Unlock()
+
+	status := "nochg"
+	if changed {
+		status = "good"
+		p.logger.Info("pushed addresses changed",
+			zap.String("name", p.Name),
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.Strings("old_ips", ipStrings(old)),
+			zap.Strings("new_ips", ipStrings(ips)))
+		p.events.Emit(p.ctx, EventIPsChanged, map[string]any{
+			"push": p.Name,
+			"old":  ipStrings(old),
+			"new":  ipStrings(ips),
+		})
+		for _, fn := range subscribers {
+			fn(ips)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = fmt.Fprintf(w, "%s %s\n", status, strings.Join(ipStrings(ips), ","))
+	return err
+}
+
+// authorized reports whether r carries the token or credentials.
+func (p PushHandler) authorized(r *http.Request) bool {
+	if p.Token != "" {
+		token := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token != "" && secretEqual(token, expandSecret(p.Token)) {
+			return true
+		}
+	}
+	if p.Username != "" {
+		username, password, ok := r.BasicAuth()
+		if ok && secretEqual(username, p.Username) && secretEqual(password, expandSecret(p.Password)) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretEqual compares a and b in constant time.
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// pushedIPs returns the addresses pushed by r.
+func pushedIPs(r *http.Request) ([]net.IP, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, name := range []string{"ip", "myip", "ipv4", "ipv6"} {
+		list = append(list, r.Form[name]...)
+	}
+	if len(list) == 0 && r.Method == http.MethodPost {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, string(body))
+	}
+	ips, err := parseIPList(strings.Join(list, ","))
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+
+	// like dyndns2, fall back to the address of the client,
+	// which respects the trusted proxies of the server
+	clientIP, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if ip := net.ParseIP(clientIP); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return nil, fmt.Errorf("no addresses pushed")
+}
+
+// Push is an IP source that returns the addresses last pushed to
+// the ddns_push HTTP handler of the same name. Since it learns of
+// changes as they are pushed, it supports the Watcher interface.
+//
+// Before the first push, e.g. after Caddy started, the lookup fails.
+type Push struct {
+	// The name the addresses are pushed under. Default: default
+	Name string `json:"name,omitempty"`
+
+	// Fail the lookup if the addresses were pushed longer than
+	// this ago, e.g. because the router stopped pushing them.
+	// Default: the addresses do not expire
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// How often a consumer of the Scheduler interface should look
+	// up the addresses, since the pushes are announced to the
+	// subscribers anyway; the dynamic_dns app does not use it.
+	// Default: 1h, or max_age if shorter
+	PollInterval caddy.Duration `json:"poll_interval,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	state  *pushState
+	key    string
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Push) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.push",
+		New: func() caddy.Module { return new(Push) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	push [<name>] {
+//	    max_age <duration>
+//	    poll_interval <duration>
+//	    filter <name> ...
+//	}
+func (p *Push) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			p.Name = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "max_age":
+				err = durationArg(d, &p.MaxAge)
+			case "poll_interval":
+				err = durationArg(d, &p.PollInterval)
+			case "filter":
+				err = p.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (p *Push) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger(p)
+	if err := p.Filters.load(ctx); err != nil {
+		return err
+	}
+	if p.Name == "" {
+		p.Name = "default"
+	}
+	var err error
+	p.state, p.key, err = loadPushState(p.Name)
+	return err
+}
+
+// Cleanup releases the pushed addresses.
+func (p *Push) Cleanup() error {
+	if p.state == nil {
+		return nil
+	}
+	_, err := pushes.Delete(p.key)
+	return err
+}
+
+// GetIPs returns the addresses last pushed. It does not wait for
+// anything, so it ignores ctx.
+func (p Push) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return p.Filters.apply(p.getIPs(versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (p Push) getIPs(versions dynamicdns.IPVersions) ([]net.IP, error) {
+	p.state.mu.Lock()
+	ips, pushed := p.state.ips, p.state.pushed
+	p.state.mu.Unlock()
+
+	if pushed.IsZero() {
+		return nil, fmt.Errorf("no addresses pushed to %s yet", p.Name)
+	}
+	if age := time.Since(pushed); p.MaxAge > 0 && age > time.Duration(p.MaxAge) {
+		p.logger.Warn("pushed addresses expired",
+			zap.String("name", p.Name),
+			zap.Duration("age", age),
+			zap.Strings("ips", ipStrings(ips)))
+		return nil, fmt.Errorf("addresses pushed to %s %s ago expired", p.Name, age.Round(time.Second))
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// Subscribe calls fn with the new addresses of the families in
+// versions, after the filters, every time different ones are
+// pushed, until the returned function is called.
+func (p Push) Subscribe(versions dynamicdns.IPVersions, fn func([]net.IP)) func() {
+	s := p.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.subscribers[id] = subscriber(versions, p.Filters, fn)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subscribers, id)
+	}
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*PushHandler)(nil)
+	_ caddy.Provisioner           = (*PushHandler)(nil)
+	_ caddy.CleanerUpper          = (*PushHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*PushHandler)(nil)
+
+	_ dynamicdns.IPSource   = (*Push)(nil)
+	_ Watcher               = (*Push)(nil)
+	_ caddy.Provisioner     = (*Push)(nil)
+	_ caddy.CleanerUpper    = (*Push)(nil)
+	_ caddyfile.Unmarshaler = (*Push)(nil)
+)
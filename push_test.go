@@ -0,0 +1,82 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func TestPushSubscribeFilters(t *testing.T) {
+	// the handler needs the events app of a running config
+	err := caddy.Load([]byte(`{"admin":{"disabled":true,"config":{"persist":false}},"apps":{"events":{}}}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+	ctx := caddy.ActiveContext()
+
+	mod, err := ctx.LoadModuleByID("http.handlers.ddns_push", []byte(`{"name":"subscribe_filters","token":"secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := mod.(*PushHandler)
+	t.Cleanup(func() { handler.Cleanup() })
+
+	filter := &SubnetFilter{Deny: []string{"10.0.0.0/8"}}
+	if err := filter.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	src := Push{Name: "subscribe_filters", Filters: Filters{filters: []Filter{filter}}, logger: zap.NewNop()}
+	src.state, src.key, err = loadPushState(src.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { src.Cleanup() })
+
+	v4, v6 := true, false
+	versions := dynamicdns.IPVersions{IPv4: &v4, IPv6: &v6}
+	var got [][]net.IP
+	unsubscribe := src.Subscribe(versions, func(ips []net.IP) {
+		got = append(got, ips)
+	})
+	defer unsubscribe()
+
+	push := func(query string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/?token=secret&"+query, nil)
+		if err := handler.ServeHTTP(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	push("ip=10.0.0.1,203.0.113.1&ipv6=2001:db8::1")
+	if len(got) != 1 || !sameIPs(got[0], []net.IP{net.ParseIP("203.0.113.1")}) {
+		t.Fatalf("after the first push: got %v, want [[203.0.113.1]]", got)
+	}
+
+	// only addresses the filter or the versions drop changed
+	push("ip=10.0.0.2,203.0.113.1&ipv6=2001:db8::2")
+	if len(got) != 1 {
+		t.Errorf("subscriber called without a change of the filtered addresses: %v", got[1:])
+	}
+
+	push("ip=203.0.113.2")
+	if len(got) != 2 || !sameIPs(got[1], []net.IP{net.ParseIP("203.0.113.2")}) {
+		t.Errorf("after the last push: got %v, want [203.0.113.2] last", got)
+	}
+	ips, err := src.GetIPs(context.Background(), versions)
+	if err != nil || !sameIPs(ips, []net.IP{net.ParseIP("203.0.113.2")}) {
+		t.Errorf("GetIPs: got %v, %v", ips, err)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Race{})
+}
+
+// raceVars are the counters of the race sources, published by
+// expvar next to the ones of the command sources. They are keyed
+// by the label of the race, then by its sources.
+var raceVars = expvar.NewMap("dynamic_dns_race")
+
+// races are the counters of the sources of the races
+// by the label of the race and the name of the source.
+var races = struct {
+	mu    sync.Mutex
+	byKey map[string]*raceSourceVars
+}{byKey: make(map[string]*raceSourceVars)}
+
+// raceSourceVars are the counters of a source of a race.
+type raceSourceVars struct {
+	// how often the source was the first with an address
+	// of the family
+	winsIPv4 expvar.Int
+	winsIPv6 expvar.Int
+
+	// how long the source took the last time it won
+	lastWinMS expvar.Int
+}
+
+// Race is an IP source that runs several sources at once and
+// returns, for each family, the addresses of the first source
+// that found any, canceling the others as soon as every family
+// has them. Unlike trying the sources one after another, a slow
+// or hanging echo service then only delays the lookup if all of
+// them are slow.
+type Race struct {
+	// The sources to run at once.
+	SourcesRaw []json.RawMessage `json:"sources,omitempty" caddy:"namespace=dynamic_dns.ip_sources inline_key=source"`
+
+	// The key of the counters of the race. Default: race
+	Label string `json:"label,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	sources []dynamicdns.IPSource
+	names   []string
+	vars    []*raceSourceVars
+	logger  *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Race) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.race",
+		New: func() caddy.Module { return new(Race) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	race {
+//	    source <name> ...
+//	    label <label>
+//	    filter <name> ...
+//	}
+func (r *Race) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "source":
+				var raw json.RawMessage
+				if raw, err = sourceArg(d); err == nil {
+					r.SourcesRaw = append(r.SourcesRaw, raw)
+				}
+			case "label":
+				err = singleArg(d, &r.Label)
+			case "filter":
+				err = r.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (r *Race) Provision(ctx caddy.Context) error {
+	r.logger = ctx.Logger(r)
+	if err := r.Filters.load(ctx); err != nil {
+		return err
+	}
+	if len(r.SourcesRaw) == 0 {
+		return fmt.Errorf("race needs at least one source")
+	}
+	if r.Label == "" {
+		r.Label = "race"
+	}
+
+	// the names, before loading the sources clears SourcesRaw
+	for i, raw := range r.SourcesRaw {
+		name, err := sourceName(raw)
+		if err != nil {
+			return fmt.Errorf("source %d: %v", i, err)
+		}
+		r.names = append(r.names, strconv.Itoa(i)+":"+name)
+	}
+
+	mods, err := ctx.LoadModule(r, "SourcesRaw")
+	if err != nil {
+		return fmt.Errorf("loading sources: %v", err)
+	}
+	for _, mod := range mods.([]any) {
+		r.sources = append(r.sources, mod.(dynamicdns.IPSource))
+	}
+	r.provisionVars()
+	return nil
+}
+
+// provisionVars loads the counters of the sources, creating them
+// for the first race with this label. They are kept as long as
+// Caddy runs, across reloads.
+func (r *Race) provisionVars() {
+	races.mu.Lock()
+	defer races.mu.Unlock()
+	m, ok := raceVars.Get(r.Label).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map).Init()
+		raceVars.Set(r.Label, m)
+	}
+	for _, name := range r.names {
+		key := r.Label + "\x00" + name
+		v, ok := races.byKey[key]
+		if !ok {
+			v = new(raceSourceVars)
+			sm := new(expvar.Map).Init()
+			sm.Set("wins_ipv4", &v.winsIPv4)
+			sm.Set("wins_ipv6", &v.winsIPv6)
+			sm.Set("last_win_ms", &v.lastWinMS)
+			m.Set(name, sm)
+			races.byKey[key] = v
+		}
+		r.vars = append(r.vars, v)
+	}
+}
+
+// GetIPs gets the addresses of the sources that were the
+// first to find addresses of each family.
+func (r Race) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return r.Filters.apply(r.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (r Race) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	// the sources that lost are canceled when the race is over
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i   int
+		ips []net.IP
+		err error
+	}
+	start := time.Now()
+	results := make(chan result, len(r.sources))
+	for i, source := range r.sources {
+		go func(i int, source dynamicdns.IPSource) {
+			ips, err := source.GetIPs(ctx, versions)
+			results <- result{i: i, ips: ips, err: err}
+		}(i, source)
+	}
+
+	var v4, v6 []net.IP
+	won4, won6 := !versions.V4Enabled(), !versions.V6Enabled()
+	var errs []error
+	for n := 0; n < len(r.sources) && !(won4 && won6); n++ {
+		res := <-results
+		if res.err != nil {
+			r.logger.Debug("race source failed",
+				zap.String("source", r.names[res.i]),
+				zap.Error(res.err))
+			errs = append(errs, fmt.Errorf("%s: %w", r.names[res.i], res.err))
+		}
+
+		// a partial result still wins the families it has
+		var got4, got6 []net.IP
+		for _, ip := range res.ips {
+			if ip.To4() != nil {
+				got4 = append(got4, ip)
+			} else {
+				got6 = append(got6, ip)
+			}
+		}
+		took := time.Since(start)
+		if !won4 && len(got4) > 0 {
+			v4, won4 = got4, true
+			r.win(res.i, "ipv4", took)
+		}
+		if !won6 && len(got6) > 0 {
+			v6, won6 = got6, true
+			r.win(res.i, "ipv6", took)
+		}
+	}
+
+	ips := append(v4, v6...)
+	if len(ips) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return ips, nil
+}
+
+// win records that source i was the first with
+// addresses of family, after took.
+func (r Race) win(i int, family string, took time.Duration) {
+	r.logger.Debug("race source won",
+		zap.String("source", r.names[i]),
+		zap.String("family", family),
+		zap.Duration("took", took))
+	if family == "ipv4" {
+		r.vars[i].winsIPv4.Add(1)
+	} else {
+		r.vars[i].winsIPv6.Add(1)
+	}
+	r.vars[i].lastWinMS.Set(took.Milliseconds())
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*Race)(nil)
+	_ caddy.Provisioner     = (*Race)(nil)
+	_ caddyfile.Unmarshaler = (*Race)(nil)
+)
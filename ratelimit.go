@@ -0,0 +1,152 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// limiters are the token buckets of the sources with MaxRate, by
+// command line, so that neither reloads nor several sources with
+// the same command can run it more often. A bucket is released
+// once no loaded config uses it.
+var limiters = caddy.NewUsagePool()
+
+// limiter is a token bucket that holds up to burst tokens and
+// refills one every interval.
+type limiter struct {
+	key string
+
+	mu       sync.Mutex
+	burst    float64
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+// parseRate parses a rate like "6/h" into the number of runs
+// and the period they are allowed in.
+func parseRate(rate string) (int, time.Duration, error) {
+	n, unit, ok := strings.Cut(rate, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("must be <n>/<unit>, like 6/h")
+	}
+	runs, err := strconv.Atoi(n)
+	if err != nil || runs <= 0 {
+		return 0, 0, fmt.Errorf("invalid number of runs %s", n)
+	}
+	switch unit {
+	case "s":
+		return runs, time.Second, nil
+	case "m":
+		return runs, time.Minute, nil
+	case "h":
+		return runs, time.Hour, nil
+	case "d":
+		return runs, 24 * time.Hour, nil
+	}
+	period, err := time.ParseDuration(unit)
+	if err != nil || period <= 0 {
+		return 0, 0, fmt.Errorf("invalid unit %s: must be s, m, h, d or a duration", unit)
+	}
+	return runs, period, nil
+}
+
+// provisionRateLimit loads the token bucket of the source, creating
+// it for the first source with this command line. The rate of the
+// config loaded last applies; the tokens are kept across reloads.
+func (c *Command) provisionRateLimit() error {
+	if c.MaxRate == "" {
+		return nil
+	}
+	runs, period, err := parseRate(c.MaxRate)
+	if err != nil {
+		return fmt.Errorf("invalid max_rate %s: %v", c.MaxRate, err)
+	}
+	// the whole command line, secrets included, so that commands
+	// that only differ by a secret arg have buckets of their own
+	sum := sha256.Sum256([]byte(strings.Join(append([]string{c.Cmd}, c.Args...), "\x00")))
+	key := "limiter:" + hex.EncodeToString(sum[:])
+
+	val, _, err := limiters.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return &limiter{key: key, tokens: float64(runs), last: time.Now()}, nil
+	})
+	if err != nil {
+		return err
+	}
+	l := val.(*limiter)
+	l.mu.Lock()
+	l.burst = float64(runs)
+	l.interval = period / time.Duration(runs)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.mu.Unlock()
+	c.limiter = l
+	return nil
+}
+
+// cleanupRateLimit releases the token bucket, which is
+// dropped if no other loaded config uses it.
+func (c *Command) cleanupRateLimit() error {
+	if c.limiter == nil {
+		return nil
+	}
+	_, err := limiters.Delete(c.limiter.key)
+	return err
+}
+
+// Destruct implements caddy.Destructor; there is nothing to release.
+func (*limiter) Destruct() error { return nil }
+
+// take takes a token and returns true, or returns false
+// and how long until the next one if there is none.
+func (l *limiter) take() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false, time.Duration((1 - l.tokens) * float64(l.interval))
+	}
+	l.tokens--
+	return true, 0
+}
+
+// allowRun returns ErrRateLimited if the command may
+// not run again yet by MaxRate, and else nil.
+func (c Command) allowRun() error {
+	if c.limiter == nil {
+		return nil
+	}
+	ok, wait := c.limiter.take()
+	if ok {
+		return nil
+	}
+	c.logger.Warn("not running command; max_rate exceeded",
+		zap.String("command", c.Cmd),
+		zap.String("max_rate", c.MaxRate),
+		zap.Duration("next_run_in", wait))
+	return ErrRateLimited
+}
+
+// Interface guards
+var (
+	_ caddy.Destructor = (*limiter)(nil)
+)
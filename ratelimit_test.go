@@ -0,0 +1,39 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import "testing"
+
+func TestRateLimitBuckets(t *testing.T) {
+	provision := func(token string) *Command {
+		t.Helper()
+		c := &Command{Cmd: "curl", Args: []string{"-H", token}, SecretArgs: []int{1}, MaxRate: "1/h"}
+		if err := c.provisionRateLimit(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	a := provision("token-a")
+	b := provision("token-b")
+	again := provision("token-a")
+	if a.limiter == b.limiter {
+		t.Error("commands that only differ by a secret arg share a bucket")
+	}
+	if a.limiter != again.limiter {
+		t.Error("sources with the same command line do not share a bucket")
+	}
+
+	for _, c := range []*Command{a, b, again} {
+		if err := c.cleanupRateLimit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []*Command{a, b} {
+		if refs, ok := limiters.References(c.limiter.key); ok {
+			t.Errorf("bucket still in use by %d sources after the cleanup", refs)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted replaces secrets in the logs.
+const Redacted = "[REDACTED]"
+
+// provisionSecrets checks SecretArgs and SecretEnv.
+func (c *Command) provisionSecrets() error {
+	for _, i := range c.SecretArgs {
+		if i < 0 || i >= len(c.Args) {
+			return fmt.Errorf("invalid secret_args %d: the command has %d args", i, len(c.Args))
+		}
+	}
+	for _, name := range c.SecretEnv {
+		if name == "" {
+			return fmt.Errorf("invalid secret_env: empty name")
+		}
+	}
+	return nil
+}
+
+// secrets returns the values of the secret args, with
+// placeholders expanded, and of the secret env vars.
+func (c Command) secrets() []string {
+	var secrets []string
+	for _, i := range c.SecretArgs {
+		expanded, _, _ := expandArgs(c.Args[i : i+1])
+		secrets = append(secrets, expanded[0])
+	}
+	for _, name := range c.SecretEnv {
+		value, ok := c.Env[name]
+		if ok {
+			value = expandSecret(value)
+		} else {
+			value = os.Getenv(name)
+		}
+		secrets = append(secrets, value)
+	}
+
+	// the longest first, in case one contains another
+	out := secrets[:0]
+	for _, s := range secrets {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return len(out[i]) > len(out[j]) })
+	return out
+}
+
+// redactingLogger returns c with a logger that replaces the
+// secrets in everything it logs with Redacted.
+func (c Command) redactingLogger() Command {
+	secrets := c.secrets()
+	if len(secrets) == 0 {
+		return c
+	}
+	r := newRedactor(secrets)
+	c.logger = c.logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return redactingCore{core, r}
+	}))
+	return c
+}
+
+// redactArgs returns args with the secret ones replaced,
+// for the args of the config, e.g. in the admin API.
+func (c Command) redactArgs(args []string) []string {
+	if len(c.SecretArgs) == 0 {
+		return args
+	}
+	out := append([]string(nil), args...)
+	for _, i := range c.SecretArgs {
+		out[i] = Redacted
+	}
+	return out
+}
+
+// redactor replaces secrets.
+type redactor struct {
+	*strings.Replacer
+}
+
+func newRedactor(secrets []string) redactor {
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, s := range secrets {
+		pairs = append(pairs, s, Redacted)
+	}
+	return redactor{strings.NewReplacer(pairs...)}
+}
+
+// strings returns s with the secrets replaced.
+func (r redactor) strings(s []string) []string {
+	out := make([]string, len(s))
+	for i := range s {
+		out[i] = r.Replace(s[i])
+	}
+	return out
+}
+
+// fields returns the fields with the secrets replaced in
+// string, string slice and error fields.
+func (r redactor) fields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case zapcore.StringType:
+			f.String = r.Replace(f.String)
+		case zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok && err != nil {
+				f = zap.String(f.Key, r.Replace(err.Error()))
+			}
+		case zapcore.ArrayMarshalerType:
+			v := reflect.ValueOf(f.Interface)
+			if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String {
+				s := make([]string, v.Len())
+				for j := range s {
+					s[j] = v.Index(j).String()
+				}
+				f = zap.Strings(f.Key, r.strings(s))
+			}
+		}
+		out[i] = f
+	}
+	return out
+}
+
+// redactingCore is a zapcore.Core that replaces
+// secrets before passing entries on to Core.
+type redactingCore struct {
+	zapcore.Core
+	r redactor
+}
+
+// With implements zapcore.Core.
+func (c redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{c.Core.With(c.r.fields(fields)), c.r}
+}
+
+// Check implements zapcore.Core.
+func (c redactingCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+// Write implements zapcore.Core.
+func (c redactingCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	e.Message = c.r.Replace(e.Message)
+	return c.Core.Write(e, c.r.fields(fields))
+}
+
+// Interface guards
+var (
+	_ zapcore.Core = (*redactingCore)(nil)
+)
@@ -0,0 +1,150 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+// provisionRefresh subscribes to the events, the signal and
+// the named pipe that expire the cached result.
+func (c *Command) provisionRefresh(ctx caddy.Context) error {
+	h := refreshHandler{state: c.state, logger: c.logger}
+	if c.RefreshRun {
+		if c.Watch {
+			return fmt.Errorf("refresh_run is not supported with watch")
+		}
+		h.run = func(kind, name string) {
+			go c.lookupNow(ctx, kind, name)
+		}
+	}
+	if len(c.RefreshOn) > 0 {
+		app, err := ctx.App("events")
+		if err != nil {
+			return fmt.Errorf("loading events app: %v", err)
+		}
+		err = app.(*caddyevents.App).Subscribe(&caddyevents.Subscription{
+			Events:   c.RefreshOn,
+			Handlers: []caddyevents.Handler{h},
+		})
+		if err != nil {
+			return fmt.Errorf("subscribing to refresh_on events: %v", err)
+		}
+	}
+
+	if c.RefreshSignal != "" {
+		sig, err := parseSignal(c.RefreshSignal)
+		if err != nil {
+			return fmt.Errorf("invalid refresh_signal '%s': %v", c.RefreshSignal, err)
+		}
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, sig)
+		c.stopRefresh = make(chan struct{})
+		go func(stop <-chan struct{}) {
+			defer signal.Stop(signals)
+			for {
+				select {
+				case <-signals:
+					h.refresh("signal", c.RefreshSignal)
+				case <-stop:
+					return
+				}
+			}
+		}(c.stopRefresh)
+	}
+
+	if c.RefreshPipe != "" {
+		pipe, err := openPipe(c.RefreshPipe)
+		if err != nil {
+			return fmt.Errorf("invalid refresh_pipe '%s': %v", c.RefreshPipe, err)
+		}
+		c.refreshPipe = pipe
+		go func() {
+			// every line written to the pipe is a trigger;
+			// reading fails once the pipe is closed
+			scanner := bufio.NewScanner(pipe)
+			for scanner.Scan() {
+				h.refresh("pipe", c.RefreshPipe)
+			}
+		}()
+	}
+	return nil
+}
+
+// cleanupRefresh stops listening for the signal and
+// closes the named pipe. The pipe itself is kept, as
+// the next config may read from it already.
+func (c *Command) cleanupRefresh() {
+	if c.stopRefresh != nil {
+		close(c.stopRefresh)
+		c.stopRefresh = nil
+	}
+	if c.refreshPipe != nil {
+		c.refreshPipe.Close()
+		c.refreshPipe = nil
+	}
+}
+
+// lookupNow runs the lookup right away after the trigger kind
+// named name expired the cached result, with RefreshRun.
+func (c *Command) lookupNow(ctx context.Context, kind, name string) {
+	ips, err := c.state.shared(ctx, dynamicdns.IPVersions{}, func() ([]net.IP, error) {
+		return c.resolve(ctx, dynamicdns.IPVersions{})
+	})
+	if err != nil {
+		c.logger.Warn("lookup after refresh failed",
+			zap.String("command", c.Cmd),
+			zap.String(kind, name),
+			zap.Error(err))
+		return
+	}
+	c.logger.Debug("looked up after refresh",
+		zap.String("command", c.Cmd),
+		zap.String(kind, name),
+		zap.Strings("ips", ipStrings(ips)))
+}
+
+// refreshHandler expires the cached result on events.
+type refreshHandler struct {
+	state  *state
+	logger *zap.Logger
+
+	// if set, runs the lookup after the cached result expired
+	run func(kind, name string)
+}
+
+// Handle implements caddyevents.Handler.
+func (h refreshHandler) Handle(_ context.Context, e caddyevents.Event) error {
+	h.refresh("event", e.CloudEvent().Type)
+	return nil
+}
+
+// refresh expires the cached result, so that the next
+// lookup runs the command, because of the trigger kind
+// named name.
+func (h refreshHandler) refresh(kind, name string) {
+	h.logger.Info("expiring cached addresses",
+		zap.String(kind, name))
+	h.state.flush()
+	if h.run != nil {
+		h.run(kind, name)
+	}
+}
+
+// Interface guards
+var (
+	_ caddyevents.Handler = (*refreshHandler)(nil)
+)
@@ -0,0 +1,88 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+// lookupWithRetries runs the lookup and retries it on failure
+// as configured.
+func (c Command) lookupWithRetries(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	for attempt := 0; ; attempt++ {
+		ips, err := c.lookupAttempt(ctx, versions)
+		if err == nil || attempt >= c.Retries || !c.retryable(err) || ctx.Err() != nil {
+			return ips, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= time.Duration(c.RetryDelay) {
+			// the retry could not even start in time
+			c.logger.Warn("lookup failed; no time left to retry",
+				zap.String("command", c.Cmd),
+				zap.Int("attempt", attempt+1),
+				zap.Time("deadline", deadline),
+				zap.Error(err))
+			return ips, err
+		}
+		if c.allowRun() != nil {
+			// retries count against max_rate too
+			return ips, err
+		}
+
+		c.logger.Warn("lookup failed; retrying",
+			zap.String("command", c.Cmd),
+			zap.Int("attempt", attempt+1),
+			zap.Int("retries", c.Retries),
+			zap.Duration("delay", time.Duration(c.RetryDelay)),
+			zap.Error(err))
+
+		select {
+		case <-time.After(time.Duration(c.RetryDelay)):
+		case <-ctx.Done():
+			return nil, deadlineError(ctx, "waiting to retry", ctx.Err())
+		}
+	}
+}
+
+// lookupAttempt runs one attempt of the lookup,
+// limited by AttemptTimeout.
+func (c Command) lookupAttempt(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	if c.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.AttemptTimeout))
+		defer cancel()
+	}
+	return c.lookup(ctx, versions)
+}
+
+// retryable returns true if the lookup may be retried after err.
+// Without any retry conditions, every failure is retried.
+func (c Command) retryable(err error) bool {
+	if errors.Is(err, ErrUnchanged) {
+		return false
+	}
+	if len(c.RetryOnExitCodes) == 0 && !c.RetryOnTimeout {
+		return true
+	}
+
+	if c.RetryOnTimeout && errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) && cmdErr.exitCode > 0 {
+		for _, code := range c.RetryOnExitCodes {
+			if code == cmdErr.exitCode {
+				return true
+			}
+		}
+	}
+	return false
+}
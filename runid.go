@@ -0,0 +1,29 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"go.uber.org/zap"
+)
+
+// newRunID returns a random ID for a run of the command.
+func newRunID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// withRunID returns c for a new run: with a new run ID, which
+// all its log entries carry, so that the entries of concurrent
+// runs can be told apart.
+func (c Command) withRunID() Command {
+	c.runID = newRunID()
+	c.logger = c.logger.With(zap.String("run_id", c.runID))
+	return c
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"time"
+
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+)
+
+// defaultWatcherPollInterval is the interval suggested for sources
+// that report changes by themselves, which only need a lookup now
+// and then in case a change got lost.
+const defaultWatcherPollInterval = time.Hour
+
+// Scheduler is an IP source that suggests how often a consumer
+// should call GetIPs, e.g. rarely for a source that reports
+// changes through the Watcher interface. The dynamic_dns app does
+// not use this interface, so it has no effect there until the app
+// supports it; the app still checks at its check_interval.
+type Scheduler interface {
+	dynamicdns.IPSource
+
+	// SuggestedInterval returns how often the source should be
+	// looked up, or 0 if it has no suggestion.
+	SuggestedInterval() time.Duration
+}
+
+// SuggestedInterval returns poll_interval, or else 1h in watch
+// mode, or else cache_ttl.
+func (c Command) SuggestedInterval() time.Duration {
+	switch {
+	case c.PollInterval > 0:
+		return time.Duration(c.PollInterval)
+	case c.Watch:
+		return defaultWatcherPollInterval
+	}
+	return time.Duration(c.CacheTTL)
+}
+
+// SuggestedInterval returns poll_interval, or else 1h, or
+// max_age if shorter, to notice when the addresses expire.
+func (p Push) SuggestedInterval() time.Duration {
+	if p.PollInterval > 0 {
+		return time.Duration(p.PollInterval)
+	}
+	if p.MaxAge > 0 && time.Duration(p.MaxAge) < defaultWatcherPollInterval {
+		return time.Duration(p.MaxAge)
+	}
+	return defaultWatcherPollInterval
+}
+
+// SuggestedInterval returns poll_interval, or else 1h with watch.
+func (n Netlink) SuggestedInterval() time.Duration {
+	if n.PollInterval > 0 {
+		return time.Duration(n.PollInterval)
+	}
+	if n.Watch {
+		return defaultWatcherPollInterval
+	}
+	return 0
+}
+
+// SuggestedInterval returns the shortest interval its sources
+// suggest, or 0 if any of them has no suggestion.
+func (r Race) SuggestedInterval() time.Duration {
+	var shortest time.Duration
+	for _, src := range r.sources {
+		interval := suggestedInterval(src)
+		if interval <= 0 {
+			return 0
+		}
+		if shortest == 0 || interval < shortest {
+			shortest = interval
+		}
+	}
+	return shortest
+}
+
+// SuggestedInterval returns the one of the primary source.
+func (c Canary) SuggestedInterval() time.Duration {
+	return suggestedInterval(c.primary)
+}
+
+// suggestedInterval returns the interval src suggests,
+// or 0 if it is no Scheduler.
+func suggestedInterval(src dynamicdns.IPSource) time.Duration {
+	if s, ok := src.(Scheduler); ok {
+		return s.SuggestedInterval()
+	}
+	return 0
+}
+
+// Interface guards
+var (
+	_ Scheduler = (*Command)(nil)
+	_ Scheduler = (*Push)(nil)
+	_ Scheduler = (*Netlink)(nil)
+	_ Scheduler = (*Race)(nil)
+	_ Scheduler = (*Canary)(nil)
+)
@@ -0,0 +1,178 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "dynamic-dns-command-schema",
+		Short: "Prints the JSON schema of the protocol of the command source",
+		Long: `
+Prints the JSON schema of the output the command source parses and
+of the environment variables it passes to the commands, so that
+scripts can be validated against it. The schema itself validates an
+envelope, the output of the latest protocol version; the extended
+format and the environment are in its $defs.`,
+		Func: func(caddycmd.Flags) (int, error) {
+			schema, err := Schema()
+			if err != nil {
+				return 1, err
+			}
+			_, err = os.Stdout.Write(append(schema, '\n'))
+			return 0, err
+		},
+	})
+}
+
+// schemaProperties refine the schemas of the
+// properties the Go types derive, by JSON name.
+var schemaProperties = map[string]map[string]any{
+	"proto": {
+		"type":        "integer",
+		"minimum":     2,
+		"maximum":     ProtocolVersion,
+		"description": "The version of the protocol the output is in; see CADDY_DDNS_PROTO.",
+	},
+	"status": {
+		"enum":        []string{"", EnvelopeUnchanged, EnvelopeNone},
+		"description": "What the command found: the addresses if empty or missing, no change, or no addresses.",
+	},
+	"ips": {
+		"description": "The IPv4 and IPv6 addresses.",
+	},
+	"ttl": {
+		"type":        []string{"string", "number", "null"},
+		"description": "How long the addresses are valid, a duration string like \"5m\" or a number of seconds.",
+	},
+	"hosts": {
+		"description": "The addresses of specific hosts, by host name.",
+	},
+}
+
+// schemaEnv are the environment variables of the
+// commands, in the order they are documented.
+var schemaEnv = []struct {
+	name, description string
+}{
+	{EnvIPv4, `"on" if IPv4 addresses are requested, "off" otherwise.`},
+	{EnvIPv6, `"on" if IPv6 addresses are requested, "off" otherwise.`},
+	{EnvTimeout, `The timeout of the command, e.g. "30s".`},
+	{EnvVersion, "The version of Caddy running the command."},
+	{EnvLastIPv4, "The IPv4 addresses the previous lookup returned, separated by commas; empty before the first one."},
+	{EnvLastIPv6, "The IPv6 addresses the previous lookup returned, separated by commas; empty before the first one."},
+	{EnvProto, "The latest version of the protocol the source understands."},
+	{EnvLabel, "The label of the source; empty if it has none."},
+	{EnvRunID, "The ID of the run."},
+	{EnvError, "Only for the on_failure command: the error message of the failed lookup."},
+	{EnvExitCode, "Only for the on_failure command: the exit code of the failed command, or -1."},
+	{EnvStderr, "Only for the on_failure command: what the failed command wrote to stderr."},
+	{EnvProbeIP, "Only for the probe command: the address to probe."},
+}
+
+// Schema returns the JSON schema of the protocol between the
+// command source and its commands. It validates an envelope,
+// the output of the latest version of the protocol, and defines
+// the extended format as "extended" and the environment
+// variables of the commands as "environment".
+func Schema() ([]byte, error) {
+	env := map[string]any{}
+	for _, v := range schemaEnv {
+		env[v.name] = map[string]any{
+			"type":        "string",
+			"description": v.description,
+		}
+	}
+
+	envelopeSchema := typeSchema(reflect.TypeOf(envelope{}))
+	envelopeSchema["required"] = []string{"proto"}
+	envelopeSchema["description"] = fmt.Sprintf("The output of a command in version %d of the protocol.", ProtocolVersion)
+	extendedSchema := typeSchema(reflect.TypeOf(extendedOutput{}))
+	extendedSchema["description"] = "The output of a command in the extended format."
+
+	schema := map[string]any{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "dynamic_dns.ip_sources.command protocol",
+		"description": "The output of the commands of the command source, and the environment they get.",
+		"$ref":        "#/$defs/envelope",
+		"$defs": map[string]any{
+			"envelope": envelopeSchema,
+			"extended": extendedSchema,
+			"environment": map[string]any{
+				"description": "The environment variables the commands get.",
+				"type":        "object",
+				"properties":  env,
+			},
+		},
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// typeSchema returns the JSON schema of the values
+// of type t, as encoding/json marshals them.
+func typeSchema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	case reflect.TypeOf(json.Number("")):
+		return map[string]any{"type": "number"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": []string{"array", "null"}, "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": []string{"object", "null"}, "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		properties := map[string]any{}
+		addProperties(t, properties)
+		return map[string]any{"type": "object", "properties": properties}
+	}
+	return map[string]any{}
+}
+
+// addProperties adds the schemas of the fields of the struct
+// type t to properties, including the ones of embedded structs.
+func addProperties(t reflect.Type, properties map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addProperties(f.Type, properties)
+			continue
+		}
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		schema := typeSchema(f.Type)
+		for k, v := range schemaProperties[name] {
+			schema[k] = v
+		}
+		properties[name] = schema
+	}
+}
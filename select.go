@@ -0,0 +1,422 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Selection is an expression that selects which of the parsed
+// addresses are returned, for setups allow and deny lists cannot
+// express, like
+//
+//	is_global && !in('2001:db8::/32') && prefix_len == 64
+//
+// It combines the following with &&, ||, ! and parentheses:
+//
+//   - is_ipv4, is_ipv6, is_global (a public unicast address),
+//     is_private, is_link_local, is_loopback and is_eui64;
+//   - comparisons of family (4 or 6), prefix_len and lifetime
+//     (the preferred lifetime in seconds) with numbers by ==,
+//     !=, <, <=, > and >=; prefix_len and lifetime are 0 if the
+//     output does not have them, which only iproute2's has;
+//   - in('<prefix>', ...), which is true if the address is in
+//     one of the prefixes.
+type Selection struct {
+	expr string
+	root boolNode
+}
+
+// ParseSelection compiles the selection expression expr.
+func ParseSelection(expr string) (*Selection, error) {
+	p := &selectionParser{expr: expr}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+	return &Selection{expr: expr, root: root}, nil
+}
+
+// String returns the expression.
+func (s *Selection) String() string {
+	return s.expr
+}
+
+// match returns true if the expression selects the candidate.
+func (s *Selection) match(c candidate) bool {
+	return s.root.evalBool(c)
+}
+
+// familySelection combines the expression for all addresses with
+// the ones for either family, each of which may be empty, into one
+// selection, or returns nil if all of them are empty.
+func familySelection(all, ipv4, ipv6 string) (*Selection, error) {
+	var root boolNode = boolConst(true)
+	var exprs []string
+	for _, e := range []struct {
+		name, expr string
+		family     int64
+	}{
+		{"select", all, 0},
+		{"select_ipv4", ipv4, 4},
+		{"select_ipv6", ipv6, 6},
+	} {
+		if e.expr == "" {
+			continue
+		}
+		s, err := ParseSelection(e.expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", e.name, e.expr, err)
+		}
+		node := s.root
+		if e.family != 0 {
+			// only applies to addresses of that family
+			other := compareNode{op: "!=", left: intIdents["family"], right: intConst(e.family)}
+			node = orNode{other, node}
+		}
+		root = andNode{root, node}
+		exprs = append(exprs, e.name+" "+e.expr)
+	}
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	return &Selection{expr: strings.Join(exprs, "; "), root: root}, nil
+}
+
+// candidate is a parsed address the selection is evaluated for.
+type candidate struct {
+	ip        net.IP
+	prefixLen int
+	lifetime  uint64
+}
+
+// boolNode is a boolean expression.
+type boolNode interface {
+	evalBool(candidate) bool
+}
+
+// intNode is an integer expression.
+type intNode interface {
+	evalInt(candidate) int64
+}
+
+type boolConst bool
+
+func (b boolConst) evalBool(candidate) bool { return bool(b) }
+
+type boolIdent func(candidate) bool
+
+func (f boolIdent) evalBool(c candidate) bool { return f(c) }
+
+type intConst int64
+
+func (i intConst) evalInt(candidate) int64 { return int64(i) }
+
+type intIdent func(candidate) int64
+
+func (f intIdent) evalInt(c candidate) int64 { return f(c) }
+
+type andNode struct{ left, right boolNode }
+
+func (n andNode) evalBool(c candidate) bool { return n.left.evalBool(c) && n.right.evalBool(c) }
+
+type orNode struct{ left, right boolNode }
+
+func (n orNode) evalBool(c candidate) bool { return n.left.evalBool(c) || n.right.evalBool(c) }
+
+type notNode struct{ operand boolNode }
+
+func (n notNode) evalBool(c candidate) bool { return !n.operand.evalBool(c) }
+
+type compareNode struct {
+	op          string
+	left, right intNode
+}
+
+func (n compareNode) evalBool(c candidate) bool {
+	l, r := n.left.evalInt(c), n.right.evalInt(c)
+	switch n.op {
+	case "==":
+		return l == r
+	case "!=":
+		return l != r
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	default:
+		return l >= r
+	}
+}
+
+type inNode []netip.Prefix
+
+func (n inNode) evalBool(c candidate) bool {
+	addr, ok := netip.AddrFromSlice(c.ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range n {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// boolIdents are the boolean properties of an address.
+var boolIdents = map[string]boolIdent{
+	"is_ipv4": func(c candidate) bool { return c.ip.To4() != nil },
+	"is_ipv6": func(c candidate) bool { return c.ip.To4() == nil },
+	"is_global": func(c candidate) bool {
+		return c.ip.IsGlobalUnicast() && !c.ip.IsPrivate()
+	},
+	"is_private":    func(c candidate) bool { return c.ip.IsPrivate() },
+	"is_link_local": func(c candidate) bool { return c.ip.IsLinkLocalUnicast() },
+	"is_loopback":   func(c candidate) bool { return c.ip.IsLoopback() },
+	"is_eui64":      func(c candidate) bool { return isEUI64(c.ip) },
+}
+
+// intIdents are the numeric properties of an address.
+var intIdents = map[string]intIdent{
+	"family": func(c candidate) int64 {
+		if c.ip.To4() != nil {
+			return 4
+		}
+		return 6
+	},
+	"prefix_len": func(c candidate) int64 { return int64(c.prefixLen) },
+	"lifetime":   func(c candidate) int64 { return int64(c.lifetime) },
+}
+
+// selectionParser parses a selection expression
+// by recursive descent.
+type selectionParser struct {
+	expr   string
+	tokens []string
+	pos    int
+}
+
+// lex splits the expression into tokens: operators,
+// parentheses, commas, identifiers, numbers and
+// quoted strings, which keep their quotes.
+func (p *selectionParser) lex() error {
+	s := p.expr
+	for i := 0; i < len(s); {
+		r := rune(s[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"),
+			strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="),
+			strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], ">="):
+			p.tokens = append(p.tokens, s[i:i+2])
+			i += 2
+		case strings.ContainsRune("!()<>,", r):
+			p.tokens = append(p.tokens, s[i:i+1])
+			i++
+		case r == '\'' || r == '"':
+			end := strings.IndexByte(s[i+1:], s[i])
+			if end < 0 {
+				return fmt.Errorf("unterminated string at %d", i)
+			}
+			p.tokens = append(p.tokens, s[i:i+end+2])
+			i += end + 2
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			p.tokens = append(p.tokens, s[i:j])
+			i = j
+		default:
+			return fmt.Errorf("unexpected %q at %d", r, i)
+		}
+	}
+	if len(p.tokens) == 0 {
+		return fmt.Errorf("empty expression")
+	}
+	return nil
+}
+
+// peek returns the current token, or "" at the end.
+func (p *selectionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// next consumes and returns the current token.
+func (p *selectionParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+// expect consumes the token want.
+func (p *selectionParser) expect(want string) error {
+	tok, err := p.next()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected %s, got %s", want, tok)
+	}
+	return nil
+}
+
+// parseOr parses: and ('||' and)*
+func (p *selectionParser) parseOr() (boolNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+// parseAnd parses: unary ('&&' unary)*
+func (p *selectionParser) parseAnd() (boolNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+// parseUnary parses: '!' unary | '(' or ')' | in(...) |
+// a boolean property | a comparison
+func (p *selectionParser) parseUnary() (boolNode, error) {
+	tok := p.peek()
+	switch {
+	case tok == "!":
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	case tok == "(":
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case tok == "in":
+		p.pos++
+		return p.parseIn()
+	case boolIdents[tok] != nil:
+		p.pos++
+		return boolIdents[tok], nil
+	}
+
+	left, err := p.parseInt()
+	if err != nil {
+		return nil, err
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("expected a comparison, got %s", op)
+	}
+	right, err := p.parseInt()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{op: op, left: left, right: right}, nil
+}
+
+// parseInt parses a numeric property or a number.
+func (p *selectionParser) parseInt() (intNode, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if ident, ok := intIdents[tok]; ok {
+		return ident, nil
+	}
+	n, err := strconv.ParseInt(tok, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unknown property %s", tok)
+	}
+	return intConst(n), nil
+}
+
+// parseIn parses the arguments of in: '(' string (',' string)* ')'
+func (p *selectionParser) parseIn() (boolNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var prefixes inNode
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if len(tok) < 2 || (tok[0] != '\'' && tok[0] != '"') {
+			return nil, fmt.Errorf("expected a quoted prefix, got %s", tok)
+		}
+		s := tok[1 : len(tok)-1]
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			// a single address
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid prefix %s: %v", s, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+
+		tok, err = p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok == ")" {
+			return prefixes, nil
+		}
+		if tok != "," {
+			return nil, fmt.Errorf("expected , or ), got %s", tok)
+		}
+	}
+}
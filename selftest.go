@@ -0,0 +1,271 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	fs := flag.NewFlagSet("dynamic-dns-command-parse", flag.ExitOnError)
+	fs.String("format", "", "Format of the sample: list, labeled, iproute2, extended or auto")
+	fs.String("config", "", "Caddyfile of a command source whose options to parse and filter with")
+	fs.String("family", "", "Only accept addresses of this family, ipv4 or ipv6, like the dynamic_dns app")
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "dynamic-dns-command-parse",
+		Usage: "[--format <format>] [--config <path>] [--family ipv4|ipv6] < <sample>",
+		Short: "Parses a sample output like the command source and explains the result",
+		Long: `
+Parses a sample of the output of a command, read from stdin, like the
+command source does, without running anything, and prints every
+address that would be accepted, and every token or address that would
+be rejected with the reason, like a private address outside of the
+allowed_subnets or an address of the wrong family.
+
+The options of the source, like format, json_path, allowed_subnets,
+max_per_family, filter, translate or synthesize, are read from the
+Caddyfile given by --config, which has the source alone, like
+"command <cmd> { ... }", with or without "ip_source" before it. The
+command itself is ignored, and so are the options that do not change
+the addresses, and probe. --format overrides the one of the config.
+
+Exits with 1 if no address would be accepted or the lookup would fail.`,
+		Flags: fs,
+		Func: func(fl caddycmd.Flags) (int, error) {
+			c, err := selfTestCommand(fl.String("config"))
+			if err != nil {
+				return caddy.ExitCodeFailedStartup, err
+			}
+			if format := fl.String("format"); format != "" {
+				c.Format = format
+			}
+			var versions dynamicdns.IPVersions
+			switch family := fl.String("family"); family {
+			case "":
+			case "ipv4", "ipv6":
+				v4, v6 := family == "ipv4", family == "ipv6"
+				versions = dynamicdns.IPVersions{IPv4: &v4, IPv6: &v6}
+			default:
+				return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown family %s", family)
+			}
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			if err := c.provisionSelfTest(ctx); err != nil {
+				return caddy.ExitCodeFailedStartup, err
+			}
+
+			sample, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return caddy.ExitCodeFailedStartup, err
+			}
+			result := c.selfTest(sample, versions)
+			for _, a := range result.accepted {
+				fmt.Printf("accepted %s%s\n", a.ip, a.reason)
+			}
+			for _, r := range result.rejected {
+				fmt.Printf("rejected %q: %s\n", r.token, r.reason)
+			}
+			if result.err != nil {
+				fmt.Printf("failed: %v\n", result.err)
+				return caddy.ExitCodeFailedStartup, nil
+			}
+			if len(result.accepted) == 0 {
+				fmt.Println("failed: no address accepted")
+				return caddy.ExitCodeFailedStartup, nil
+			}
+			return caddy.ExitCodeSuccess, nil
+		},
+	})
+}
+
+// selfTestCommand returns the command source configured by the
+// Caddyfile at path, or one with the default options if path is
+// empty.
+func selfTestCommand(path string) (*Command, error) {
+	c := new(Command)
+	if path == "" {
+		return c, nil
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := caddyfile.Tokenize(body, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) > 0 && (tokens[0].Text == "ip_source" || tokens[0].Text == "ip_sources") {
+		tokens = tokens[1:]
+	}
+	if err := c.UnmarshalCaddyfile(caddyfile.NewDispenser(tokens)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// provisionSelfTest sets up what parsing and filtering the output
+// needs, without the rest of Provision, which would prepare to
+// run the commands.
+func (c *Command) provisionSelfTest(ctx caddy.Context) error {
+	c.logger = zap.NewNop()
+	c.state = new(state)
+	for _, t := range c.Translate {
+		if err := t.provision(); err != nil {
+			return fmt.Errorf("invalid translate: %v", err)
+		}
+	}
+	if err := c.provisionOutput(); err != nil {
+		return err
+	}
+	if err := c.provisionSynthesize(); err != nil {
+		return err
+	}
+	if err := c.provisionFilters(); err != nil {
+		return err
+	}
+	return c.Filters.load(ctx)
+}
+
+// selfTestResult is the outcome of parsing a sample output.
+type selfTestResult struct {
+	accepted []acceptedAddress
+	rejected []rejectedToken
+
+	// why the lookup would fail, if it would
+	err error
+}
+
+// acceptedAddress is an address of the result, with the option
+// that added it, if it was not in the output.
+type acceptedAddress struct {
+	ip     net.IP
+	reason string
+}
+
+// rejectedToken is a token of the output, or an address, that
+// is not in the result, with the reason.
+type rejectedToken struct {
+	token  string
+	reason string
+}
+
+// selfTest parses sample like the output of a lookup and tells,
+// step by step, which addresses are kept and why the others are
+// dropped.
+func (c Command) selfTest(sample []byte, versions dynamicdns.IPVersions) selfTestResult {
+	var result selfTestResult
+	reject := func(before, after []net.IP, reason string) {
+		for _, ip := range ipsMissing(before, after) {
+			result.rejected = append(result.rejected, rejectedToken{token: ip.String(), reason: reason})
+		}
+	}
+
+	output, err := c.transformOutput(sample)
+	if err != nil {
+		result.err = fmt.Errorf("transforming output: %v", err)
+		return result
+	}
+
+	// parsed without the selection and skipping invalid tokens,
+	// to tell why each one is missing
+	var skipped []string
+	opts := c.parseOptions(new(Metadata))
+	opts.Select = nil
+	opts.OnParseError = ParseErrorSkip
+	opts.Skipped = &skipped
+	all, err := ParseOutput([]byte(output), opts)
+	failInvalid := c.OnParseError != ParseErrorSkip && c.OnParseError != ParseErrorSkipAndWarn
+	for _, token := range skipped {
+		reason := "not an address; skipped by on_parse_error"
+		if failInvalid {
+			reason = "not an address"
+		}
+		result.rejected = append(result.rejected, rejectedToken{token: token, reason: reason})
+	}
+	if failInvalid && len(skipped) > 0 {
+		// the first invalid token fails the lookup
+		result.err = &ErrInvalidIP{Token: skipped[0]}
+	}
+	if err != nil {
+		result.err = err
+		return result
+	}
+	parsed := make([]net.IP, 0, len(all))
+	for _, addr := range all {
+		parsed = append(parsed, net.IP(addr.AsSlice()))
+	}
+
+	ips := parsed
+	if c.selection != nil {
+		opts = c.parseOptions(new(Metadata))
+		opts.OnParseError = ParseErrorSkip
+		selected, err := ParseOutput([]byte(output), opts)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		ips = ips[:0:0]
+		for _, addr := range selected {
+			ips = append(ips, net.IP(addr.AsSlice()))
+		}
+		reject(parsed, ips, "not selected by select")
+	}
+
+	var kept []net.IP
+	for _, ip := range ips {
+		switch {
+		case len(c.allowedSubnets) > 0 && !subnetsContain(c.allowedSubnets, ip):
+			result.rejected = append(result.rejected, rejectedToken{token: ip.String(), reason: "outside of allowed_subnets"})
+		case subnetsContain(c.deniedSubnets, ip):
+			result.rejected = append(result.rejected, rejectedToken{token: ip.String(), reason: "in denied_subnets"})
+		default:
+			kept = append(kept, ip)
+		}
+	}
+	ips, kept = kept, c.preferAddresses(kept)
+	reject(ips, kept, "another address of its family is in an earlier prefer_subnets")
+	ips, kept = kept, c.limitAddresses(kept)
+	reject(ips, kept, "more than max_per_family addresses of its family")
+	ips, kept = kept, c.Filters.filter(kept)
+	reject(ips, kept, "dropped by a filter module")
+
+	filtered := kept
+	translated := c.translateAddresses(filtered)
+	synthesized, err := c.synthesizeAddresses(translated)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	final := filterVersions(synthesized, versions)
+	reject(synthesized, final, "not of the requested family")
+
+	for _, ip := range final {
+		reason := ""
+		switch {
+		case !ipListContains(filtered, ip) && ipListContains(translated, ip):
+			reason = " (added by translate)"
+		case !ipListContains(translated, ip):
+			reason = " (added by synthesize)"
+		}
+		result.accepted = append(result.accepted, acceptedAddress{ip: ip, reason: reason})
+	}
+	if result.err == nil {
+		result.err = c.checkAddresses(final, versions)
+	}
+	return result
+}
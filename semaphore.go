@@ -0,0 +1,133 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// processes holds the semaphore limiting how many processes all
+// command sources run at once. It is shared by every instance of
+// the module, across server blocks and config reloads.
+var processes = caddy.NewUsagePool()
+
+// The key of the semaphore in processes.
+const processesKey = "processes"
+
+// semaphore limits how many processes run at once. Waiters
+// are admitted in the order they arrived.
+type semaphore struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	waiters []chan struct{}
+}
+
+// provisionSemaphore loads the shared semaphore, creating it
+// if needed. The limit configured last applies to all.
+func (c *Command) provisionSemaphore() error {
+	if c.MaxProcesses <= 0 {
+		return nil
+	}
+	val, loaded, err := processes.LoadOrNew(processesKey, func() (caddy.Destructor, error) {
+		return &semaphore{limit: c.MaxProcesses}, nil
+	})
+	if err != nil {
+		return err
+	}
+	sem := val.(*semaphore)
+	if loaded {
+		if old := sem.resize(c.MaxProcesses); old != c.MaxProcesses {
+			c.logger.Warn("changed limit of processes shared by all command sources",
+				zap.Int("old", old),
+				zap.Int("new", c.MaxProcesses))
+		}
+	}
+	c.semaphore = sem
+	return nil
+}
+
+// cleanupSemaphore releases the shared semaphore.
+func (c *Command) cleanupSemaphore() error {
+	if c.semaphore == nil {
+		return nil
+	}
+	_, err := processes.Delete(processesKey)
+	return err
+}
+
+// acquire waits until a process may be started or ctx is done.
+// It returns a function to call when the process exited.
+func (s *semaphore) acquire(ctx context.Context) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	s.mu.Lock()
+	if s.running < s.limit {
+		s.running++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	ready := make(chan struct{})
+	s.waiters = append(s.waiters, ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return s.release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for i, w := range s.waiters {
+			if w == ready {
+				s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+				s.mu.Unlock()
+				return nil, ctx.Err()
+			}
+		}
+		s.mu.Unlock()
+		// admitted while giving up, so pass it on
+		s.release()
+		return nil, ctx.Err()
+	}
+}
+
+// release lets the next waiter start its process.
+func (s *semaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.admit()
+}
+
+// resize changes the limit and returns the previous one.
+func (s *semaphore) resize(limit int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.limit
+	s.limit = limit
+	s.admit()
+	return old
+}
+
+// admit lets waiters start while below the limit.
+// It must be called with s.mu held.
+func (s *semaphore) admit() {
+	for s.running < s.limit && len(s.waiters) > 0 {
+		s.running++
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+	}
+}
+
+// Destruct implements caddy.Destructor.
+func (s *semaphore) Destruct() error {
+	return nil
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !windows
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// signals are the signals that may trigger a refresh. The ones
+// Caddy acts on itself, like SIGINT and SIGTERM, are left out.
+var signals = map[string]syscall.Signal{
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGHUP":  syscall.SIGHUP,
+}
+
+// parseSignal returns the signal with the given
+// name, with or without the SIG prefix.
+func parseSignal(name string) (os.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signals[name]
+	if !ok {
+		return nil, fmt.Errorf("must be SIGUSR1, SIGUSR2 or SIGHUP")
+	}
+	return sig, nil
+}
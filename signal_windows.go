@@ -0,0 +1,16 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"os"
+)
+
+// parseSignal fails, as Windows has no signals to trigger a refresh.
+func parseSignal(string) (os.Signal, error) {
+	return nil, fmt.Errorf("not supported on windows")
+}
@@ -0,0 +1,432 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/gosnmp/gosnmp"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(SNMP{})
+}
+
+// The OIDs of the IF-MIB and IP-MIB that are used.
+const (
+	oidIfDescr        = ".1.3.6.1.2.1.2.2.1.2"
+	oidIfName         = ".1.3.6.1.2.1.31.1.1.1.1"
+	oidIPAdEntIfIndex = ".1.3.6.1.2.1.4.20.1.2"
+)
+
+// SNMP is an IP source that reads the WAN address of a router
+// over SNMP, which many ISP-provided gateways support although
+// they offer nothing else to script against.
+//
+// The address is either read from an OID, which is useful for
+// vendor MIBs, or looked up in the address table of the IP-MIB
+// for the WAN interface. The IP-MIB only holds IPv4 addresses.
+type SNMP struct {
+	// The router, as host or host:port. The port defaults to 161.
+	Target string `json:"target,omitempty"`
+
+	// The SNMP version, 2c or 3. Default: 2c
+	Version string `json:"version,omitempty"`
+
+	// The community for SNMPv2c. Global placeholders like
+	// {env.SNMP_COMMUNITY} are expanded. Default: public
+	Community string `json:"community,omitempty"`
+
+	// The user for SNMPv3.
+	Username string `json:"username,omitempty"`
+
+	// The authentication protocol for SNMPv3: MD5, SHA,
+	// SHA224, SHA256, SHA384 or SHA512. Default: none
+	AuthProtocol string `json:"auth_protocol,omitempty"`
+
+	// The authentication passphrase for SNMPv3. Global
+	// placeholders like {env.SNMP_AUTH} are expanded.
+	AuthPassphrase string `json:"auth_passphrase,omitempty"`
+
+	// The privacy protocol for SNMPv3: DES, AES, AES192,
+	// AES256, AES192C or AES256C. Default: none
+	PrivProtocol string `json:"priv_protocol,omitempty"`
+
+	// The privacy passphrase for SNMPv3. Global placeholders
+	// like {env.SNMP_PRIV} are expanded.
+	PrivPassphrase string `json:"priv_passphrase,omitempty"`
+
+	// The OID to get the address from. Its value must be an
+	// IpAddress or an address as octet string.
+	OID string `json:"oid,omitempty"`
+
+	// The WAN interface, by ifIndex, ifName or ifDescr, to look
+	// up the address of in the IP-MIB, if no OID is set.
+	Interface string `json:"interface,omitempty"`
+
+	// How long to wait for the router. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// How often to retry requests the router did not answer. Default: 1
+	Retries int `json:"retries,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	host   string
+	port   uint16
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (SNMP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.snmp",
+		New: func() caddy.Module { return new(SNMP) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	snmp <host[:port]> {
+//	    version <2c|3>
+//	    community <community>
+//	    username <user>
+//	    auth_protocol <protocol>
+//	    auth_passphrase <passphrase>
+//	    priv_protocol <protocol>
+//	    priv_passphrase <passphrase>
+//	    oid <oid>
+//	    interface <index|name>
+//	    timeout <duration>
+//	    retries <count>
+//	    filter <name> ...
+//	}
+func (s *SNMP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&s.Target) {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "version":
+				err = singleArg(d, &s.Version)
+			case "community":
+				err = singleArg(d, &s.Community)
+			case "username":
+				err = singleArg(d, &s.Username)
+			case "auth_protocol":
+				err = singleArg(d, &s.AuthProtocol)
+			case "auth_passphrase":
+				err = singleArg(d, &s.AuthPassphrase)
+			case "priv_protocol":
+				err = singleArg(d, &s.PrivProtocol)
+			case "priv_passphrase":
+				err = singleArg(d, &s.PrivPassphrase)
+			case "oid":
+				err = singleArg(d, &s.OID)
+			case "interface":
+				err = singleArg(d, &s.Interface)
+			case "timeout":
+				err = durationArg(d, &s.Timeout)
+			case "retries":
+				err = intArg(d, &s.Retries)
+			case "filter":
+				err = s.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (s *SNMP) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger(s)
+	if err := s.Filters.load(ctx); err != nil {
+		return err
+	}
+
+	host, port, err := net.SplitHostPort(s.Target)
+	if err != nil {
+		host, port = s.Target, "161"
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port '%s': %v", port, err)
+	}
+	s.host, s.port = host, uint16(p)
+
+	switch s.Version {
+	case "":
+		s.Version = "2c"
+	case "2c", "3":
+	default:
+		return fmt.Errorf("unsupported SNMP version '%s'", s.Version)
+	}
+	if s.Community == "" {
+		s.Community = "public"
+	}
+	if s.Version == "3" && s.Username == "" {
+		return fmt.Errorf("SNMPv3 requires a username")
+	}
+	if _, err := snmpAuthProtocol(s.AuthProtocol); err != nil {
+		return err
+	}
+	if _, err := snmpPrivProtocol(s.PrivProtocol); err != nil {
+		return err
+	}
+	if s.PrivProtocol != "" && s.AuthProtocol == "" {
+		return fmt.Errorf("priv_protocol requires auth_protocol")
+	}
+	if (s.OID == "") == (s.Interface == "") {
+		return fmt.Errorf("either oid or interface must be set")
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = caddy.Duration(5 * time.Second)
+	}
+	if s.Retries == 0 {
+		s.Retries = 1
+	}
+	return nil
+}
+
+// GetIPs gets the WAN address of the router.
+func (s SNMP) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return s.Filters.apply(s.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (s SNMP) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Conn.Close()
+
+	var ips []net.IP
+	if s.OID != "" {
+		ips, err = s.getOID(client)
+	} else {
+		ips, err = s.interfaceAddresses(client)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// connect returns a client connected to the router.
+func (s SNMP) connect(ctx context.Context) (*gosnmp.GoSNMP, error) {
+	community, err := secret(ctx, s.Community)
+	if err != nil {
+		return nil, err
+	}
+	client := &gosnmp.GoSNMP{
+		Context:            ctx,
+		Target:             s.host,
+		Port:               s.port,
+		Transport:          "udp",
+		Community:          community,
+		Version:            gosnmp.Version2c,
+		Timeout:            time.Duration(s.Timeout),
+		Retries:            s.Retries,
+		MaxOids:            gosnmp.MaxOids,
+		ExponentialTimeout: true,
+	}
+
+	if s.Version == "3" {
+		auth, _ := snmpAuthProtocol(s.AuthProtocol)
+		priv, _ := snmpPrivProtocol(s.PrivProtocol)
+		flags := gosnmp.NoAuthNoPriv
+		if auth != gosnmp.NoAuth {
+			flags = gosnmp.AuthNoPriv
+		}
+		if priv != gosnmp.NoPriv {
+			flags = gosnmp.AuthPriv
+		}
+		authPassphrase, err := secret(ctx, s.AuthPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		privPassphrase, err := secret(ctx, s.PrivPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		client.Version = gosnmp.Version3
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.MsgFlags = flags
+		client.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			UserName:                 s.Username,
+			AuthenticationProtocol:   auth,
+			AuthenticationPassphrase: authPassphrase,
+			PrivacyProtocol:          priv,
+			PrivacyPassphrase:        privPassphrase,
+		}
+	}
+
+	if err := client.Connect(); err != nil {
+		return nil, fmt.Errorf("connecting to %s: %v", s.Target, err)
+	}
+	return client, nil
+}
+
+// getOID gets the address from the configured OID.
+func (s SNMP) getOID(client *gosnmp.GoSNMP) ([]net.IP, error) {
+	result, err := client.Get([]string{s.OID})
+	if err != nil {
+		return nil, fmt.Errorf("getting %s: %v", s.OID, err)
+	}
+	for _, v := range result.Variables {
+		ip, err := snmpAddress(v)
+		if err != nil {
+			return nil, fmt.Errorf("getting %s: %v", s.OID, err)
+		}
+		return []net.IP{ip}, nil
+	}
+	return nil, fmt.Errorf("getting %s: no value", s.OID)
+}
+
+// interfaceAddresses looks up the addresses of the
+// WAN interface in the address table of the IP-MIB.
+func (s SNMP) interfaceAddresses(client *gosnmp.GoSNMP) ([]net.IP, error) {
+	ifIndex, err := s.ifIndex(client)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	err = client.BulkWalk(oidIPAdEntIfIndex, func(v gosnmp.SnmpPDU) error {
+		if gosnmp.ToBigInt(v.Value).Int64() != int64(ifIndex) {
+			return nil
+		}
+		// the address is the index of the table entry
+		ip := net.ParseIP(strings.TrimPrefix(v.Name, oidIPAdEntIfIndex+"."))
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walking address table: %v", err)
+	}
+
+	s.logger.Debug("interface addresses",
+		zap.String("interface", s.Interface),
+		zap.Int("if_index", ifIndex),
+		zap.Strings("ips", ipStrings(ips)))
+	return ips, nil
+}
+
+// ifIndex returns the ifIndex of the WAN interface,
+// looking it up by ifName and ifDescr if needed.
+func (s SNMP) ifIndex(client *gosnmp.GoSNMP) (int, error) {
+	if index, err := strconv.Atoi(s.Interface); err == nil {
+		return index, nil
+	}
+	for _, oid := range []string{oidIfName, oidIfDescr} {
+		index := -1
+		err := client.BulkWalk(oid, func(v gosnmp.SnmpPDU) error {
+			name, ok := v.Value.([]byte)
+			if ok && string(name) == s.Interface && index < 0 {
+				index, _ = strconv.Atoi(v.Name[strings.LastIndexByte(v.Name, '.')+1:])
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("walking interface table: %v", err)
+		}
+		if index >= 0 {
+			return index, nil
+		}
+	}
+	return 0, fmt.Errorf("router has no interface %s", s.Interface)
+}
+
+// snmpAddress returns the address held by v.
+func snmpAddress(v gosnmp.SnmpPDU) (net.IP, error) {
+	switch v.Type {
+	case gosnmp.IPAddress:
+		if ip := net.ParseIP(fmt.Sprint(v.Value)); ip != nil {
+			return ip, nil
+		}
+	case gosnmp.OctetString:
+		b, _ := v.Value.([]byte)
+		// either the raw address or its textual form
+		if len(b) == net.IPv4len || len(b) == net.IPv6len {
+			return net.IP(b), nil
+		}
+		if ip := net.ParseIP(strings.TrimSpace(string(b))); ip != nil {
+			return ip, nil
+		}
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance:
+		return nil, fmt.Errorf("no such object")
+	}
+	return nil, fmt.Errorf("value %v of type %s is not an address", v.Value, v.Type)
+}
+
+// snmpAuthProtocol returns the SNMPv3 authentication protocol called name.
+func snmpAuthProtocol(name string) (gosnmp.SnmpV3AuthProtocol, error) {
+	switch strings.ToUpper(name) {
+	case "":
+		return gosnmp.NoAuth, nil
+	case "MD5":
+		return gosnmp.MD5, nil
+	case "SHA":
+		return gosnmp.SHA, nil
+	case "SHA224":
+		return gosnmp.SHA224, nil
+	case "SHA256":
+		return gosnmp.SHA256, nil
+	case "SHA384":
+		return gosnmp.SHA384, nil
+	case "SHA512":
+		return gosnmp.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported auth_protocol '%s'", name)
+}
+
+// snmpPrivProtocol returns the SNMPv3 privacy protocol called name.
+func snmpPrivProtocol(name string) (gosnmp.SnmpV3PrivProtocol, error) {
+	switch strings.ToUpper(name) {
+	case "":
+		return gosnmp.NoPriv, nil
+	case "DES":
+		return gosnmp.DES, nil
+	case "AES":
+		return gosnmp.AES, nil
+	case "AES192":
+		return gosnmp.AES192, nil
+	case "AES256":
+		return gosnmp.AES256, nil
+	case "AES192C":
+		return gosnmp.AES192C, nil
+	case "AES256C":
+		return gosnmp.AES256C, nil
+	}
+	return 0, fmt.Errorf("unsupported priv_protocol '%s'", name)
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*SNMP)(nil)
+	_ caddy.Provisioner     = (*SNMP)(nil)
+	_ caddyfile.Unmarshaler = (*SNMP)(nil)
+)
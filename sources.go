@@ -0,0 +1,267 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+)
+
+// parseIPList parses a list of addresses separated
+// by commas and/or whitespace.
+func parseIPList(list string) ([]net.IP, error) {
+	var ips []net.IP
+	fields := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	})
+	for _, field := range fields {
+		ip := net.ParseIP(stripZone(field))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", field)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// filterVersions returns the addresses of ips
+// which belong to the enabled IP versions.
+func filterVersions(ips []net.IP, versions dynamicdns.IPVersions) []net.IP {
+	var out []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil && !versions.V4Enabled() {
+			continue
+		}
+		if ip.To4() == nil && !versions.V6Enabled() {
+			continue
+		}
+		out = append(out, ip)
+	}
+	return out
+}
+
+// singleArg parses the single argument of the
+// current subdirective of d into s.
+func singleArg(d *caddyfile.Dispenser, s *string) error {
+	if !d.AllArgs(s) {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// durationArg parses the single duration argument
+// of the current subdirective of d into dur.
+func durationArg(d *caddyfile.Dispenser, dur *caddy.Duration) error {
+	name := d.Val()
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	parsed, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return d.Errf("invalid %s '%s': %v", name, d.Val(), err)
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	*dur = caddy.Duration(parsed)
+	return nil
+}
+
+// sourceArg parses the IP source of the current subdirective
+// of d, like the ip_source option of the dynamic_dns app.
+func sourceArg(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, "dynamic_dns.ip_sources."+name)
+	if err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(unm, "source", name, nil), nil
+}
+
+// sourceName returns the name of the IP source
+// module configured by raw.
+func sourceName(raw json.RawMessage) (string, error) {
+	var mod struct {
+		Source string `json:"source"`
+	}
+	if err := json.Unmarshal(raw, &mod); err != nil {
+		return "", err
+	}
+	return mod.Source, nil
+}
+
+// errNotFound is returned by metadataRequest if
+// the metadata service has no such entry.
+var errNotFound = errors.New("not found")
+
+// statusError is returned by metadataRequest if the
+// metadata service responds with an unexpected status.
+type statusError struct {
+	method   string
+	endpoint string
+	code     int
+	status   string
+	body     []byte
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.method, e.endpoint, e.status)
+}
+
+func (e statusError) Is(target error) bool {
+	return target == errNotFound && e.code == http.StatusNotFound
+}
+
+// metadataRequest sends a request to a cloud metadata service
+// and returns the body of the response, trimmed of whitespace.
+func metadataRequest(ctx context.Context, client *http.Client, method, endpoint string, header http.Header) (string, error) {
+	body, err := apiRequest(ctx, client, method, endpoint, header, nil)
+	return strings.TrimSpace(string(body)), err
+}
+
+// apiRequest sends a request with the given body, if any,
+// to an HTTP API and returns the body of the response.
+func apiRequest(ctx context.Context, client *http.Client, method, endpoint string, header http.Header, reqBody []byte) ([]byte, error) {
+	var r io.Reader
+	if reqBody != nil {
+		r = bytes.NewReader(reqBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, r)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError{
+			method:   method,
+			endpoint: endpoint,
+			code:     resp.StatusCode,
+			status:   resp.Status,
+			body:     body,
+		}
+	}
+	return body, nil
+}
+
+// apiClient returns a client for the HTTP API of a device, which
+// trusts the CA certificates in caFile in addition to the system's,
+// or does not verify certificates at all if insecure is set, as
+// devices often use self-signed certificates.
+func apiClient(timeout caddy.Duration, caFile string, insecure bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout:   time.Duration(timeout),
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+// expandSecret replaces the global placeholders in s, like
+// {env.ROUTER_PASSWORD}, and the credential placeholders, to
+// keep secrets out of the config. Unlike secret, it expands a
+// credential that cannot be looked up to an empty string.
+func expandSecret(s string) string {
+	out, _ := secret(context.Background(), s)
+	return out
+}
+
+// basicAuth returns the Authorization header value
+// for HTTP Basic authentication.
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// stripZone drops the zone of a scoped IPv6 address, like
+// the %eth0 of fe80::1%eth0, as printed by ip or ipconfig,
+// since the records cannot have it.
+func stripZone(s string) string {
+	if i := strings.IndexByte(s, '%'); i >= 0 && strings.Contains(s[:i], ":") {
+		return s[:i]
+	}
+	return s
+}
+
+// interfaceAddress parses an interface address in CIDR
+// notation, like 192.0.2.1/24, or a plain address. The
+// zone of scoped addresses, like fe80::1%em0, is dropped.
+func interfaceAddress(s string) net.IP {
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		zone := s[i:]
+		if j := strings.IndexByte(zone, '/'); j >= 0 {
+			zone = zone[:j]
+		}
+		s = strings.Replace(s, zone, "", 1)
+	}
+	if ip, _, err := net.ParseCIDR(s); err == nil {
+		return ip
+	}
+	return net.ParseIP(s)
+}
+
+// intArg parses the single integer argument
+// of the current subdirective of d into i.
+func intArg(d *caddyfile.Dispenser, i *int) error {
+	name := d.Val()
+	var s string
+	if !d.AllArgs(&s) {
+		return d.ArgErr()
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return d.Errf("invalid %s '%s': %v", name, s, err)
+	}
+	*i = n
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// NewCommand returns a command source that runs cmd with args,
+// for use as a library, e.g. in tools and tests, without Caddy
+// provisioning it. It logs nothing and has the default timeout.
+// Options set on it afterwards that need provisioning, like the
+// format or the hooks, require Provision with a Caddy context
+// instead.
+func NewCommand(cmd string, args ...string) *Command {
+	c := &Command{Cmd: cmd, Args: args}
+	c.provisionStandalone()
+	return c
+}
+
+// provisionStandalone sets up what GetIPs needs of a source that
+// was not provisioned: a logger that discards the logs, the
+// default timeout and the state. GetIPs calls it on a copy of a
+// source that was not provisioned, which then does not keep its
+// state, like the cached addresses, across calls.
+func (c *Command) provisionStandalone() {
+	if c.logger == nil {
+		c.logger = zap.NewNop()
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = caddy.Duration(30 * time.Second)
+	}
+	if c.state == nil {
+		c.state = new(state)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+// verifyOnStart runs the lookup once and returns
+// an error if it fails or returns no addresses.
+func (c Command) verifyOnStart() error {
+	ips, err := c.lookupWithHooks(context.Background(), dynamicdns.IPVersions{})
+	if errors.Is(err, ErrUnchanged) {
+		// the command works, it just has nothing new to say
+		c.logger.Info("verified command on start; it reported no change",
+			zap.String("command", c.Cmd))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("verify_on_start: %v", err)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("verify_on_start: command %s returned no addresses", c.Cmd)
+	}
+	c.logger.Info("verified command on start",
+		zap.String("command", c.Cmd),
+		zap.Strings("ips", ipStrings(ips)))
+	return nil
+}
+
+// warmUp runs the lookup and keeps its result
+// for the first call to GetIPs.
+func (c Command) warmUp(ctx context.Context) {
+	ips, err := c.state.shared(ctx, dynamicdns.IPVersions{}, func() ([]net.IP, error) {
+		return c.resolve(ctx, dynamicdns.IPVersions{})
+	})
+	if err != nil {
+		c.logger.Warn("warm-up failed",
+			zap.String("command", c.Cmd),
+			zap.Error(err))
+		return
+	}
+	c.state.putWarm(ips)
+	c.logger.Debug("warmed up",
+		zap.String("command", c.Cmd),
+		zap.Strings("ips", ipStrings(ips)))
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+)
+
+// state is the mutable state of a Command that
+// is kept between calls to GetIPs.
+type state struct {
+	mu sync.Mutex
+
+	// the addresses that were last reported
+	reported []net.IP
+
+	// a changed set of addresses waiting for
+	// confirmation and how often it was seen
+	pending      []net.IP
+	pendingCount int
+
+	// the last non-empty result and how many runs
+	// in a row returned no addresses since
+	nonEmpty  []net.IP
+	emptyRuns int
+
+	// the last successful result, its metadata
+	// and when it was looked up
+	cacheMu  sync.Mutex
+	cacheIPs []net.IP
+	metadata *Metadata
+	cachedAt time.Time
+
+	// when the addresses of each family were last looked
+	// up, for the cache TTLs per family
+	cachedAt4 time.Time
+	cachedAt6 time.Time
+
+	// the lookups currently in flight, by the families
+	// they were asked for
+	flightMu sync.Mutex
+	flights  map[flightKey]*flight
+
+	// the result of the warm-up, until the first call
+	// to GetIPs takes it, and whether that happened
+	warmMu    sync.Mutex
+	warmIPs   []net.IP
+	warmTaken bool
+
+	// the outcomes of the lookups
+	health health
+
+	// the last lookups
+	history history
+
+	// the output of the commands of the last lookup
+	capture capture
+}
+
+// flightKey is the families a lookup was asked for.
+type flightKey struct {
+	ipv4, ipv6 bool
+}
+
+// errFlightPanicked is the error of the callers that waited
+// for a lookup that panicked.
+var errFlightPanicked = errors.New("the shared lookup panicked")
+
+// flight is a lookup that is in progress or finished.
+type flight struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// setMetadata remembers the metadata of the last lookup.
+func (s *state) setMetadata(meta *Metadata) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	s.metadata = meta
+}
+
+// cache remembers ips as the last successful result of
+// a lookup of versions.
+func (s *state) cache(ips []net.IP, versions dynamicdns.IPVersions) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	s.cacheIPs = ips
+	s.cachedAt = time.Now()
+	if versions.V4Enabled() {
+		s.cachedAt4 = s.cachedAt
+	}
+	if versions.V6Enabled() {
+		s.cachedAt6 = s.cachedAt
+	}
+}
+
+// restore takes over ips as the last result, e.g. of a
+// previous run of Caddy. They are expired, like flushed ones,
+// but compared against and reused like them.
+func (s *state) restore(ips []net.IP) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if s.cacheIPs == nil && len(ips) > 0 {
+		s.cacheIPs = ips
+	}
+}
+
+// cached returns the last successful result if it is
+// not older than ttl. A negative ttl never expires.
+func (s *state) cached(ttl time.Duration) ([]net.IP, bool) {
+	if ttl == 0 {
+		return nil, false
+	}
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if s.cacheIPs == nil || (ttl > 0 && time.Since(s.cachedAt) > ttl) {
+		return nil, false
+	}
+	return s.cacheIPs, true
+}
+
+// flush expires the cached result and discards the result of
+// the warm-up. The cached addresses are still kept, so that an
+// unchanged exit code can reuse them.
+func (s *state) flush() {
+	s.cacheMu.Lock()
+	s.cachedAt, s.cachedAt4, s.cachedAt6 = time.Time{}, time.Time{}, time.Time{}
+	s.cacheMu.Unlock()
+
+	s.warmMu.Lock()
+	s.warmIPs, s.warmTaken = nil, true
+	s.warmMu.Unlock()
+}
+
+// putWarm remembers ips as the result of the warm-up,
+// unless GetIPs was already called.
+func (s *state) putWarm(ips []net.IP) {
+	s.warmMu.Lock()
+	defer s.warmMu.Unlock()
+	if !s.warmTaken {
+		s.warmIPs = ips
+	}
+}
+
+// takeWarm returns the result of the warm-up, if any. Only
+// the first call can take it; later ones return false.
+func (s *state) takeWarm() ([]net.IP, bool) {
+	s.warmMu.Lock()
+	defer s.warmMu.Unlock()
+	ips := s.warmIPs
+	s.warmIPs, s.warmTaken = nil, true
+	return ips, ips != nil
+}
+
+// shared calls fn and returns its result. If fn is already
+// running from another call for the same versions, it waits for
+// that call to finish and returns its result instead, so that
+// overlapping lookups never run the command concurrently for the
+// same families. Lookups for other families, which would get
+// the wrong addresses from it, do not wait.
+func (s *state) shared(ctx context.Context, versions dynamicdns.IPVersions, fn func() ([]net.IP, error)) ([]net.IP, error) {
+	key := flightKey{ipv4: versions.V4Enabled(), ipv6: versions.V6Enabled()}
+	s.flightMu.Lock()
+	if f, ok := s.flights[key]; ok {
+		s.flightMu.Unlock()
+		select {
+		case <-f.done:
+			return f.ips, f.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	f := &flight{done: make(chan struct{}), err: errFlightPanicked}
+	if s.flights == nil {
+		s.flights = make(map[flightKey]*flight)
+	}
+	s.flights[key] = f
+	s.flightMu.Unlock()
+
+	// even if fn panics, so that later calls do not wait forever
+	defer func() {
+		s.flightMu.Lock()
+		delete(s.flights, key)
+		s.flightMu.Unlock()
+		close(f.done)
+	}()
+	ips, err := fn()
+	f.ips, f.err = ips, err
+	return ips, err
+}
+
+// sameIPs returns true if a and b contain
+// the same addresses, regardless of order.
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ip := range a {
+		if !ipListContains(b, ip) {
+			return false
+		}
+	}
+	for _, ip := range b {
+		if !ipListContains(a, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ipListContains returns true if list contains ip; false otherwise.
+func ipListContains(list []net.IP, ip net.IP) bool {
+	for _, ipInList := range list {
+		if ipInList.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipStrings returns the string representations of ips.
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = ip.String()
+	}
+	return out
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// When the watch command is restarted after it exited.
+const (
+	WatchRestartAlways    = "always"
+	WatchRestartOnFailure = "on_failure"
+	WatchRestartNever     = "never"
+)
+
+// The states of the watch command.
+const (
+	watchRunning    = "running"
+	watchRestarting = "restarting"
+	watchStopped    = "stopped"
+)
+
+// The window WatchMaxRestarts applies to.
+const watchRestartWindow = time.Hour
+
+// provisionSupervisor sets the defaults of the restart policy.
+func (c *Command) provisionSupervisor() error {
+	switch c.WatchRestart {
+	case "":
+		c.WatchRestart = WatchRestartAlways
+	case WatchRestartAlways, WatchRestartOnFailure, WatchRestartNever:
+	default:
+		return fmt.Errorf("unknown watch restart policy %s", c.WatchRestart)
+	}
+	if c.WatchRestartDelay < 0 || c.WatchRestartMaxDelay < 0 || c.WatchMaxRestarts < 0 {
+		return fmt.Errorf("invalid watch restart_delay or max_restarts")
+	}
+	if c.WatchRestartDelay == 0 {
+		c.WatchRestartDelay = caddy.Duration(time.Second)
+	}
+	if c.WatchRestartMaxDelay == 0 {
+		c.WatchRestartMaxDelay = caddy.Duration(time.Minute)
+	}
+	if c.WatchRestartMaxDelay < c.WatchRestartDelay {
+		c.WatchRestartMaxDelay = c.WatchRestartDelay
+	}
+	return nil
+}
+
+// unmarshalWatch parses the block of the watch subdirective.
+func (c *Command) unmarshalWatch(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "restart":
+			if err := singleArg(d, &c.WatchRestart); err != nil {
+				return err
+			}
+
+		case "restart_delay":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			for i, arg := range args {
+				dur, err := caddy.ParseDuration(arg)
+				if err != nil {
+					return d.Errf("invalid restart_delay '%s': %v", arg, err)
+				}
+				if i == 0 {
+					c.WatchRestartDelay = caddy.Duration(dur)
+				} else {
+					c.WatchRestartMaxDelay = caddy.Duration(dur)
+				}
+			}
+
+		case "max_restarts":
+			if err := intArg(d, &c.WatchMaxRestarts); err != nil {
+				return err
+			}
+
+		default:
+			return d.Errf("unrecognized watch subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// watch runs the watch command until ctx is done, restarting it
+// by the restart policy when it exits, with a delay that doubles
+// with every restart up to WatchRestartMaxDelay. The delay starts
+// over once the command ran for WatchRestartMaxDelay. It keeps
+// running across reloads, until the carried state is released.
+func (c Command) watch(ctx context.Context) {
+	c = c.redactingLogger()
+	sup := &c.watchState.supervisor
+	delay := time.Duration(c.WatchRestartDelay)
+	for {
+		started := time.Now()
+		err := c.runWatch(ctx)
+		if ctx.Err() != nil {
+			// the config was unloaded
+			sup.stopped(nil)
+			return
+		}
+		if time.Since(started) >= time.Duration(c.WatchRestartMaxDelay) {
+			delay = time.Duration(c.WatchRestartDelay)
+		}
+		failed := err != nil
+		if err == nil {
+			err = fmt.Errorf("watch command %s exited", c.Cmd)
+		}
+		c.recordFailure(err)
+
+		if c.WatchRestart == WatchRestartNever || (c.WatchRestart == WatchRestartOnFailure && !failed) {
+			sup.stopped(err)
+			c.logger.Error("watch command exited; keeping its last addresses",
+				zap.String("command", c.Cmd),
+				zap.Strings("ips", ipStrings(c.watchState.get())),
+				zap.Error(err))
+			return
+		}
+
+		wait := delay
+		if w := sup.rateLimit(c.WatchMaxRestarts); w > wait {
+			wait = w
+		}
+		sup.restarting(err, wait)
+		c.logger.Error("watch command exited; restarting it and keeping its last addresses until then",
+			zap.String("command", c.Cmd),
+			zap.Strings("ips", ipStrings(c.watchState.get())),
+			zap.Duration("delay", wait),
+			zap.Error(err))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			sup.stopped(nil)
+			return
+		}
+		sup.restarted()
+		c.countWatchRestart()
+		delay *= 2
+		if delay > time.Duration(c.WatchRestartMaxDelay) {
+			delay = time.Duration(c.WatchRestartMaxDelay)
+		}
+	}
+}
+
+// SupervisorStatus is the state of the watch command.
+type SupervisorStatus struct {
+	// running, restarting or stopped
+	State string `json:"state"`
+
+	// The process ID of the running command.
+	PID int `json:"pid,omitempty"`
+
+	// How often the command was restarted.
+	Restarts int `json:"restarts"`
+
+	// The error the command last exited with.
+	LastExitError string `json:"last_exit_error,omitempty"`
+
+	// When the command is restarted, while restarting.
+	NextRestart *time.Time `json:"next_restart,omitempty"`
+}
+
+// supervisor tracks the state of the watch command.
+type supervisor struct {
+	mu            sync.Mutex
+	state         string
+	pid           int
+	restarts      []time.Time
+	count         int
+	lastExitError string
+	nextRestart   time.Time
+}
+
+// running records that the command started as pid.
+func (s *supervisor) running(pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state, s.pid = watchRunning, pid
+	s.nextRestart = time.Time{}
+}
+
+// restarting records that the command exited with err
+// and is restarted after wait.
+func (s *supervisor) restarting(err error, wait time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state, s.pid = watchRestarting, 0
+	s.lastExitError = err.Error()
+	s.nextRestart = time.Now().Add(wait)
+}
+
+// restarted records a restart.
+func (s *supervisor) restarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	s.restarts = append(s.restarts, time.Now())
+}
+
+// stopped records that the command is not restarted,
+// after it exited with err, if any.
+func (s *supervisor) stopped(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state, s.pid = watchStopped, 0
+	if err != nil {
+		s.lastExitError = err.Error()
+	}
+	s.nextRestart = time.Time{}
+}
+
+// rateLimit returns how long to wait until a restart is within
+// max restarts in the last watchRestartWindow, if max is set.
+func (s *supervisor) rateLimit(max int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-watchRestartWindow)
+	for len(s.restarts) > 0 && s.restarts[0].Before(cutoff) {
+		s.restarts = s.restarts[1:]
+	}
+	if max == 0 || len(s.restarts) < max {
+		return 0
+	}
+	return time.Until(s.restarts[len(s.restarts)-max].Add(watchRestartWindow))
+}
+
+// status returns the state of the watch command.
+func (s *supervisor) status() SupervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := SupervisorStatus{
+		State:         s.state,
+		PID:           s.pid,
+		Restarts:      s.count,
+		LastExitError: s.lastExitError,
+	}
+	if !s.nextRestart.IsZero() {
+		t := s.nextRestart
+		out.NextRestart = &t
+	}
+	return out
+}
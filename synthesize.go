@@ -0,0 +1,134 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"go.uber.org/zap"
+)
+
+// synthesizeData is the data the synthesize templates
+// are executed with, once for every address.
+type synthesizeData struct {
+	// The address, and whether it is an IPv4 or IPv6 address.
+	IP   string
+	IPv4 bool
+	IPv6 bool
+
+	// All addresses of the result.
+	IPs []string
+}
+
+// synthesizeFuncs are the functions of the synthesize
+// templates, in addition to the sprig ones.
+var synthesizeFuncs = template.FuncMap{
+	"ipNetwork":    ipNetwork,
+	"ipWithSuffix": ipWithSuffix,
+}
+
+// ipNetwork returns the first address of the prefix
+// of length bits that ip is in, e.g. the /64 of an
+// IPv6 address.
+func ipNetwork(ip string, bits int) (string, error) {
+	return ipWithSuffix(ip, bits, "::")
+}
+
+// ipWithSuffix returns the address with the first bits
+// of ip and the other bits of suffix, e.g. the address
+// ending in ::10 in the /64 of an IPv6 address. The
+// suffix of an IPv4 address is an IPv4 address too,
+// like 0.0.0.10.
+func ipWithSuffix(ip string, bits int, suffix string) (string, error) {
+	prefix := net.ParseIP(ip)
+	host := net.ParseIP(suffix)
+	if prefix == nil {
+		return "", fmt.Errorf("invalid IP %s", ip)
+	}
+	if host == nil {
+		return "", fmt.Errorf("invalid suffix %s", suffix)
+	}
+	if ip4 := prefix.To4(); ip4 != nil {
+		prefix, host = ip4, host.To4()
+		if host == nil {
+			return "", fmt.Errorf("suffix %s of IPv4 address %s is not an IPv4 address", suffix, ip)
+		}
+	}
+	if bits < 0 || bits > len(prefix)*8 {
+		return "", fmt.Errorf("invalid prefix length %d for %s", bits, ip)
+	}
+	mask := net.CIDRMask(bits, len(prefix)*8)
+	out := make(net.IP, len(prefix))
+	for i := range out {
+		out[i] = prefix[i]&mask[i] | host[i]&^mask[i]
+	}
+	return out.String(), nil
+}
+
+// provisionSynthesize parses the synthesize templates.
+func (c *Command) provisionSynthesize() error {
+	for i, text := range c.Synthesize {
+		tmpl, err := template.New(fmt.Sprintf("synthesize[%d]", i)).
+			Funcs(sprig.TxtFuncMap()).
+			Funcs(synthesizeFuncs).
+			Parse(text)
+		if err != nil {
+			return fmt.Errorf("parsing synthesize template %q: %v", text, err)
+		}
+		c.synthesize = append(c.synthesize, tmpl)
+	}
+	return nil
+}
+
+// synthesizeAddresses appends the addresses the synthesize
+// templates derive from each of ips, unless ips already has
+// them. A template may print no address, or several
+// separated by commas or whitespace.
+func (c Command) synthesizeAddresses(ips []net.IP) ([]net.IP, error) {
+	if len(c.synthesize) == 0 {
+		return ips, nil
+	}
+	all := ipStrings(ips)
+	out := append([]net.IP(nil), ips...)
+	for _, ip := range ips {
+		data := synthesizeData{
+			IP:   ip.String(),
+			IPv4: ip.To4() != nil,
+			IPv6: ip.To4() == nil,
+			IPs:  all,
+		}
+		for _, tmpl := range c.synthesize {
+			var sb strings.Builder
+			if err := tmpl.Execute(&sb, data); err != nil {
+				return nil, fmt.Errorf("executing synthesize template for %s: %v", ip, err)
+			}
+			for _, s := range strings.FieldsFunc(sb.String(), func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+			}) {
+				synthesized := net.ParseIP(s)
+				if synthesized == nil {
+					return nil, fmt.Errorf("synthesize template for %s: %w", ip, &ErrInvalidIP{Token: s})
+				}
+				if ip4 := synthesized.To4(); ip4 != nil {
+					synthesized = ip4
+				}
+				if ipListContains(out, synthesized) {
+					continue
+				}
+				c.logger.Debug("synthesized address",
+					zap.String("command", c.Cmd),
+					zap.String("from", ip.String()),
+					zap.String("ip", synthesized.String()))
+				out = append(out, synthesized)
+			}
+		}
+	}
+	return out, nil
+}
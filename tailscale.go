@@ -0,0 +1,213 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Tailscale{})
+}
+
+// The default socket of the tailscaled LocalAPI.
+const defaultTailscaleSocket = "/var/run/tailscale/tailscaled.sock"
+
+// Tailscale is an IP source that looks up the tailnet addresses
+// of this node from the local tailscaled, e.g. to publish them in
+// a private DNS zone.
+//
+// The addresses are read from the LocalAPI socket of tailscaled.
+// If the socket does not exist, `tailscale status --json` is run
+// instead, which also works on platforms without a socket.
+type Tailscale struct {
+	// The LocalAPI socket of tailscaled.
+	// Default: /var/run/tailscale/tailscaled.sock
+	Socket string `json:"socket,omitempty"`
+
+	// The tailscale CLI to run if the socket does not exist.
+	// Default: tailscale
+	CLI string `json:"cli,omitempty"`
+
+	// How long to wait for tailscaled. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	client *http.Client
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Tailscale) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.tailscale",
+		New: func() caddy.Module { return new(Tailscale) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	tailscale {
+//	    socket <path>
+//	    cli <path>
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (t *Tailscale) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "socket":
+				err = singleArg(d, &t.Socket)
+			case "cli":
+				err = singleArg(d, &t.CLI)
+			case "timeout":
+				err = durationArg(d, &t.Timeout)
+			case "filter":
+				err = t.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (t *Tailscale) Provision(ctx caddy.Context) error {
+	t.logger = ctx.Logger(t)
+	if err := t.Filters.load(ctx); err != nil {
+		return err
+	}
+	if t.Socket == "" {
+		t.Socket = defaultTailscaleSocket
+	}
+	if t.CLI == "" {
+		t.CLI = "tailscale"
+	}
+	if t.Timeout <= 0 {
+		t.Timeout = caddy.Duration(5 * time.Second)
+	}
+	socket := t.Socket
+	t.client = &http.Client{
+		Timeout: time.Duration(t.Timeout),
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	return nil
+}
+
+// tailscaleStatus is the subset of the status of
+// tailscaled that is returned by both LocalAPI and CLI.
+type tailscaleStatus struct {
+	BackendState string `json:"BackendState"`
+	Self         *struct {
+		TailscaleIPs []string `json:"TailscaleIPs"`
+	} `json:"Self"`
+}
+
+// GetIPs gets the tailnet addresses of this machine.
+func (t Tailscale) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return t.Filters.apply(t.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (t Tailscale) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	var status tailscaleStatus
+	var err error
+	if _, statErr := os.Stat(t.Socket); statErr == nil {
+		err = t.localAPIStatus(ctx, &status)
+	} else {
+		t.logger.Debug("tailscaled socket not found; running cli",
+			zap.String("socket", t.Socket),
+			zap.String("cli", t.CLI))
+		err = t.cliStatus(ctx, &status)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if status.BackendState != "Running" {
+		return nil, fmt.Errorf("tailscale is not running: %s", status.BackendState)
+	}
+	if status.Self == nil {
+		return nil, fmt.Errorf("tailscale status has no self node")
+	}
+
+	var ips []net.IP
+	for _, addr := range status.Self.TailscaleIPs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", addr)
+		}
+		ips = append(ips, ip)
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// localAPIStatus gets the status from the LocalAPI socket.
+func (t Tailscale) localAPIStatus(ctx context.Context, status *tailscaleStatus) error {
+	// the host is ignored by the dialer, but tailscaled checks it
+	body, err := metadataRequest(ctx, t.client, http.MethodGet,
+		"http://local-tailscaled.sock/localapi/v0/status?peers=false", nil)
+	if err != nil {
+		return fmt.Errorf("querying tailscaled: %v", err)
+	}
+	if err := json.Unmarshal([]byte(body), status); err != nil {
+		return fmt.Errorf("decoding tailscale status: %v", err)
+	}
+	return nil
+}
+
+// cliStatus gets the status by running `tailscale status --json`.
+func (t Tailscale) cliStatus(ctx context.Context, status *tailscaleStatus) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(t.Timeout))
+	defer cancel()
+
+	stdout, err := exec.CommandContext(ctx, t.CLI, "status", "--json", "--peers=false").Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("running %s: %v: %s", t.CLI, err, exitErr.Stderr)
+		}
+		return fmt.Errorf("running %s: %v", t.CLI, err)
+	}
+	if err := json.Unmarshal(stdout, status); err != nil {
+		return fmt.Errorf("decoding tailscale status: %v", err)
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*Tailscale)(nil)
+	_ caddy.Provisioner     = (*Tailscale)(nil)
+	_ caddyfile.Unmarshaler = (*Tailscale)(nil)
+)
@@ -0,0 +1,135 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// tracerName is the name of the tracer that creates the spans.
+const tracerName = "github.com/mietzen/caddy-dynamicdns-cmd-source"
+
+// The tracer provider is shared by all instances which enable tracing,
+// like Caddy's tracing handler does. The exporter is configured by the
+// standard OTEL_EXPORTER_OTLP_* environment variables.
+var (
+	tracerProviderMu    sync.Mutex
+	tracerProvider      *sdktrace.TracerProvider
+	tracerProviderUsers int
+)
+
+// provisionTracing sets up the tracer if tracing is enabled.
+func (c *Command) provisionTracing(ctx caddy.Context) error {
+	if !c.Tracing {
+		return nil
+	}
+
+	tracerProviderMu.Lock()
+	defer tracerProviderMu.Unlock()
+
+	if tracerProvider == nil {
+		version, _ := caddy.Version()
+		res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+			semconv.WebEngineName("Caddy"),
+			semconv.WebEngineVersion(version),
+		))
+		if err != nil {
+			return fmt.Errorf("creating tracing resource: %v", err)
+		}
+		exporter, err := otlptracegrpc.New(ctx)
+		if err != nil {
+			return fmt.Errorf("creating trace exporter: %v", err)
+		}
+		tracerProvider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(res),
+		)
+	}
+	tracerProviderUsers++
+
+	c.tracer = tracerProvider.Tracer(tracerName)
+	return nil
+}
+
+// cleanupTracing releases the tracer, shutting down
+// the tracer provider if it was the last user.
+func (c *Command) cleanupTracing() error {
+	if c.tracer == nil {
+		return nil
+	}
+	c.tracer = nil
+
+	tracerProviderMu.Lock()
+	defer tracerProviderMu.Unlock()
+
+	tracerProviderUsers--
+	if tracerProviderUsers > 0 {
+		return nil
+	}
+
+	tp := tracerProvider
+	tracerProvider = nil
+	if err := tp.ForceFlush(context.Background()); err != nil {
+		c.logger.Error("flushing traces", zap.Error(err))
+	}
+	if err := tp.Shutdown(context.Background()); err != nil {
+		return fmt.Errorf("shutting down tracer provider: %v", err)
+	}
+	return nil
+}
+
+// startSpan starts a span for running cmd, if tracing is enabled.
+// The returned env passes the trace context on to the command in
+// the TRACEPARENT environment variable.
+func (c Command) startSpan(ctx context.Context, cmd string, args []string) (context.Context, trace.Span, []string) {
+	if c.tracer == nil {
+		return ctx, trace.SpanFromContext(ctx), nil
+	}
+
+	ctx, span := c.tracer.Start(ctx, "dynamic_dns.command",
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(
+			attribute.String("command", cmd),
+			attribute.StringSlice("args", args),
+			attribute.String("run_id", c.runID),
+			attribute.String("label", c.Label),
+		))
+
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	var env []string
+	if traceparent := carrier.Get("traceparent"); traceparent != "" {
+		env = append(env, "TRACEPARENT="+traceparent)
+	}
+
+	return ctx, span, env
+}
+
+// endSpan records the outcome of a command run in span and ends it.
+func endSpan(span trace.Span, exitCode, addresses int, err error) {
+	span.SetAttributes(
+		attribute.Int("exit_code", exitCode),
+		attribute.Int("addresses", addresses),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Translation types.
+const (
+	// Translate6to4 derives the 6to4 address (RFC 3056) in
+	// 2002::/16 of an IPv4 address, and the IPv4 address
+	// embedded in a 6to4 address.
+	Translate6to4 = "6to4"
+
+	// Translate6rd derives the address in the delegated 6rd
+	// prefix (RFC 5969) of an IPv4 address, and the IPv4
+	// address embedded in an address of the 6rd prefix.
+	Translate6rd = "6rd"
+
+	// TranslateNAT64 derives the IPv4 address embedded in an
+	// address of the NAT64 prefix (RFC 6052), e.g. of 464XLAT.
+	TranslateNAT64 = "nat64"
+)
+
+// Translation derives the address of the other family from the
+// addresses of the result, for IPv6 tunneled over IPv4 and vice
+// versa, so that one lookup yields the addresses of both.
+type Translation struct {
+	// 6to4, 6rd or nat64.
+	Type string `json:"type"`
+
+	// The 6rd prefix of the ISP, or the NAT64 prefix, whose
+	// length must be 32, 40, 48, 56, 64 or 96.
+	// Default for nat64: 64:ff9b::/96
+	Prefix string `json:"prefix,omitempty"`
+
+	// For 6rd, the prefix all IPv4 addresses of the ISP share,
+	// whose bits the 6rd prefix leaves out. Only IPv4 addresses
+	// in it are translated. Default: all 32 bits are embedded
+	IPv4Prefix string `json:"ipv4_prefix,omitempty"`
+
+	// The interface identifier of the IPv6 addresses derived
+	// for 6to4 and 6rd, after the delegated prefix.
+	// Default: ::1
+	Suffix string `json:"suffix,omitempty"`
+
+	prefix     *net.IPNet
+	ipv4Prefix *net.IPNet
+	suffix     net.IP
+}
+
+// unmarshalTranslation parses the translate subdirective
+// from the current position of d. Syntax:
+//
+//	translate 6to4|6rd|nat64 [<prefix>] {
+//	    ipv4_prefix <cidr>
+//	    suffix <ip>
+//	}
+func unmarshalTranslation(d *caddyfile.Dispenser) (*Translation, error) {
+	t := new(Translation)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	t.Type = d.Val()
+	if d.NextArg() {
+		t.Prefix = d.Val()
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "ipv4_prefix":
+			err = singleArg(d, &t.IPv4Prefix)
+		case "suffix":
+			err = singleArg(d, &t.Suffix)
+		default:
+			err = d.Errf("unrecognized translate subdirective '%s'", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.provision(); err != nil {
+		return nil, d.Errf("invalid translate: %v", err)
+	}
+	return t, nil
+}
+
+// provision checks t and sets its defaults.
+func (t *Translation) provision() error {
+	prefix := t.Prefix
+	switch t.Type {
+	case Translate6to4:
+		if prefix != "" {
+			return fmt.Errorf("6to4 has no prefix")
+		}
+		prefix = "2002::/16"
+	case Translate6rd:
+		if prefix == "" {
+			return fmt.Errorf("6rd needs the 6rd prefix")
+		}
+	case TranslateNAT64:
+		if prefix == "" {
+			prefix = "64:ff9b::/96"
+		}
+	default:
+		return fmt.Errorf("unknown type '%s'", t.Type)
+	}
+
+	var err error
+	_, t.prefix, err = net.ParseCIDR(prefix)
+	if err != nil || t.prefix.IP.To4() != nil {
+		return fmt.Errorf("invalid IPv6 prefix '%s'", prefix)
+	}
+	bits, _ := t.prefix.Mask.Size()
+
+	if t.IPv4Prefix != "" {
+		if t.Type != Translate6rd {
+			return fmt.Errorf("ipv4_prefix is only for 6rd")
+		}
+		_, t.ipv4Prefix, err = net.ParseCIDR(t.IPv4Prefix)
+		if err != nil || t.ipv4Prefix.IP.To4() == nil {
+			return fmt.Errorf("invalid ipv4_prefix '%s'", t.IPv4Prefix)
+		}
+	}
+
+	switch t.Type {
+	case Translate6rd:
+		if bits+t.embeddedBits() > 64 {
+			return fmt.Errorf("the 6rd prefix /%d and %d bits of IPv4 address are longer than /64", bits, t.embeddedBits())
+		}
+	case TranslateNAT64:
+		switch bits {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return fmt.Errorf("invalid length /%d of NAT64 prefix '%s'", bits, prefix)
+		}
+		if t.Suffix != "" {
+			return fmt.Errorf("nat64 has no suffix")
+		}
+	}
+
+	t.suffix = net.ParseIP("::1")
+	if t.Suffix != "" {
+		t.suffix = net.ParseIP(t.Suffix)
+		if t.suffix == nil || t.suffix.To4() != nil {
+			return fmt.Errorf("invalid IPv6 suffix '%s'", t.Suffix)
+		}
+	}
+	return nil
+}
+
+// embeddedBits returns how many bits of an IPv4 address
+// are embedded in the IPv6 address.
+func (t *Translation) embeddedBits() int {
+	if t.ipv4Prefix == nil {
+		return 32
+	}
+	ones, _ := t.ipv4Prefix.Mask.Size()
+	return 32 - ones
+}
+
+// translate returns the address of the other family derived from
+// ip, or nil if ip is not one that t translates.
+func (t *Translation) translate(ip net.IP) net.IP {
+	bits, _ := t.prefix.Mask.Size()
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if t.Type == TranslateNAT64 {
+			return nil
+		}
+		if t.ipv4Prefix != nil && !t.ipv4Prefix.Contains(ip4) {
+			return nil
+		}
+		// the delegated prefix, the first subnet of it if it is
+		// shorter than /64, and the suffix as interface identifier
+		n := t.embeddedBits()
+		out := make(net.IP, net.IPv6len)
+		copyBits(out, 0, t.prefix.IP.To16(), 0, bits)
+		copyBits(out, bits, ip4, 32-n, n)
+		copyBits(out, 64, t.suffix.To16(), 64, 64)
+		return out
+	}
+
+	if !t.prefix.Contains(ip) {
+		return nil
+	}
+	ip = ip.To16()
+	out := make(net.IP, net.IPv4len)
+	switch t.Type {
+	case TranslateNAT64:
+		// the IPv4 bits skip bits 64 to 71, the u octet
+		for i := 0; i < 32; i++ {
+			pos := bits + i
+			if pos >= 64 && bits < 96 {
+				pos += 8
+			}
+			setBit(out, i, bit(ip, pos))
+		}
+	default:
+		n := t.embeddedBits()
+		if t.ipv4Prefix != nil {
+			copy(out, t.ipv4Prefix.IP.To4())
+		}
+		copyBits(out, 32-n, ip, bits, n)
+	}
+	return out
+}
+
+// translateAddresses appends the addresses the translations
+// derive from ips, unless ips already has them.
+func (c Command) translateAddresses(ips []net.IP) []net.IP {
+	if len(c.Translate) == 0 {
+		return ips
+	}
+	out := append([]net.IP(nil), ips...)
+	for _, ip := range ips {
+		for _, t := range c.Translate {
+			translated := t.translate(ip)
+			if translated == nil || ipListContains(out, translated) {
+				continue
+			}
+			c.logger.Debug("translated address",
+				zap.String("command", c.Cmd),
+				zap.String("type", t.Type),
+				zap.String("from", ip.String()),
+				zap.String("ip", translated.String()))
+			out = append(out, translated)
+		}
+	}
+	return out
+}
+
+// bit returns bit i of b, counting from the most significant.
+func bit(b []byte, i int) bool {
+	return b[i/8]&(0x80>>(i%8)) != 0
+}
+
+// setBit sets bit i of b, counting from the most significant.
+func setBit(b []byte, i int, v bool) {
+	if v {
+		b[i/8] |= 0x80 >> (i % 8)
+	} else {
+		b[i/8] &^= 0x80 >> (i % 8)
+	}
+}
+
+// copyBits copies n bits of src from bit srcOff to dst at bit dstOff.
+func copyBits(dst []byte, dstOff int, src []byte, srcOff, n int) {
+	for i := 0; i < n; i++ {
+		setBit(dst, dstOff+i, bit(src, srcOff+i))
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(UniFi{})
+}
+
+// UniFi is an IP source that reads the WAN address of a site from
+// a UniFi Network controller, either self-hosted or running on a
+// UniFi OS console like a UDM or Cloud Key.
+//
+// It authenticates with an API key, which requires UniFi OS, or
+// with a username and password. Logins are kept in a session which
+// is renewed when the controller rejects it.
+type UniFi struct {
+	// The URL of the controller, e.g. https://192.168.1.1
+	// for a UDM or https://unifi:8443 for a self-hosted one.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The site to read the WAN address of. Default: default
+	Site string `json:"site,omitempty"`
+
+	// An API key of the controller. Global placeholders
+	// like {env.UNIFI_API_KEY} are expanded.
+	APIKey string `json:"api_key,omitempty"`
+
+	// The user to log in as, if no API key is set. A local
+	// read-only admin suffices.
+	Username string `json:"username,omitempty"`
+
+	// The password of the user. Global placeholders
+	// like {env.UNIFI_PASSWORD} are expanded.
+	Password string `json:"password,omitempty"`
+
+	// A PEM file with the CA certificate(s) to trust, e.g.
+	// the controller's self-signed certificate.
+	CA string `json:"ca,omitempty"`
+
+	// Do not verify the controller's certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// How long to wait for the controller. Default: 10s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	client  *http.Client
+	session *unifiSession
+	logger  *zap.Logger
+}
+
+// unifiSession is the login session with the controller.
+type unifiSession struct {
+	mu        sync.Mutex
+	loggedIn  bool
+	unifiOS   bool
+	csrfToken string
+}
+
+// CaddyModule returns the Caddy module information.
+func (UniFi) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.unifi",
+		New: func() caddy.Module { return new(UniFi) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	unifi <url> {
+//	    site <name>
+//	    api_key <key>
+//	    username <user>
+//	    password <password>
+//	    ca <pem file>
+//	    insecure_skip_verify
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (u *UniFi) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&u.Endpoint) {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "site":
+				err = singleArg(d, &u.Site)
+			case "api_key":
+				err = singleArg(d, &u.APIKey)
+			case "username":
+				err = singleArg(d, &u.Username)
+			case "password":
+				err = singleArg(d, &u.Password)
+			case "ca":
+				err = singleArg(d, &u.CA)
+			case "insecure_skip_verify":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.InsecureSkipVerify = true
+			case "timeout":
+				err = durationArg(d, &u.Timeout)
+			case "filter":
+				err = u.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (u *UniFi) Provision(ctx caddy.Context) error {
+	u.logger = ctx.Logger(u)
+	if err := u.Filters.load(ctx); err != nil {
+		return err
+	}
+	if u.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	u.Endpoint = strings.TrimSuffix(u.Endpoint, "/")
+	if u.Site == "" {
+		u.Site = "default"
+	}
+	if u.APIKey == "" && u.Username == "" {
+		return fmt.Errorf("either api_key or username must be set")
+	}
+	if u.APIKey != "" && u.Username != "" {
+		return fmt.Errorf("api_key and username are mutually exclusive")
+	}
+	if u.Timeout <= 0 {
+		u.Timeout = caddy.Duration(10 * time.Second)
+	}
+
+	client, err := apiClient(u.Timeout, u.CA, u.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	client.Jar, err = cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	u.client = client
+	// API keys are only supported by UniFi OS
+	u.session = &unifiSession{unifiOS: u.APIKey != ""}
+	return nil
+}
+
+// GetIPs gets the WAN addresses of the site.
+func (u UniFi) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return u.Filters.apply(u.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (u UniFi) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	body, err := u.get(ctx, "/api/s/"+url.PathEscape(u.Site)+"/stat/health")
+	if err != nil {
+		return nil, err
+	}
+
+	var health struct {
+		Data []struct {
+			Subsystem string `json:"subsystem"`
+			WANIP     string `json:"wan_ip"`
+			Status    string `json:"status"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &health); err != nil {
+		return nil, fmt.Errorf("decoding site health: %v", err)
+	}
+
+	for _, subsystem := range health.Data {
+		if subsystem.Subsystem != "wan" {
+			continue
+		}
+		if subsystem.WANIP == "" {
+			return nil, fmt.Errorf("site %s has no WAN address, status %s", u.Site, subsystem.Status)
+		}
+		ip := net.ParseIP(subsystem.WANIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", subsystem.WANIP)
+		}
+		return filterVersions([]net.IP{ip}, versions), nil
+	}
+	return nil, fmt.Errorf("site %s has no gateway", u.Site)
+}
+
+// get gets path of the Network API, logging in first if needed
+// and once more if the controller rejects the session.
+func (u UniFi) get(ctx context.Context, path string) ([]byte, error) {
+	u.session.mu.Lock()
+	defer u.session.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if u.APIKey == "" && !u.session.loggedIn {
+			if err := u.login(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		prefix := ""
+		header := http.Header{"Accept": {"application/json"}}
+		if u.session.unifiOS {
+			prefix = "/proxy/network"
+		}
+		if u.APIKey != "" {
+			apiKey, err := secret(ctx, u.APIKey)
+			if err != nil {
+				return nil, err
+			}
+			header.Set("X-Api-Key", apiKey)
+		}
+		if u.session.csrfToken != "" {
+			header.Set("X-Csrf-Token", u.session.csrfToken)
+		}
+
+		body, err := apiRequest(ctx, u.client, http.MethodGet, u.Endpoint+prefix+path, header, nil)
+		var se statusError
+		if u.APIKey == "" && attempt == 0 && errors.As(err, &se) && se.code == http.StatusUnauthorized {
+			u.logger.Debug("session expired; logging in again")
+			u.session.loggedIn = false
+			continue
+		}
+		return body, err
+	}
+}
+
+// login logs in with username and password, trying the login
+// endpoint of UniFi OS first and then that of a self-hosted
+// controller. The session is kept in the cookie jar.
+func (u UniFi) login(ctx context.Context) error {
+	username, err := secret(ctx, u.Username)
+	if err != nil {
+		return err
+	}
+	password, err := secret(ctx, u.Password)
+	if err != nil {
+		return err
+	}
+	credentials, err := json.Marshal(map[string]any{
+		"username": username,
+		"password": password,
+		"remember": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, unifiOS := range []bool{true, false} {
+		endpoint := u.Endpoint + "/api/login"
+		if unifiOS {
+			endpoint = u.Endpoint + "/api/auth/login"
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(credentials))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := u.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("logging in to controller: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound && unifiOS {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("logging in to controller as %s: %s", u.Username, resp.Status)
+		}
+		u.session.loggedIn = true
+		u.session.unifiOS = unifiOS
+		u.session.csrfToken = resp.Header.Get("X-Csrf-Token")
+		u.logger.Debug("logged in to controller",
+			zap.String("username", u.Username),
+			zap.Bool("unifi_os", unifiOS))
+		return nil
+	}
+	return fmt.Errorf("controller has no login endpoint")
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*UniFi)(nil)
+	_ caddy.Provisioner     = (*UniFi)(nil)
+	_ caddyfile.Unmarshaler = (*UniFi)(nil)
+)
@@ -0,0 +1,27 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// reportUsage logs the CPU time and the peak memory the process
+// of name used, once it exited, and adds them to the counters,
+// to tell whether a lookup is what keeps a small device busy.
+func (c Command) reportUsage(name string, state *os.ProcessState) {
+	user, system := state.UserTime(), state.SystemTime()
+	rss := maxRSS(state)
+	c.logger.Debug("process resource usage",
+		zap.String("command", name),
+		zap.Int("pid", state.Pid()),
+		zap.Int64("cpu_user_ms", user.Milliseconds()),
+		zap.Int64("cpu_system_ms", system.Milliseconds()),
+		zap.Int64("max_rss_kb", rss/1024))
+	c.countUsage(user+system, rss)
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+//go:build !windows
+
+package command
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// maxRSS returns the peak resident set size of the
+// exited process in bytes, or 0 if it is unknown.
+func maxRSS(state *os.ProcessState) int64 {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+		// in bytes, unlike in kilobytes elsewhere
+		return int64(usage.Maxrss)
+	}
+	return int64(usage.Maxrss) * 1024
+}
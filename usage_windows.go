@@ -0,0 +1,14 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import "os"
+
+// maxRSS returns 0, as Windows does not report the
+// peak memory of an exited process.
+func maxRSS(*os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vars are the counters of the command sources, published by
+// expvar, which Caddy's admin API serves on /debug/vars, for
+// deployments without a metrics stack. They are keyed by the
+// label of the source or else by the command line, with the
+// args redacted like in the logs.
+var vars = expvar.NewMap("dynamic_dns_command")
+
+// sources are the counters of the sources by label or command line.
+var sources = struct {
+	mu    sync.Mutex
+	byKey map[string]*sourceVars
+}{byKey: make(map[string]*sourceVars)}
+
+// sourceVars are the counters of a command source.
+type sourceVars struct {
+	// lookups run, including the ones by the admin API
+	executions expvar.Int
+
+	// lookups that failed
+	failures expvar.Int
+
+	// how long the last lookup took
+	lastDurationMS expvar.Int
+
+	// how often the addresses changed
+	changes expvar.Int
+
+	// when the addresses last changed, as Unix time
+	lastIPChangeUnix expvar.Int
+
+	// how often the watch command was restarted
+	watchRestarts expvar.Int
+
+	// the CPU time of all processes that exited, and of the
+	// last one, in milliseconds
+	cpuMS     expvar.Int
+	lastCPUMS expvar.Int
+
+	// the peak memory of the last process that exited
+	lastMaxRSSKB expvar.Int
+
+	// addresses withheld as the probe failed
+	probeFailures expvar.Int
+}
+
+// provisionVars loads the counters of the source, creating them
+// for the first source with this label or command line. They are
+// kept as long as Caddy runs, across reloads.
+func (c *Command) provisionVars() {
+	key := c.Label
+	if key == "" {
+		key = strings.Join(append([]string{c.Cmd}, c.redactArgs(c.Args)...), " ")
+	}
+
+	sources.mu.Lock()
+	defer sources.mu.Unlock()
+	if v, ok := sources.byKey[key]; ok {
+		c.vars = v
+		return
+	}
+	v := new(sourceVars)
+	m := new(expvar.Map).Init()
+	m.Set("executions", &v.executions)
+	m.Set("failures", &v.failures)
+	m.Set("last_duration_ms", &v.lastDurationMS)
+	m.Set("ip_changes", &v.changes)
+	m.Set("last_ip_change_unix", &v.lastIPChangeUnix)
+	m.Set("watch_restarts", &v.watchRestarts)
+	m.Set("cpu_ms", &v.cpuMS)
+	m.Set("last_cpu_ms", &v.lastCPUMS)
+	m.Set("last_max_rss_kb", &v.lastMaxRSSKB)
+	m.Set("probe_failures", &v.probeFailures)
+	vars.Set(key, m)
+	sources.byKey[key] = v
+	c.vars = v
+}
+
+// countLookup counts a lookup that took d and failed with err, if any.
+func (c Command) countLookup(d time.Duration, err error) {
+	if c.vars == nil {
+		return
+	}
+	c.vars.executions.Add(1)
+	if err != nil {
+		c.vars.failures.Add(1)
+	}
+	c.vars.lastDurationMS.Set(d.Milliseconds())
+}
+
+// countChange records that the addresses changed.
+func (c Command) countChange() {
+	if c.vars == nil {
+		return
+	}
+	c.vars.changes.Add(1)
+	c.vars.lastIPChangeUnix.Set(time.Now().Unix())
+}
+
+// countWatchRestart counts a restart of the watch command.
+func (c Command) countWatchRestart() {
+	if c.vars == nil {
+		return
+	}
+	c.vars.watchRestarts.Add(1)
+}
+
+// countUsage records the CPU time and the peak memory
+// in bytes of a process that exited.
+func (c Command) countUsage(cpu time.Duration, maxRSS int64) {
+	if c.vars == nil {
+		return
+	}
+	c.vars.cpuMS.Add(cpu.Milliseconds())
+	c.vars.lastCPUMS.Set(cpu.Milliseconds())
+	c.vars.lastMaxRSSKB.Set(maxRSS / 1024)
+}
+
+// countProbeFailure counts an address withheld as the probe failed.
+func (c Command) countProbeFailure() {
+	if c.vars == nil {
+		return
+	}
+	c.vars.probeFailures.Add(1)
+}
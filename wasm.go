@@ -0,0 +1,297 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(WASM{})
+}
+
+// WASM is an IP source that looks up the public IP addresses by
+// running a WebAssembly module instead of a process, e.g. in a
+// distroless image without a shell or curl.
+//
+// The module is a WASI (preview 1) program, run in a sandbox with
+// neither a filesystem nor network access; it only gets its args,
+// the environment variables and a clock. By default, it is run as
+// a command, like a process, and must print the addresses comma
+// or whitespace separated to stdout. If Function is set, that
+// exported function is called instead and returns the addresses.
+type WASM struct {
+	// The path of the .wasm file.
+	Path string `json:"path,omitempty"`
+
+	// Arguments to the module, available to it like the
+	// command-line arguments of a process. Placeholders,
+	// including {file.<path>}, are expanded like in the
+	// args of a command.
+	Args []string `json:"args,omitempty"`
+
+	// Environment variables for the module. Global placeholders
+	// like {env.API_TOKEN} in the values are expanded. Besides
+	// them, it only gets CADDY_DDNS_IPV4 and CADDY_DDNS_IPV6,
+	// like a command.
+	Env map[string]string `json:"env,omitempty"`
+
+	// An exported function without parameters to call instead
+	// of running the module as a command. It returns the memory
+	// offset of the addresses in the upper 32 bits of an i64 and
+	// their length in bytes in the lower 32 bits. The module's
+	// _initialize function, if any, is called first.
+	Function string `json:"function,omitempty"`
+
+	// How long the module may run. Default: 30s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	logger   *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (WASM) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.wasm",
+		New: func() caddy.Module { return new(WASM) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	wasm <path> <args...> {
+//	    env <name> <value>
+//	    function <name>
+//	    timeout <duration>
+//	    filter <name> ...
+//	}
+func (w *WASM) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		w.Path = d.Val()
+		w.Args = d.RemainingArgs()
+
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "env":
+				var name, value string
+				if !d.AllArgs(&name, &value) {
+					return d.ArgErr()
+				}
+				if w.Env == nil {
+					w.Env = make(map[string]string)
+				}
+				w.Env[name] = value
+			case "function":
+				err = singleArg(d, &w.Function)
+			case "timeout":
+				err = durationArg(d, &w.Timeout)
+			case "filter":
+				err = w.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision compiles the module.
+func (w *WASM) Provision(ctx caddy.Context) error {
+	w.logger = ctx.Logger(w)
+	if err := w.Filters.load(ctx); err != nil {
+		return err
+	}
+	if w.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = caddy.Duration(30 * time.Second)
+	}
+	code, err := os.ReadFile(w.Path)
+	if err != nil {
+		return fmt.Errorf("reading module: %v", err)
+	}
+
+	// the module is stopped when it runs longer than the timeout
+	w.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, w.runtime); err != nil {
+		w.runtime.Close(ctx)
+		return fmt.Errorf("instantiating WASI: %v", err)
+	}
+	w.compiled, err = w.runtime.CompileModule(ctx, code)
+	if err != nil {
+		w.runtime.Close(ctx)
+		return fmt.Errorf("compiling module %s: %v", w.Path, err)
+	}
+
+	if w.Function != "" {
+		fn, ok := w.compiled.ExportedFunctions()[w.Function]
+		if !ok {
+			w.runtime.Close(ctx)
+			return fmt.Errorf("module %s does not export function %s", w.Path, w.Function)
+		}
+		if len(fn.ParamTypes()) != 0 || len(fn.ResultTypes()) != 1 || fn.ResultTypes()[0] != api.ValueTypeI64 {
+			w.runtime.Close(ctx)
+			return fmt.Errorf("function %s must take no parameters and return an i64", w.Function)
+		}
+	}
+	return nil
+}
+
+// Cleanup releases the compiled module.
+func (w *WASM) Cleanup() error {
+	if w.runtime == nil {
+		return nil
+	}
+	return w.runtime.Close(context.Background())
+}
+
+// GetIPs gets the public addresses of this machine.
+func (w WASM) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return w.Filters.apply(w.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (w WASM) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	args, _, err := expandArgs(w.Args)
+	if err != nil {
+		return nil, fmt.Errorf("expanding args of module %s: %v", w.Path, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.Timeout))
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(append([]string{w.Path}, args...)...).
+		WithStdout(&stdout).
+		WithStderr(&stderr).
+		WithRandSource(rand.Reader).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep()
+	for _, kv := range w.env(versions) {
+		name, value, _ := strings.Cut(kv, "=")
+		config = config.WithEnv(name, value)
+	}
+	if w.Function != "" {
+		config = config.WithStartFunctions("_initialize")
+	}
+
+	mod, err := w.runtime.InstantiateModule(ctx, w.compiled, config)
+	if err == nil {
+		defer mod.Close(ctx)
+	}
+	if err == nil && w.Function != "" {
+		var output []byte
+		output, err = w.call(ctx, mod)
+		stdout.Reset()
+		stdout.Write(output)
+	}
+	if err != nil {
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 && w.Function == "" {
+			// the command exited by proc_exit(0)
+			err = nil
+		} else if ctx.Err() != nil {
+			err = fmt.Errorf("%w: %w: %w", ErrTimeout, ctx.Err(), err)
+		}
+	}
+	if err != nil {
+		w.logger.Error("running module failed",
+			zap.String("path", w.Path),
+			zap.String("function", w.Function),
+			zap.String("stdout", stdout.String()),
+			zap.String("stderr", stderr.String()),
+			zap.Error(err))
+		return nil, fmt.Errorf("running module %s: %w", w.Path, err)
+	}
+
+	ips, err := parseIPList(stdout.String())
+	if err != nil {
+		w.logger.Error("parsing output failed",
+			zap.String("path", w.Path),
+			zap.String("stdout", stdout.String()),
+			zap.Error(err))
+		return nil, err
+	}
+	return filterVersions(ips, versions), nil
+}
+
+// call calls the configured function of mod and
+// returns the addresses it returned from its memory.
+func (w WASM) call(ctx context.Context, mod api.Module) ([]byte, error) {
+	results, err := mod.ExportedFunction(w.Function).Call(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mod.Memory() == nil {
+		return nil, fmt.Errorf("module %s has no memory to return the addresses in", w.Path)
+	}
+	offset, length := uint32(results[0]>>32), uint32(results[0])
+	output, ok := mod.Memory().Read(offset, length)
+	if !ok {
+		return nil, fmt.Errorf("function %s returned %d bytes at %d, which are out of the memory", w.Function, length, offset)
+	}
+	// the memory is gone once the module is closed
+	return append([]byte(nil), output...), nil
+}
+
+// env returns the environment variables of the module.
+func (w WASM) env(versions dynamicdns.IPVersions) []string {
+	names := make([]string, 0, len(w.Env))
+	for name := range w.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []string
+	for _, name := range names {
+		out = append(out, name+"="+expandSecret(w.Env[name]))
+	}
+	return append(out,
+		EnvIPv4+"="+onOff(versions.V4Enabled()),
+		EnvIPv6+"="+onOff(versions.V6Enabled()),
+	)
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*WASM)(nil)
+	_ caddy.Provisioner     = (*WASM)(nil)
+	_ caddy.CleanerUpper    = (*WASM)(nil)
+	_ caddyfile.Unmarshaler = (*WASM)(nil)
+)
@@ -0,0 +1,290 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+)
+
+// Watcher is an IP source that learns about address changes by
+// itself, instead of only when GetIPs is called, so that a consumer
+// could subscribe to update the records as soon as the addresses
+// change. The dynamic_dns app does not use this interface, so it
+// has no effect there until the app supports it; the app still
+// updates the records only at its next check.
+type Watcher interface {
+	dynamicdns.IPSource
+
+	// Subscribe calls fn with the new addresses every time they
+	// changed, until the returned function is called. Like
+	// GetIPs, it only passes the addresses of the families in
+	// versions that the filters of the source keep.
+	Subscribe(versions dynamicdns.IPVersions, fn func([]net.IP)) (unsubscribe func())
+}
+
+// subscriber wraps fn, a subscriber of a Watcher, so that it gets
+// the addresses like GetIPs returns them for versions, after the
+// filters, and only when those changed.
+func subscriber(versions dynamicdns.IPVersions, filters Filters, fn func([]net.IP)) func([]net.IP) {
+	var mu sync.Mutex
+	var last []net.IP
+	seen := false
+	return func(ips []net.IP) {
+		ips, _ = filters.apply(filterVersions(ips, versions), nil)
+		mu.Lock()
+		if seen && sameIPs(last, ips) {
+			mu.Unlock()
+			return
+		}
+		last, seen = ips, true
+		mu.Unlock()
+		fn(ips)
+	}
+}
+
+// watchState is the state of a command run in watch mode.
+type watchState struct {
+	mu   sync.Mutex
+	ips  []net.IP
+	seen bool
+
+	// closed when the first addresses were reported
+	ready chan struct{}
+
+	subscribers map[int]func([]net.IP)
+	nextID      int
+
+	// restarts the command when it exits
+	supervisor supervisor
+}
+
+// provisionWatch checks the options of the watch mode
+// and loads the events app to announce changes with.
+func (c *Command) provisionWatch(ctx caddy.Context) error {
+	if !c.Watch {
+		return nil
+	}
+	if len(c.Commands) > 0 || len(c.Pipeline) > 0 {
+		return fmt.Errorf("watch does not support further commands and pipe")
+	}
+	if c.VerifyOnStart || c.WarmUp {
+		return fmt.Errorf("watch does not support verify_on_start and warm_up")
+	}
+	if c.Mode != "" && c.Mode != ModeExec {
+		return fmt.Errorf("watch is not supported in %s mode", c.Mode)
+	}
+
+	if err := c.provisionSupervisor(); err != nil {
+		return err
+	}
+	c.watchState = c.carried.watchState()
+	return nil
+}
+
+// runWatch runs the watch command once, until it exits or ctx
+// is done, and takes every line it prints as the new set of
+// addresses. It returns the error the command exited with.
+func (c Command) runWatch(ctx context.Context) error {
+	c = c.withRunID()
+	e := Exec{Cmd: c.Cmd, Args: c.Args, Dir: c.Dir}
+	expandedArgs, loggedArgs, err := expandArgs(e.Args)
+	if err != nil {
+		c.logger.Error("expanding args failed",
+			zap.String("command", e.Cmd),
+			zap.Strings("args", e.Args),
+			zap.Error(err))
+		return err
+	}
+
+	env := c.requestEnv(dynamicdns.IPVersions{})
+	if c.Debug {
+		c.logResolved(e, e.Cmd, loggedArgs, env)
+	}
+	ec, err := c.command(e.Cmd, expandedArgs, e.Dir, env)
+	if err != nil {
+		c.logger.Error("starting watch command failed",
+			zap.String("command", e.Cmd),
+			zap.Error(err))
+		return err
+	}
+	if c.Stdin != "" {
+		stdin, err := c.stdin()
+		if err != nil {
+			c.logger.Error("expanding stdin failed",
+				zap.String("command", e.Cmd),
+				zap.Error(err))
+			return err
+		}
+		ec.Stdin = stdin
+	}
+	p := ec.Process(ctx)
+	cmd := p.Cmd
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		c.logger.Error("starting watch command failed",
+			zap.String("command", e.Cmd),
+			zap.Error(err))
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		c.logger.Error("starting watch command failed",
+			zap.String("command", e.Cmd),
+			zap.Error(err))
+		return err
+	}
+	if err := p.Start(); err != nil {
+		c.logger.Error("starting watch command failed",
+			zap.String("command", e.Cmd),
+			zap.Error(err))
+		return err
+	}
+	c.watchState.supervisor.running(cmd.Process.Pid)
+	c.logger.Info("started watch command",
+		zap.String("command", e.Cmd),
+		zap.Strings("args", loggedArgs),
+		zap.Int("pid", cmd.Process.Pid))
+
+	go func() {
+		lines := bufio.NewScanner(stderr)
+		for lines.Scan() {
+			c.logger.Warn("watch command wrote to stderr",
+				zap.String("command", e.Cmd),
+				zap.String("stderr", string(c.decodeOutput(lines.Bytes()))))
+		}
+	}()
+
+	lines := bufio.NewScanner(stdout)
+	lines.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for lines.Scan() {
+		line := c.decodeOutput(lines.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		c.watchUpdate(e, loggedArgs, line)
+	}
+
+	return p.Wait()
+}
+
+// watchUpdate parses a line the watch command printed
+// and announces the addresses if they changed.
+func (c Command) watchUpdate(e Exec, loggedArgs []string, line []byte) {
+	c.logOutput(e, loggedArgs, line)
+	meta := new(Metadata)
+	// a line has no deadline, unlike a lookup
+	ips, err := c.parseOutput(context.Background(), e, loggedArgs, line, meta)
+	if err == nil {
+		ips, err = c.processAddresses(context.Background(), ips)
+	}
+	if err == nil {
+		err = c.checkAddresses(ips, dynamicdns.IPVersions{})
+	}
+	if errors.Is(err, ErrUnchanged) {
+		return
+	}
+	if err != nil {
+		c.logger.Error("ignoring output of watch command",
+			zap.String("command", e.Cmd),
+			zap.String("stdout", string(line)),
+			zap.Error(err))
+		c.recordFailure(err)
+		return
+	}
+	c.recordSuccess()
+	if c.hasMetadata() {
+		c.state.setMetadata(meta)
+	}
+
+	old, changed, subscribers := c.watchState.set(ips)
+	if !changed {
+		return
+	}
+	c.audit(ips, 0, AuditSourceWatch)
+	c.recordChange(old, ips)
+	for _, fn := range subscribers {
+		fn(ips)
+	}
+}
+
+// get returns the last addresses of the watch command.
+func (w *watchState) get() []net.IP {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ips
+}
+
+// set stores the addresses and returns the previous ones, whether
+// they changed and the subscribers to notify if they did.
+func (w *watchState) set(ips []net.IP) ([]net.IP, bool, []func([]net.IP)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old := w.ips
+	if w.seen && sameIPs(old, ips) {
+		return old, false, nil
+	}
+	if !w.seen {
+		close(w.ready)
+	}
+	w.ips, w.seen = ips, true
+
+	subscribers := make([]func([]net.IP), 0, len(w.subscribers))
+	for _, fn := range w.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	return old, true, subscribers
+}
+
+// watchIPs returns the last addresses of the watch command. Until
+// it reported the first ones, it waits for them up to the timeout.
+func (c Command) watchIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	timer := time.NewTimer(time.Duration(c.Timeout))
+	defer timer.Stop()
+	select {
+	case <-c.watchState.ready:
+	case <-timer.C:
+		return nil, fmt.Errorf("watch command %s did not report addresses yet", c.Cmd)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return filterVersions(c.watchState.get(), versions), nil
+}
+
+// Subscribe calls fn with the new addresses of the families in
+// versions every time the watch command reports a change, until
+// the returned function is called. Without watch, fn is never
+// called.
+func (c Command) Subscribe(versions dynamicdns.IPVersions, fn func([]net.IP)) func() {
+	if c.watchState == nil {
+		return func() {}
+	}
+	w := c.watchState
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	id := w.nextID
+	w.nextID++
+	w.subscribers[id] = subscriber(versions, Filters{}, fn)
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.subscribers, id)
+	}
+}
+
+// Interface guards
+var (
+	_ Watcher = (*Command)(nil)
+)
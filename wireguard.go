@@ -0,0 +1,171 @@
+// Copyright (c) 2023 Nils Stein
+//
+// This software is released under the MIT License.
+// https://opensource.org/licenses/MIT
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dynamicdns "github.com/mholt/caddy-dynamicdns"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func init() {
+	caddy.RegisterModule(WireGuard{})
+}
+
+// WireGuard is an IP source that returns the endpoint address of a
+// peer of a WireGuard interface, i.e. the address the peer's packets
+// were last received from.
+//
+// Run on the machine a NATed site connects to, it returns the public
+// address of that site as seen from outside, which interface
+// inspection at the site itself cannot tell.
+type WireGuard struct {
+	// The WireGuard interface, e.g. wg0.
+	Interface string `json:"interface,omitempty"`
+
+	// The base64 encoded public key of the peer. Default:
+	// the peer with the most recent handshake
+	Peer string `json:"peer,omitempty"`
+
+	// Endpoints of peers whose last handshake is older are
+	// ignored, as the peer may be gone. Default: 3m
+	MaxHandshakeAge caddy.Duration `json:"max_handshake_age,omitempty"`
+
+	// Filter modules applied to the addresses, in order.
+	Filters
+
+	peer   *wgtypes.Key
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (WireGuard) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dynamic_dns.ip_sources.wireguard",
+		New: func() caddy.Module { return new(WireGuard) },
+	}
+}
+
+// UnmarshalCaddyfile parses the module's Caddyfile config. Syntax:
+//
+//	wireguard <interface> {
+//	    peer <public key>
+//	    max_handshake_age <duration>
+//	    filter <name> ...
+//	}
+func (w *WireGuard) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&w.Interface) {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "peer":
+				err = singleArg(d, &w.Peer)
+			case "max_handshake_age":
+				err = durationArg(d, &w.MaxHandshakeAge)
+			case "filter":
+				err = w.Filters.unmarshal(d)
+			default:
+				err = d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (w *WireGuard) Provision(ctx caddy.Context) error {
+	w.logger = ctx.Logger(w)
+	if err := w.Filters.load(ctx); err != nil {
+		return err
+	}
+	if w.Interface == "" {
+		return fmt.Errorf("interface is required")
+	}
+	if w.Peer != "" {
+		key, err := wgtypes.ParseKey(w.Peer)
+		if err != nil {
+			return fmt.Errorf("invalid peer key: %v", err)
+		}
+		w.peer = &key
+	}
+	if w.MaxHandshakeAge <= 0 {
+		w.MaxHandshakeAge = caddy.Duration(3 * time.Minute)
+	}
+	return nil
+}
+
+// GetIPs gets the public address of the peer.
+func (w WireGuard) GetIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	return w.Filters.apply(w.getIPs(ctx, versions))
+}
+
+// getIPs gets the addresses like GetIPs, before the filters.
+func (w WireGuard) getIPs(ctx context.Context, versions dynamicdns.IPVersions) ([]net.IP, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("opening wireguard control: %v", err)
+	}
+	defer client.Close()
+
+	device, err := client.Device(w.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("reading wireguard interface %s: %v", w.Interface, err)
+	}
+
+	var latest *wgtypes.Peer
+	for i, peer := range device.Peers {
+		if w.peer != nil && peer.PublicKey != *w.peer {
+			continue
+		}
+		if peer.Endpoint == nil {
+			continue
+		}
+		if latest == nil || peer.LastHandshakeTime.After(latest.LastHandshakeTime) {
+			latest = &device.Peers[i]
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no peer of wireguard interface %s has an endpoint", w.Interface)
+	}
+
+	age := time.Since(latest.LastHandshakeTime)
+	if age > time.Duration(w.MaxHandshakeAge) {
+		return nil, fmt.Errorf("last handshake of peer %s was %s ago", latest.PublicKey, age.Round(time.Second))
+	}
+
+	w.logger.Debug("peer endpoint",
+		zap.String("interface", w.Interface),
+		zap.String("peer", latest.PublicKey.String()),
+		zap.String("endpoint", latest.Endpoint.String()),
+		zap.Time("last_handshake", latest.LastHandshakeTime))
+
+	ip := latest.Endpoint.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return filterVersions([]net.IP{ip}, versions), nil
+}
+
+// Interface guards
+var (
+	_ dynamicdns.IPSource   = (*WireGuard)(nil)
+	_ caddy.Provisioner     = (*WireGuard)(nil)
+	_ caddyfile.Unmarshaler = (*WireGuard)(nil)
+)